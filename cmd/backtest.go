@@ -0,0 +1,123 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var backtestOptions server.BacktestOptions
+
+var backtestFlags struct {
+	filters    []string
+	output     string
+	csv        string
+	summaryCsv string
+}
+
+var backtestCmd = &cobra.Command{
+	Use:   "backtest [flags] RECORDING...",
+	Short: "Evaluate rules against recorded exchange messages",
+	Long: `Replay recordings made with the server's --record option as fast as
+possible, evaluating the alert rules from the config file and any --filter
+rules, and report how often each rule triggered and the price change after
+each trigger.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := viper.UnmarshalKey("alerts.rules", &backtestOptions.Rules); err != nil {
+			log.Fatalf("error: alerts.rules: %v\n", err)
+		}
+		for _, filter := range backtestFlags.filters {
+			parts := strings.SplitN(filter, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				log.Fatalf("error: invalid filter, expected NAME=EXPRESSION: %s\n", filter)
+			}
+			backtestOptions.Rules = append(backtestOptions.Rules, server.AlertRule{
+				Name:   parts[0],
+				Filter: parts[1],
+			})
+		}
+		if len(backtestOptions.Rules) == 0 {
+			log.Fatalf("error: no rules to backtest\n")
+		}
+
+		player, err := pkg.NewPlayer(args, 0)
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		backtestOptions.Player = player
+		backtestOptions.Buckets = getBuckets()
+
+		report, err := server.RunBacktest(backtestOptions)
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+
+		writeReport(backtestFlags.output, report.WriteJSON)
+		if backtestFlags.csv != "" {
+			writeReport(backtestFlags.csv, report.WriteTriggersCSV)
+		}
+		if backtestFlags.summaryCsv != "" {
+			writeReport(backtestFlags.summaryCsv, report.WriteSummaryCSV)
+		}
+	},
+}
+
+// writeReport writes a report to filename, or stdout if filename is -.
+func writeReport(filename string, write func(w io.Writer) error) {
+	if filename == "-" {
+		if err := write(os.Stdout); err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		return
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+	if err := write(file); err != nil {
+		log.Fatalf("error: %s: %v\n", filename, err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatalf("error: %s: %v\n", filename, err)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(backtestCmd)
+
+	flags := backtestCmd.Flags()
+	flags.StringSliceVar(&backtestOptions.Exchanges, "exchanges",
+		server.SupportedExchanges, "Exchanges to backtest")
+	flags.DurationSliceVar(&backtestOptions.Horizons, "horizons",
+		server.DefaultBacktestHorizons, "Horizons to calculate returns at")
+	flags.StringArrayVar(&backtestFlags.filters, "filter", nil,
+		"A rule to backtest as NAME=EXPRESSION, may be repeated")
+	flags.StringVarP(&backtestFlags.output, "output", "o", "-",
+		"File to write the JSON report to, - for stdout")
+	flags.StringVar(&backtestFlags.csv, "csv", "",
+		"File to write a CSV row for each trigger to")
+	flags.StringVar(&backtestFlags.summaryCsv, "summary-csv", "",
+		"File to write a CSV row for each rule and horizon to")
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/server"
+	"github.com/spf13/cobra"
+)
+
+var replayOptions server.Options
+var replaySpeed string
+
+var replayCmd = &cobra.Command{
+	Use:   "replay [flags] RECORDING...",
+	Short: "Run the server on recorded exchange messages",
+	Long: `Run the server on messages recorded by the server's --record option,
+instead of the live exchange feeds. Each RECORDING is a recording file or
+a directory of recording files.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		speed, err := pkg.ParseReplaySpeed(replaySpeed)
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		player, err := pkg.NewPlayer(args, speed)
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		replayOptions.Buckets = getBuckets()
+		replayOptions.Player = player
+		server.ServerMain(replayOptions)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replayCmd)
+
+	flags := replayCmd.Flags()
+	flags.Uint16VarP(&replayOptions.Port, "port", "p", 6035, "Port to listen on")
+	flags.StringSliceVar(&replayOptions.Exchanges, "exchanges",
+		server.SupportedExchanges, "Exchanges to replay")
+	flags.StringVar(&replaySpeed, "speed", "1",
+		"Replay speed: 1 for real time, eg. 10 for 10x, or max")
+}
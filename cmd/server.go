@@ -18,6 +18,16 @@ package cmd
 import (
 	"github.com/spf13/cobra"
 	"github.com/crankykernel/cryptoxscanner/server"
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/binance"
+	"github.com/crankykernel/cryptoxscanner/pkg/kucoin"
+	"github.com/spf13/viper"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+	"github.com/mitchellh/go-homedir"
 )
 
 var options server.Options
@@ -25,13 +35,191 @@ var options server.Options
 var binanceCmd = &cobra.Command{
 	Use: "server",
 	Run: func(cmd *cobra.Command, args []string) {
+		options.Buckets = getBuckets()
+		if err := viper.UnmarshalKey("alerts.rules", &options.AlertRules); err != nil {
+			log.Fatalf("error: alerts.rules: %v\n", err)
+		}
+		options.AlertWebhooks = viper.GetStringSlice("alerts.webhooks")
+		home, err := homedir.Dir()
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		options.AlertHistory = viper.GetString("alerts.history")
+		if options.AlertHistory == "" {
+			options.AlertHistory = filepath.Join(home, ".cryptoxscanner", "alerts.jsonl")
+		}
+		options.AlertRetention = viper.GetDuration("alerts.retention")
+		options.Cache.Backend = viper.GetString("cache.backend")
+		options.Cache.Directory = viper.GetString("cache.dir")
+		if options.Cache.Directory == "" {
+			options.Cache.Directory = filepath.Join(home, ".cryptoxscanner", "cache")
+		}
+		options.SnapshotInterval = viper.GetDuration("cache.snapshot-interval")
+		options.RecordDir = viper.GetString("record.dir")
+		options.BinanceMaxStreams = viper.GetInt("binance.max-streams")
+		options.BinanceRestUrl = viper.GetString("binance.rest-url")
+		options.BinanceStreamUrl = viper.GetString("binance.stream-url")
+		options.KucoinRestUrl = viper.GetString("kucoin.rest-url")
+		options.BinanceDepthSymbols = viper.GetStringSlice("binance.depth-symbols")
+		options.BinanceDepthLevels = viper.GetInt("binance.depth-levels")
+		options.DepthPercent = viper.GetFloat64("depth.percent")
+		options.Backoff = pkg.BackoffOptions{
+			InitialDelay:     viper.GetDuration("reconnect.initial-delay"),
+			MaxDelay:         viper.GetDuration("reconnect.max-delay"),
+			Multiplier:       viper.GetFloat64("reconnect.multiplier"),
+			Jitter:           viper.GetFloat64("reconnect.jitter"),
+			BreakerThreshold: viper.GetInt("reconnect.breaker-threshold"),
+			BreakerCooldown:  viper.GetDuration("reconnect.breaker-cooldown"),
+		}
+		if options.Backoff.Multiplier < 1 {
+			log.Fatalf("error: reconnect.multiplier must be at least 1\n")
+		}
+		options.Watchdog = pkg.WatchdogOptions{
+			MaxSilence: viper.GetDuration("watchdog.max-silence"),
+			MaxLag:     viper.GetDuration("watchdog.max-lag"),
+		}
+		options.Cache.Redis = pkg.RedisOptions{
+			Address:      viper.GetString("redis.address"),
+			Password:     viper.GetString("redis.password"),
+			DB:           viper.GetInt("redis.db"),
+			TLS:          viper.GetBool("redis.tls"),
+			TLSInsecure:  viper.GetBool("redis.tls-insecure"),
+			KeyPrefix:    viper.GetString("redis.key-prefix"),
+			PoolSize:     viper.GetInt("redis.pool-size"),
+			DialTimeout:  viper.GetDuration("redis.dial-timeout"),
+			ReadTimeout:  viper.GetDuration("redis.read-timeout"),
+			WriteTimeout: viper.GetDuration("redis.write-timeout"),
+		}
 		server.ServerMain(options)
 	},
 }
 
+// getBuckets returns the configured metric buckets by exchange name.
+func getBuckets() map[string][]pkg.Bucket {
+	buckets := map[string][]pkg.Bucket{}
+	for _, exchange := range server.SupportedExchanges {
+		key := fmt.Sprintf("%s.buckets", exchange)
+		names := viper.GetStringSlice(key)
+		if len(names) == 0 {
+			continue
+		}
+		parsed, err := pkg.ParseBuckets(names)
+		if err != nil {
+			log.Fatalf("error: %s: %v\n", key, err)
+		}
+		buckets[exchange] = parsed
+	}
+	return buckets
+}
+
 func init() {
 	rootCmd.AddCommand(binanceCmd)
 
 	flags := binanceCmd.Flags()
 	flags.Uint16VarP(&options.Port, "port", "p", 6035, "Port to listen on")
+
+	flags.StringSliceVar(&options.Exchanges, "exchanges",
+		server.SupportedExchanges, "Exchanges to run")
+
+	for _, exchange := range server.SupportedExchanges {
+		name := fmt.Sprintf("%s-buckets", exchange)
+		flags.StringSlice(name, nil, fmt.Sprintf(
+			"Metric buckets for %s, eg. 30s,1m,5m,1h,4h", exchange))
+		viper.BindPFlag(fmt.Sprintf("%s.buckets", exchange), flags.Lookup(name))
+	}
+
+	flags.Int("binance-max-streams", binance.DefaultMaxStreamsPerConnection,
+		"Maximum Binance trade streams per websocket connection")
+	viper.BindPFlag("binance.max-streams", flags.Lookup("binance-max-streams"))
+
+	flags.String("binance-rest-url", binance.DefaultRestUrl,
+		"Base URL of the Binance REST API")
+	viper.BindPFlag("binance.rest-url", flags.Lookup("binance-rest-url"))
+	flags.String("binance-stream-url", binance.DefaultStreamUrl,
+		"Base URL of the Binance websocket API")
+	viper.BindPFlag("binance.stream-url", flags.Lookup("binance-stream-url"))
+	flags.String("kucoin-rest-url", kucoin.DefaultRestUrl,
+		"Base URL of the KuCoin REST API")
+	viper.BindPFlag("kucoin.rest-url", flags.Lookup("kucoin-rest-url"))
+
+	flags.StringSlice("binance-depth-symbols", nil,
+		"Binance symbols to maintain order books for, eg. BTCUSDT,ETHBTC")
+	viper.BindPFlag("binance.depth-symbols", flags.Lookup("binance-depth-symbols"))
+	flags.Int("binance-depth-levels", 0,
+		"Use the Binance partial book depth streams with 5, 10 or 20 levels instead of syncing full order books")
+	viper.BindPFlag("binance.depth-levels", flags.Lookup("binance-depth-levels"))
+	flags.Float64("depth-percent", pkg.DefaultDepthPercent,
+		"Distance from the mid price, in percent, order book depth is measured within")
+	viper.BindPFlag("depth.percent", flags.Lookup("depth-percent"))
+
+	flags.Duration("reconnect-initial-delay", pkg.DefaultBackoffOptions.InitialDelay,
+		"Delay before the first reconnect to an exchange stream")
+	viper.BindPFlag("reconnect.initial-delay", flags.Lookup("reconnect-initial-delay"))
+	flags.Duration("reconnect-max-delay", pkg.DefaultBackoffOptions.MaxDelay,
+		"Maximum delay between reconnects to an exchange stream")
+	viper.BindPFlag("reconnect.max-delay", flags.Lookup("reconnect-max-delay"))
+	flags.Float64("reconnect-multiplier", pkg.DefaultBackoffOptions.Multiplier,
+		"Factor the reconnect delay is multiplied by after each failure")
+	viper.BindPFlag("reconnect.multiplier", flags.Lookup("reconnect-multiplier"))
+	flags.Float64("reconnect-jitter", pkg.DefaultBackoffOptions.Jitter,
+		"Fraction reconnect delays are randomly varied by")
+	viper.BindPFlag("reconnect.jitter", flags.Lookup("reconnect-jitter"))
+	flags.Int("circuit-breaker-threshold", pkg.DefaultBackoffOptions.BreakerThreshold,
+		"Consecutive reconnect failures before only retrying every cooldown, 0 to disable")
+	viper.BindPFlag("reconnect.breaker-threshold", flags.Lookup("circuit-breaker-threshold"))
+	flags.Duration("circuit-breaker-cooldown", pkg.DefaultBackoffOptions.BreakerCooldown,
+		"Delay between reconnects while the circuit breaker is open")
+	viper.BindPFlag("reconnect.breaker-cooldown", flags.Lookup("circuit-breaker-cooldown"))
+
+	flags.Duration("stale-after", pkg.DefaultWatchdogOptions.MaxSilence,
+		"Reconnect an exchange stream that delivers nothing for this long, 0 to disable")
+	viper.BindPFlag("watchdog.max-silence", flags.Lookup("stale-after"))
+	flags.Duration("max-lag", pkg.DefaultWatchdogOptions.MaxLag,
+		"Reconnect an exchange stream lagging the local time by more than this, 0 to disable")
+	viper.BindPFlag("watchdog.max-lag", flags.Lookup("max-lag"))
+
+	flags.StringSlice("alert-webhooks", nil,
+		"Webhooks to post alerts to for rules without their own")
+	viper.BindPFlag("alerts.webhooks", flags.Lookup("alert-webhooks"))
+
+	flags.String("alert-history", "",
+		"File to record alerts in (default is $HOME/.cryptoxscanner/alerts.jsonl)")
+	viper.BindPFlag("alerts.history", flags.Lookup("alert-history"))
+	flags.Duration("alert-retention", server.DefaultAlertRetention,
+		"How long to keep alerts in the history, 0 to keep them forever")
+	viper.BindPFlag("alerts.retention", flags.Lookup("alert-retention"))
+
+	flags.String("cache-backend", pkg.CacheBackendRedis, fmt.Sprintf(
+		"Backend for the input caches: %s", strings.Join(pkg.CacheBackends, ", ")))
+	viper.BindPFlag("cache.backend", flags.Lookup("cache-backend"))
+	flags.String("cache-dir", "",
+		"Directory for the disk cache (default is $HOME/.cryptoxscanner/cache)")
+	viper.BindPFlag("cache.dir", flags.Lookup("cache-dir"))
+	flags.Duration("snapshot-interval", 5*time.Minute,
+		"How often to snapshot the trackers to the cache backend, 0 to disable")
+	viper.BindPFlag("cache.snapshot-interval", flags.Lookup("snapshot-interval"))
+
+	flags.String("record", "",
+		"Directory to record raw exchange messages to, for the replay command")
+	viper.BindPFlag("record.dir", flags.Lookup("record"))
+
+	flags.String("redis-address", pkg.DefaultRedisAddress, "Redis server address")
+	flags.String("redis-password", "", "Redis password")
+	flags.Int("redis-db", 0, "Redis database number")
+	flags.Bool("redis-tls", false, "Connect to Redis with TLS")
+	flags.Bool("redis-tls-insecure", false,
+		"Don't verify the Redis server certificate")
+	flags.String("redis-key-prefix", "",
+		"Prefix for Redis keys, eg. to run multiple instances on one server")
+	flags.Int("redis-pool-size", 0,
+		"Redis connection pool size (default is 10 per CPU)")
+	flags.Duration("redis-dial-timeout", 0, "Redis connect timeout (default 5s)")
+	flags.Duration("redis-read-timeout", 0, "Redis read timeout (default 3s)")
+	flags.Duration("redis-write-timeout", 0,
+		"Redis write timeout (default is the read timeout)")
+	for _, name := range []string{"address", "password", "db", "tls",
+		"tls-insecure", "key-prefix", "pool-size", "dial-timeout",
+		"read-timeout", "write-timeout"} {
+		viper.BindPFlag("redis."+name, flags.Lookup("redis-"+name))
+	}
 }
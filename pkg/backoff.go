@@ -0,0 +1,160 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states.
+const (
+	// Retrying with exponential backoff.
+	CircuitClosed = "closed"
+
+	// Too many consecutive failures, retrying once every cooldown.
+	CircuitOpen = "open"
+
+	// Making an attempt after the cooldown, which closes the circuit if it
+	// succeeds or opens it again if it fails.
+	CircuitHalfOpen = "half-open"
+)
+
+type BackoffOptions struct {
+	// The delay after the first failure.
+	InitialDelay time.Duration
+
+	// The limit the delay grows to.
+	MaxDelay time.Duration
+
+	// The factor the delay is multiplied by after each failure.
+	Multiplier float64
+
+	// The fraction of the delay it is randomly varied by, so clients that
+	// failed together don't retry together.
+	Jitter float64
+
+	// The number of consecutive failures that opens the circuit, never if
+	// 0.
+	BreakerThreshold int
+
+	// The delay between attempts while the circuit is open.
+	BreakerCooldown time.Duration
+}
+
+var DefaultBackoffOptions = BackoffOptions{
+	InitialDelay:     time.Second,
+	MaxDelay:         time.Minute,
+	Multiplier:       2,
+	Jitter:           0.5,
+	BreakerThreshold: 10,
+	BreakerCooldown:  5 * time.Minute,
+}
+
+// BackoffStatus is the state of a Backoff, as reported by the status API.
+type BackoffStatus struct {
+	// The total number of attempts made.
+	Attempts int64 `json:"attempts"`
+
+	// The number of failures since the last success.
+	Failures int `json:"consecutive_failures"`
+
+	Circuit string `json:"circuit"`
+
+	// When the next attempt is due, if waiting.
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+// Backoff calculates the delays between retries of an operation, growing
+// the delay after each consecutive failure up to a maximum, and opening
+// the circuit after too many failures. It is safe for concurrent use.
+type Backoff struct {
+	options BackoffOptions
+	status  BackoffStatus
+	random  *rand.Rand
+	lock    sync.Mutex
+}
+
+func NewBackoff(options BackoffOptions) *Backoff {
+	return &Backoff{
+		options: options,
+		status: BackoffStatus{
+			Circuit: CircuitClosed,
+		},
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Attempt records an attempt being made.
+func (b *Backoff) Attempt() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.status.Attempts++
+	b.status.NextAttempt = time.Time{}
+	if b.status.Circuit == CircuitOpen {
+		b.status.Circuit = CircuitHalfOpen
+	}
+}
+
+// Success records a successful attempt, resetting the delay and closing
+// the circuit.
+func (b *Backoff) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.status.Failures = 0
+	b.status.Circuit = CircuitClosed
+}
+
+// Failure records a failed attempt, returning the delay before the next
+// attempt.
+func (b *Backoff) Failure() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.status.Failures++
+
+	var delay time.Duration
+	if b.options.BreakerThreshold > 0 && b.status.Failures >= b.options.BreakerThreshold {
+		b.status.Circuit = CircuitOpen
+		delay = b.options.BreakerCooldown
+	} else {
+		delay = time.Duration(float64(b.options.InitialDelay) *
+			math.Pow(b.options.Multiplier, float64(b.status.Failures-1)))
+		if delay > b.options.MaxDelay || delay < 0 {
+			delay = b.options.MaxDelay
+		}
+	}
+
+	if b.options.Jitter > 0 {
+		delay = time.Duration(float64(delay) *
+			(1 + b.options.Jitter*(2*b.random.Float64()-1)))
+	}
+
+	b.status.NextAttempt = time.Now().Add(delay)
+	return delay
+}
+
+// Wait records a failed attempt and sleeps until the next attempt is due.
+func (b *Backoff) Wait() {
+	time.Sleep(b.Failure())
+}
+
+func (b *Backoff) Status() BackoffStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.status
+}
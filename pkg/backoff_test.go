@@ -0,0 +1,156 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowth(t *testing.T) {
+	backoff := NewBackoff(BackoffOptions{
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   3,
+	})
+	expected := []time.Duration{
+		time.Second,
+		3 * time.Second,
+		9 * time.Second,
+		27 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}
+	for i, delay := range expected {
+		backoff.Attempt()
+		if got := backoff.Failure(); got != delay {
+			t.Errorf("failure %d: expected %v, got %v", i+1, delay, got)
+		}
+	}
+
+	// A success starts again from the initial delay.
+	backoff.Attempt()
+	backoff.Success()
+	backoff.Attempt()
+	if got := backoff.Failure(); got != time.Second {
+		t.Errorf("expected %v after a success, got %v", time.Second, got)
+	}
+	if status := backoff.Status(); status.Attempts != 8 || status.Failures != 1 {
+		t.Errorf("expected 8 attempts and 1 failure, got %+v", status)
+	}
+}
+
+func TestBackoffMaxDelayOverflow(t *testing.T) {
+	backoff := NewBackoff(BackoffOptions{
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+	})
+	for i := 0; i < 100; i++ {
+		backoff.Failure()
+	}
+	if got := backoff.Failure(); got != time.Minute {
+		t.Fatalf("expected the max delay once the delay overflows, got %v", got)
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	options := BackoffOptions{
+		InitialDelay: time.Second,
+		MaxDelay:     4 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.25,
+	}
+	for failures, base := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second,
+	} {
+		min := time.Duration(float64(base) * (1 - options.Jitter))
+		max := time.Duration(float64(base) * (1 + options.Jitter))
+		distinct := map[time.Duration]bool{}
+		for i := 0; i < 200; i++ {
+			backoff := NewBackoff(options)
+			for j := 0; j < failures; j++ {
+				backoff.Failure()
+			}
+			delay := backoff.Failure()
+			if delay < min || delay > max {
+				t.Fatalf("failure %d: delay %v outside %v to %v",
+					failures+1, delay, min, max)
+			}
+			distinct[delay] = true
+		}
+		if len(distinct) < 10 {
+			t.Errorf("failure %d: expected varied delays, got %d distinct",
+				failures+1, len(distinct))
+		}
+	}
+}
+
+func TestBackoffBreaker(t *testing.T) {
+	backoff := NewBackoff(BackoffOptions{
+		InitialDelay:     time.Second,
+		MaxDelay:         time.Minute,
+		Multiplier:       2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  5 * time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		backoff.Attempt()
+		backoff.Failure()
+		if circuit := backoff.Status().Circuit; circuit != CircuitClosed {
+			t.Fatalf("failure %d: expected the circuit closed, got %s", i+1, circuit)
+		}
+	}
+
+	// The threshold opens the circuit, waiting the cooldown.
+	backoff.Attempt()
+	if delay := backoff.Failure(); delay != 5*time.Minute {
+		t.Errorf("expected the cooldown, got %v", delay)
+	}
+	status := backoff.Status()
+	if status.Circuit != CircuitOpen {
+		t.Fatalf("expected the circuit open, got %s", status.Circuit)
+	}
+	if status.NextAttempt.IsZero() {
+		t.Errorf("expected the next attempt time to be set")
+	}
+
+	// An attempt after the cooldown is half open, and failing opens the
+	// circuit again.
+	backoff.Attempt()
+	if circuit := backoff.Status().Circuit; circuit != CircuitHalfOpen {
+		t.Fatalf("expected the circuit half open, got %s", circuit)
+	}
+	if delay := backoff.Failure(); delay != 5*time.Minute {
+		t.Errorf("expected the cooldown, got %v", delay)
+	}
+	if circuit := backoff.Status().Circuit; circuit != CircuitOpen {
+		t.Fatalf("expected the circuit open, got %s", circuit)
+	}
+
+	// A success resets it.
+	backoff.Attempt()
+	backoff.Success()
+	status = backoff.Status()
+	if status.Circuit != CircuitClosed || status.Failures != 0 {
+		t.Fatalf("expected the circuit closed with no failures, got %+v", status)
+	}
+	backoff.Attempt()
+	if delay := backoff.Failure(); delay != time.Second {
+		t.Errorf("expected the initial delay, got %v", delay)
+	}
+}
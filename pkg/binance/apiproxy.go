@@ -35,11 +35,15 @@ type proxyCacheEntry struct {
 type ApiProxy struct {
 	cache map[string]*proxyCacheEntry
 	lock  sync.RWMutex
+
+	// The base URL of the REST API requests are proxied to.
+	url string
 }
 
-func NewApiProxy() *ApiProxy {
+func NewApiProxy(url string) *ApiProxy {
 	return &ApiProxy{
 		cache: make(map[string]*proxyCacheEntry),
+		url:   url,
 	}
 }
 
@@ -56,7 +60,7 @@ func (p *ApiProxy) GetFromCache(key string) *proxyCacheEntry {
 }
 
 func (p *ApiProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	url := fmt.Sprintf("https://api.binance.com%s",
+	url := fmt.Sprintf("%s%s", p.url,
 		r.URL.RequestURI()[len("/api/1/binance/proxy"):])
 
 	cached := p.GetFromCache(url)
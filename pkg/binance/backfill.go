@@ -0,0 +1,316 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptotrader/binance"
+)
+
+// The default maximum number of missing trades waiting to be backfilled
+// across all symbols. Only the most recent are backfilled of a gap that
+// doesn't fit.
+const DefaultMaxBackfill = 10000
+
+// The default minimum interval between aggTrades requests across all
+// symbols, keeping backfills well under the REST API request limit.
+const DefaultBackfillInterval = 100 * time.Millisecond
+
+// The most trades the aggTrades endpoint returns per request.
+const aggTradesLimit = 1000
+
+// wireAggTrade is an aggregate trade as sent on the stream, or returned by
+// the aggTrades endpoint without the event fields.
+type wireAggTrade struct {
+	EventType    string `json:"e,omitempty"`
+	EventTime    int64  `json:"E,omitempty"`
+	Symbol       string `json:"s,omitempty"`
+	AggTradeId   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeId int64  `json:"f"`
+	LastTradeId  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	BuyerMaker   bool   `json:"m"`
+	BestMatch    bool   `json:"M"`
+}
+
+// tradeMessage is a decoded trade with the message it was decoded from.
+type tradeMessage struct {
+	body  []byte
+	trade *binance.AggTrade
+}
+
+// sequence checks a trade follows the last trade seen for its symbol by
+// aggregate trade ID. It returns the trades to publish in order: none if
+// the trade is a duplicate, or if backfill is set and there is a gap, in
+// which case the trade and those following it are held until the missing
+// trades are backfilled. Otherwise the trade is returned.
+func (b *TradeStream) sequence(message tradeMessage, backfill bool) []tradeMessage {
+	trade := message.trade
+	if held, ok := b.held[trade.Symbol]; ok {
+		b.held[trade.Symbol] = append(held, message)
+		return nil
+	}
+	last, ok := b.lastAggTradeIds[trade.Symbol]
+	if ok && trade.TradeID <= last {
+		log.Printf("binance: %s: dropping duplicate aggTrade %d, last was %d\n",
+			trade.Symbol, trade.TradeID, last)
+		return nil
+	}
+	if !ok || trade.TradeID == last+1 {
+		b.lastAggTradeIds[trade.Symbol] = trade.TradeID
+		return []tradeMessage{message}
+	}
+
+	from := last + 1
+	to := trade.TradeID - 1
+	log.Printf("warning: binance: %s: missing aggTrades %d to %d\n",
+		trade.Symbol, from, to)
+	if backfill && b.backfiller != nil {
+		if start, ok := b.backfiller.add(trade.Symbol, from, to); ok {
+			if start > from {
+				logUnfilled(trade.Symbol, from, start-1)
+			}
+			b.held[trade.Symbol] = []tradeMessage{message}
+			return nil
+		}
+	}
+	logUnfilled(trade.Symbol, from, to)
+	b.lastAggTradeIds[trade.Symbol] = trade.TradeID
+	return []tradeMessage{message}
+}
+
+// completeBackfill publishes the trades backfilled for a gap, then the
+// trades held while waiting for them.
+func (b *TradeStream) completeBackfill(result backfillResult) {
+	log.Printf("binance: %s: backfilled %d aggTrades\n",
+		result.symbol, len(result.messages))
+	filled := result.from - 1
+	if n := len(result.messages); n > 0 {
+		filled = result.messages[n-1].trade.TradeID
+	}
+	if filled < result.to {
+		logUnfilled(result.symbol, filled+1, result.to)
+	}
+	b.publishMessages(result.messages)
+	b.lastAggTradeIds[result.symbol] = result.to
+
+	held := b.held[result.symbol]
+	delete(b.held, result.symbol)
+	for _, message := range held {
+		b.publishMessages(b.sequence(message, true))
+	}
+}
+
+// logUnfilled logs the trades of a gap that won't be backfilled, so the
+// trades of symbol are known to be incomplete.
+func logUnfilled(symbol string, from, to int64) {
+	log.Printf("warning: binance: %s: aggTrades %d to %d not backfilled\n",
+		symbol, from, to)
+}
+
+type backfillRequest struct {
+	symbol string
+	from   int64
+	to     int64
+}
+
+type backfillResult struct {
+	backfillRequest
+	messages []tradeMessage
+}
+
+// backfiller gets the missing trades of gaps from the REST API in the
+// background, one gap at a time, so the trade stream isn't held up. The
+// requests are rate limited, and the trades waiting to be backfilled
+// capped, across all symbols.
+type backfiller struct {
+	stream *TradeStream
+
+	// The most trades waiting to be backfilled, all if 0.
+	max int64
+
+	// The minimum interval between requests.
+	interval    time.Duration
+	lastRequest time.Time
+
+	requests []backfillRequest
+
+	// The number of trades in requests, and the request being got.
+	waiting int64
+
+	lock sync.Mutex
+	wake chan bool
+
+	// The trades got for each request, in the order requested.
+	results chan backfillResult
+}
+
+func newBackfiller(stream *TradeStream) *backfiller {
+	return &backfiller{
+		stream:   stream,
+		max:      stream.MaxBackfill,
+		interval: stream.BackfillInterval,
+		wake:     make(chan bool, 1),
+		results:  make(chan backfillResult),
+	}
+}
+
+// add requests the trades of symbol from from to to, or as many of the
+// most recent as fit. It returns the first trade requested, or false if
+// none fit.
+func (f *backfiller) add(symbol string, from, to int64) (int64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.max > 0 {
+		available := f.max - f.waiting
+		if available <= 0 {
+			return 0, false
+		}
+		if to-from+1 > available {
+			from = to - available + 1
+		}
+	}
+	f.waiting += to - from + 1
+	f.requests = append(f.requests, backfillRequest{
+		symbol: symbol,
+		from:   from,
+		to:     to,
+	})
+	select {
+	case f.wake <- true:
+	default:
+	}
+	return from, true
+}
+
+func (f *backfiller) next() (backfillRequest, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.requests) == 0 {
+		return backfillRequest{}, false
+	}
+	request := f.requests[0]
+	f.requests = f.requests[1:]
+	return request, true
+}
+
+func (f *backfiller) run() {
+	for range f.wake {
+		for {
+			request, ok := f.next()
+			if !ok {
+				break
+			}
+			messages, err := f.backfill(request.symbol, request.from, request.to)
+			if err != nil {
+				log.Printf("error: binance: %s: failed to backfill aggTrades: %v\n",
+					request.symbol, err)
+			}
+			f.lock.Lock()
+			f.waiting -= request.to - request.from + 1
+			f.lock.Unlock()
+			f.results <- backfillResult{
+				backfillRequest: request,
+				messages:        messages,
+			}
+		}
+	}
+}
+
+// throttle waits until interval after the last request.
+func (f *backfiller) throttle() {
+	if wait := f.interval - time.Since(f.lastRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	f.lastRequest = time.Now()
+}
+
+// backfill gets the trades of symbol with aggregate trade IDs from from to
+// to from the REST API, encoded as stream messages. The trades got before
+// any error are returned.
+func (f *backfiller) backfill(symbol string, from, to int64) ([]tradeMessage, error) {
+	messages := []tradeMessage{}
+	for from <= to {
+		limit := to - from + 1
+		if limit > aggTradesLimit {
+			limit = aggTradesLimit
+		}
+		f.throttle()
+		trades, err := f.stream.getAggTrades(symbol, from, limit)
+		if err != nil {
+			return messages, err
+		}
+		if len(trades) == 0 {
+			return messages, nil
+		}
+		for _, trade := range trades {
+			if trade.AggTradeId < from {
+				continue
+			}
+			if trade.AggTradeId > to {
+				return messages, nil
+			}
+			message, err := f.stream.encodeAggTrade(symbol, trade)
+			if err != nil {
+				return messages, err
+			}
+			messages = append(messages, message)
+			from = trade.AggTradeId + 1
+		}
+	}
+	return messages, nil
+}
+
+// encodeAggTrade encodes a trade from the REST API as a stream message, so
+// it can be cached and decoded the same as trades from the stream.
+func (b *TradeStream) encodeAggTrade(symbol string, trade wireAggTrade) (tradeMessage, error) {
+	trade.EventType = "aggTrade"
+	trade.EventTime = trade.TradeTime
+	trade.Symbol = symbol
+	body, err := json.Marshal(&struct {
+		Stream string       `json:"stream"`
+		Data   wireAggTrade `json:"data"`
+	}{
+		Stream: fmt.Sprintf("%s@aggTrade", strings.ToLower(symbol)),
+		Data:   trade,
+	})
+	if err != nil {
+		return tradeMessage{}, err
+	}
+	decoded, err := b.DecodeTrade(body)
+	if err != nil {
+		return tradeMessage{}, err
+	}
+	return tradeMessage{body: body, trade: decoded}, nil
+}
+
+func (b *TradeStream) getAggTrades(symbol string, fromId int64, limit int64) ([]wireAggTrade, error) {
+	trades := []wireAggTrade{}
+	path := fmt.Sprintf("/api/v3/aggTrades?symbol=%s&fromId=%d&limit=%d",
+		symbol, fromId, limit)
+	if err := restGet(b.RestUrl, path, &trades); err != nil {
+		return nil, err
+	}
+	return trades, nil
+}
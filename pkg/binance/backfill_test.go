@@ -0,0 +1,234 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/fakeexchange"
+)
+
+// aggTradesStub forwards REST requests to the fake exchange, recording
+// when aggTrades are requested and, if handle is set, letting it answer
+// them instead.
+type aggTradesStub struct {
+	server   *httptest.Server
+	handle   func(w http.ResponseWriter, r *http.Request) bool
+	requests []time.Time
+	lock     sync.Mutex
+}
+
+func newAggTradesStub(t *testing.T, fake *fakeexchange.BinanceServer) *aggTradesStub {
+	target, err := url.Parse(fake.RestUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	stub := &aggTradesStub{}
+	stub.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v3/aggTrades" {
+				stub.lock.Lock()
+				stub.requests = append(stub.requests, time.Now())
+				stub.lock.Unlock()
+				if stub.handle != nil && stub.handle(w, r) {
+					return
+				}
+			}
+			proxy.ServeHTTP(w, r)
+		}))
+	return stub
+}
+
+func (s *aggTradesStub) requestTimes() []time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]time.Time{}, s.requests...)
+}
+
+func expectTrades(t *testing.T, trades chan pkg.CommonTrade, symbol string, ids ...int64) {
+	t.Helper()
+	for _, id := range ids {
+		trade := receiveTrade(t, trades)
+		if trade.Symbol != symbol || trade.TradeId != id {
+			t.Fatalf("expected %s trade %d, got %s trade %d",
+				symbol, id, trade.Symbol, trade.TradeId)
+		}
+	}
+}
+
+func expectNoTrade(t *testing.T, trades chan pkg.CommonTrade) {
+	t.Helper()
+	select {
+	case trade := <-trades:
+		t.Fatalf("unexpected %s trade %d", trade.Symbol, trade.TradeId)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startTestTradeStream(t *testing.T, fake *fakeexchange.BinanceServer,
+	configure func(stream *TradeStream)) chan pkg.CommonTrade {
+	t.Helper()
+	stream := newTestTradeStream(fake)
+	stream.SymbolRefreshInterval = 0
+	stream.BackfillInterval = 0
+	if configure != nil {
+		configure(stream)
+	}
+	trades := stream.Subscribe()
+	go stream.Run(time.Time{})
+	for _, symbol := range []string{"ethbtc", "ltcbtc"} {
+		if err := fake.WaitForStream(symbol+"@aggTrade", testTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return trades
+}
+
+var ethbtc = fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: 1}
+var ltcbtc = fakeexchange.Trade{Symbol: "LTCBTC", Price: 1, Quantity: 1}
+
+func TestTradeStreamBackfill(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+	trades := startTestTradeStream(t, fake, nil)
+
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 1)
+	fake.LoseTrade(ethbtc)
+	fake.LoseTrade(ethbtc)
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 2, 3, 4)
+	expectNoTrade(t, trades)
+}
+
+// TestTradeStreamBackfillCap checks only the most recent trades of a gap
+// are backfilled when more are missing than the cap.
+func TestTradeStreamBackfillCap(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+	trades := startTestTradeStream(t, fake, func(stream *TradeStream) {
+		stream.MaxBackfill = 2
+	})
+
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 1)
+	for i := 0; i < 3; i++ {
+		fake.LoseTrade(ethbtc)
+	}
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 3, 4, 5)
+}
+
+// TestTradeStreamBackfillFails checks a gap that can't be backfilled is
+// skipped and the following trades still published.
+func TestTradeStreamBackfillFails(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+	stub := newAggTradesStub(t, fake)
+	defer stub.server.Close()
+	stub.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	trades := startTestTradeStream(t, fake, func(stream *TradeStream) {
+		stream.RestUrl = stub.server.URL
+	})
+
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 1)
+	fake.LoseTrade(ethbtc)
+	fake.SendTrade(ethbtc)
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 3, 4)
+	if requests := len(stub.requestTimes()); requests != 1 {
+		t.Errorf("expected 1 backfill request, got %d", requests)
+	}
+}
+
+// TestTradeStreamBackfillHoldsSymbol checks that while a backfill is in
+// progress the symbol's trades are held, without holding up other
+// symbols.
+func TestTradeStreamBackfillHoldsSymbol(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+	stub := newAggTradesStub(t, fake)
+	defer stub.server.Close()
+	release := make(chan bool)
+	stub.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		<-release
+		return false
+	}
+	trades := startTestTradeStream(t, fake, func(stream *TradeStream) {
+		stream.RestUrl = stub.server.URL
+	})
+
+	fake.SendTrade(ethbtc)
+	expectTrades(t, trades, "ETHBTC", 1)
+	fake.LoseTrade(ethbtc)
+	fake.SendTrade(ethbtc)
+	waitFor(t, "the backfill request", func() bool {
+		return len(stub.requestTimes()) == 1
+	})
+
+	fake.SendTrade(ltcbtc)
+	expectTrades(t, trades, "LTCBTC", 1)
+	fake.SendTrade(ethbtc)
+	expectNoTrade(t, trades)
+
+	close(release)
+	expectTrades(t, trades, "ETHBTC", 2, 3, 4)
+}
+
+// TestTradeStreamBackfillRateLimit checks backfill requests are spaced by
+// the interval across symbols.
+func TestTradeStreamBackfillRateLimit(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+	stub := newAggTradesStub(t, fake)
+	defer stub.server.Close()
+	const interval = 200 * time.Millisecond
+	trades := startTestTradeStream(t, fake, func(stream *TradeStream) {
+		stream.RestUrl = stub.server.URL
+		stream.BackfillInterval = interval
+	})
+
+	fake.SendTrade(ethbtc)
+	fake.SendTrade(ltcbtc)
+	expectTrades(t, trades, "ETHBTC", 1)
+	expectTrades(t, trades, "LTCBTC", 1)
+	fake.LoseTrade(ethbtc)
+	fake.LoseTrade(ltcbtc)
+	fake.SendTrade(ethbtc)
+	fake.SendTrade(ltcbtc)
+	expectTrades(t, trades, "ETHBTC", 2, 3)
+	expectTrades(t, trades, "LTCBTC", 2, 3)
+
+	requests := stub.requestTimes()
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 backfill requests, got %d", len(requests))
+	}
+	if gap := requests[1].Sub(requests[0]); gap < interval {
+		t.Errorf("expected requests at least %v apart, got %v", interval, gap)
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// The number of levels requested per side in an order book snapshot.
+const depthSnapshotLimit = 1000
+
+// The most diff events buffered for a symbol while its snapshot is got.
+// Older events are dropped, if that leaves a gap the book is resynced.
+const maxDepthBuffer = 1000
+
+// The levels of a partial book depth stream.
+var DepthLevels = []int{5, 10, 20}
+
+// DepthStream maintains local order books for the configured symbols and
+// publishes their metrics as they change.
+//
+// By default the diff depth streams are used, each book being synced from
+// a REST snapshot then kept up to date by the diffs, using the update IDs
+// to detect missed diffs and resync. If Levels is set the partial book
+// depth streams are used instead, each message replacing the book with
+// that many levels per side.
+//
+// When a book goes out of sync, or its connection is lost, metrics marked
+// Unsynced are published so the last metrics are not taken as live.
+//
+// Order books are not cached or recorded, they are only tracked live.
+type DepthStream struct {
+	subscribers map[chan pkg.DepthMetrics]bool
+	lock        sync.RWMutex
+	clock       pkg.Clock
+
+	// The symbols to maintain order books for, such as ETHBTC.
+	Symbols []string
+
+	// The levels per side of the partial book depth streams, one of
+	// DepthLevels, or 0 for the diff depth streams.
+	Levels int
+
+	// The distance from the mid price, in percent, depth is measured
+	// within.
+	Percent float64
+
+	// The REST API the snapshots are got from.
+	RestUrl string
+
+	// The websocket API the depth streams are read from.
+	StreamUrl string
+
+	// The maximum number of streams subscribed to on one connection.
+	MaxStreamsPerConnection int
+
+	// The connections the streams are sharded over, once connected.
+	shards []*StreamClient
+
+	// How reconnects and snapshot requests are backed off.
+	backoffOptions pkg.BackoffOptions
+
+	// When a shard is considered stale and reconnected.
+	watchdogOptions pkg.WatchdogOptions
+
+	// The order books by symbol, only used by Run.
+	books map[string]*depthBook
+}
+
+// depthBook is the local order book of a symbol and its sync state.
+type depthBook struct {
+	symbol       string
+	book         *pkg.OrderBook
+	lastUpdateId int64
+
+	// Set once the book has been synced from a snapshot, and cleared when
+	// a diff is missed.
+	synced bool
+
+	// Set while a snapshot is being got.
+	syncing bool
+
+	// The diffs received while not synced, applied once the snapshot is
+	// got.
+	buffer []depthUpdate
+
+	// Snapshot requests are backed off after failing.
+	backoff *pkg.Backoff
+	retryAt time.Time
+}
+
+// depthUpdate is a diff depth event. All fields are declared so none are
+// matched to another by the case insensitive decoding.
+type depthUpdate struct {
+	EventType     string      `json:"e"`
+	EventTime     int64       `json:"E"`
+	Symbol        string      `json:"s"`
+	FirstUpdateId int64       `json:"U"`
+	FinalUpdateId int64       `json:"u"`
+	Bids          [][2]string `json:"b"`
+	Asks          [][2]string `json:"a"`
+}
+
+// depthSnapshot is an order book from the REST API, or a partial book
+// depth event, which has the same fields.
+type depthSnapshot struct {
+	LastUpdateId int64       `json:"lastUpdateId"`
+	Bids         [][2]string `json:"bids"`
+	Asks         [][2]string `json:"asks"`
+}
+
+// snapshotResult is the outcome of getting the snapshot of a symbol.
+type snapshotResult struct {
+	symbol   string
+	snapshot *depthSnapshot
+	err      error
+}
+
+func NewDepthStream(clock pkg.Clock) *DepthStream {
+	return &DepthStream{
+		subscribers: map[chan pkg.DepthMetrics]bool{},
+		clock:       clock,
+		Percent:     pkg.DefaultDepthPercent,
+		RestUrl:     DefaultRestUrl,
+		StreamUrl:   DefaultStreamUrl,
+
+		MaxStreamsPerConnection: DefaultMaxStreamsPerConnection,
+		backoffOptions:          pkg.DefaultBackoffOptions,
+		watchdogOptions:         pkg.DefaultWatchdogOptions,
+		books:                   map[string]*depthBook{},
+	}
+}
+
+func (d *DepthStream) Subscribe() chan pkg.DepthMetrics {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	channel := make(chan pkg.DepthMetrics)
+	d.subscribers[channel] = true
+	return channel
+}
+
+func (d *DepthStream) Publish(metrics pkg.DepthMetrics) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for subscriber := range d.subscribers {
+		subscriber <- metrics
+	}
+}
+
+// Streams returns the depth streams of the symbols.
+func (d *DepthStream) Streams() []string {
+	streams := []string{}
+	for _, symbol := range d.Symbols {
+		stream := fmt.Sprintf("%s@depth", strings.ToLower(symbol))
+		if d.Levels > 0 {
+			stream = fmt.Sprintf("%s%d", stream, d.Levels)
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (d *DepthStream) Run() {
+	shards := ShardStreams(d.Streams(), d.MaxStreamsPerConnection)
+	log.Printf("binance: subscribing to %d depth streams over %d connections\n",
+		len(d.Symbols), len(shards))
+	bodies := make(chan []byte)
+
+	// The symbols of a shard that has disconnected, whose books are no
+	// longer kept up to date.
+	disconnects := make(chan []string)
+
+	d.lock.Lock()
+	for i, shard := range shards {
+		client := NewStreamClient(d.clock, fmt.Sprintf("depth.%d", i), shard...)
+		client.Url = d.StreamUrl
+		client.SetBackoffOptions(d.backoffOptions)
+		client.SetWatchdogOptions(d.watchdogOptions)
+		symbols := []string{}
+		for _, stream := range shard {
+			symbols = append(symbols, strings.ToUpper(strings.Split(stream, "@")[0]))
+		}
+		client.OnDisconnect = func() {
+			disconnects <- symbols
+		}
+		d.shards = append(d.shards, client)
+		go client.RunRaw(bodies)
+	}
+	d.lock.Unlock()
+
+	snapshots := make(chan snapshotResult)
+	for {
+		select {
+		case body := <-bodies:
+			if err := d.handleMessage(body, snapshots); err != nil {
+				log.Printf("binance: failed to decode depth message: %v\n", err)
+			}
+		case result := <-snapshots:
+			d.handleSnapshot(result, snapshots)
+		case symbols := <-disconnects:
+			for _, symbol := range symbols {
+				if book := d.books[symbol]; book != nil && book.synced {
+					d.invalidate(book, nil)
+				}
+			}
+		}
+	}
+}
+
+// handleMessage applies a message from a depth stream to its book,
+// requesting a snapshot on snapshots if the book needs syncing.
+func (d *DepthStream) handleMessage(body []byte, snapshots chan snapshotResult) error {
+	var message struct {
+		Stream string          `json:"stream"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil {
+		return err
+	}
+
+	if d.Levels > 0 {
+		// Partial book depth events don't include the symbol, it is
+		// taken from the stream name.
+		var snapshot depthSnapshot
+		if err := json.Unmarshal(message.Data, &snapshot); err != nil {
+			return err
+		}
+		symbol := strings.ToUpper(strings.Split(message.Stream, "@")[0])
+		book := d.getBook(symbol)
+		if err := book.reset(&snapshot); err != nil {
+			return err
+		}
+		book.synced = true
+		d.publishBook(book, d.clock.Now())
+		return nil
+	}
+
+	var update depthUpdate
+	if err := json.Unmarshal(message.Data, &update); err != nil {
+		return err
+	}
+	book := d.getBook(update.Symbol)
+	if !book.synced {
+		book.buffer = append(book.buffer, update)
+		if len(book.buffer) > maxDepthBuffer {
+			book.buffer = book.buffer[len(book.buffer)-maxDepthBuffer:]
+		}
+		d.requestSnapshot(book, snapshots)
+		return nil
+	}
+	if err := d.applyUpdate(book, update); err != nil {
+		return err
+	}
+	if book.synced {
+		d.publishBook(book, depthEventTime(update.EventTime))
+	} else {
+		d.requestSnapshot(book, snapshots)
+	}
+	return nil
+}
+
+// handleSnapshot syncs a book from its snapshot and the diffs buffered
+// while it was got.
+func (d *DepthStream) handleSnapshot(result snapshotResult, snapshots chan snapshotResult) {
+	book := d.getBook(result.symbol)
+	book.syncing = false
+	err := result.err
+	if err == nil {
+		err = book.reset(result.snapshot)
+	}
+	if err != nil {
+		delay := book.backoff.Failure()
+		book.retryAt = time.Now().Add(delay)
+		log.Printf("error: binance: %s: failed to get depth snapshot, retrying in %v: %v\n",
+			book.symbol, delay, err)
+		return
+	}
+	book.backoff.Success()
+
+	buffer := book.buffer
+	book.buffer = nil
+	book.synced = true
+	updateTime := d.clock.Now()
+	for i, update := range buffer {
+		if err := d.applyUpdate(book, update); err != nil {
+			log.Printf("error: binance: %s: failed to apply depth update: %v\n",
+				book.symbol, err)
+		}
+		if !book.synced {
+			// The snapshot is older than the buffered diffs, keep them
+			// for the next one.
+			book.buffer = buffer[i:]
+			d.requestSnapshot(book, snapshots)
+			return
+		}
+		updateTime = depthEventTime(update.EventTime)
+	}
+	log.Printf("binance: %s: synced order book at update %d\n",
+		book.symbol, book.lastUpdateId)
+	d.publishBook(book, updateTime)
+}
+
+// applyUpdate applies a diff to a synced book. Diffs already in the book
+// are dropped, and if a diff was missed the book is marked as not synced.
+func (d *DepthStream) applyUpdate(book *depthBook, update depthUpdate) error {
+	if update.FinalUpdateId <= book.lastUpdateId {
+		return nil
+	}
+	if update.FirstUpdateId > book.lastUpdateId+1 {
+		log.Printf("warning: binance: %s: missed depth updates %d to %d, resyncing\n",
+			book.symbol, book.lastUpdateId+1, update.FirstUpdateId-1)
+		d.invalidate(book, []depthUpdate{update})
+		return nil
+	}
+	bids, err := decodeLevels(update.Bids)
+	if err != nil {
+		return err
+	}
+	asks, err := decodeLevels(update.Asks)
+	if err != nil {
+		return err
+	}
+	book.book.Update(bids, asks)
+	book.lastUpdateId = update.FinalUpdateId
+	return nil
+}
+
+// requestSnapshot gets the snapshot of a book in the background, sending
+// the result on snapshots, unless one is already being got or the retry
+// is not yet due.
+func (d *DepthStream) requestSnapshot(book *depthBook, snapshots chan snapshotResult) {
+	if book.syncing || time.Now().Before(book.retryAt) {
+		return
+	}
+	book.syncing = true
+	book.backoff.Attempt()
+	go func(symbol string) {
+		snapshot, err := d.getSnapshot(symbol)
+		snapshots <- snapshotResult{symbol: symbol, snapshot: snapshot, err: err}
+	}(book.symbol)
+}
+
+// invalidate marks a book as not synced, keeping buffer to apply once it
+// is resynced, and publishes that its metrics are no longer live.
+func (d *DepthStream) invalidate(book *depthBook, buffer []depthUpdate) {
+	book.synced = false
+	book.buffer = buffer
+	d.Publish(pkg.DepthMetrics{
+		Symbol:    book.symbol,
+		Timestamp: d.clock.Now(),
+		Unsynced:  true,
+	})
+}
+
+func (d *DepthStream) publishBook(book *depthBook, timestamp time.Time) {
+	metrics, ok := book.book.Metrics(d.Percent)
+	if !ok {
+		return
+	}
+	metrics.Symbol = book.symbol
+	metrics.Timestamp = timestamp
+	d.Publish(metrics)
+}
+
+func (d *DepthStream) getBook(symbol string) *depthBook {
+	book := d.books[symbol]
+	if book == nil {
+		book = &depthBook{
+			symbol:  symbol,
+			book:    pkg.NewOrderBook(),
+			backoff: pkg.NewBackoff(d.backoffOptions),
+		}
+		d.books[symbol] = book
+	}
+	return book
+}
+
+// reset replaces the book with snapshot.
+func (b *depthBook) reset(snapshot *depthSnapshot) error {
+	bids, err := decodeLevels(snapshot.Bids)
+	if err != nil {
+		return err
+	}
+	asks, err := decodeLevels(snapshot.Asks)
+	if err != nil {
+		return err
+	}
+	b.book = pkg.NewOrderBook()
+	b.book.Update(bids, asks)
+	b.lastUpdateId = snapshot.LastUpdateId
+	return nil
+}
+
+func (d *DepthStream) getSnapshot(symbol string) (*depthSnapshot, error) {
+	snapshot := &depthSnapshot{}
+	path := fmt.Sprintf("/api/v3/depth?symbol=%s&limit=%d", symbol, depthSnapshotLimit)
+	if err := restGet(d.RestUrl, path, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// decodeLevels decodes price levels sent as [price, quantity] strings.
+func decodeLevels(raw [][2]string) ([]pkg.PriceLevel, error) {
+	levels := []pkg.PriceLevel{}
+	for _, level := range raw {
+		price, err := strconv.ParseFloat(level[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		quantity, err := strconv.ParseFloat(level[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		levels = append(levels, pkg.PriceLevel{Price: price, Quantity: quantity})
+	}
+	return levels, nil
+}
+
+// depthEventTime converts an event time in milliseconds to a time.
+func depthEventTime(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// Status returns the status of each depth stream connection.
+func (d *DepthStream) Status() []pkg.StreamStatus {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	statuses := []pkg.StreamStatus{}
+	for _, shard := range d.shards {
+		statuses = append(statuses, shard.Status())
+	}
+	return statuses
+}
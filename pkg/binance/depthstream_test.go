@@ -0,0 +1,151 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/fakeexchange"
+)
+
+// subscribeDepth buffers the metrics published by the depth stream.
+func subscribeDepth(d *DepthStream) chan pkg.DepthMetrics {
+	channel := d.Subscribe()
+	buffered := make(chan pkg.DepthMetrics, 100)
+	go func() {
+		for metrics := range channel {
+			buffered <- metrics
+		}
+	}()
+	return buffered
+}
+
+func receiveDepth(t *testing.T, channel chan pkg.DepthMetrics) pkg.DepthMetrics {
+	t.Helper()
+	select {
+	case metrics := <-channel:
+		return metrics
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for depth metrics")
+	}
+	return pkg.DepthMetrics{}
+}
+
+func TestDepthStreamApplyUpdate(t *testing.T) {
+	d := NewDepthStream(pkg.SystemClock{})
+	metrics := subscribeDepth(d)
+	book := d.getBook("ETHBTC")
+	err := book.reset(&depthSnapshot{
+		LastUpdateId: 10,
+		Bids:         [][2]string{{"0.9", "1"}},
+		Asks:         [][2]string{{"1.1", "1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	book.synced = true
+
+	apply := func(first, final int64, bid string) {
+		t.Helper()
+		err := d.applyUpdate(book, depthUpdate{
+			Symbol:        "ETHBTC",
+			FirstUpdateId: first,
+			FinalUpdateId: final,
+			Bids:          [][2]string{{"0.9", bid}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Already in the snapshot.
+	apply(5, 10, "5")
+	if book.book.Bids[0.9] != 1 || book.lastUpdateId != 10 {
+		t.Fatalf("expected an old diff to be dropped, got %v at %d",
+			book.book.Bids, book.lastUpdateId)
+	}
+
+	// Overlapping the snapshot, then following on.
+	apply(9, 12, "2")
+	apply(13, 13, "3")
+	if book.book.Bids[0.9] != 3 || book.lastUpdateId != 13 || !book.synced {
+		t.Fatalf("expected the diffs to be applied, got %v at %d",
+			book.book.Bids, book.lastUpdateId)
+	}
+
+	// A gap unsyncs the book, keeping the diff for the resync.
+	apply(15, 16, "4")
+	if book.synced || book.book.Bids[0.9] != 3 {
+		t.Fatalf("expected the book to be unsynced without applying the diff")
+	}
+	if len(book.buffer) != 1 || book.buffer[0].FirstUpdateId != 15 {
+		t.Fatalf("expected the diff to be buffered, got %+v", book.buffer)
+	}
+	if m := receiveDepth(t, metrics); !m.Unsynced || m.Symbol != "ETHBTC" {
+		t.Fatalf("expected unsynced metrics for ETHBTC, got %+v", m)
+	}
+}
+
+// TestDepthStreamDisconnect checks the books of a disconnected shard are
+// reported unsynced, then resynced once it reconnects.
+func TestDepthStreamDisconnect(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC")
+	defer fake.Close()
+
+	d := NewDepthStream(pkg.SystemClock{})
+	d.Symbols = []string{"ETHBTC"}
+	d.Percent = 20
+	d.RestUrl = fake.RestUrl()
+	d.StreamUrl = fake.StreamUrl()
+	d.backoffOptions.InitialDelay = 10 * time.Millisecond
+	metrics := subscribeDepth(d)
+	go d.Run()
+	if err := fake.WaitForStream("ethbtc@depth", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.SendDepthUpdate(fakeexchange.DepthUpdate{
+		Symbol: "ETHBTC",
+		Bids:   []fakeexchange.Level{{Price: 0.9, Quantity: 10}},
+		Asks:   []fakeexchange.Level{{Price: 1.1, Quantity: 10}},
+	})
+	if m := receiveDepth(t, metrics); m.Unsynced || m.BidDepth != 9 {
+		t.Fatalf("expected a bid depth of 9, got %+v", m)
+	}
+
+	fake.DropConnections()
+	if m := receiveDepth(t, metrics); !m.Unsynced {
+		t.Fatalf("expected unsynced metrics on disconnect, got %+v", m)
+	}
+
+	waitFor(t, "the reconnect", func() bool {
+		statuses := d.Status()
+		return len(statuses) == 1 && statuses[0].Connected &&
+			statuses[0].Reconnects == 1
+	})
+	if err := fake.WaitForStream("ethbtc@depth", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	fake.SendDepthUpdate(fakeexchange.DepthUpdate{
+		Symbol: "ETHBTC",
+		Bids:   []fakeexchange.Level{{Price: 0.95, Quantity: 10}},
+	})
+	if m := receiveDepth(t, metrics); m.Unsynced || m.BidDepth != 18.5 {
+		t.Fatalf("expected a resynced bid depth of 18.5, got %+v", m)
+	}
+}
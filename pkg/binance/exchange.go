@@ -0,0 +1,173 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// Exchange provides the Binance ticker, trade and depth streams.
+type Exchange struct {
+	tickerStream *TickerStream
+	tradeStream  *TradeStream
+
+	// Nil when replaying, order books are only tracked live.
+	depthStream *DepthStream
+}
+
+func NewExchange(clock pkg.Clock, cacheOptions pkg.CacheOptions) (*Exchange, error) {
+	tickerCache, err := pkg.OpenInputCache(cacheOptions, "binance", clock)
+	if err != nil {
+		return nil, err
+	}
+	tradeCache, err := pkg.OpenInputCache(cacheOptions, "binance.trades", clock)
+	if err != nil {
+		return nil, err
+	}
+	return &Exchange{
+		tickerStream: NewTickerStream(clock, tickerCache),
+		tradeStream:  NewTradeStream(clock, tradeCache),
+		depthStream:  NewDepthStream(clock),
+	}, nil
+}
+
+// NewReplayExchange creates an exchange fed by the messages replayed by
+// player. Nothing is cached, as there is no state to restore.
+func NewReplayExchange(clock pkg.Clock, player *pkg.Player) *Exchange {
+	exchange := &Exchange{
+		tickerStream: NewTickerStream(clock, pkg.NopInputCache{}),
+		tradeStream:  NewTradeStream(clock, pkg.NopInputCache{}),
+	}
+	exchange.tickerStream.replay = player.Subscribe(RecordSourceTickers)
+	exchange.tradeStream.replay = player.Subscribe(RecordSourceTrades)
+	return exchange
+}
+
+func (e *Exchange) Name() string {
+	return "binance"
+}
+
+func (e *Exchange) TickerFeed() pkg.TickerFeed {
+	return e.tickerStream
+}
+
+func (e *Exchange) TradeFeed() pkg.TradeFeed {
+	return e.tradeStream
+}
+
+// DepthFeed returns nil unless depth symbols have been set.
+func (e *Exchange) DepthFeed() pkg.DepthFeed {
+	if e.depthStream == nil || len(e.depthStream.Symbols) == 0 {
+		return nil
+	}
+	return e.depthStream
+}
+
+func (e *Exchange) Symbols() ([]string, error) {
+	return getSymbols(e.tradeStream.RestUrl)
+}
+
+func (e *Exchange) SetMaxAge(maxAge time.Duration) {
+	e.tickerStream.MaxAge = maxAge
+	e.tradeStream.MaxAge = maxAge
+}
+
+func (e *Exchange) SetRecorder(recorder *pkg.Recorder) {
+	e.tickerStream.recorder = recorder
+	e.tradeStream.recorder = recorder
+}
+
+// SetRestUrl sets the base URL of the REST API.
+func (e *Exchange) SetRestUrl(url string) {
+	e.tradeStream.RestUrl = url
+	if e.depthStream != nil {
+		e.depthStream.RestUrl = url
+	}
+}
+
+// SetStreamUrl sets the base URL of the websocket API.
+func (e *Exchange) SetStreamUrl(url string) {
+	e.tickerStream.client.Url = url
+	e.tradeStream.StreamUrl = url
+	if e.depthStream != nil {
+		e.depthStream.StreamUrl = url
+	}
+}
+
+// SetMaxStreamsPerConnection sets the maximum number of trade streams
+// subscribed to on one connection.
+func (e *Exchange) SetMaxStreamsPerConnection(max int) {
+	e.tradeStream.MaxStreamsPerConnection = max
+	if e.depthStream != nil {
+		e.depthStream.MaxStreamsPerConnection = max
+	}
+}
+
+// SetDepthOptions sets the symbols order books are maintained for, none by
+// default, and the levels and percent of the depth stream. Levels must be
+// 0 for the diff depth streams or one of DepthLevels.
+func (e *Exchange) SetDepthOptions(symbols []string, levels int, percent float64) error {
+	if e.depthStream == nil {
+		return nil
+	}
+	valid := levels == 0
+	for _, l := range DepthLevels {
+		valid = valid || levels == l
+	}
+	if !valid {
+		return fmt.Errorf("invalid depth levels %d, must be one of %v",
+			levels, DepthLevels)
+	}
+	if percent <= 0 {
+		return fmt.Errorf("invalid depth percent %v, must be positive", percent)
+	}
+	e.depthStream.Symbols = []string{}
+	for _, symbol := range symbols {
+		e.depthStream.Symbols = append(e.depthStream.Symbols, strings.ToUpper(symbol))
+	}
+	e.depthStream.Levels = levels
+	e.depthStream.Percent = percent
+	return nil
+}
+
+func (e *Exchange) SetBackoffOptions(options pkg.BackoffOptions) {
+	e.tickerStream.SetBackoffOptions(options)
+	e.tradeStream.backoffOptions = options
+	if e.depthStream != nil {
+		e.depthStream.backoffOptions = options
+	}
+}
+
+func (e *Exchange) SetWatchdogOptions(options pkg.WatchdogOptions) {
+	e.tickerStream.SetWatchdogOptions(options)
+	e.tradeStream.watchdogOptions = options
+	if e.depthStream != nil {
+		e.depthStream.watchdogOptions = options
+	}
+}
+
+func (e *Exchange) Streams() []pkg.StreamStatus {
+	if e.tickerStream.replay != nil {
+		return []pkg.StreamStatus{}
+	}
+	statuses := append([]pkg.StreamStatus{e.tickerStream.Status()},
+		e.tradeStream.Status()...)
+	return append(statuses, e.depthStream.Status()...)
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DefaultRestUrl = "https://api.binance.com"
+
+var restHttpClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// restGet gets path from the REST API at baseUrl, decoding the JSON
+// response into v.
+func restGet(baseUrl string, path string, v interface{}) error {
+	response, err := restHttpClient.Get(baseUrl + path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("binance: GET %s: %s: %s", path, response.Status,
+			strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// getSymbols returns the symbols currently trading.
+func getSymbols(baseUrl string) ([]string, error) {
+	var exchangeInfo struct {
+		Symbols []struct {
+			Symbol string `json:"symbol"`
+			Status string `json:"status"`
+		} `json:"symbols"`
+	}
+	if err := restGet(baseUrl, "/api/v3/exchangeInfo", &exchangeInfo); err != nil {
+		return nil, err
+	}
+	symbols := []string{}
+	for _, symbol := range exchangeInfo.Symbols {
+		if symbol.Status == "TRADING" {
+			symbols = append(symbols, symbol.Symbol)
+		}
+	}
+	return symbols, nil
+}
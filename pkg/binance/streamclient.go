@@ -20,27 +20,158 @@ import (
 	"log"
 	"time"
 	"encoding/json"
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/websocket"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const DefaultStreamUrl = "wss://stream.binance.com:9443"
+
+// Sources of recorded messages.
+const (
+	RecordSourceTickers = "binance.tickers"
+	RecordSourceTrades  = "binance.trades"
 )
 
 type StreamClient struct {
 	name          string
-	client        *binance.StreamClient
 	streams       []string
+
+	// The base URL of the websocket API the combined stream is read from.
+	Url string
+
+	conn     *websocket.Conn
+	connLock sync.Mutex
+
+	// Closed by Stop.
+	stopped  chan bool
+	stopOnce sync.Once
+
+	// Messages read are recorded to recorder if set.
+	recorder     *pkg.Recorder
+	recordSource string
+
+	// If set, called when the connection is lost, before reconnecting.
+	OnDisconnect func()
+
+	health *pkg.StreamHealth
 }
 
-func NewStreamClient(name string, streams ...string) *StreamClient {
+func NewStreamClient(clock pkg.Clock, name string, streams ...string) *StreamClient {
 	return &StreamClient{
 		name:          name,
-		client:        binance.NewStreamClient(),
 		streams:       streams,
+		Url:           DefaultStreamUrl,
+		stopped:       make(chan bool),
+		health:        pkg.NewStreamHealth(clock, name, len(streams)),
+	}
+}
+
+// Stop closes the connection and stops reconnecting, so Run and RunRaw
+// return.
+func (s *StreamClient) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+	s.Close()
+}
+
+func (s *StreamClient) isStopped() bool {
+	select {
+	case <-s.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for delay, returning false if stopped first.
+func (s *StreamClient) sleep(delay time.Duration) bool {
+	select {
+	case <-s.stopped:
+		return false
+	case <-time.After(delay):
+		return true
 	}
 }
 
+// SetBackoffOptions sets how reconnects are backed off.
+func (s *StreamClient) SetBackoffOptions(options pkg.BackoffOptions) {
+	s.health.SetBackoffOptions(options)
+}
+
+// SetWatchdogOptions sets when the stream is considered stale and
+// reconnected.
+func (s *StreamClient) SetWatchdogOptions(options pkg.WatchdogOptions) {
+	s.health.SetWatchdogOptions(options)
+}
+
+func (s *StreamClient) Status() pkg.StreamStatus {
+	return s.health.Status()
+}
+
+// Record records each message read to recorder as coming from source.
+func (s *StreamClient) Record(recorder *pkg.Recorder, source string) {
+	s.recorder = recorder
+	s.recordSource = source
+}
+
 func (s *StreamClient) ReadNext() ([]byte, error) {
-	_, body, err := s.client.Next()
+	s.connLock.Lock()
+	conn := s.conn
+	s.connLock.Unlock()
+	_, body, err := conn.ReadMessage()
+	if err == nil {
+		s.health.Message()
+		if eventTime, ok := decodeEventTime(body); ok {
+			s.health.ServerTime(eventTime)
+		}
+		s.recorder.Record(s.recordSource, body)
+	}
 	return body, err
 }
 
+// decodeEventTime returns the latest event time of a combined stream
+// message, whose data is an event or an array of events.
+func decodeEventTime(body []byte) (time.Time, bool) {
+	type event struct {
+		// Declared so it isn't matched to E by the case insensitive
+		// decoding.
+		EventType string `json:"e"`
+		EventTime int64  `json:"E"`
+	}
+	var message struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &message); err != nil || len(message.Data) == 0 {
+		return time.Time{}, false
+	}
+	events := []event{}
+	if message.Data[0] == '[' {
+		if err := json.Unmarshal(message.Data, &events); err != nil {
+			return time.Time{}, false
+		}
+	} else {
+		var single event
+		if err := json.Unmarshal(message.Data, &single); err != nil {
+			return time.Time{}, false
+		}
+		events = append(events, single)
+	}
+	latest := int64(0)
+	for _, event := range events {
+		if event.EventTime > latest {
+			latest = event.EventTime
+		}
+	}
+	if latest == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, latest*int64(time.Millisecond)), true
+}
+
 func (s *StreamClient) Decode(buf []byte) (*binance.RawStreamMessage, error) {
 	var message binance.RawStreamMessage
 	err := json.Unmarshal(buf, &message)
@@ -48,44 +179,130 @@ func (s *StreamClient) Decode(buf []byte) (*binance.RawStreamMessage, error) {
 }
 
 func (s *StreamClient) Run(channel chan *binance.RawStreamMessage) {
+	s.run(func(body []byte) {
+		message, err := s.Decode(body)
+		if err != nil {
+			log.Printf("binance: failed to decode message on stream [%s]: %v\n",
+				s.name, err)
+			return
+		}
+		channel <- message
+	})
+}
+
+// RunRaw sends each message read on channel undecoded, reconnecting as
+// required. It does not return until stopped.
+func (s *StreamClient) RunRaw(channel chan []byte) {
+	s.run(func(body []byte) {
+		channel <- body
+	})
+}
+
+func (s *StreamClient) run(handle func(body []byte)) {
 	for {
 		// Connect, runs in its own loop until connected.
 		log.Printf("binance: connecting to stream [%s]\n", s.name)
-		s.Connect()
+		if !s.Connect() {
+			return
+		}
 		log.Printf("binance: connected to stream [%s]\n", s.name)
 
+		// The connection only counts as a success once a message is
+		// received, so a server that accepts connections then drops them
+		// still gets backed off from.
+		backoff := s.health.Backoff()
+		received := false
+
+		// The watchdog closes the connection if it goes stale, so the read
+		// below fails and it is reconnected.
+		done := make(chan bool)
+		go s.health.Watch(done, s.Close)
+
 		// Read loop.
-	ReadLoop:
 		for {
 			body, err := s.ReadNext()
+			if err != nil && s.isStopped() {
+				log.Printf("binance: stopped stream [%s]\n", s.name)
+				close(done)
+				s.health.Disconnected(err)
+				return
+			}
 			if err != nil {
 				log.Printf("binance: read error on stream [%s]: %v\n",
 					s.name, err)
-				break ReadLoop
+				s.health.Disconnected(err)
+				if s.OnDisconnect != nil {
+					s.OnDisconnect()
+				}
+				break
 			}
-
-			message, err := s.Decode(body)
-			if err != nil {
-				log.Printf("binance: failed to decode message on stream [%s]: %v\n",
-					s.name, err)
-				goto ReadLoop
+			if !received {
+				backoff.Success()
+				received = true
 			}
+			handle(body)
+		}
+		close(done)
+		s.Close()
 
-			channel <- message
+		delay := backoff.Failure()
+		log.Printf("binance: reconnecting to stream [%s] in %v\n", s.name, delay)
+		if !s.sleep(delay) {
+			return
 		}
+	}
+}
+
+// Close closes the current connection, making a blocked read fail.
+func (s *StreamClient) Close() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *StreamClient) dial() error {
+	url := fmt.Sprintf("%s/stream?streams=%s", s.Url, strings.Join(s.streams, "/"))
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	s.connLock.Lock()
+	s.conn = conn
+	s.connLock.Unlock()
 
-		time.Sleep(1 * time.Second)
+	// Stop may have closed the previous connection while dialing.
+	if s.isStopped() {
+		conn.Close()
+		return fmt.Errorf("stopped")
 	}
+	return nil
 }
 
-func (s *StreamClient) Connect() {
+// Connect connects, retrying with backoff. It returns false if the client
+// is stopped first.
+func (s *StreamClient) Connect() bool {
+	backoff := s.health.Backoff()
 	for {
-		err := s.client.Connect(s.streams...)
+		if s.isStopped() {
+			return false
+		}
+		backoff.Attempt()
+		err := s.dial()
 		if err == nil {
-			return
+			s.health.Connected()
+			return true
+		}
+		if s.isStopped() {
+			return false
+		}
+		s.health.Disconnected(err)
+		delay := backoff.Failure()
+		log.Printf("binance: failed to connect to stream [%s], retrying in %v: %v\n",
+			s.name, delay, err)
+		if !s.sleep(delay) {
+			return false
 		}
-		log.Printf("binance: failed to connect to stream [%s]: %v\n",
-			s.name, err)
-		time.Sleep(1 * time.Second)
 	}
 }
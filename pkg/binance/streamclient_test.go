@@ -0,0 +1,151 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/fakeexchange"
+)
+
+// TestStreamClientReconnectBackoff drops the connection before any message
+// is received, so each reconnect counts as a failure, checking the delay
+// grows until the breaker opens, and a message resets it.
+func TestStreamClientReconnectBackoff(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC")
+	defer fake.Close()
+
+	client := NewStreamClient(pkg.SystemClock{}, "test", "ethbtc@aggTrade")
+	client.Url = fake.StreamUrl()
+	client.SetBackoffOptions(pkg.BackoffOptions{
+		InitialDelay:     100 * time.Millisecond,
+		MaxDelay:         time.Second,
+		Multiplier:       2,
+		BreakerThreshold: 3,
+		BreakerCooldown:  600 * time.Millisecond,
+	})
+	bodies := make(chan []byte, 1)
+	go client.RunRaw(bodies)
+	defer client.Stop()
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []struct {
+		delay   time.Duration
+		circuit string
+	}{
+		{100 * time.Millisecond, pkg.CircuitClosed},
+		{200 * time.Millisecond, pkg.CircuitClosed},
+		{600 * time.Millisecond, pkg.CircuitHalfOpen},
+	} {
+		dropped := time.Now()
+		fake.DropConnections()
+		reconnects := int64(i + 1)
+		waitFor(t, "a reconnect", func() bool {
+			return client.Status().Reconnects == reconnects
+		})
+		status := client.Status()
+		if delay := status.ConnectedAt.Sub(dropped); delay < expected.delay {
+			t.Errorf("reconnect %d: expected a delay of at least %v, got %v",
+				reconnects, expected.delay, delay)
+		}
+		if status.Failures != i+1 {
+			t.Errorf("reconnect %d: expected %d failures, got %d",
+				reconnects, i+1, status.Failures)
+		}
+		if status.Circuit != expected.circuit {
+			t.Errorf("reconnect %d: expected the circuit %s, got %s",
+				reconnects, expected.circuit, status.Circuit)
+		}
+	}
+
+	// A message on the half open connection closes the circuit.
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	fake.SendTrade(fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: 1})
+	select {
+	case <-bodies:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	waitFor(t, "the circuit to close", func() bool {
+		status := client.Status()
+		return status.Circuit == pkg.CircuitClosed && status.Failures == 0
+	})
+
+	// So the next reconnect is back to the initial delay.
+	dropped := time.Now()
+	fake.DropConnections()
+	waitFor(t, "a reconnect", func() bool {
+		return client.Status().Reconnects == 4
+	})
+	if delay := client.Status().ConnectedAt.Sub(dropped); delay >= 600*time.Millisecond {
+		t.Errorf("expected the initial delay after a reset, got %v", delay)
+	}
+}
+
+// TestStreamClientWatchdog checks a connection that goes stale is closed
+// by the watchdog and reconnected.
+func TestStreamClientWatchdog(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC")
+	defer fake.Close()
+
+	clock := pkg.NewManualClock(time.Unix(1500000000, 0))
+	client := NewStreamClient(clock, "test", "ethbtc@aggTrade")
+	client.Url = fake.StreamUrl()
+	client.SetBackoffOptions(pkg.BackoffOptions{
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     time.Second,
+		Multiplier:   2,
+	})
+	client.SetWatchdogOptions(pkg.WatchdogOptions{
+		MaxSilence: time.Minute,
+		Interval:   10 * time.Millisecond,
+	})
+	bodies := make(chan []byte, 1)
+	go client.RunRaw(bodies)
+	defer client.Stop()
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	waitFor(t, "the stale stream to reconnect", func() bool {
+		status := client.Status()
+		return status.Connected && status.Reconnects == 1
+	})
+	status := client.Status()
+	if !status.Degraded || status.DegradedReason != "no messages for 2m0s" {
+		t.Errorf("expected the stream degraded until a message, got %+v", status)
+	}
+
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	fake.SendTrade(fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: 1})
+	select {
+	case <-bodies:
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	waitFor(t, "the stream to recover", func() bool {
+		return !client.Status().Degraded
+	})
+}
@@ -23,18 +23,37 @@ import (
 )
 
 type TickerStream struct {
-	Cache *pkg.RedisInputCache
+	Cache pkg.InputCache
+	clock pkg.Clock
+
+	// How long tickers are kept in the cache.
+	MaxAge time.Duration
+
+	recorder *pkg.Recorder
+
+	// If set, raw messages are read from here instead of the stream.
+	replay chan []byte
+
+	client *StreamClient
 }
 
-func NewTickerStream() *TickerStream {
+func NewTickerStream(clock pkg.Clock, cache pkg.InputCache) *TickerStream {
 	return &TickerStream{
-		Cache: pkg.NewRedisInputCache("binance"),
+		Cache:  cache,
+		clock:  clock,
+		MaxAge: time.Hour,
+		client: NewStreamClient(clock, "binance.ticker", "!ticker@arr"),
 	}
 }
 
 func (s *TickerStream) Run(channel chan []pkg.CommonTicker) {
+	if s.replay != nil {
+		s.runReplay(channel)
+		return
+	}
 	inChannel := make(chan *binance.RawStreamMessage)
-	go NewStreamClient("binance.ticker", "!ticker@arr").Run(inChannel)
+	s.client.Record(s.recorder, RecordSourceTickers)
+	go s.client.Run(inChannel)
 	for {
 		streamMessage := <-inChannel
 		s.CacheAdd(streamMessage.RawData)
@@ -43,23 +62,61 @@ func (s *TickerStream) Run(channel chan []pkg.CommonTicker) {
 	}
 }
 
+// runReplay handles replayed messages as they would be handled if
+// received from the stream.
+func (s *TickerStream) runReplay(channel chan []pkg.CommonTicker) {
+	for body := range s.replay {
+		s.CacheAdd(body)
+		s.PruneCache()
+		tickers, err := s.DecodeTickers(body)
+		if err != nil {
+			log.Printf("error: failed to decode replayed tickers: %v\n", err)
+			continue
+		}
+		channel <- tickers
+	}
+}
+
+func (s *TickerStream) SetBackoffOptions(options pkg.BackoffOptions) {
+	s.client.SetBackoffOptions(options)
+}
+
+func (s *TickerStream) SetWatchdogOptions(options pkg.WatchdogOptions) {
+	s.client.SetWatchdogOptions(options)
+}
+
+func (s *TickerStream) Status() pkg.StreamStatus {
+	return s.client.Status()
+}
+
 func (s *TickerStream) CacheAdd(body []byte) {
 	s.Cache.RPush(body)
 }
 
 func (s *TickerStream) PruneCache() {
-	for {
-		next, err := s.Cache.GetFirst()
+	if err := s.Cache.Prune(s.clock.Now().Add(-s.MaxAge)); err != nil {
+		log.Printf("error: binance ticker stream: failed to prune cache: %v\n", err)
+	}
+}
+
+// ReplayCache calls cb with each batch of tickers cached after after that
+// is not older than MaxAge.
+func (s *TickerStream) ReplayCache(after time.Time, cb func(tickers []pkg.CommonTicker)) {
+	after = pkg.ReplayStartTime(s.clock, after, s.MaxAge)
+	pkg.ReplayInputCache("binance tickers", s.Cache, after,
+		pkg.CacheEndTime(s.Cache), func(entry pkg.CacheEntry) {
+		tickers, err := s.DecodeTickers([]byte(entry.Message))
 		if err != nil {
-			log.Printf("error: binance ticker stream: failed to read from redis: %v\n", err)
-			break
+			log.Printf("error: failed to decode cached tickers: %v\n", err)
+			return
 		}
-		if time.Now().Sub(time.Unix(next.Timestamp, 0)) > time.Hour {
-			s.Cache.LRemove()
-		} else {
-			break
+		if len(tickers) == 0 {
+			log.Printf("warning: decoded 0 length tickers\n")
+			return
 		}
-	}
+
+		cb(tickers)
+	})
 }
 
 func (s *TickerStream) TransformTickers(inTickers []binance.RawTicker24) []pkg.CommonTicker {
@@ -26,65 +26,127 @@ import (
 	"sync"
 )
 
+// The default maximum number of streams per connection. Binance allows up
+// to 1024, but the streams are given in the URL so fewer keeps it to a
+// sensible length.
+const DefaultMaxStreamsPerConnection = 200
+
+// The default interval the symbols are got at, so listed symbols are
+// subscribed to and delisted symbols unsubscribed from.
+const DefaultSymbolRefreshInterval = 10 * time.Minute
+
+// How long new shards are given to connect before the shards they replace
+// are stopped.
+const reshardConnectTimeout = 30 * time.Second
+
 type TradeStream struct {
-	subscribers map[chan binance.AggTrade]bool
-	cache       *pkg.RedisInputCache
+	subscribers map[chan pkg.CommonTrade]bool
+	cache       pkg.InputCache
 	lock        sync.RWMutex
+	clock       pkg.Clock
+
+	// How long trades are kept in the cache.
+	MaxAge time.Duration
+
+	// The maximum number of streams subscribed to on one connection.
+	MaxStreamsPerConnection int
+
+	// The connections the streams are sharded over, once connected.
+	shards []*StreamClient
+
+	// The streams subscribed to.
+	streams []string
+
+	// How often the symbols are got to update the streams subscribed to,
+	// never if 0.
+	SymbolRefreshInterval time.Duration
+
+	// How reconnects and getting the streams are backed off.
+	backoffOptions pkg.BackoffOptions
+
+	// When a shard is considered stale and reconnected.
+	watchdogOptions pkg.WatchdogOptions
+
+	recorder *pkg.Recorder
+
+	// If set, raw messages are read from here instead of the stream.
+	replay chan []byte
+
+	// The REST API the symbols are got from and missing trades are
+	// backfilled from.
+	RestUrl string
+
+	// The websocket API the trade streams are read from.
+	StreamUrl string
+
+	// The most missing trades waiting to be backfilled across all
+	// symbols, all if 0.
+	MaxBackfill int64
+
+	// The minimum interval between backfill requests across all symbols.
+	BackfillInterval time.Duration
+
+	// Gets missing trades, if backfilling.
+	backfiller *backfiller
+
+	// The last aggregate trade ID published by symbol.
+	lastAggTradeIds map[string]int64
+
+	// The trades received by symbol while waiting for a backfill.
+	held map[string][]tradeMessage
 }
 
-func NewTradeStream() *TradeStream {
+func NewTradeStream(clock pkg.Clock, cache pkg.InputCache) *TradeStream {
 	return &TradeStream{
-		subscribers: map[chan binance.AggTrade]bool{},
-		cache:       pkg.NewRedisInputCache("binance.trades"),
+		subscribers: map[chan pkg.CommonTrade]bool{},
+		cache:       cache,
+		clock:       clock,
+		MaxAge:      time.Hour,
+
+		MaxStreamsPerConnection: DefaultMaxStreamsPerConnection,
+		SymbolRefreshInterval:   DefaultSymbolRefreshInterval,
+		backoffOptions:          pkg.DefaultBackoffOptions,
+		watchdogOptions:         pkg.DefaultWatchdogOptions,
+		RestUrl:                 DefaultRestUrl,
+		StreamUrl:               DefaultStreamUrl,
+		MaxBackfill:             DefaultMaxBackfill,
+		BackfillInterval:        DefaultBackfillInterval,
+		lastAggTradeIds:         map[string]int64{},
+		held:                    map[string][]tradeMessage{},
 	}
 }
 
-func (b *TradeStream) Subscribe() chan binance.AggTrade {
+func (b *TradeStream) Subscribe() chan pkg.CommonTrade {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	channel := make(chan binance.AggTrade)
+	channel := make(chan pkg.CommonTrade)
 	b.subscribers[channel] = true
 	return channel
 }
 
-func (b *TradeStream) Unsubscribe(channel chan binance.AggTrade) {
+func (b *TradeStream) Unsubscribe(channel chan pkg.CommonTrade) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	delete(b.subscribers, channel)
 }
 
-func (b *TradeStream) RestoreFromCache(channel chan *binance.AggTrade, count int64) {
-	i := int64(0)
-	start := time.Now()
+// RestoreFromCache sends the trades cached after after and up until until,
+// and not older than MaxAge, on channel followed by nil.
+func (b *TradeStream) RestoreFromCache(channel chan *binance.AggTrade, after, until time.Time) {
 	first := time.Time{}
 	last := time.Time{}
 
-	log.Printf("binance trade Cache: restoring %d Cache entries\n", count)
-
-	for {
-		next, err := b.cache.GetN(i)
-		if err != nil {
-			log.Printf("error: redis: %v", err)
-			break
-		}
-		if next == nil {
-			if i < count {
-				log.Printf("error: only restored %d trades, requested %d\n",
-					i, count)
-			}
-			break
-		}
-		i += 1
-
-		if next.Timestamp == 0 {
+	after = pkg.ReplayStartTime(b.clock, after, b.MaxAge)
+	pkg.ReplayInputCache("binance trades", b.cache, after, until, func(entry pkg.CacheEntry) {
+		if entry.Timestamp == 0 {
 			log.Printf("error: redis: Cache entry with 0 timestamp\n")
-			continue
+			return
 		}
 
-		aggTrade, err := b.DecodeTrade([]byte(next.Message))
+		aggTrade, err := b.DecodeTrade([]byte(entry.Message))
 		if err != nil {
 			log.Printf("error: failed to decode aggTrade from redis Cache: %v\n", err)
-			continue
+			return
 		}
 		last = aggTrade.Timestamp
 
@@ -93,82 +155,79 @@ func (b *TradeStream) RestoreFromCache(channel chan *binance.AggTrade, count int
 		}
 
 		channel <- aggTrade
+	})
 
-		if i == count {
-			break
-		}
-	}
-
-	restoreDuration := time.Now().Sub(start)
-	restoreRange := last.Sub(first)
-	log.Printf("binance trades: restored %d trades in %v; range=%v\n",
-		i, restoreDuration, restoreRange)
+	log.Printf("binance trades: restored trade range=%v\n", last.Sub(first))
 
 	channel <- nil
 }
 
-func (b *TradeStream) Run() {
+func (b *TradeStream) Run(after time.Time) {
 
 	cacheChannel := make(chan *binance.AggTrade)
-	tradeChannel := make(chan *binance.AggTrade)
-
-	cacheCount, err := b.cache.Len()
-	if err != nil {
-		log.Printf("error: failed to get Cache len: %v\n", err)
-	}
+	tradeChannel := make(chan tradeMessage)
 
-	go b.RestoreFromCache(cacheChannel, cacheCount)
+	// Only restore what was cached before starting, new trades are cached
+	// as they arrive.
+	go b.RestoreFromCache(cacheChannel, after, pkg.CacheEndTime(b.cache))
 
 	go func() {
+		if b.replay != nil {
+			b.readReplay(tradeChannel)
+			return
+		}
+
+		// Get the streams to subscribe to.
+		var streams []string
+		backoff := pkg.NewBackoff(b.backoffOptions)
 		for {
-			// Get the streams to subscribe to.
-			var streams []string
-			for {
-				var err error
-				streams, err = b.GetStreams()
-				if err != nil {
-					log.Printf("binance: failed to get streams: %v\n", err)
-					goto TryAgain
-				}
-				if len(streams) == 0 {
-					log.Printf("binance: got 0 streams, trying again\n", len(streams))
-					goto TryAgain
-				}
+			backoff.Attempt()
+			var err error
+			streams, err = b.GetStreams()
+			if err == nil && len(streams) == 0 {
+				err = fmt.Errorf("got 0 streams")
+			}
+			if err == nil {
 				log.Printf("binance: got %d streams\n", len(streams))
 				break
-			TryAgain:
-				time.Sleep(1 * time.Second)
 			}
+			delay := backoff.Failure()
+			log.Printf("binance: failed to get streams, trying again in %v: %v\n",
+				delay, err)
+			time.Sleep(delay)
+		}
 
-			tradeStream := NewStreamClient("aggTrades", streams...)
-			log.Printf("binance: connecting to trade stream.")
-			tradeStream.Connect()
-
-			// Read loop.
-		ReadLoop:
-			for {
-				body, err := tradeStream.ReadNext()
-				if err != nil {
-					log.Printf("binance: trade feed read error: %v\n", err)
-					break ReadLoop
-				}
-
-				b.Cache(body)
-
-				trade, err := b.DecodeTrade(body)
-				if err != nil {
-					log.Printf("binance: failed to decode trade feed: %v\n", err)
-					goto ReadLoop
-				}
-
-				tradeChannel <- trade
+		bodies := make(chan []byte)
+		shards := b.startShards(streams, bodies)
+		b.lock.Lock()
+		b.shards = shards
+		b.streams = streams
+		b.lock.Unlock()
+		go b.refreshStreams(bodies)
+
+		for body := range bodies {
+			trade, err := b.DecodeTrade(body)
+			if err != nil {
+				log.Printf("binance: failed to decode trade feed: %v\n", err)
+				continue
 			}
 
+			tradeChannel <- tradeMessage{body: body, trade: trade}
 		}
 	}()
 
+	// Replayed trades are not backfilled, the recording is replayed as
+	// it was received.
+	backfill := b.replay == nil
+	var backfillResults chan backfillResult
+	if backfill {
+		b.backfiller = newBackfiller(b)
+		backfillResults = b.backfiller.results
+		go b.backfiller.run()
+	}
+
 	cacheDone := false
-	tradeQueue := []*binance.AggTrade{}
+	tradeQueue := []tradeMessage{}
 	for {
 		select {
 		case trade := <-cacheChannel:
@@ -179,7 +238,9 @@ func (b *TradeStream) Run() {
 			if cacheDone {
 				log.Printf("warning: got cached trade in state Cache done\n")
 			}
-			b.Publish(trade)
+			for _, message := range b.sequence(tradeMessage{trade: trade}, false) {
+				b.Publish(message.trade)
+			}
 		case trade := <-tradeChannel:
 			if !cacheDone {
 				// The Cache is still being processed. Queue.
@@ -191,16 +252,129 @@ func (b *TradeStream) Run() {
 				log.Printf("binace trade stream: submitting %d queued trades\n",
 					len(tradeQueue))
 				for _, trade := range tradeQueue {
-					b.Publish(trade)
+					b.publishMessages(b.sequence(trade, backfill))
 				}
-				tradeQueue = []*binance.AggTrade{}
+				tradeQueue = []tradeMessage{}
 			}
-			b.Publish(trade)
+			b.publishMessages(b.sequence(trade, backfill))
 			b.PruneCache()
+		case result := <-backfillResults:
+			b.completeBackfill(result)
+		}
+	}
+}
+
+// startShards shards the streams over new connections sending each message
+// read on bodies. Each shard connects and reconnects independently, so a
+// disconnect only drops the trades of its own streams.
+func (b *TradeStream) startShards(streams []string, bodies chan []byte) []*StreamClient {
+	shards := ShardStreams(streams, b.MaxStreamsPerConnection)
+	log.Printf("binance: subscribing to %d trade streams over %d connections\n",
+		len(streams), len(shards))
+	clients := []*StreamClient{}
+	for i, shard := range shards {
+		client := NewStreamClient(b.clock, fmt.Sprintf("aggTrades.%d", i), shard...)
+		client.Url = b.StreamUrl
+		client.Record(b.recorder, RecordSourceTrades)
+		client.SetBackoffOptions(b.backoffOptions)
+		client.SetWatchdogOptions(b.watchdogOptions)
+		clients = append(clients, client)
+		go client.RunRaw(bodies)
+	}
+	return clients
+}
+
+// refreshStreams gets the streams every SymbolRefreshInterval and, if they
+// have changed, reshards: the new shards are started and given time to
+// connect before the old shards are stopped. While both are connected
+// trades are received twice, the duplicates are dropped by sequence.
+func (b *TradeStream) refreshStreams(bodies chan []byte) {
+	if b.SymbolRefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(b.SymbolRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		streams, err := b.GetStreams()
+		if err != nil {
+			log.Printf("error: binance: failed to refresh trade streams: %v\n", err)
+			continue
+		}
+		b.lock.RLock()
+		current := b.streams
+		b.lock.RUnlock()
+		if len(streams) == 0 || sameStreams(streams, current) {
+			continue
+		}
+
+		log.Printf("binance: trade streams changed from %d to %d, resharding\n",
+			len(current), len(streams))
+		shards := b.startShards(streams, bodies)
+		waitConnected(shards, reshardConnectTimeout)
+
+		b.lock.Lock()
+		old := b.shards
+		b.shards = shards
+		b.streams = streams
+		b.lock.Unlock()
+		for _, shard := range old {
+			shard.Stop()
+		}
+	}
+}
+
+// sameStreams returns true if a and b have the same streams in any order.
+func sameStreams(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, stream := range a {
+		set[stream] = true
+	}
+	for _, stream := range b {
+		if !set[stream] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitConnected waits until all the clients are connected, or timeout.
+func waitConnected(clients []*StreamClient, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, client := range clients {
+		for !client.Status().Connected {
+			if time.Now().After(deadline) {
+				log.Printf("warning: binance: stream [%s] not connected after %v\n",
+					client.name, timeout)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
 	}
+}
+
+// publishMessages caches and publishes trades received from the stream or
+// backfilled, so they are cached in the order they are published.
+func (b *TradeStream) publishMessages(messages []tradeMessage) {
+	for _, message := range messages {
+		b.Cache(message.body)
+		b.Publish(message.trade)
+	}
+}
 
-	log.Printf("binance: trade feed exiting.\n")
+// readReplay handles replayed messages as they would be handled if
+// received from the stream.
+func (b *TradeStream) readReplay(channel chan tradeMessage) {
+	for body := range b.replay {
+		trade, err := b.DecodeTrade(body)
+		if err != nil {
+			log.Printf("binance: failed to decode replayed trade: %v\n", err)
+			continue
+		}
+		channel <- tradeMessage{body: body, trade: trade}
+	}
 }
 
 func (b *TradeStream) Cache(body []byte) {
@@ -208,24 +382,17 @@ func (b *TradeStream) Cache(body []byte) {
 }
 
 func (b *TradeStream) PruneCache() {
-	for {
-		next, err := b.cache.GetFirst()
-		if err != nil {
-			break
-		}
-		if time.Now().Sub(time.Unix(next.Timestamp, 0)) > time.Hour {
-			b.cache.LRemove()
-		} else {
-			break
-		}
+	if err := b.cache.Prune(b.clock.Now().Add(-b.MaxAge)); err != nil {
+		log.Printf("error: binance trade stream: failed to prune cache: %v\n", err)
 	}
 }
 
 func (b *TradeStream) Publish(trade *binance.AggTrade) {
+	commonTrade := pkg.CommonTradeFromBinanceAggTrade(*trade)
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 	for subscriber := range b.subscribers {
-		subscriber <- *trade
+		subscriber <- commonTrade
 	}
 }
 
@@ -233,16 +400,15 @@ func (b *TradeStream) DecodeTrade(body []byte) (*binance.AggTrade, error) {
 	var rawAggTrade binance.RawStreamAggTrade
 	if err := json.Unmarshal(body, &rawAggTrade); err != nil {
 		return nil, err
-		log.Printf("binance: failed to decode stream agg trade: %v\n", err)
 	}
 	aggTrade := binance.NewAggTradeFromRaw(rawAggTrade.AggTrade)
 	return &aggTrade, nil
 }
 
 func (b *TradeStream) GetStreams() ([]string, error) {
-	symbols, err := binance.NewClient(nil).GetAllSymbols()
+	symbols, err := getSymbols(b.RestUrl)
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 	streams := []string{}
 	for _, symbol := range symbols {
@@ -252,3 +418,30 @@ func (b *TradeStream) GetStreams() ([]string, error) {
 
 	return streams, nil
 }
+
+// ShardStreams splits streams into shards of at most max streams, of as
+// even a size as possible.
+func ShardStreams(streams []string, max int) [][]string {
+	if max <= 0 {
+		max = DefaultMaxStreamsPerConnection
+	}
+	count := (len(streams) + max - 1) / max
+	shards := [][]string{}
+	for i := 0; i < count; i++ {
+		start := len(streams) * i / count
+		end := len(streams) * (i + 1) / count
+		shards = append(shards, streams[start:end])
+	}
+	return shards
+}
+
+// Status returns the status of each trade stream connection.
+func (b *TradeStream) Status() []pkg.StreamStatus {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	statuses := []pkg.StreamStatus{}
+	for _, shard := range b.shards {
+		statuses = append(statuses, shard.Status())
+	}
+	return statuses
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package binance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/fakeexchange"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestTradeStream(fake *fakeexchange.BinanceServer) *TradeStream {
+	clock := pkg.SystemClock{}
+	stream := NewTradeStream(clock, pkg.NewMemoryInputCache(clock))
+	stream.RestUrl = fake.RestUrl()
+	stream.StreamUrl = fake.StreamUrl()
+	stream.backoffOptions.InitialDelay = 10 * time.Millisecond
+	return stream
+}
+
+func receiveTrade(t *testing.T, channel chan pkg.CommonTrade) pkg.CommonTrade {
+	t.Helper()
+	select {
+	case trade := <-channel:
+		return trade
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a trade")
+	}
+	return pkg.CommonTrade{}
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShardStreams(t *testing.T) {
+	streams := []string{}
+	for i := 0; i < 450; i++ {
+		streams = append(streams, "stream")
+	}
+	shards := ShardStreams(streams, 200)
+	if len(shards) != 3 {
+		t.Fatalf("expected 3 shards, got %d", len(shards))
+	}
+	for _, shard := range shards {
+		if len(shard) != 150 {
+			t.Errorf("expected shards of 150 streams, got %d", len(shard))
+		}
+	}
+	if shards := ShardStreams(streams[:200], 200); len(shards) != 1 {
+		t.Errorf("expected 1 shard, got %d", len(shards))
+	}
+}
+
+// TestTradeStreamRefreshesSymbols checks a newly listed symbol is
+// subscribed to, and the old connections closed, without trades being
+// published twice.
+func TestTradeStreamRefreshesSymbols(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC")
+	defer fake.Close()
+
+	stream := newTestTradeStream(fake)
+	stream.SymbolRefreshInterval = 50 * time.Millisecond
+	trades := stream.Subscribe()
+	go stream.Run(time.Time{})
+
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	fake.SendTrade(fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: 1})
+	if trade := receiveTrade(t, trades); trade.Symbol != "ETHBTC" {
+		t.Fatalf("expected an ETHBTC trade, got %+v", trade)
+	}
+
+	fake.SetSymbols("ETHBTC", "LTCBTC")
+	if err := fake.WaitForStream("ltcbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the old connection to close", func() bool {
+		return fake.Connections() == 1
+	})
+	waitFor(t, "the status to show the new shard", func() bool {
+		statuses := stream.Status()
+		return len(statuses) == 1 && statuses[0].Streams == 2
+	})
+
+	fake.SendTrade(fakeexchange.Trade{Symbol: "LTCBTC", Price: 1, Quantity: 1})
+	if trade := receiveTrade(t, trades); trade.Symbol != "LTCBTC" {
+		t.Fatalf("expected an LTCBTC trade, got %+v", trade)
+	}
+	fake.SendTrade(fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: 1})
+	if trade := receiveTrade(t, trades); trade.Symbol != "ETHBTC" || trade.TradeId != 2 {
+		t.Fatalf("expected ETHBTC trade 2, got %+v", trade)
+	}
+	select {
+	case trade := <-trades:
+		t.Fatalf("unexpected trade %+v", trade)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStreamClientStop(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC")
+	defer fake.Close()
+
+	client := NewStreamClient(pkg.SystemClock{}, "test", "ethbtc@aggTrade")
+	client.Url = fake.StreamUrl()
+	bodies := make(chan []byte)
+	done := make(chan bool)
+	go func() {
+		client.RunRaw(bodies)
+		close(done)
+	}()
+	if err := fake.WaitForStream("ethbtc@aggTrade", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Stop()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("RunRaw did not return after Stop")
+	}
+	waitFor(t, "the connection to close", func() bool {
+		return fake.Connections() == 0
+	})
+}
+
+// TestTradeStreamDecodeTrade checks an aggTrade message converts to a
+// CommonTrade. The buyer being the maker makes the seller the aggressor,
+// and the trade time is in milliseconds.
+func TestTradeStreamDecodeTrade(t *testing.T) {
+	stream := NewTradeStream(pkg.SystemClock{}, pkg.NopInputCache{})
+	for _, test := range []struct {
+		buyerMaker string
+		side       pkg.TradeSide
+	}{
+		{buyerMaker: "false", side: pkg.TradeSideBuy},
+		{buyerMaker: "true", side: pkg.TradeSideSell},
+	} {
+		body := `{"stream":"ethbtc@aggTrade","data":{"e":"aggTrade",
+			"E":1500000000999,"s":"ETHBTC","a":12345,"p":"0.03","q":"2.5",
+			"f":100,"l":105,"T":1500000000123,"m":` + test.buyerMaker + `}}`
+		aggTrade, err := stream.DecodeTrade([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := pkg.CommonTrade{
+			Symbol:        "ETHBTC",
+			Timestamp:     time.Unix(1500000000, 123000000),
+			Price:         0.03,
+			Quantity:      2.5,
+			QuoteQuantity: 0.075,
+			Side:          test.side,
+			TradeId:       12345,
+			FirstTradeId:  100,
+			LastTradeId:   105,
+		}
+		trade := pkg.CommonTradeFromBinanceAggTrade(*aggTrade)
+		if trade != expected || !trade.Timestamp.Equal(expected.Timestamp) {
+			t.Errorf("m=%s: expected %+v, got %+v", test.buyerMaker, expected, trade)
+		}
+		if trade.IsBuy() != (test.side == pkg.TradeSideBuy) {
+			t.Errorf("m=%s: expected IsBuy to match the side %s", test.buyerMaker, test.side)
+		}
+	}
+}
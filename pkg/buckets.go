@@ -0,0 +1,143 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Bucket is a window of time, ending now, that metrics are calculated
+// over.
+type Bucket struct {
+	// The name of the bucket, as used in the price_change_pct and
+	// volume_change_pct maps: 30s, 5m, 1h...
+	Name string
+
+	Duration time.Duration
+}
+
+var DefaultBuckets []Bucket
+
+func init() {
+	var err error
+	DefaultBuckets, err = ParseBuckets([]string{
+		"1m", "2m", "3m", "4m", "5m", "10m", "15m", "1h",
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func NewBucket(duration time.Duration) Bucket {
+	name := ""
+	switch {
+	case duration%time.Hour == 0:
+		name = fmt.Sprintf("%dh", duration/time.Hour)
+	case duration%time.Minute == 0:
+		name = fmt.Sprintf("%dm", duration/time.Minute)
+	default:
+		name = fmt.Sprintf("%ds", duration/time.Second)
+	}
+	return Bucket{
+		Name:     name,
+		Duration: duration,
+	}
+}
+
+// Message keys used by the 24 hour metrics, r_24 and rp_24, which a
+// bucket's keys would be overwritten by.
+var reservedBucketKeys = map[string]bool{
+	"24": true,
+}
+
+// Bucket names used by the 24 hour metrics, price_change_pct.24h, which a
+// bucket's metrics would be overwritten by.
+var reservedBucketNames = map[string]bool{
+	"24h": true,
+}
+
+// ParseBuckets parses a list of durations (30s, 5m, 4h) into buckets
+// sorted from shortest to longest.
+func ParseBuckets(durations []string) ([]Bucket, error) {
+	seen := map[time.Duration]bool{}
+	buckets := []Bucket{}
+	for _, value := range durations {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %s: %v", value, err)
+		}
+		if duration < time.Second || duration%time.Second != 0 {
+			return nil, fmt.Errorf(
+				"invalid bucket %s: must be a whole number of seconds", value)
+		}
+		if seen[duration] {
+			continue
+		}
+		seen[duration] = true
+		bucket := NewBucket(duration)
+		if reservedBucketKeys[bucket.Key()] {
+			return nil, fmt.Errorf(
+				"invalid bucket %s: its key %s is used by the 24 hour metrics",
+				value, bucket.Key())
+		}
+		if reservedBucketNames[bucket.Name] {
+			return nil, fmt.Errorf(
+				"invalid bucket %s: its name %s is used by the 24 hour metrics",
+				value, bucket.Name)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no buckets")
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Duration < buckets[j].Duration
+	})
+	return buckets, nil
+}
+
+// Key is the suffix used for flat message keys such as l_5 and h_60. For
+// compatibility with existing clients whole minute buckets are keyed by
+// their number of minutes, anything else by seconds: l_30s.
+func (b Bucket) Key() string {
+	if b.Duration%time.Minute == 0 {
+		return fmt.Sprintf("%d", b.Duration/time.Minute)
+	}
+	return fmt.Sprintf("%ds", b.Duration/time.Second)
+}
+
+// MinuteKey is like Key but with the unit always present, as used by the
+// vwap keys: vwap_5m, vwap_60m, vwap_30s.
+func (b Bucket) MinuteKey() string {
+	if b.Duration%time.Minute == 0 {
+		return fmt.Sprintf("%dm", b.Duration/time.Minute)
+	}
+	return b.Key()
+}
+
+// BucketRetention returns how long ticks and trades need to be kept to
+// calculate the given buckets. This is never less than an hour.
+func BucketRetention(buckets []Bucket) time.Duration {
+	retention := time.Hour
+	for _, bucket := range buckets {
+		if bucket.Duration > retention {
+			retention = bucket.Duration
+		}
+	}
+	return retention
+}
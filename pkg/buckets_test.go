@@ -0,0 +1,65 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBuckets(t *testing.T) {
+	buckets, err := ParseBuckets([]string{"1h", "30s", "5m", "5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		name     string
+		key      string
+		duration time.Duration
+	}{
+		{"30s", "30s", 30 * time.Second},
+		{"5m", "5", 5 * time.Minute},
+		{"1h", "60", time.Hour},
+	}
+	if len(buckets) != len(expected) {
+		t.Fatalf("expected %d buckets, got %+v", len(expected), buckets)
+	}
+	for i, bucket := range buckets {
+		if bucket.Name != expected[i].name || bucket.Key() != expected[i].key ||
+			bucket.Duration != expected[i].duration {
+			t.Errorf("bucket %d: expected %+v, got %+v with key %s",
+				i, expected[i], bucket, bucket.Key())
+		}
+	}
+}
+
+func TestParseBucketsInvalid(t *testing.T) {
+	for _, durations := range [][]string{
+		{},
+		{"x"},
+		{"500ms"},
+		{"90500ms"},
+		// Keyed 24, the same as the 24 hour range keys.
+		{"24m"},
+		// Named 24h, the same as the 24 hour price change.
+		{"24h"},
+		{"1440m"},
+	} {
+		if _, err := ParseBuckets(durations); err == nil {
+			t.Errorf("expected %v to be invalid", durations)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"log"
+	"time"
+)
+
+// The number of entries read from a cache in one request during replay.
+var ReplayBatchSize int64 = 1000
+
+// The number of batches read ahead of the batch being replayed.
+const replayPrefetchBatches = 4
+
+// How often replay progress is logged.
+const replayProgressInterval = 5 * time.Second
+
+type replayBatch struct {
+	entries []CacheEntry
+	err     error
+}
+
+// prefetchInputCache reads the entries after after and not after until in
+// batches, sending each batch on channel, which is closed when done.
+func prefetchInputCache(cache InputCache, after, until time.Time, channel chan replayBatch) {
+	defer close(channel)
+	for {
+		entries, err := cache.Range(after, until, ReplayBatchSize)
+		if err != nil {
+			channel <- replayBatch{err: err}
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+		channel <- replayBatch{entries: entries}
+		last := entries[len(entries)-1]
+		after = time.Unix(0, last.Micros()*int64(time.Microsecond))
+	}
+}
+
+// CacheEndTime returns the time of the last entry in the cache, or the zero
+// time if it is empty. Replaying until this time replays what is currently
+// in the cache, as entry times can run ahead of the clock.
+func CacheEndTime(cache InputCache) time.Time {
+	entry, err := cache.GetN(-1)
+	if err != nil || entry == nil {
+		return time.Time{}
+	}
+	return time.Unix(0, entry.Micros()*int64(time.Microsecond))
+}
+
+// ReplayStartTime returns the time to replay a cache from: after, but not
+// more than maxAge ago.
+func ReplayStartTime(clock Clock, after time.Time, maxAge time.Duration) time.Time {
+	oldest := clock.Now().Add(-maxAge)
+	if after.Before(oldest) {
+		return oldest
+	}
+	return after
+}
+
+// ReplayInputCache calls cb with each entry in the cache with a time after
+// after and not after until, oldest first. Entries are read in batches by
+// a goroutine that reads ahead of cb, and progress is logged periodically.
+// The number of entries replayed is returned.
+func ReplayInputCache(name string, cache InputCache, after, until time.Time, cb func(entry CacheEntry)) int64 {
+	// Only used to report progress.
+	count, err := cache.Len()
+	if err != nil {
+		log.Printf("error: %s: failed to get cache length: %v\n", name, err)
+	}
+
+	log.Printf("%s: replaying cache entries since %v\n", name, after)
+	startTime := time.Now()
+	lastProgress := startTime
+
+	channel := make(chan replayBatch, replayPrefetchBatches)
+	go prefetchInputCache(cache, after, until, channel)
+
+	replayed := int64(0)
+	for batch := range channel {
+		if batch.err != nil {
+			log.Printf("error: %s: failed to read cache: %v\n", name, batch.err)
+			break
+		}
+		for _, entry := range batch.entries {
+			cb(entry)
+			replayed++
+		}
+		if time.Since(lastProgress) >= replayProgressInterval {
+			lastProgress = time.Now()
+			elapsed := lastProgress.Sub(startTime)
+			log.Printf("%s: replayed %d of up to %d cache entries in %v\n",
+				name, replayed, count, elapsed)
+		}
+	}
+
+	log.Printf("%s: replayed %d cache entries in %v\n",
+		name, replayed, time.Since(startTime))
+	return replayed
+}
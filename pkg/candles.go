@@ -0,0 +1,173 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+type CandleInterval struct {
+	Name     string
+	Duration time.Duration
+}
+
+var CandleIntervals []CandleInterval
+
+// The number of candles kept for each interval.
+const MaxCandles = 120
+
+func init() {
+	CandleIntervals = []CandleInterval{
+		{"1m", time.Minute},
+		{"5m", time.Minute * 5},
+		{"15m", time.Minute * 15},
+		{"1h", time.Hour},
+	}
+}
+
+type Candle struct {
+	OpenTime    time.Time `json:"open_time"`
+	Open        float64   `json:"open"`
+	High        float64   `json:"high"`
+	Low         float64   `json:"low"`
+	Close       float64   `json:"close"`
+	Volume      float64   `json:"volume"`
+	QuoteVolume float64   `json:"quote_volume"`
+	Trades      int       `json:"trades"`
+
+	// Volume where the taker was the buyer, only available when the
+	// candle is built from trades.
+	TakerBuyVolume      float64 `json:"taker_buy_volume"`
+	TakerBuyQuoteVolume float64 `json:"taker_buy_quote_volume"`
+}
+
+// CandleBuilder aggregates trades into OHLCV candles of a fixed interval.
+// For exchanges without a trade feed the candles are built from the
+// ticker price and the change in 24h quote volume between tickers. Once
+// trades arrive, the ticker candles before the first trade's candle are
+// kept as history, without taker volumes.
+type CandleBuilder struct {
+	Interval time.Duration
+	Candles  []Candle
+
+	// Set once a trade has been seen, after which tickers are ignored.
+	haveTrades bool
+
+	lastQuoteVolume float64
+}
+
+func NewCandleBuilder(interval time.Duration) *CandleBuilder {
+	return &CandleBuilder{
+		Interval: interval,
+		Candles:  []Candle{},
+	}
+}
+
+// current returns the candle for the given time, opening a new candle if
+// required. Nil is returned if the time falls before the current candle.
+func (b *CandleBuilder) current(timestamp time.Time, price float64) *Candle {
+	openTime := timestamp.Truncate(b.Interval)
+	if len(b.Candles) > 0 {
+		last := &b.Candles[len(b.Candles)-1]
+		if last.OpenTime.Equal(openTime) {
+			return last
+		}
+		if openTime.Before(last.OpenTime) {
+			return nil
+		}
+	}
+	b.Candles = append(b.Candles, Candle{
+		OpenTime: openTime,
+		Open:     price,
+		High:     price,
+		Low:      price,
+		Close:    price,
+	})
+	if len(b.Candles) > MaxCandles {
+		b.Candles = b.Candles[len(b.Candles)-MaxCandles:]
+	}
+	return &b.Candles[len(b.Candles)-1]
+}
+
+func (c *Candle) updatePrice(price float64) {
+	if price > c.High {
+		c.High = price
+	}
+	if price < c.Low {
+		c.Low = price
+	}
+	c.Close = price
+}
+
+func (b *CandleBuilder) AddTrade(trade CommonTrade) {
+	if !b.haveTrades {
+		// Drop the ticker candles from the first trade's candle on, so
+		// trade and ticker derived volumes are not mixed in a candle.
+		b.haveTrades = true
+		openTime := trade.Timestamp.Truncate(b.Interval)
+		keep := 0
+		for keep < len(b.Candles) && b.Candles[keep].OpenTime.Before(openTime) {
+			keep++
+		}
+		b.Candles = b.Candles[:keep]
+	}
+	candle := b.current(trade.Timestamp, trade.Price)
+	if candle == nil {
+		return
+	}
+	candle.updatePrice(trade.Price)
+	candle.Volume += trade.Quantity
+	candle.QuoteVolume += trade.QuoteQuantity
+	candle.Trades++
+	if trade.IsBuy() {
+		candle.TakerBuyVolume += trade.Quantity
+		candle.TakerBuyQuoteVolume += trade.QuoteQuantity
+	}
+}
+
+func (b *CandleBuilder) Update(ticker CommonTicker) {
+	if b.haveTrades || ticker.LastPrice == 0 {
+		return
+	}
+
+	// The 24h volume also drops as old volume falls out of its window, so
+	// only count increases.
+	volume := float64(0)
+	if b.lastQuoteVolume > 0 && ticker.QuoteVolume > b.lastQuoteVolume {
+		volume = ticker.QuoteVolume - b.lastQuoteVolume
+	}
+	b.lastQuoteVolume = ticker.QuoteVolume
+
+	candle := b.current(ticker.Timestamp, ticker.LastPrice)
+	if candle == nil {
+		return
+	}
+	candle.updatePrice(ticker.LastPrice)
+	candle.QuoteVolume += volume
+	candle.Volume += volume / ticker.LastPrice
+}
+
+// GetCandles returns a copy of the most recent count candles, or all of
+// them if count is 0.
+func (b *CandleBuilder) GetCandles(count int) []Candle {
+	start := 0
+	if count > 0 && count < len(b.Candles) {
+		start = len(b.Candles) - count
+	}
+	candles := make([]Candle, len(b.Candles)-start)
+	copy(candles, b.Candles[start:])
+	return candles
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func candleTrade(offset time.Duration, price, quantity float64, side TradeSide) CommonTrade {
+	return CommonTrade{
+		Symbol:        "ETHBTC",
+		Timestamp:     testStart.Add(offset),
+		Price:         price,
+		Quantity:      quantity,
+		QuoteQuantity: price * quantity,
+		Side:          side,
+	}
+}
+
+func candleTicker(offset time.Duration, price, quoteVolume float64) CommonTicker {
+	return CommonTicker{
+		Symbol:      "ETHBTC",
+		Timestamp:   testStart.Add(offset),
+		LastPrice:   price,
+		QuoteVolume: quoteVolume,
+	}
+}
+
+func TestCandleBuilderTrades(t *testing.T) {
+	builder := NewCandleBuilder(time.Minute)
+	builder.AddTrade(candleTrade(0, 2, 1, TradeSideBuy))
+	builder.AddTrade(candleTrade(10*time.Second, 3, 2, TradeSideSell))
+	builder.AddTrade(candleTrade(20*time.Second, 1, 1, TradeSideBuy))
+	builder.AddTrade(candleTrade(time.Minute-time.Millisecond, 2.5, 1, TradeSideSell))
+
+	// On the boundary, so in the next candle.
+	builder.AddTrade(candleTrade(time.Minute, 4, 1, TradeSideBuy))
+
+	// Before the current candle, so dropped.
+	builder.AddTrade(candleTrade(30*time.Second, 10, 1, TradeSideBuy))
+
+	candles := builder.GetCandles(0)
+	if len(candles) != 2 {
+		t.Fatalf("expected 2 candles, got %+v", candles)
+	}
+	expected := Candle{
+		OpenTime:            testStart,
+		Open:                2,
+		High:                3,
+		Low:                 1,
+		Close:               2.5,
+		Volume:              5,
+		QuoteVolume:         2 + 6 + 1 + 2.5,
+		Trades:              4,
+		TakerBuyVolume:      2,
+		TakerBuyQuoteVolume: 3,
+	}
+	if candles[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, candles[0])
+	}
+	expected = Candle{
+		OpenTime:            testStart.Add(time.Minute),
+		Open:                4,
+		High:                4,
+		Low:                 4,
+		Close:               4,
+		Volume:              1,
+		QuoteVolume:         4,
+		Trades:              1,
+		TakerBuyVolume:      1,
+		TakerBuyQuoteVolume: 4,
+	}
+	if candles[1] != expected {
+		t.Errorf("expected %+v, got %+v", expected, candles[1])
+	}
+}
+
+func TestCandleBuilderTickers(t *testing.T) {
+	builder := NewCandleBuilder(time.Minute)
+	builder.Update(candleTicker(0, 2, 1000))
+	builder.Update(candleTicker(10*time.Second, 4, 1100))
+
+	// The 24h volume dropping is not counted.
+	builder.Update(candleTicker(20*time.Second, 1, 1050))
+	builder.Update(candleTicker(time.Minute, 5, 1150))
+
+	candles := builder.GetCandles(0)
+	if len(candles) != 2 {
+		t.Fatalf("expected 2 candles, got %+v", candles)
+	}
+	expected := Candle{
+		OpenTime:    testStart,
+		Open:        2,
+		High:        4,
+		Low:         1,
+		Close:       1,
+		Volume:      25,
+		QuoteVolume: 100,
+	}
+	if candles[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, candles[0])
+	}
+	if candles[1].QuoteVolume != 100 || candles[1].Volume != 20 {
+		t.Errorf("expected a quote volume of 100 and volume of 20, got %+v",
+			candles[1])
+	}
+}
+
+// TestCandleBuilderTickersToTrades checks the ticker candles before the
+// first trade are kept, and the candle the first trade falls in is
+// rebuilt from trades alone.
+func TestCandleBuilderTickersToTrades(t *testing.T) {
+	builder := NewCandleBuilder(time.Minute)
+	builder.Update(candleTicker(0, 2, 1000))
+	builder.Update(candleTicker(time.Minute, 3, 1100))
+	builder.Update(candleTicker(2*time.Minute, 4, 1200))
+	builder.Update(candleTicker(2*time.Minute+10*time.Second, 5, 1300))
+
+	builder.AddTrade(candleTrade(2*time.Minute+20*time.Second, 6, 1, TradeSideBuy))
+
+	// Tickers are ignored from the first trade on.
+	builder.Update(candleTicker(2*time.Minute+30*time.Second, 100, 5000))
+	builder.Update(candleTicker(3*time.Minute, 100, 6000))
+
+	candles := builder.GetCandles(0)
+	if len(candles) != 3 {
+		t.Fatalf("expected 3 candles, got %+v", candles)
+	}
+	if candles[0].Close != 2 || candles[1].Close != 3 ||
+		candles[1].QuoteVolume != 100 {
+		t.Errorf("expected the ticker candles to be kept, got %+v", candles[:2])
+	}
+	expected := Candle{
+		OpenTime:            testStart.Add(2 * time.Minute),
+		Open:                6,
+		High:                6,
+		Low:                 6,
+		Close:               6,
+		Volume:              1,
+		QuoteVolume:         6,
+		Trades:              1,
+		TakerBuyVolume:      1,
+		TakerBuyQuoteVolume: 6,
+	}
+	if candles[2] != expected {
+		t.Errorf("expected %+v, got %+v", expected, candles[2])
+	}
+}
+
+func TestCandleBuilderLimit(t *testing.T) {
+	builder := NewCandleBuilder(time.Minute)
+	for i := 0; i < MaxCandles+10; i++ {
+		builder.AddTrade(candleTrade(time.Duration(i)*time.Minute, float64(i),
+			1, TradeSideBuy))
+	}
+
+	candles := builder.GetCandles(0)
+	if len(candles) != MaxCandles {
+		t.Fatalf("expected %d candles, got %d", MaxCandles, len(candles))
+	}
+	if candles[0].Open != 10 || candles[MaxCandles-1].Open != MaxCandles+9 {
+		t.Errorf("expected the most recent candles, got %v to %v",
+			candles[0].Open, candles[MaxCandles-1].Open)
+	}
+
+	candles = builder.GetCandles(3)
+	if len(candles) != 3 || candles[0].Open != MaxCandles+7 {
+		t.Errorf("expected the last 3 candles, got %+v", candles)
+	}
+	if candles := builder.GetCandles(MaxCandles + 1); len(candles) != MaxCandles {
+		t.Errorf("expected all %d candles, got %d", MaxCandles, len(candles))
+	}
+
+	// A copy is returned.
+	candles[0].Open = -1
+	if builder.Candles[MaxCandles-3].Open == -1 {
+		t.Errorf("expected a copy of the candles")
+	}
+}
@@ -0,0 +1,519 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of entries written to a segment before starting a new one.
+const diskCacheSegmentEntries = 10000
+
+// How often the head position is saved while removing entries.
+const diskCacheHeadSaveInterval = time.Second
+
+// How often buffered entries are written out and synced to disk.
+const diskCacheFlushInterval = time.Second
+
+type diskCacheSegment struct {
+	id   int64
+	file *os.File
+
+	// Buffers the entries pushed to the last segment, nil for the others.
+	writer *bufio.Writer
+
+	// The offset of each entry, and the size of the segment including any
+	// buffered entries.
+	offsets []int64
+	size    int64
+
+	// The time of each entry in Unix microseconds, so entries are found by
+	// time without reading them.
+	times []int64
+}
+
+func (s *diskCacheSegment) filename(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%012d.seg", s.id))
+}
+
+// read returns entry i of the segment, without its trailing newline.
+func (s *diskCacheSegment) read(i int) (string, error) {
+	end := s.size
+	if i+1 < len(s.offsets) {
+		end = s.offsets[i+1]
+	}
+	buf := make([]byte, end-s.offsets[i]-1)
+	if _, err := s.file.ReadAt(buf, s.offsets[i]); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// DiskInputCache is an InputCache stored in a directory of append only
+// segment files, one entry per line. Entries are removed from the front by
+// advancing the head, the number of entries removed from the first
+// segment, with segments deleted once all their entries are removed. The
+// entry times are kept in memory, so pruning and searching by time don't
+// read the files.
+//
+// Pushed entries are buffered and written out and synced every
+// diskCacheFlushInterval, and the head saved at most once every
+// diskCacheHeadSaveInterval, so after a crash the last second or so of
+// entries may be lost and a few removed entries may reappear.
+type DiskInputCache struct {
+	dir          string
+	segments     []*diskCacheSegment
+	head         int
+	headSaveTime time.Time
+	encoder      cacheEntryEncoder
+
+	// The ID of the last segment created. Saved so IDs keep increasing
+	// after all the segments are removed.
+	lastSegmentId int64
+
+	dirty bool
+	done  chan bool
+	lock  sync.RWMutex
+}
+
+func OpenDiskInputCache(dir string, clock Clock) (*DiskInputCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	cache := &DiskInputCache{
+		dir:      dir,
+		segments: []*diskCacheSegment{},
+		encoder:  cacheEntryEncoder{clock: clock},
+		done:     make(chan bool),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".seg") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(file.Name(), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		segment, err := cache.openSegment(id)
+		if err != nil {
+			cache.Close()
+			return nil, err
+		}
+		cache.segments = append(cache.segments, segment)
+		cache.lastSegmentId = id
+	}
+
+	if buf, err := ioutil.ReadFile(cache.segmentIdFilename()); err == nil {
+		id, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+		if err == nil && id > cache.lastSegmentId {
+			cache.lastSegmentId = id
+		}
+	}
+
+	if buf, err := ioutil.ReadFile(cache.headFilename()); err == nil {
+		head, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+		if err == nil && len(cache.segments) > 0 &&
+			head <= len(cache.segments[0].offsets) {
+			cache.head = head
+		}
+	}
+
+	// Continue the entry times on from the last entry.
+	if n := len(cache.segments); n > 0 {
+		if times := cache.segments[n-1].times; len(times) > 0 {
+			cache.encoder.last = times[len(times)-1]
+		}
+	}
+
+	go cache.flushLoop()
+
+	return cache, nil
+}
+
+func (c *DiskInputCache) headFilename() string {
+	return filepath.Join(c.dir, "head")
+}
+
+func (c *DiskInputCache) segmentIdFilename() string {
+	return filepath.Join(c.dir, "segment")
+}
+
+// openSegment opens a segment, indexing its entries by offset and time. A
+// partially written last entry is truncated.
+func (c *DiskInputCache) openSegment(id int64) (*diskCacheSegment, error) {
+	segment := &diskCacheSegment{id: id, offsets: []int64{}, times: []int64{}}
+	file, err := os.OpenFile(segment.filename(c.dir), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	segment.file = file
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("warning: disk cache: truncating partial entry in %s\n",
+					segment.filename(c.dir))
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		entry, err := DecodeCacheEntry(string(line))
+		if err != nil {
+			log.Printf("error: disk cache: failed to decode entry in %s: %v\n",
+				segment.filename(c.dir), err)
+		}
+		segment.offsets = append(segment.offsets, offset)
+		segment.times = append(segment.times, entry.Micros())
+		offset += int64(len(line))
+	}
+	segment.size = offset
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return segment, nil
+}
+
+func (c *DiskInputCache) saveHead() {
+	c.headSaveTime = time.Now()
+	err := ioutil.WriteFile(c.headFilename(),
+		[]byte(strconv.Itoa(c.head)), 0644)
+	if err != nil {
+		log.Printf("error: disk cache: failed to save head: %v\n", err)
+	}
+}
+
+func (c *DiskInputCache) RPush(buf []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	encoded, micros := c.encoder.encode(buf)
+
+	var segment *diskCacheSegment
+	if len(c.segments) > 0 {
+		segment = c.segments[len(c.segments)-1]
+	}
+	if segment == nil || len(segment.offsets) >= diskCacheSegmentEntries {
+		if segment != nil {
+			c.flush(segment)
+			segment.writer = nil
+		}
+		var err error
+		segment, err = c.createSegment()
+		if err != nil {
+			log.Printf("error: disk cache: failed to create segment: %v\n", err)
+			return
+		}
+	}
+	if segment.writer == nil {
+		segment.writer = bufio.NewWriter(segment.file)
+	}
+
+	n, _ := segment.writer.Write(append(encoded, '\n'))
+	segment.offsets = append(segment.offsets, segment.size)
+	segment.times = append(segment.times, micros)
+	segment.size += int64(n)
+	c.dirty = true
+}
+
+// createSegment saves the next segment ID then creates the segment. The
+// lock must be held.
+func (c *DiskInputCache) createSegment() (*diskCacheSegment, error) {
+	id := c.lastSegmentId + 1
+	err := ioutil.WriteFile(c.segmentIdFilename(),
+		[]byte(strconv.FormatInt(id, 10)), 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.lastSegmentId = id
+	segment, err := c.openSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	c.segments = append(c.segments, segment)
+	return segment, nil
+}
+
+// flush writes out and syncs the segment's buffered entries. If that fails
+// the entries not completely written are dropped so the segment stays
+// consistent. The lock must be held.
+func (c *DiskInputCache) flush(segment *diskCacheSegment) {
+	if segment.writer == nil || segment.writer.Buffered() == 0 {
+		return
+	}
+	err := segment.writer.Flush()
+	if err == nil {
+		err = segment.file.Sync()
+		if err != nil {
+			log.Printf("error: disk cache: failed to sync segment: %v\n", err)
+		}
+		return
+	}
+
+	// Keep the entries that were completely written.
+	written := segment.size - int64(segment.writer.Buffered())
+	i := sort.Search(len(segment.offsets), func(i int) bool {
+		return segment.offsets[i] >= written
+	})
+	end := segment.size
+	if i < len(segment.offsets) {
+		end = segment.offsets[i]
+	}
+	if i > 0 && end > written {
+		// The entry before was partly written.
+		i--
+	}
+	size := segment.size
+	if i < len(segment.offsets) {
+		size = segment.offsets[i]
+	}
+	log.Printf("error: disk cache: failed to write entries, dropping %d: %v\n",
+		len(segment.offsets)-i, err)
+	segment.offsets = segment.offsets[:i]
+	segment.times = segment.times[:i]
+	segment.size = size
+	segment.file.Truncate(size)
+	segment.file.Seek(size, io.SeekStart)
+	segment.writer.Reset(segment.file)
+}
+
+// flushLoop writes out buffered entries every diskCacheFlushInterval.
+func (c *DiskInputCache) flushLoop() {
+	ticker := time.NewTicker(diskCacheFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.lock.Lock()
+			if c.dirty && len(c.segments) > 0 {
+				c.flush(c.segments[len(c.segments)-1])
+				c.dirty = false
+			}
+			c.lock.Unlock()
+		}
+	}
+}
+
+func (c *DiskInputCache) length() int64 {
+	length := int64(-c.head)
+	for _, segment := range c.segments {
+		length += int64(len(segment.offsets))
+	}
+	return length
+}
+
+// firstBuffered returns the index of the first entry that is buffered and
+// not yet written to the file, or the length if there is none. The lock
+// must be held.
+func (c *DiskInputCache) firstBuffered() int64 {
+	length := c.length()
+	if len(c.segments) == 0 {
+		return length
+	}
+	last := c.segments[len(c.segments)-1]
+	if last.writer == nil || last.writer.Buffered() == 0 {
+		return length
+	}
+	written := last.size - int64(last.writer.Buffered())
+	i := sort.Search(len(last.offsets), func(i int) bool {
+		return last.offsets[i] >= written
+	})
+	return length - int64(len(last.offsets)-i)
+}
+
+func (c *DiskInputCache) LRange(start, stop int64) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	start, end, ok := rangeBounds(start, stop, c.length())
+	if !ok {
+		return []string{}, nil
+	}
+
+	// Buffered entries are flushed before reading them from the file.
+	if end > c.firstBuffered() {
+		c.flush(c.segments[len(c.segments)-1])
+	}
+
+	elements := make([]string, 0, end-start)
+
+	// Convert to an index from the start of the first segment.
+	index := start + int64(c.head)
+	for _, segment := range c.segments {
+		count := int64(len(segment.offsets))
+		if index >= count {
+			index -= count
+			continue
+		}
+		for ; index < count && int64(len(elements)) < end-start; index++ {
+			element, err := segment.read(int(index))
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+		if int64(len(elements)) == end-start {
+			break
+		}
+		index = 0
+	}
+
+	return elements, nil
+}
+
+func (c *DiskInputCache) GetFirst() (*CacheEntry, error) {
+	return c.GetN(0)
+}
+
+func (c *DiskInputCache) GetN(n int64) (*CacheEntry, error) {
+	return getCacheEntry(c, n)
+}
+
+func (c *DiskInputCache) Len() (int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.length(), nil
+}
+
+func (c *DiskInputCache) LRemove() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove()
+}
+
+// search returns the index of the first entry with a time not before t,
+// or the length of the cache if there is none. The lock must be held.
+func (c *DiskInputCache) search(t time.Time) int64 {
+	micros := timeToMicros(t)
+	index := int64(0)
+	for i, segment := range c.segments {
+		times := segment.times
+		if i == 0 {
+			times = times[c.head:]
+		}
+		n := sort.Search(len(times), func(i int) bool {
+			return times[i] >= micros
+		})
+		index += int64(n)
+		if n < len(times) {
+			break
+		}
+	}
+	return index
+}
+
+func (c *DiskInputCache) Prune(before time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := c.search(before)
+	for i := int64(0); i < n; i++ {
+		c.remove()
+	}
+	return nil
+}
+
+func (c *DiskInputCache) Range(after, until time.Time, count int64) ([]CacheEntry, error) {
+	c.lock.RLock()
+	start := c.search(after.Add(time.Microsecond))
+	c.lock.RUnlock()
+	return rangeFrom(c, start, until, count)
+}
+
+// remove removes the first entry, deleting the first segment once it has
+// no entries left. The lock must be held.
+func (c *DiskInputCache) remove() {
+	if len(c.segments) == 0 {
+		return
+	}
+	first := c.segments[0]
+	if c.head < len(first.offsets) {
+		c.head++
+	}
+
+	if c.head < len(first.offsets) {
+		if time.Since(c.headSaveTime) >= diskCacheHeadSaveInterval {
+			c.saveHead()
+		}
+		return
+	}
+
+	// The first segment is empty, delete it unless it is still being
+	// written to.
+	if len(c.segments) == 1 && len(first.offsets) < diskCacheSegmentEntries {
+		c.saveHead()
+		return
+	}
+	first.file.Close()
+	if err := os.Remove(first.filename(c.dir)); err != nil {
+		log.Printf("error: disk cache: failed to remove segment: %v\n", err)
+	}
+	c.segments = c.segments[1:]
+	c.head = 0
+	c.saveHead()
+}
+
+func (c *DiskInputCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.segments == nil {
+		return nil
+	}
+	close(c.done)
+	c.saveHead()
+	for _, segment := range c.segments {
+		c.flush(segment)
+		segment.file.Close()
+	}
+	c.segments = nil
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestDiskCache(t *testing.T, dir string) *DiskInputCache {
+	cache, err := OpenDiskInputCache(dir, NewManualClock(time.Unix(1500000000, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func pushEntries(cache *DiskInputCache, from, n int) {
+	for i := from; i < from+n; i++ {
+		cache.RPush([]byte(fmt.Sprintf("message %d", i)))
+	}
+}
+
+func segmentIds(cache *DiskInputCache) []int64 {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	ids := []int64{}
+	for _, segment := range cache.segments {
+		ids = append(ids, segment.id)
+	}
+	return ids
+}
+
+func TestDiskInputCacheSegmentIdsNotReused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := openTestDiskCache(t, dir)
+	pushEntries(cache, 0, diskCacheSegmentEntries*2)
+	if ids := segmentIds(cache); len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("expected segments 1 and 2, got %v", ids)
+	}
+
+	// Removing every entry removes both full segments.
+	for i := 0; i < diskCacheSegmentEntries*2; i++ {
+		cache.LRemove()
+	}
+	if ids := segmentIds(cache); len(ids) != 0 {
+		t.Fatalf("expected no segments, got %v", ids)
+	}
+	cache.Close()
+
+	cache = openTestDiskCache(t, dir)
+	defer cache.Close()
+	pushEntries(cache, 0, 1)
+	if ids := segmentIds(cache); len(ids) != 1 || ids[0] != 3 {
+		t.Fatalf("expected segment 3, got %v", ids)
+	}
+}
+
+func TestDiskInputCacheBufferedWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := openTestDiskCache(t, dir)
+	pushEntries(cache, 0, 10)
+
+	// Buffered entries can be read before they are written out.
+	entry, err := cache.GetN(9)
+	if err != nil || entry == nil || entry.Message != "message 9" {
+		t.Fatalf("expected message 9, got %+v, %v", entry, err)
+	}
+
+	// Then the flush loop writes out later entries within the interval.
+	pushEntries(cache, 10, 10)
+	segment := cache.segments[0]
+	deadline := time.Now().Add(diskCacheFlushInterval * 5)
+	for {
+		info, err := os.Stat(segment.filename(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.lock.RLock()
+		size := segment.size
+		cache.lock.RUnlock()
+		if info.Size() == size {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entries not flushed: file is %d bytes, expected %d",
+				info.Size(), size)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// And what is buffered at close isn't lost.
+	pushEntries(cache, 20, 10)
+	cache.Close()
+	cache = openTestDiskCache(t, dir)
+	defer cache.Close()
+	if length, _ := cache.Len(); length != 30 {
+		t.Fatalf("expected 30 entries after reopening, got %d", length)
+	}
+	entry, err = cache.GetN(29)
+	if err != nil || entry == nil || entry.Message != "message 29" {
+		t.Fatalf("expected message 29, got %+v, %v", entry, err)
+	}
+}
+
+// TestDiskInputCachePruneInMemory checks pruning finds entries by their
+// times in memory, without writing out the buffered entries, and that the
+// times are restored on reopening.
+func TestDiskInputCachePruneInMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The clock doesn't move, so entry i is at start plus i microseconds.
+	start := time.Unix(1500000000, 0)
+	cache := openTestDiskCache(t, dir)
+	pushEntries(cache, 0, diskCacheSegmentEntries+10)
+	last := cache.segments[len(cache.segments)-1]
+
+	// So the flush loop leaves the entries buffered.
+	cache.lock.Lock()
+	cache.dirty = false
+	cache.lock.Unlock()
+
+	info, err := os.Stat(last.filename(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Into the second segment, removing the first.
+	if err := cache.Prune(start.Add(diskCacheSegmentEntries*time.Microsecond + 5*time.Microsecond)); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := cache.Len(); length != 5 {
+		t.Fatalf("expected 5 entries after pruning, got %d", length)
+	}
+	after, err := os.Stat(last.filename(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != info.Size() {
+		t.Errorf("expected pruning not to flush, file grew from %d to %d bytes",
+			info.Size(), after.Size())
+	}
+
+	// Reading a buffered entry does flush.
+	entry, err := cache.GetN(0)
+	expected := fmt.Sprintf("message %d", diskCacheSegmentEntries+5)
+	if err != nil || entry == nil || entry.Message != expected {
+		t.Fatalf("expected %s, got %+v, %v", expected, entry, err)
+	}
+	cache.Close()
+
+	cache = openTestDiskCache(t, dir)
+	defer cache.Close()
+	entries, err := cache.Range(start.Add((diskCacheSegmentEntries+7)*time.Microsecond),
+		start.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Message != fmt.Sprintf("message %d", diskCacheSegmentEntries+8) {
+		t.Fatalf("expected the last 2 entries after reopening, got %+v", entries)
+	}
+	if err := cache.Prune(start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := cache.Len(); length != 0 {
+		t.Fatalf("expected no entries after pruning all, got %d", length)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+// TickerFeed is an exchange's source of tickers.
+type TickerFeed interface {
+	// ReplayCache calls cb with each batch of tickers cached after the
+	// given time, oldest first, so trackers can be restored on startup.
+	// Tickers older than the max age are not replayed.
+	ReplayCache(after time.Time, cb func(tickers []CommonTicker))
+
+	// Run sends each batch of new tickers to channel, caching them as
+	// they are received. It does not return.
+	Run(channel chan []CommonTicker)
+}
+
+// TradeFeed is an exchange's source of trades. Cached trades are
+// published before any new trades.
+type TradeFeed interface {
+	Subscribe() chan CommonTrade
+	Unsubscribe(channel chan CommonTrade)
+
+	// Run restores the trades cached after the given time, then publishes
+	// new trades to the subscribers. It does not return.
+	Run(after time.Time)
+}
+
+// DepthFeed is an exchange's source of order book metrics, published as
+// the local order books change.
+type DepthFeed interface {
+	Subscribe() chan DepthMetrics
+
+	// Run syncs the order books then publishes their metrics. It does not
+	// return.
+	Run()
+}
+
+// Exchange is an exchange the scanner can track.
+type Exchange interface {
+	// The name of the exchange as used in URLs: binance, kucoin.
+	Name() string
+
+	TickerFeed() TickerFeed
+
+	// TradeFeed returns nil if the exchange does not provide trades.
+	TradeFeed() TradeFeed
+
+	// DepthFeed returns nil if the exchange does not provide order books,
+	// or none are enabled.
+	DepthFeed() DepthFeed
+
+	// Symbols returns the symbols available on the exchange.
+	Symbols() ([]string, error)
+
+	// SetMaxAge sets how long the exchange's feeds keep data cached.
+	SetMaxAge(maxAge time.Duration)
+
+	// Streams returns the status of each websocket connection to the
+	// exchange.
+	Streams() []StreamStatus
+
+	// SetBackoffOptions sets how reconnects to the exchange are backed
+	// off. Must be called before the feeds are run.
+	SetBackoffOptions(options BackoffOptions)
+
+	// SetWatchdogOptions sets when a stream that stays connected but stops
+	// delivering data in time is reconnected. Must be called before the
+	// feeds are run.
+	SetWatchdogOptions(options WatchdogOptions)
+
+	// SetRecorder sets the recorder raw messages from the exchange are
+	// recorded to. Must be called before the feeds are run.
+	SetRecorder(recorder *Recorder)
+}
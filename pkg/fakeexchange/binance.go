@@ -0,0 +1,488 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fakeexchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The stream all tickers are sent on.
+const BinanceTickerStream = "!ticker@arr"
+
+// BinanceServer is a fake Binance serving exchangeInfo, 24 hour tickers,
+// aggTrades and order books over REST, and combined websocket streams of
+// tickers, aggTrades and diff and partial book depth.
+type BinanceServer struct {
+	server  *httptest.Server
+	hub     *hub
+	symbols []string
+
+	// The last ticker sent by symbol.
+	tickers map[string]Ticker
+
+	// Every trade sent or lost by symbol, indexed by aggregate trade ID
+	// less one.
+	trades map[string][]binanceAggTrade
+
+	// The order book by symbol.
+	books map[string]*binanceBook
+
+	lock sync.RWMutex
+}
+
+// binanceBook is an order book and the ID of its last update.
+type binanceBook struct {
+	bids         map[float64]float64
+	asks         map[float64]float64
+	lastUpdateId int64
+}
+
+type binanceAggTrade struct {
+	EventType    string `json:"e"`
+	EventTime    int64  `json:"E"`
+	Symbol       string `json:"s"`
+	AggTradeId   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeId int64  `json:"f"`
+	LastTradeId  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	BuyerMaker   bool   `json:"m"`
+	BestMatch    bool   `json:"M"`
+}
+
+// The aggTrade as returned by the REST API, without the event fields.
+type binanceRestAggTrade struct {
+	AggTradeId   int64  `json:"a"`
+	Price        string `json:"p"`
+	Quantity     string `json:"q"`
+	FirstTradeId int64  `json:"f"`
+	LastTradeId  int64  `json:"l"`
+	TradeTime    int64  `json:"T"`
+	BuyerMaker   bool   `json:"m"`
+	BestMatch    bool   `json:"M"`
+}
+
+// NewBinanceServer starts a fake Binance listing symbols, such as ETHBTC.
+func NewBinanceServer(symbols ...string) *BinanceServer {
+	s := &BinanceServer{
+		hub:     newHub(),
+		symbols: symbols,
+		tickers: map[string]Ticker{},
+		trades:  map[string][]binanceAggTrade{},
+		books:   map[string]*binanceBook{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/exchangeInfo", s.handleExchangeInfo)
+	mux.HandleFunc("/api/v3/ticker/24hr", s.handleTicker24hr)
+	mux.HandleFunc("/api/v3/aggTrades", s.handleAggTrades)
+	mux.HandleFunc("/api/v3/depth", s.handleDepth)
+	mux.HandleFunc("/stream", s.handleStream)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// RestUrl is the base URL of the REST API.
+func (s *BinanceServer) RestUrl() string {
+	return s.server.URL
+}
+
+// StreamUrl is the base URL of the websocket API.
+func (s *BinanceServer) StreamUrl() string {
+	return websocketUrl(s.server.URL)
+}
+
+func (s *BinanceServer) Close() {
+	s.hub.closeAll()
+	s.server.Close()
+}
+
+// Connections returns the number of open websocket connections.
+func (s *BinanceServer) Connections() int {
+	return s.hub.count()
+}
+
+// DropConnections closes all websocket connections.
+func (s *BinanceServer) DropConnections() {
+	s.hub.closeAll()
+}
+
+// SetSymbols replaces the symbols listed, as when symbols are listed or
+// delisted.
+func (s *BinanceServer) SetSymbols(symbols ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.symbols = symbols
+}
+
+// WaitForStream waits until a connection is subscribed to stream, such as
+// BinanceTickerStream, ethbtc@aggTrade or ethbtc@depth. Anything sent
+// before is lost.
+func (s *BinanceServer) WaitForStream(stream string, timeout time.Duration) error {
+	return s.hub.waitFor(stream, timeout)
+}
+
+// SendTickers sends the tickers in one message on the ticker stream.
+func (s *BinanceServer) SendTickers(tickers ...Ticker) {
+	events := []map[string]interface{}{}
+	s.lock.Lock()
+	for _, ticker := range tickers {
+		ticker.Time = eventTime(ticker.Time)
+		s.tickers[ticker.Symbol] = ticker
+		events = append(events, binanceTickerEvent(ticker))
+	}
+	s.lock.Unlock()
+	s.sendStream(BinanceTickerStream, events)
+}
+
+// SendTrade sends an aggTrade on the symbol's trade stream, returning its
+// aggregate trade ID.
+func (s *BinanceServer) SendTrade(trade Trade) int64 {
+	aggTrade := s.addTrade(trade)
+	s.sendStream(binanceTradeStream(trade.Symbol), aggTrade)
+	return aggTrade.AggTradeId
+}
+
+// LoseTrade adds an aggTrade that is not sent on the stream but can be got
+// from the REST API, as if it was missed during a disconnect.
+func (s *BinanceServer) LoseTrade(trade Trade) int64 {
+	return s.addTrade(trade).AggTradeId
+}
+
+// SendDepthUpdate applies update to the symbol's order book, and sends it
+// as a diff on the diff depth stream and the resulting book on the partial
+// book depth streams. It returns the first and final update IDs of the
+// diff, one per level changed.
+func (s *BinanceServer) SendDepthUpdate(update DepthUpdate) (int64, int64) {
+	first, last := s.updateBook(update)
+	symbol := strings.ToLower(update.Symbol)
+	s.sendStream(symbol+"@depth", map[string]interface{}{
+		"e": "depthUpdate",
+		"E": millis(eventTime(update.Time)),
+		"s": update.Symbol,
+		"U": first,
+		"u": last,
+		"b": binanceLevels(update.Bids),
+		"a": binanceLevels(update.Asks),
+	})
+	for _, levels := range []int{5, 10, 20} {
+		stream := fmt.Sprintf("%s@depth%d", symbol, levels)
+		if s.hub.subscribed(stream) {
+			s.sendStream(stream, s.bookSnapshot(update.Symbol, levels))
+		}
+	}
+	return first, last
+}
+
+// LoseDepthUpdate applies update to the symbol's order book without
+// sending it, as if it was missed during a disconnect.
+func (s *BinanceServer) LoseDepthUpdate(update DepthUpdate) (int64, int64) {
+	return s.updateBook(update)
+}
+
+func (s *BinanceServer) updateBook(update DepthUpdate) (int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	book := s.books[update.Symbol]
+	if book == nil {
+		book = &binanceBook{
+			bids: map[float64]float64{},
+			asks: map[float64]float64{},
+		}
+		s.books[update.Symbol] = book
+	}
+	first := book.lastUpdateId + 1
+	updateLevels(book.bids, update.Bids)
+	updateLevels(book.asks, update.Asks)
+	book.lastUpdateId += int64(len(update.Bids) + len(update.Asks))
+	if book.lastUpdateId < first {
+		book.lastUpdateId = first
+	}
+	return first, book.lastUpdateId
+}
+
+func updateLevels(side map[float64]float64, levels []Level) {
+	for _, level := range levels {
+		if level.Quantity == 0 {
+			delete(side, level.Price)
+		} else {
+			side[level.Price] = level.Quantity
+		}
+	}
+}
+
+// bookSnapshot returns up to limit levels per side of the symbol's order
+// book, best first.
+func (s *BinanceServer) bookSnapshot(symbol string, limit int) map[string]interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	bids := []Level{}
+	asks := []Level{}
+	lastUpdateId := int64(0)
+	if book := s.books[symbol]; book != nil {
+		for price, quantity := range book.bids {
+			bids = append(bids, Level{Price: price, Quantity: quantity})
+		}
+		for price, quantity := range book.asks {
+			asks = append(asks, Level{Price: price, Quantity: quantity})
+		}
+		lastUpdateId = book.lastUpdateId
+	}
+	sort.Slice(bids, func(i, j int) bool { return bids[i].Price > bids[j].Price })
+	sort.Slice(asks, func(i, j int) bool { return asks[i].Price < asks[j].Price })
+	if len(bids) > limit {
+		bids = bids[:limit]
+	}
+	if len(asks) > limit {
+		asks = asks[:limit]
+	}
+	return map[string]interface{}{
+		"lastUpdateId": lastUpdateId,
+		"bids":         binanceLevels(bids),
+		"asks":         binanceLevels(asks),
+	}
+}
+
+func binanceLevels(levels []Level) [][2]string {
+	encoded := [][2]string{}
+	for _, level := range levels {
+		encoded = append(encoded, [2]string{
+			formatFloat(level.Price), formatFloat(level.Quantity)})
+	}
+	return encoded
+}
+
+// Play sends the events of script, returning once all have been sent.
+func (s *BinanceServer) Play(script []ScriptEvent) {
+	play(s, script)
+}
+
+func (s *BinanceServer) addTrade(trade Trade) binanceAggTrade {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	tradeTime := millis(eventTime(trade.Time))
+	id := int64(len(s.trades[trade.Symbol]) + 1)
+	aggTrade := binanceAggTrade{
+		EventType:    "aggTrade",
+		EventTime:    tradeTime,
+		Symbol:       trade.Symbol,
+		AggTradeId:   id,
+		Price:        formatFloat(trade.Price),
+		Quantity:     formatFloat(trade.Quantity),
+		FirstTradeId: id,
+		LastTradeId:  id,
+		TradeTime:    tradeTime,
+		BuyerMaker:   trade.BuyerMaker,
+		BestMatch:    true,
+	}
+	s.trades[trade.Symbol] = append(s.trades[trade.Symbol], aggTrade)
+	return aggTrade
+}
+
+func (s *BinanceServer) sendStream(stream string, data interface{}) {
+	buf, err := json.Marshal(map[string]interface{}{
+		"stream": stream,
+		"data":   data,
+	})
+	if err != nil {
+		panic(err)
+	}
+	s.hub.send(stream, buf)
+}
+
+func binanceTradeStream(symbol string) string {
+	return fmt.Sprintf("%s@aggTrade", strings.ToLower(symbol))
+}
+
+func binanceTickerEvent(ticker Ticker) map[string]interface{} {
+	return map[string]interface{}{
+		"e": "24hrTicker",
+		"E": millis(ticker.Time),
+		"s": ticker.Symbol,
+		"P": formatFloat(ticker.PriceChangePercent),
+		"c": formatFloat(ticker.LastPrice),
+		"b": formatFloat(ticker.Bid),
+		"a": formatFloat(ticker.Ask),
+		"h": formatFloat(ticker.High),
+		"l": formatFloat(ticker.Low),
+		"v": formatFloat(ticker.Volume),
+		"q": formatFloat(ticker.QuoteVolume),
+		"O": millis(ticker.Time.Add(-24 * time.Hour)),
+		"C": millis(ticker.Time),
+	}
+}
+
+func binanceRestTicker(ticker Ticker) map[string]interface{} {
+	return map[string]interface{}{
+		"symbol":             ticker.Symbol,
+		"priceChangePercent": formatFloat(ticker.PriceChangePercent),
+		"lastPrice":          formatFloat(ticker.LastPrice),
+		"bidPrice":           formatFloat(ticker.Bid),
+		"askPrice":           formatFloat(ticker.Ask),
+		"highPrice":          formatFloat(ticker.High),
+		"lowPrice":           formatFloat(ticker.Low),
+		"volume":             formatFloat(ticker.Volume),
+		"quoteVolume":        formatFloat(ticker.QuoteVolume),
+		"openTime":           millis(ticker.Time.Add(-24 * time.Hour)),
+		"closeTime":          millis(ticker.Time),
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeBinanceError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": -1100,
+		"msg":  message,
+	})
+}
+
+func (s *BinanceServer) handleExchangeInfo(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	symbols := []map[string]interface{}{}
+	for _, symbol := range s.symbols {
+		symbols = append(symbols, map[string]interface{}{
+			"symbol": symbol,
+			"status": "TRADING",
+		})
+	}
+	writeJson(w, map[string]interface{}{
+		"timezone":   "UTC",
+		"serverTime": millis(time.Now()),
+		"symbols":    symbols,
+	})
+}
+
+func (s *BinanceServer) handleTicker24hr(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if symbol := r.FormValue("symbol"); symbol != "" {
+		ticker, ok := s.tickers[symbol]
+		if !ok {
+			writeBinanceError(w, http.StatusBadRequest, "Invalid symbol.")
+			return
+		}
+		writeJson(w, binanceRestTicker(ticker))
+		return
+	}
+	tickers := []map[string]interface{}{}
+	for _, symbol := range s.symbols {
+		if ticker, ok := s.tickers[symbol]; ok {
+			tickers = append(tickers, binanceRestTicker(ticker))
+		}
+	}
+	writeJson(w, tickers)
+}
+
+func (s *BinanceServer) handleAggTrades(w http.ResponseWriter, r *http.Request) {
+	fromId, err := strconv.ParseInt(r.FormValue("fromId"), 10, 64)
+	if err != nil {
+		writeBinanceError(w, http.StatusBadRequest, "Invalid fromId.")
+		return
+	}
+	limit := 500
+	if value := r.FormValue("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > 1000 {
+			writeBinanceError(w, http.StatusBadRequest, "Invalid limit.")
+			return
+		}
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	trades := []binanceRestAggTrade{}
+	all := s.trades[r.FormValue("symbol")]
+	for i := fromId - 1; i >= 0 && i < int64(len(all)) && len(trades) < limit; i++ {
+		trade := all[i]
+		trades = append(trades, binanceRestAggTrade{
+			AggTradeId:   trade.AggTradeId,
+			Price:        trade.Price,
+			Quantity:     trade.Quantity,
+			FirstTradeId: trade.FirstTradeId,
+			LastTradeId:  trade.LastTradeId,
+			TradeTime:    trade.TradeTime,
+			BuyerMaker:   trade.BuyerMaker,
+			BestMatch:    trade.BestMatch,
+		})
+	}
+	writeJson(w, trades)
+}
+
+func (s *BinanceServer) handleDepth(w http.ResponseWriter, r *http.Request) {
+	symbol := r.FormValue("symbol")
+	found := false
+	s.lock.RLock()
+	for _, listed := range s.symbols {
+		found = found || listed == symbol
+	}
+	s.lock.RUnlock()
+	if !found {
+		writeBinanceError(w, http.StatusBadRequest, "Invalid symbol.")
+		return
+	}
+	limit := 100
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > 5000 {
+			writeBinanceError(w, http.StatusBadRequest, "Invalid limit.")
+			return
+		}
+	}
+	writeJson(w, s.bookSnapshot(symbol, limit))
+}
+
+// handleStream serves a combined stream, subscribed to the streams given
+// in the URL.
+func (s *BinanceServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{
+		ws:      ws,
+		streams: map[string]bool{},
+	}
+	for _, stream := range strings.Split(r.FormValue("streams"), "/") {
+		if stream != "" {
+			c.streams[stream] = true
+		}
+	}
+	s.hub.add(c)
+	defer s.hub.remove(c)
+	defer ws.Close()
+
+	// Nothing is expected from the client, but reading handles pings and
+	// notices the connection closing.
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package fakeexchange provides local fake Binance and KuCoin servers,
+// serving the REST endpoints and websocket streams the scanner uses with
+// scripted tickers, trades and order book updates, so it can be run end to
+// end offline.
+//
+// Point an exchange at a server by setting its base URLs, for example:
+//
+//	server := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+//	defer server.Close()
+//	exchange.SetRestUrl(server.RestUrl())
+//	exchange.SetStreamUrl(server.StreamUrl())
+//	server.WaitForStream("!ticker@arr", time.Second)
+//	server.SendTickers(fakeexchange.Ticker{Symbol: "ETHBTC", LastPrice: 0.03})
+package fakeexchange
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Ticker struct {
+	Symbol      string
+	LastPrice   float64
+	Bid         float64
+	Ask         float64
+	High        float64
+	Low         float64
+	Volume      float64
+	QuoteVolume float64
+
+	// The 24 hour price change, in percent.
+	PriceChangePercent float64
+
+	// Now if zero.
+	Time time.Time
+}
+
+type Trade struct {
+	Symbol   string
+	Price    float64
+	Quantity float64
+
+	// True for a sell, the buyer being the maker.
+	BuyerMaker bool
+
+	// Now if zero.
+	Time time.Time
+}
+
+// Level is an order book price level, a quantity of 0 removes it.
+type Level struct {
+	Price    float64
+	Quantity float64
+}
+
+// DepthUpdate changes the levels of a symbol's order book.
+type DepthUpdate struct {
+	Symbol string
+	Bids   []Level
+	Asks   []Level
+
+	// Now if zero.
+	Time time.Time
+}
+
+// ScriptEvent is sent by Play after waiting for its delay.
+type ScriptEvent struct {
+	// The delay after the previous event.
+	After time.Duration
+
+	Tickers []Ticker
+	Trades  []Trade
+
+	// Ignored by servers without order books.
+	DepthUpdates []DepthUpdate
+}
+
+// sender is implemented by the fake servers for Play.
+type sender interface {
+	SendTickers(tickers ...Ticker)
+	SendTrade(trade Trade) int64
+}
+
+// depthSender is implemented by the fake servers with order books.
+type depthSender interface {
+	SendDepthUpdate(update DepthUpdate) (int64, int64)
+}
+
+// play sends each event of script to server with its delay, returning once
+// all have been sent.
+func play(server sender, script []ScriptEvent) {
+	for _, event := range script {
+		time.Sleep(event.After)
+		if len(event.Tickers) > 0 {
+			server.SendTickers(event.Tickers...)
+		}
+		for _, trade := range event.Trades {
+			server.SendTrade(trade)
+		}
+		if depthServer, ok := server.(depthSender); ok {
+			for _, update := range event.DepthUpdates {
+				depthServer.SendDepthUpdate(update)
+			}
+		}
+	}
+}
+
+func eventTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now()
+	}
+	return t
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// conn is a websocket connection to a fake server and the streams or
+// topics it is subscribed to.
+type conn struct {
+	ws        *websocket.Conn
+	streams   map[string]bool
+	writeLock sync.Mutex
+}
+
+func (c *conn) write(message []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, message)
+}
+
+// hub tracks the websocket connections to a fake server.
+type hub struct {
+	conns map[*conn]bool
+	lock  sync.RWMutex
+}
+
+func newHub() *hub {
+	return &hub{
+		conns: map[*conn]bool{},
+	}
+}
+
+func (h *hub) add(c *conn) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.conns[c] = true
+}
+
+func (h *hub) remove(c *conn) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.conns, c)
+}
+
+func (h *hub) subscribe(c *conn, stream string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	c.streams[stream] = true
+}
+
+// send writes message to each connection subscribed to stream.
+func (h *hub) send(stream string, message []byte) {
+	h.lock.RLock()
+	conns := []*conn{}
+	for c := range h.conns {
+		if c.streams[stream] {
+			conns = append(conns, c)
+		}
+	}
+	h.lock.RUnlock()
+	for _, c := range conns {
+		c.write(message)
+	}
+}
+
+func (h *hub) subscribed(stream string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for c := range h.conns {
+		if c.streams[stream] {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hub) count() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.conns)
+}
+
+// closeAll closes every connection, as if the server dropped them.
+func (h *hub) closeAll() {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for c := range h.conns {
+		c.ws.Close()
+	}
+}
+
+// waitFor waits until a connection is subscribed to stream.
+func (h *hub) waitFor(stream string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !h.subscribed(stream) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for a subscription to %s", stream)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func websocketUrl(httpUrl string) string {
+	return "ws" + strings.TrimPrefix(httpUrl, "http")
+}
@@ -0,0 +1,303 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package fakeexchange
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KucoinServer is a fake KuCoin serving symbols, all tickers and public
+// websocket tokens over REST, and a websocket feed of market snapshots and
+// matches.
+type KucoinServer struct {
+	server  *httptest.Server
+	hub     *hub
+	symbols []string
+
+	// The last ticker sent by symbol.
+	tickers map[string]Ticker
+
+	// The last sequence number by symbol.
+	sequences map[string]int64
+
+	lock sync.RWMutex
+}
+
+// NewKucoinServer starts a fake KuCoin listing symbols, such as ETH-BTC.
+func NewKucoinServer(symbols ...string) *KucoinServer {
+	s := &KucoinServer{
+		hub:       newHub(),
+		symbols:   symbols,
+		tickers:   map[string]Ticker{},
+		sequences: map[string]int64{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/symbols", s.handleSymbols)
+	mux.HandleFunc("/api/v1/market/allTickers", s.handleAllTickers)
+	mux.HandleFunc("/api/v1/bullet-public", s.handleBullet)
+	mux.HandleFunc("/endpoint", s.handleEndpoint)
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+// RestUrl is the base URL of the REST API, the websocket endpoint is got
+// from it.
+func (s *KucoinServer) RestUrl() string {
+	return s.server.URL
+}
+
+func (s *KucoinServer) Close() {
+	s.hub.closeAll()
+	s.server.Close()
+}
+
+// Connections returns the number of open websocket connections.
+func (s *KucoinServer) Connections() int {
+	return s.hub.count()
+}
+
+// DropConnections closes all websocket connections.
+func (s *KucoinServer) DropConnections() {
+	s.hub.closeAll()
+}
+
+// WaitForTopic waits until a connection is subscribed to topic, such as
+// /market/snapshot:BTC or /market/match:ETH-BTC. Anything sent before is
+// lost.
+func (s *KucoinServer) WaitForTopic(topic string, timeout time.Duration) error {
+	return s.hub.waitFor(topic, timeout)
+}
+
+// SendTickers sends a market snapshot for each ticker.
+func (s *KucoinServer) SendTickers(tickers ...Ticker) {
+	for _, ticker := range tickers {
+		ticker.Time = eventTime(ticker.Time)
+		s.lock.Lock()
+		s.tickers[ticker.Symbol] = ticker
+		sequence := s.nextSequence(ticker.Symbol)
+		s.lock.Unlock()
+
+		topic := "/market/snapshot:" + kucoinMarket(ticker.Symbol)
+		s.sendMessage(topic, "trade.snapshot", map[string]interface{}{
+			"sequence": fmt.Sprintf("%d", sequence),
+			"data": map[string]interface{}{
+				"symbol":          ticker.Symbol,
+				"datetime":        millis(ticker.Time),
+				"lastTradedPrice": ticker.LastPrice,
+				"buy":             ticker.Bid,
+				"sell":            ticker.Ask,
+				"high":            ticker.High,
+				"low":             ticker.Low,
+				"vol":             ticker.Volume,
+				"volValue":        ticker.QuoteVolume,
+				"changeRate":      ticker.PriceChangePercent / 100,
+				"trading":         true,
+			},
+		})
+	}
+}
+
+// SendTrade sends a match, returning its sequence number.
+func (s *KucoinServer) SendTrade(trade Trade) int64 {
+	s.lock.Lock()
+	sequence := s.nextSequence(trade.Symbol)
+	s.lock.Unlock()
+
+	side := "buy"
+	if trade.BuyerMaker {
+		side = "sell"
+	}
+	s.sendMessage("/market/match:"+trade.Symbol, "trade.l3match", map[string]interface{}{
+		"symbol":   trade.Symbol,
+		"sequence": fmt.Sprintf("%d", sequence),
+		"side":     side,
+		"price":    formatFloat(trade.Price),
+		"size":     formatFloat(trade.Quantity),
+		"tradeId":  fmt.Sprintf("%d", sequence),
+		"time":     fmt.Sprintf("%d", eventTime(trade.Time).UnixNano()),
+	})
+	return sequence
+}
+
+// Play sends the events of script, returning once all have been sent.
+func (s *KucoinServer) Play(script []ScriptEvent) {
+	play(s, script)
+}
+
+// nextSequence returns the next sequence number of symbol. The lock must
+// be held.
+func (s *KucoinServer) nextSequence(symbol string) int64 {
+	s.sequences[symbol]++
+	return s.sequences[symbol]
+}
+
+func (s *KucoinServer) sendMessage(topic string, subject string, data interface{}) {
+	buf, err := json.Marshal(map[string]interface{}{
+		"type":    "message",
+		"topic":   topic,
+		"subject": subject,
+		"data":    data,
+	})
+	if err != nil {
+		panic(err)
+	}
+	s.hub.send(topic, buf)
+}
+
+// kucoinMarket returns the quote currency of symbol, which its snapshots
+// are published under.
+func kucoinMarket(symbol string) string {
+	parts := strings.Split(symbol, "-")
+	return parts[len(parts)-1]
+}
+
+func writeKucoinData(w http.ResponseWriter, data interface{}) {
+	writeJson(w, map[string]interface{}{
+		"code": "200000",
+		"data": data,
+	})
+}
+
+func (s *KucoinServer) handleSymbols(w http.ResponseWriter, r *http.Request) {
+	symbols := []map[string]interface{}{}
+	for _, symbol := range s.symbols {
+		parts := strings.Split(symbol, "-")
+		symbols = append(symbols, map[string]interface{}{
+			"symbol":        symbol,
+			"name":          symbol,
+			"baseCurrency":  parts[0],
+			"quoteCurrency": kucoinMarket(symbol),
+			"market":        kucoinMarket(symbol),
+			"enableTrading": true,
+		})
+	}
+	writeKucoinData(w, symbols)
+}
+
+func (s *KucoinServer) handleAllTickers(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	tickers := []map[string]interface{}{}
+	for _, symbol := range s.symbols {
+		ticker, ok := s.tickers[symbol]
+		if !ok {
+			continue
+		}
+		tickers = append(tickers, map[string]interface{}{
+			"symbol":     symbol,
+			"symbolName": symbol,
+			"buy":        formatFloat(ticker.Bid),
+			"sell":       formatFloat(ticker.Ask),
+			"changeRate": formatFloat(ticker.PriceChangePercent / 100),
+			"high":       formatFloat(ticker.High),
+			"low":        formatFloat(ticker.Low),
+			"vol":        formatFloat(ticker.Volume),
+			"volValue":   formatFloat(ticker.QuoteVolume),
+			"last":       formatFloat(ticker.LastPrice),
+		})
+	}
+	writeKucoinData(w, map[string]interface{}{
+		"time":   millis(time.Now()),
+		"ticker": tickers,
+	})
+}
+
+func (s *KucoinServer) handleBullet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeKucoinData(w, map[string]interface{}{
+		"token": "fake",
+		"instanceServers": []map[string]interface{}{
+			{
+				"endpoint":     websocketUrl(s.server.URL) + "/endpoint",
+				"protocol":     "websocket",
+				"encrypt":      false,
+				"pingInterval": 18000,
+				"pingTimeout":  10000,
+			},
+		},
+	})
+}
+
+// handleEndpoint serves the websocket feed, acknowledging subscriptions
+// and answering pings.
+func (s *KucoinServer) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{
+		ws:      ws,
+		streams: map[string]bool{},
+	}
+	s.hub.add(c)
+	defer s.hub.remove(c)
+	defer ws.Close()
+
+	welcome, _ := json.Marshal(map[string]interface{}{
+		"id":   r.FormValue("connectId"),
+		"type": "welcome",
+	})
+	if err := c.write(welcome); err != nil {
+		return
+	}
+
+	for {
+		var request struct {
+			Id       string `json:"id"`
+			Type     string `json:"type"`
+			Topic    string `json:"topic"`
+			Response bool   `json:"response"`
+		}
+		if err := ws.ReadJSON(&request); err != nil {
+			return
+		}
+		reply := ""
+		switch request.Type {
+		case "ping":
+			reply = "pong"
+		case "subscribe":
+			// Match topics can list several symbols, they are tracked
+			// individually as messages are sent per symbol.
+			parts := strings.SplitN(request.Topic, ":", 2)
+			if len(parts) == 2 {
+				for _, symbol := range strings.Split(parts[1], ",") {
+					s.hub.subscribe(c, parts[0]+":"+symbol)
+				}
+			}
+			if request.Response {
+				reply = "ack"
+			}
+		}
+		if reply != "" {
+			buf, _ := json.Marshal(map[string]interface{}{
+				"id":   request.Id,
+				"type": reply,
+			})
+			if err := c.write(buf); err != nil {
+				return
+			}
+		}
+	}
+}
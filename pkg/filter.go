@@ -0,0 +1,508 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a parsed screener expression that is matched against the
+// fields of a ticker update message, for example:
+//
+//     price_change_pct.5m > 2 && volume > 100 && symbol endsWith BTC
+//
+// Fields are referenced by name, with a dot selecting a key of a nested
+// map. Comparisons are made with > >= < <= == != and the string operators
+// contains, startsWith and endsWith, which take a quoted string or a bare
+// word. A bare word on the right of == or != is a field if the message
+// has it, otherwise a string, so symbol == ETHBTC works without quotes.
+// Comparisons can be combined with && (and), || (or), ! (not) and
+// parentheses.
+//
+// A comparison against a field that is missing, or of the wrong type, is
+// false.
+type Filter struct {
+	Expression string
+	root       filterNode
+}
+
+func ParseFilter(expression string) (*Filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	parser := filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != filterTokenEnd {
+		return nil, fmt.Errorf("unexpected %s at position %d",
+			token.text, token.pos)
+	}
+	return &Filter{
+		Expression: expression,
+		root:       root,
+	}, nil
+}
+
+// Match returns true if the fields match the filter.
+func (f *Filter) Match(fields map[string]interface{}) bool {
+	return isTrue(f.root.eval(fields))
+}
+
+type filterTokenKind int
+
+const (
+	filterTokenEnd filterTokenKind = iota
+	filterTokenIdent
+	filterTokenNumber
+	filterTokenString
+	filterTokenOp
+	filterTokenLParen
+	filterTokenRParen
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+	pos  int
+}
+
+// The word operators, lower cased.
+var filterWordOps = map[string]string{
+	"and":        "&&",
+	"or":         "||",
+	"not":        "!",
+	"contains":   "contains",
+	"startswith": "startsWith",
+	"endswith":   "endsWith",
+}
+
+var filterSymbolOps = []string{
+	"&&", "||", ">=", "<=", "==", "!=", ">", "<", "!", "=",
+}
+
+func isFilterIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isFilterIdentChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) ||
+		r == '_' || r == '.' || r == '-'
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	input := []rune(expression)
+	i := 0
+Loop:
+	for i < len(input) {
+		r := input[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{filterTokenLParen, "(", start})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{filterTokenRParen, ")", start})
+			i++
+		case r == '"' || r == '\'':
+			i++
+			for i < len(input) && input[i] != r {
+				i++
+			}
+			if i == len(input) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			tokens = append(tokens, filterToken{filterTokenString,
+				string(input[start+1 : i]), start})
+			i++
+		case unicode.IsDigit(r) || r == '.' || r == '-':
+			i++
+			for i < len(input) && (unicode.IsDigit(input[i]) ||
+				input[i] == '.' || input[i] == 'e' || input[i] == 'E' ||
+				((input[i] == '-' || input[i] == '+') &&
+					(input[i-1] == 'e' || input[i-1] == 'E'))) {
+				i++
+			}
+			text := string(input[start:i])
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("invalid number %s at position %d",
+					text, start)
+			}
+			tokens = append(tokens, filterToken{filterTokenNumber, text, start})
+		case isFilterIdentStart(r):
+			for i < len(input) && isFilterIdentChar(input[i]) {
+				i++
+			}
+			text := string(input[start:i])
+			if op, ok := filterWordOps[strings.ToLower(text)]; ok {
+				tokens = append(tokens, filterToken{filterTokenOp, op, start})
+			} else {
+				tokens = append(tokens, filterToken{filterTokenIdent, text, start})
+			}
+		default:
+			for _, op := range filterSymbolOps {
+				if strings.HasPrefix(string(input[i:]), op) {
+					i += len(op)
+					if op == "=" {
+						op = "=="
+					}
+					tokens = append(tokens, filterToken{filterTokenOp, op, start})
+					continue Loop
+				}
+			}
+			return nil, fmt.Errorf("unexpected character %q at position %d",
+				r, start)
+		}
+	}
+	tokens = append(tokens, filterToken{filterTokenEnd, "end of expression", i})
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.tokens[p.pos]
+	if token.kind != filterTokenEnd {
+		p.pos++
+	}
+	return token
+}
+
+func (p *filterParser) acceptOp(op string) bool {
+	token := p.peek()
+	if token.kind == filterTokenOp && token.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.acceptOp("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var filterComparisonOps = map[string]bool{
+	">": true, ">=": true, "<": true, "<=": true, "==": true, "!=": true,
+	"contains": true, "startsWith": true, "endsWith": true,
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	token := p.peek()
+	if token.kind != filterTokenOp || !filterComparisonOps[token.text] {
+		return left, nil
+	}
+	p.next()
+
+	var right filterNode
+	next := p.peek()
+	if next.kind == filterTokenIdent && isFilterStringOp(token.text) {
+		// Bare words are strings for the string operators, so
+		// "symbol endsWith BTC" works without quotes.
+		p.next()
+		right = &filterLiteral{value: next.text}
+	} else if next.kind == filterTokenIdent && isFilterEqualityOp(token.text) &&
+		!isFilterBool(next.text) {
+		p.next()
+		right = &filterFieldOrWord{field: filterField{path: next.text}}
+	} else {
+		right, err = p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &filterComparison{op: token.text, left: left, right: right}, nil
+}
+
+func isFilterStringOp(op string) bool {
+	return op == "contains" || op == "startsWith" || op == "endsWith"
+}
+
+func isFilterEqualityOp(op string) bool {
+	return op == "==" || op == "!="
+}
+
+func isFilterBool(word string) bool {
+	word = strings.ToLower(word)
+	return word == "true" || word == "false"
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	token := p.next()
+	switch token.kind {
+	case filterTokenNumber:
+		value, _ := strconv.ParseFloat(token.text, 64)
+		return &filterLiteral{value: value}, nil
+	case filterTokenString:
+		return &filterLiteral{value: token.text}, nil
+	case filterTokenIdent:
+		switch strings.ToLower(token.text) {
+		case "true":
+			return &filterLiteral{value: true}, nil
+		case "false":
+			return &filterLiteral{value: false}, nil
+		}
+		return &filterField{path: token.text}, nil
+	case filterTokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != filterTokenRParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %s",
+				closing.pos, closing.text)
+		}
+		return node, nil
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", token.text, token.pos)
+}
+
+type filterNode interface {
+	eval(fields map[string]interface{}) interface{}
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+func (n *filterLiteral) eval(fields map[string]interface{}) interface{} {
+	return n.value
+}
+
+type filterField struct {
+	path string
+}
+
+// eval looks up the field, first as a top level key then by following the
+// dotted path into nested maps.
+func (n *filterField) eval(fields map[string]interface{}) interface{} {
+	if value, ok := fields[n.path]; ok {
+		return normalizeFilterValue(value)
+	}
+	var value interface{} = fields
+	for _, key := range strings.Split(n.path, ".") {
+		switch m := value.(type) {
+		case map[string]interface{}:
+			value = m[key]
+		case map[string]float64:
+			v, ok := m[key]
+			if !ok {
+				return nil
+			}
+			value = v
+		default:
+			return nil
+		}
+	}
+	return normalizeFilterValue(value)
+}
+
+// filterFieldOrWord is a bare word compared for equality, the field of
+// that name if there is one, otherwise the word itself.
+type filterFieldOrWord struct {
+	field filterField
+}
+
+func (n *filterFieldOrWord) eval(fields map[string]interface{}) interface{} {
+	if value := n.field.eval(fields); value != nil {
+		return value
+	}
+	return n.field.path
+}
+
+// normalizeFilterValue converts numbers to float64 so they can be
+// compared.
+func normalizeFilterValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+type filterNot struct {
+	operand filterNode
+}
+
+func (n *filterNot) eval(fields map[string]interface{}) interface{} {
+	return !isTrue(n.operand.eval(fields))
+}
+
+type filterLogical struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+func (n *filterLogical) eval(fields map[string]interface{}) interface{} {
+	left := isTrue(n.left.eval(fields))
+	if n.op == "&&" {
+		return left && isTrue(n.right.eval(fields))
+	}
+	return left || isTrue(n.right.eval(fields))
+}
+
+type filterComparison struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+func (n *filterComparison) eval(fields map[string]interface{}) interface{} {
+	left := n.left.eval(fields)
+	right := n.right.eval(fields)
+
+	if isFilterStringOp(n.op) {
+		l, lok := left.(string)
+		r, rok := right.(string)
+		if !lok || !rok {
+			return false
+		}
+		switch n.op {
+		case "contains":
+			return strings.Contains(l, r)
+		case "startsWith":
+			return strings.HasPrefix(l, r)
+		default:
+			return strings.HasSuffix(l, r)
+		}
+	}
+
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case ">":
+			return l > r
+		case ">=":
+			return l >= r
+		case "<":
+			return l < r
+		case "<=":
+			return l <= r
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case ">":
+			return l > r
+		case ">=":
+			return l >= r
+		case "<":
+			return l < r
+		case "<=":
+			return l <= r
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		}
+	}
+	return false
+}
+
+func isTrue(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+)
+
+var filterTestFields = map[string]interface{}{
+	"symbol": "ETHBTC",
+	"close":  0.03,
+	"bid":    0.029,
+	"volume": 120.0,
+	"count":  5,
+	"active": true,
+	"price_change_pct": map[string]float64{
+		"5m": 2.5,
+		"1h": -1,
+	},
+	"nested": map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": 3.0,
+		},
+	},
+}
+
+func TestFilterMatch(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		match      bool
+	}{
+		// Precedence: ! before && before ||.
+		{"volume > 100 || close > 1 && bid > 1", true},
+		{"(volume > 100 || close > 1) && bid > 1", false},
+		{"close > 1 && bid > 1 || volume > 100", true},
+		{"close > 1 && (bid > 1 || volume > 100)", false},
+		{"!close > 1", true},
+		{"!(volume > 100) || symbol == ETHBTC", true},
+		{"!(volume > 100 || symbol == LTCBTC)", false},
+		{"not volume > 100 and close > 0", false},
+		{"close > 1 or volume > 100", true},
+		{"!!volume", true},
+
+		// Numeric comparisons.
+		{"volume > 100", true},
+		{"volume > 120", false},
+		{"volume >= 120", true},
+		{"volume >= 120.5", false},
+		{"close < 0.04", true},
+		{"close < 0.03", false},
+		{"close <= 0.03", true},
+		{"close <= 0.02", false},
+		{"volume == 120", true},
+		{"volume = 120", true},
+		{"volume == 1.2e2", true},
+		{"volume == 121", false},
+		{"volume != 121", true},
+		{"volume != 120", false},
+		{"price_change_pct.1h < -0.5", true},
+		{"bid < close", true},
+		{"count == 5", true},
+
+		// String operators, case sensitive, with quoted or bare words.
+		{"symbol contains TH", true},
+		{"symbol contains eth", false},
+		{"symbol startsWith ETH", true},
+		{"symbol startswith 'LTC'", false},
+		{"symbol endsWith \"BTC\"", true},
+		{"symbol endsWith USDT", false},
+		{"close contains 0", false},
+
+		// String and bool equality, bare words being strings unless a
+		// field.
+		{"symbol == \"ETHBTC\"", true},
+		{"symbol == ETHBTC", true},
+		{"symbol == LTCBTC", false},
+		{"symbol != LTCBTC", true},
+		{"symbol != ETHBTC", false},
+		{"symbol > EOSBTC", false},
+		{"symbol > \"EOSBTC\"", true},
+		{"symbol == close", false},
+		{"active == true", true},
+		{"active != false", true},
+		{"active == false", false},
+		{"active", true},
+
+		// Missing fields and fields of the wrong type.
+		{"missing > 1", false},
+		{"missing < 1", false},
+		{"missing == missing", false},
+		{"!(missing > 1)", true},
+		{"symbol > 1", false},
+		{"volume startsWith 1", false},
+
+		// Nested keys.
+		{"price_change_pct.5m > 2", true},
+		{"price_change_pct.5m > 3", false},
+		{"price_change_pct.15m > 0", false},
+		{"price_change_pct.15m < 0", false},
+		{"nested.a.b == 3", true},
+		{"nested.a.c == 3", false},
+		{"symbol.a == 1", false},
+	} {
+		filter, err := ParseFilter(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+		if match := filter.Match(filterTestFields); match != test.match {
+			t.Errorf("%s: expected %v, got %v", test.expression, test.match, match)
+		}
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"close >",
+		"close > > 1",
+		"(close > 1",
+		"close > 1)",
+		"close > 1 &&",
+		"&& close > 1",
+		"close > 1 volume > 1",
+		"symbol == 'ETHBTC",
+		"close > 1.2.3",
+		"close # 1",
+		"()",
+	} {
+		if _, err := ParseFilter(expression); err == nil {
+			t.Errorf("expected %q to be invalid", expression)
+		}
+	}
+}
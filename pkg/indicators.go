@@ -0,0 +1,373 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Indicator is a technical indicator plugin. An instance is created for
+// each TickerTracker and is fed the same ticks and trades as the tracker.
+// Indicators calculated from the tick prices alone should use the
+// tracker's PriceSeries they are created with rather than keep their own.
+type Indicator interface {
+	// Update is called with each ticker added to the tracker.
+	Update(ticker CommonTicker)
+
+	// AddTrade is called with each trade added to the tracker.
+	AddTrade(trade CommonTrade)
+
+	// Calculate returns the indicator values over the window ending at
+	// now. Values that cannot be calculated yet should be left out of the
+	// map rather than set to NaN.
+	Calculate(now time.Time, window time.Duration) map[string]float64
+
+	// Prune drops any history older than the given time.
+	Prune(before time.Time)
+}
+
+// IndicatorFactory creates an indicator for a tracker, given the price
+// history of the tracker's ticks. The series is updated and pruned by the
+// tracker before the indicators.
+type IndicatorFactory func(prices *PriceSeries) Indicator
+
+var indicatorRegistry = map[string]IndicatorFactory{}
+var indicatorRegistryLock sync.RWMutex
+
+// RegisterIndicator registers an indicator under the given name. Trackers
+// created after registration will include the indicator.
+func RegisterIndicator(name string, factory IndicatorFactory) {
+	indicatorRegistryLock.Lock()
+	defer indicatorRegistryLock.Unlock()
+	if _, exists := indicatorRegistry[name]; exists {
+		log.Printf("warning: replacing registered indicator %s\n", name)
+	}
+	indicatorRegistry[name] = factory
+}
+
+// IndicatorNames returns the names of the registered indicators, sorted.
+func IndicatorNames() []string {
+	indicatorRegistryLock.RLock()
+	defer indicatorRegistryLock.RUnlock()
+	names := []string{}
+	for name := range indicatorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewIndicators creates a new instance of each registered indicator, keyed
+// by name, sharing the price series.
+func NewIndicators(prices *PriceSeries) map[string]Indicator {
+	indicatorRegistryLock.RLock()
+	defer indicatorRegistryLock.RUnlock()
+	indicators := map[string]Indicator{}
+	for name, factory := range indicatorRegistry {
+		indicators[name] = factory(prices)
+	}
+	return indicators
+}
+
+func init() {
+	RegisterIndicator("rsi", func(prices *PriceSeries) Indicator {
+		return &RsiIndicator{seriesIndicator{prices}}
+	})
+	RegisterIndicator("ma", func(prices *PriceSeries) Indicator {
+		return &MovingAverageIndicator{seriesIndicator{prices}}
+	})
+	RegisterIndicator("macd", func(prices *PriceSeries) Indicator {
+		return &MacdIndicator{seriesIndicator{prices}}
+	})
+	RegisterIndicator("bb", func(prices *PriceSeries) Indicator {
+		return &BollingerIndicator{seriesIndicator: seriesIndicator{prices},
+			Deviations: 2}
+	})
+	RegisterIndicator("atr", func(prices *PriceSeries) Indicator {
+		return &AtrIndicator{seriesIndicator: seriesIndicator{prices},
+			Period: time.Minute}
+	})
+}
+
+type pricePoint struct {
+	Timestamp time.Time
+	Price     float64
+}
+
+// PriceSeries is the tick price history of a tracker, shared by its
+// indicators.
+type PriceSeries struct {
+	points []pricePoint
+}
+
+func (s *PriceSeries) Update(ticker CommonTicker) {
+	if ticker.LastPrice == 0 {
+		return
+	}
+	s.points = append(s.points, pricePoint{
+		Timestamp: ticker.Timestamp,
+		Price:     ticker.LastPrice,
+	})
+}
+
+func (s *PriceSeries) Prune(before time.Time) {
+	chop := 0
+	for i, point := range s.points {
+		if !point.Timestamp.Before(before) {
+			break
+		}
+		chop = i + 1
+	}
+	if chop > 0 {
+		s.points = s.points[chop:]
+	}
+}
+
+// windowStart returns the index of the first point with a timestamp within
+// window of now.
+func (s *PriceSeries) windowStart(now time.Time, window time.Duration) int {
+	start := now.Add(-window)
+	return sort.Search(len(s.points), func(i int) bool {
+		return s.points[i].Timestamp.After(start)
+	})
+}
+
+// Window returns the prices with a timestamp within window of now.
+func (s *PriceSeries) Window(now time.Time, window time.Duration) []float64 {
+	i := s.windowStart(now, window)
+	prices := make([]float64, 0, len(s.points)-i)
+	for _, point := range s.points[i:] {
+		prices = append(prices, point.Price)
+	}
+	return prices
+}
+
+// seriesIndicator is embedded by the built in indicators, which are
+// calculated from the tracker's price series so have nothing to update.
+type seriesIndicator struct {
+	prices *PriceSeries
+}
+
+func (i *seriesIndicator) Update(ticker CommonTicker) {}
+
+func (i *seriesIndicator) AddTrade(trade CommonTrade) {}
+
+func (i *seriesIndicator) Prune(before time.Time) {}
+
+func sma(prices []float64) float64 {
+	sum := float64(0)
+	for _, price := range prices {
+		sum += price
+	}
+	return sum / float64(len(prices))
+}
+
+// ema returns the exponential moving average of prices using a smoothing
+// factor based on span, seeded with the first price.
+func ema(prices []float64, span float64) float64 {
+	alpha := 2 / (span + 1)
+	value := prices[0]
+	for _, price := range prices[1:] {
+		value = alpha*price + (1-alpha)*value
+	}
+	return value
+}
+
+func isFinite(val float64) bool {
+	return !math.IsNaN(val) && !math.IsInf(val, 0)
+}
+
+// RsiIndicator is the relative strength index over all ticks in the
+// window, using simple averages of the gains and losses.
+type RsiIndicator struct {
+	seriesIndicator
+}
+
+func (i *RsiIndicator) Calculate(now time.Time, window time.Duration) map[string]float64 {
+	prices := i.prices.Window(now, window)
+	if len(prices) < 2 {
+		return nil
+	}
+	gain := float64(0)
+	loss := float64(0)
+	for j := 1; j < len(prices); j++ {
+		diff := prices[j] - prices[j-1]
+		if diff > 0 {
+			gain += diff
+		} else {
+			loss -= diff
+		}
+	}
+	if gain+loss == 0 {
+		return map[string]float64{"rsi": 50}
+	}
+	return map[string]float64{
+		"rsi": Round3(100 * gain / (gain + loss)),
+	}
+}
+
+// MovingAverageIndicator provides the simple and exponential moving
+// averages of the window along with the percentage the EMA is above (or
+// below) the SMA. A change in sign of ema_sma_pct is a crossover.
+type MovingAverageIndicator struct {
+	seriesIndicator
+}
+
+func (i *MovingAverageIndicator) Calculate(now time.Time, window time.Duration) map[string]float64 {
+	prices := i.prices.Window(now, window)
+	if len(prices) == 0 {
+		return nil
+	}
+	simple := sma(prices)
+	exponential := ema(prices, float64(len(prices)))
+	values := map[string]float64{
+		"sma": Round8(simple),
+		"ema": Round8(exponential),
+	}
+	if pct := (exponential - simple) / simple * 100; isFinite(pct) {
+		values["ema_sma_pct"] = Round3(pct)
+	}
+	return values
+}
+
+// MacdIndicator scales the classic 12/26/9 MACD to the number of ticks in
+// the window, so the slow EMA spans the whole window.
+type MacdIndicator struct {
+	seriesIndicator
+}
+
+func (i *MacdIndicator) Calculate(now time.Time, window time.Duration) map[string]float64 {
+	prices := i.prices.Window(now, window)
+	if len(prices) < 3 {
+		return nil
+	}
+	slowSpan := float64(len(prices))
+	fastSpan := slowSpan * 12 / 26
+	signalSpan := slowSpan * 9 / 26
+
+	fastAlpha := 2 / (fastSpan + 1)
+	slowAlpha := 2 / (slowSpan + 1)
+	signalAlpha := 2 / (signalSpan + 1)
+
+	fast := prices[0]
+	slow := prices[0]
+	signal := float64(0)
+	for _, price := range prices[1:] {
+		fast = fastAlpha*price + (1-fastAlpha)*fast
+		slow = slowAlpha*price + (1-slowAlpha)*slow
+		signal = signalAlpha*(fast-slow) + (1-signalAlpha)*signal
+	}
+	macd := fast - slow
+	return map[string]float64{
+		"macd":        Round8(macd),
+		"macd_signal": Round8(signal),
+		"macd_hist":   Round8(macd - signal),
+	}
+}
+
+// BollingerIndicator provides bands Deviations standard deviations either
+// side of the SMA of the window, and where the last price sits within
+// them (%b).
+type BollingerIndicator struct {
+	seriesIndicator
+	Deviations float64
+}
+
+func (i *BollingerIndicator) Calculate(now time.Time, window time.Duration) map[string]float64 {
+	prices := i.prices.Window(now, window)
+	if len(prices) < 2 {
+		return nil
+	}
+	mean := sma(prices)
+	variance := float64(0)
+	for _, price := range prices {
+		variance += (price - mean) * (price - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(prices)))
+	upper := mean + stddev*i.Deviations
+	lower := mean - stddev*i.Deviations
+	values := map[string]float64{
+		"bb_upper": Round8(upper),
+		"bb_lower": Round8(lower),
+	}
+	last := prices[len(prices)-1]
+	if pctB := (last - lower) / (upper - lower); isFinite(pctB) {
+		values["bb_pct_b"] = Round3(pctB)
+	}
+	return values
+}
+
+// AtrIndicator is the average true range of Period long bars built from
+// the ticks in the window, and that range as a percentage of the last
+// price.
+type AtrIndicator struct {
+	seriesIndicator
+	Period time.Duration
+}
+
+func (i *AtrIndicator) Calculate(now time.Time, window time.Duration) map[string]float64 {
+	var high, low, close, prevClose float64
+	barEnd := time.Time{}
+	haveBar := false
+	havePrev := false
+	trSum := float64(0)
+	trCount := 0
+
+	closeBar := func() {
+		tr := high - low
+		if havePrev {
+			tr = math.Max(tr, math.Max(
+				math.Abs(high-prevClose), math.Abs(low-prevClose)))
+		}
+		trSum += tr
+		trCount++
+		prevClose = close
+		havePrev = true
+	}
+
+	for _, point := range i.prices.points[i.prices.windowStart(now, window):] {
+		if haveBar && !point.Timestamp.Before(barEnd) {
+			closeBar()
+			haveBar = false
+		}
+		if !haveBar {
+			high = point.Price
+			low = point.Price
+			barEnd = point.Timestamp.Truncate(i.Period).Add(i.Period)
+			haveBar = true
+		}
+		high = math.Max(high, point.Price)
+		low = math.Min(low, point.Price)
+		close = point.Price
+	}
+	if !haveBar {
+		return nil
+	}
+	closeBar()
+
+	atr := trSum / float64(trCount)
+	values := map[string]float64{
+		"atr": Round8(atr),
+	}
+	if pct := atr / close * 100; isFinite(pct) {
+		values["atr_pct"] = Round3(pct)
+	}
+	return values
+}
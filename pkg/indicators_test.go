@@ -0,0 +1,213 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+// calculateIndicator calculates the named indicator over the prices, a
+// second apart from testStart, unless offsets are given, with a window
+// of an hour ending at the last price.
+func calculateIndicator(name string, prices []float64, offsets ...time.Duration) map[string]float64 {
+	series := &PriceSeries{}
+	indicator := NewIndicators(series)[name]
+	now := testStart
+	for i, price := range prices {
+		now = testStart.Add(time.Duration(i) * time.Second)
+		if offsets != nil {
+			now = testStart.Add(offsets[i])
+		}
+		ticker := CommonTicker{Timestamp: now, LastPrice: price}
+		series.Update(ticker)
+		indicator.Update(ticker)
+	}
+	return indicator.Calculate(now, time.Hour)
+}
+
+func equalValues(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIndicators(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		prices   []float64
+		offsets  []time.Duration
+		expected map[string]float64
+	}{
+		// Warm up, before there are enough prices.
+		{name: "rsi", prices: []float64{1}},
+		{name: "macd", prices: []float64{1, 2}},
+		{name: "bb", prices: []float64{1}},
+		{name: "atr"},
+		{name: "ma"},
+
+		{
+			name:     "rsi",
+			prices:   []float64{1, 2, 1.5, 2.5},
+			expected: map[string]float64{"rsi": 80},
+		},
+		{
+			name:     "rsi",
+			prices:   []float64{1, 1},
+			expected: map[string]float64{"rsi": 50},
+		},
+		{
+			name:     "rsi",
+			prices:   []float64{2, 1},
+			expected: map[string]float64{"rsi": 0},
+		},
+		{
+			name:   "macd",
+			prices: []float64{1, 2, 3},
+			expected: map[string]float64{
+				"macd":        0.56269511,
+				"macd_signal": 0.55834839,
+				"macd_hist":   0.00434672,
+			},
+		},
+		{
+			name:   "macd",
+			prices: []float64{2, 2, 2},
+			expected: map[string]float64{
+				"macd":        0,
+				"macd_signal": 0,
+				"macd_hist":   0,
+			},
+		},
+		{
+			name:   "bb",
+			prices: []float64{1, 2, 3, 4},
+			expected: map[string]float64{
+				"bb_upper": 4.73606798,
+				"bb_lower": 0.26393202,
+				"bb_pct_b": 0.835,
+			},
+		},
+		{
+			// No %b without a width to the bands.
+			name:   "bb",
+			prices: []float64{2, 2},
+			expected: map[string]float64{
+				"bb_upper": 2,
+				"bb_lower": 2,
+			},
+		},
+		{
+			// Bars of 3 and 2, the second from the previous close.
+			name:   "atr",
+			prices: []float64{10, 12, 9, 11, 13, 12},
+			offsets: []time.Duration{0, 10 * time.Second, 20 * time.Second,
+				30 * time.Second, time.Minute, time.Minute + 10*time.Second},
+			expected: map[string]float64{
+				"atr":     2.5,
+				"atr_pct": 20.833,
+			},
+		},
+		{
+			name:   "atr",
+			prices: []float64{10},
+			expected: map[string]float64{
+				"atr":     0,
+				"atr_pct": 0,
+			},
+		},
+		{
+			name:   "ma",
+			prices: []float64{1, 2, 3},
+			expected: map[string]float64{
+				"sma":         2,
+				"ema":         2.25,
+				"ema_sma_pct": 12.5,
+			},
+		},
+	} {
+		values := calculateIndicator(test.name, test.prices, test.offsets...)
+		if !equalValues(values, test.expected) {
+			t.Errorf("%s %v: expected %v, got %v",
+				test.name, test.prices, test.expected, values)
+		}
+	}
+}
+
+func TestIndicatorsWindow(t *testing.T) {
+	series := &PriceSeries{}
+	indicator := NewIndicators(series)["rsi"]
+	for i, price := range []float64{5, 1, 2, 1.5, 2.5} {
+		series.Update(CommonTicker{
+			Timestamp: testStart.Add(time.Duration(i) * time.Minute),
+			LastPrice: price,
+		})
+	}
+	now := testStart.Add(4 * time.Minute)
+
+	// The first price is outside the window.
+	if values := indicator.Calculate(now, 4*time.Minute); values["rsi"] != 80 {
+		t.Errorf("expected an rsi of 80 within the window, got %v", values)
+	}
+
+	series.Prune(testStart.Add(3 * time.Minute))
+	if values := indicator.Calculate(now, time.Hour); values["rsi"] != 100 {
+		t.Errorf("expected an rsi of 100 after pruning, got %v", values)
+	}
+}
+
+// TestTrackerIndicatorsSharePrices checks the built in indicators are
+// calculated from the tracker's one price series.
+func TestTrackerIndicatorsSharePrices(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	for _, name := range []string{"rsi", "ma", "macd", "bb", "atr"} {
+		var prices *PriceSeries
+		switch indicator := tracker.Indicators[name].(type) {
+		case *RsiIndicator:
+			prices = indicator.prices
+		case *MovingAverageIndicator:
+			prices = indicator.prices
+		case *MacdIndicator:
+			prices = indicator.prices
+		case *BollingerIndicator:
+			prices = indicator.prices
+		case *AtrIndicator:
+			prices = indicator.prices
+		}
+		if prices != tracker.Prices {
+			t.Errorf("%s: expected the tracker's price series", name)
+		}
+	}
+
+	addTick(clock, tracker, 0, 1)
+	addTick(clock, tracker, time.Second, 2)
+	addTick(clock, tracker, 2*time.Second, 1.5)
+	addTick(clock, tracker, 3*time.Second, 2.5)
+	tracker.Recalculate()
+	if rsi := tracker.Metrics["1m"].Indicators["rsi"]; rsi != 80 {
+		t.Errorf("expected an rsi of 80, got %v", rsi)
+	}
+	if sma := tracker.Metrics["1m"].Indicators["sma"]; sma != 1.75 {
+		t.Errorf("expected an sma of 1.75, got %v", sma)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// InputCache is a list of timestamped raw messages from an exchange, used
+// to restore state on startup. Messages are pushed on the end and pruned
+// from the front. Each element is an encoded CacheEntry, with entry
+// times increasing through the list.
+type InputCache interface {
+	RPush(buf []byte)
+
+	// LRange returns the elements from start to stop inclusive. Negative
+	// indexes are relative to the end of the list, as with the Redis
+	// LRANGE command.
+	LRange(start, stop int64) ([]string, error)
+
+	GetFirst() (*CacheEntry, error)
+
+	// GetN returns the nth entry, or nil if there is no such entry.
+	GetN(n int64) (*CacheEntry, error)
+
+	Len() (int64, error)
+
+	// LRemove removes the first element.
+	LRemove()
+
+	// Prune removes the entries older than before.
+	Prune(before time.Time) error
+
+	// Range returns up to count entries with a time after after and not
+	// after until, oldest first.
+	Range(after, until time.Time, count int64) ([]CacheEntry, error)
+}
+
+// CacheEntry is the format of the elements of every InputCache.
+type CacheEntry struct {
+	// Unix seconds.
+	Timestamp int64 `json:"timestamp"`
+
+	// Unix microseconds, unique within a cache. Not set on entries cached
+	// by older versions.
+	TimeMicros int64 `json:"time_us,omitempty"`
+
+	Message string `json:"message"`
+}
+
+// Micros returns the time of the entry in Unix microseconds.
+func (e *CacheEntry) Micros() int64 {
+	if e.TimeMicros != 0 {
+		return e.TimeMicros
+	}
+	return e.Timestamp * int64(time.Second/time.Microsecond)
+}
+
+func DecodeCacheEntry(buf string) (CacheEntry, error) {
+	var cacheEntry CacheEntry
+	err := json.Unmarshal([]byte(buf), &cacheEntry)
+	return cacheEntry, err
+}
+
+const (
+	CacheBackendRedis  = "redis"
+	CacheBackendMemory = "memory"
+	CacheBackendDisk   = "disk"
+)
+
+var CacheBackends = []string{
+	CacheBackendRedis,
+	CacheBackendMemory,
+	CacheBackendDisk,
+}
+
+type CacheOptions struct {
+	// One of CacheBackends, defaults to redis.
+	Backend string
+
+	// The directory the disk backend keeps its segment files in.
+	Directory string
+
+	Redis RedisOptions
+}
+
+// OpenInputCache opens the cache for key using the configured backend. A
+// Redis cache left by an older version is migrated first.
+func OpenInputCache(options CacheOptions, key string, clock Clock) (InputCache, error) {
+	switch options.Backend {
+	case CacheBackendRedis, "":
+		cache := NewRedisInputCache(options.Redis, key, clock)
+		if err := cache.Migrate(); err != nil {
+			log.Printf("error: redis: failed to migrate list %s: %v\n",
+				cache.listKey, err)
+		}
+		return cache, nil
+	case CacheBackendMemory:
+		return NewMemoryInputCache(clock), nil
+	case CacheBackendDisk:
+		if options.Directory == "" {
+			return nil, fmt.Errorf("no directory for disk cache")
+		}
+		return OpenDiskInputCache(filepath.Join(options.Directory, key), clock)
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", options.Backend)
+}
+
+func timeToMicros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// cacheEntryEncoder encodes entries with a time that increases with each
+// entry, even if the clock doesn't, so entries can be ordered and selected
+// by time. It is not safe for concurrent use.
+type cacheEntryEncoder struct {
+	clock Clock
+	last  int64
+}
+
+func (e *cacheEntryEncoder) encode(buf []byte) ([]byte, int64) {
+	now := e.clock.Now()
+	micros := timeToMicros(now)
+	if micros <= e.last {
+		micros = e.last + 1
+	}
+	e.last = micros
+	entry := CacheEntry{
+		Timestamp:  now.Unix(),
+		TimeMicros: micros,
+		Message:    string(buf),
+	}
+	encoded, _ := json.Marshal(&entry)
+	return encoded, micros
+}
+
+// rangeBounds converts LRANGE style start and stop indexes to slice
+// bounds, returning false if the range is empty.
+func rangeBounds(start, stop, length int64) (int64, int64, bool) {
+	if start < 0 {
+		start += length
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	return start, stop + 1, true
+}
+
+// searchCache returns the index of the first entry with a time not before
+// t, or the length of the cache if there is none, by binary search of the
+// entries by index.
+func searchCache(cache InputCache, t time.Time) (int64, error) {
+	length, err := cache.Len()
+	if err != nil {
+		return 0, err
+	}
+	micros := timeToMicros(t)
+	low, high := int64(0), length
+	for low < high {
+		mid := low + (high-low)/2
+		entry, err := getCacheEntry(cache, mid)
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			// Pruned while searching.
+			high = mid
+			continue
+		}
+		if entry.Micros() < micros {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	return low, nil
+}
+
+// rangeByIndex implements Range for caches without a time index.
+func rangeByIndex(cache InputCache, after, until time.Time, count int64) ([]CacheEntry, error) {
+	start, err := searchCache(cache, after.Add(time.Microsecond))
+	if err != nil {
+		return nil, err
+	}
+	return rangeFrom(cache, start, until, count)
+}
+
+// rangeFrom returns up to count entries from index start, stopping at the
+// first entry after until.
+func rangeFrom(cache InputCache, start int64, until time.Time, count int64) ([]CacheEntry, error) {
+	elements, err := cache.LRange(start, start+count-1)
+	if err != nil {
+		return nil, err
+	}
+	untilMicros := timeToMicros(until)
+	entries := make([]CacheEntry, 0, len(elements))
+	for _, element := range elements {
+		entry, err := DecodeCacheEntry(element)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Micros() > untilMicros {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func getCacheEntry(cache InputCache, n int64) (*CacheEntry, error) {
+	elements, err := cache.LRange(n, n)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, nil
+	}
+	cacheEntry, err := DecodeCacheEntry(elements[0])
+	return &cacheEntry, err
+}
+
+// MemoryInputCache is an InputCache that is not persisted, for running
+// without Redis when restoring state on restart isn't needed.
+type MemoryInputCache struct {
+	elements []string
+	encoder  cacheEntryEncoder
+	lock     sync.RWMutex
+}
+
+func NewMemoryInputCache(clock Clock) *MemoryInputCache {
+	return &MemoryInputCache{
+		elements: []string{},
+		encoder:  cacheEntryEncoder{clock: clock},
+	}
+}
+
+func (c *MemoryInputCache) RPush(buf []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	encoded, _ := c.encoder.encode(buf)
+	c.elements = append(c.elements, string(encoded))
+}
+
+func (c *MemoryInputCache) LRange(start, stop int64) ([]string, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	start, end, ok := rangeBounds(start, stop, int64(len(c.elements)))
+	if !ok {
+		return []string{}, nil
+	}
+	elements := make([]string, end-start)
+	copy(elements, c.elements[start:end])
+	return elements, nil
+}
+
+func (c *MemoryInputCache) GetFirst() (*CacheEntry, error) {
+	return c.GetN(0)
+}
+
+func (c *MemoryInputCache) GetN(n int64) (*CacheEntry, error) {
+	return getCacheEntry(c, n)
+}
+
+func (c *MemoryInputCache) Len() (int64, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return int64(len(c.elements)), nil
+}
+
+func (c *MemoryInputCache) LRemove() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.elements) > 0 {
+		c.elements[0] = ""
+		c.elements = c.elements[1:]
+	}
+}
+
+func (c *MemoryInputCache) Prune(before time.Time) error {
+	n, err := searchCache(c, before)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n > int64(len(c.elements)) {
+		n = int64(len(c.elements))
+	}
+	for i := int64(0); i < n; i++ {
+		c.elements[i] = ""
+	}
+	c.elements = c.elements[n:]
+	return nil
+}
+
+func (c *MemoryInputCache) Range(after, until time.Time, count int64) ([]CacheEntry, error) {
+	return rangeByIndex(c, after, until, count)
+}
+
+// NopInputCache is an InputCache that caches nothing, for replaying
+// recordings where there is no state to restore.
+type NopInputCache struct{}
+
+func (c NopInputCache) RPush(buf []byte) {}
+
+func (c NopInputCache) LRange(start, stop int64) ([]string, error) {
+	return []string{}, nil
+}
+
+func (c NopInputCache) GetFirst() (*CacheEntry, error) {
+	return nil, nil
+}
+
+func (c NopInputCache) GetN(n int64) (*CacheEntry, error) {
+	return nil, nil
+}
+
+func (c NopInputCache) Len() (int64, error) {
+	return 0, nil
+}
+
+func (c NopInputCache) LRemove() {}
+
+func (c NopInputCache) Prune(before time.Time) error {
+	return nil
+}
+
+func (c NopInputCache) Range(after, until time.Time, count int64) ([]CacheEntry, error) {
+	return []CacheEntry{}, nil
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// Exchange provides KuCoin tickers and trades from the websocket feed,
+// with tickers polled from the REST API while the websocket is down.
+type Exchange struct {
+	tickerStream *TickerStream
+	tradeStream  *TradeStream
+}
+
+func NewExchange(clock pkg.Clock, cacheOptions pkg.CacheOptions) (*Exchange, error) {
+	tickerCache, err := pkg.OpenInputCache(cacheOptions, "kucoin.tickers.list", clock)
+	if err != nil {
+		return nil, err
+	}
+	tradeCache, err := pkg.OpenInputCache(cacheOptions, "kucoin.trades", clock)
+	if err != nil {
+		return nil, err
+	}
+
+	tickerStream := NewTickerStream(clock, tickerCache)
+	tradeStream := NewTradeStream(clock, tradeCache)
+
+	stream := NewStreamClient(clock)
+	stream.OnTicker = tickerStream.OnStreamTicker
+	stream.OnTrade = tradeStream.OnStreamTrade
+	tickerStream.stream = stream
+
+	return &Exchange{
+		tickerStream: tickerStream,
+		tradeStream:  tradeStream,
+	}, nil
+}
+
+// NewReplayExchange creates an exchange fed by the messages replayed by
+// player. Nothing is cached, as there is no state to restore.
+func NewReplayExchange(clock pkg.Clock, player *pkg.Player) *Exchange {
+	tickerStream := NewTickerStream(clock, pkg.NopInputCache{})
+	tradeStream := NewTradeStream(clock, pkg.NopInputCache{})
+
+	// Tickers are replayed as sent by the ticker stream, so only trades are
+	// taken from the replayed websocket messages.
+	stream := NewStreamClient(clock)
+	stream.OnTrade = tradeStream.OnStreamTrade
+	stream.replay = player.Subscribe(RecordSourceStream)
+	tickerStream.stream = stream
+	tickerStream.replay = player.Subscribe(RecordSourceTickers)
+
+	return &Exchange{
+		tickerStream: tickerStream,
+		tradeStream:  tradeStream,
+	}
+}
+
+func (e *Exchange) Name() string {
+	return "kucoin"
+}
+
+func (e *Exchange) TickerFeed() pkg.TickerFeed {
+	return e.tickerStream
+}
+
+func (e *Exchange) TradeFeed() pkg.TradeFeed {
+	return e.tradeStream
+}
+
+// DepthFeed returns nil, KuCoin order books are not tracked.
+func (e *Exchange) DepthFeed() pkg.DepthFeed {
+	return nil
+}
+
+func (e *Exchange) Symbols() ([]string, error) {
+	entries, err := getSymbols(e.tickerStream.RestUrl)
+	if err != nil {
+		return nil, err
+	}
+	symbols := []string{}
+	for _, entry := range entries {
+		if entry.EnableTrading {
+			symbols = append(symbols, entry.Symbol)
+		}
+	}
+	return symbols, nil
+}
+
+// SetRestUrl sets the base URL of the REST API, which the websocket
+// endpoint is also got from.
+func (e *Exchange) SetRestUrl(url string) {
+	e.tickerStream.RestUrl = url
+	if e.tickerStream.stream != nil {
+		e.tickerStream.stream.RestUrl = url
+	}
+}
+
+func (e *Exchange) SetMaxAge(maxAge time.Duration) {
+	e.tickerStream.MaxAge = maxAge
+	e.tradeStream.MaxAge = maxAge
+}
+
+func (e *Exchange) SetRecorder(recorder *pkg.Recorder) {
+	e.tickerStream.recorder = recorder
+	if e.tickerStream.stream != nil {
+		e.tickerStream.stream.recorder = recorder
+	}
+}
+
+func (e *Exchange) SetBackoffOptions(options pkg.BackoffOptions) {
+	if e.tickerStream.stream != nil {
+		e.tickerStream.stream.SetBackoffOptions(options)
+	}
+}
+
+func (e *Exchange) SetWatchdogOptions(options pkg.WatchdogOptions) {
+	if e.tickerStream.stream != nil {
+		e.tickerStream.stream.SetWatchdogOptions(options)
+	}
+}
+
+func (e *Exchange) Streams() []pkg.StreamStatus {
+	stream := e.tickerStream.stream
+	if stream == nil || stream.replay != nil {
+		return []pkg.StreamStatus{}
+	}
+	return []pkg.StreamStatus{stream.Status()}
+}
@@ -0,0 +1,439 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/websocket"
+)
+
+const DefaultRestUrl = "https://api.kucoin.com"
+
+// The maximum number of symbols KuCoin allows in one match topic.
+const maxSymbolsPerTopic = 100
+
+// Sources of recorded messages.
+const (
+	RecordSourceTickers = "kucoin.tickers"
+	RecordSourceStream  = "kucoin.stream"
+)
+
+type restResponse struct {
+	Code string          `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+type bulletResponse struct {
+	Token           string `json:"token"`
+	InstanceServers []struct {
+		Endpoint     string `json:"endpoint"`
+		Protocol     string `json:"protocol"`
+		PingInterval int64  `json:"pingInterval"`
+		PingTimeout  int64  `json:"pingTimeout"`
+	} `json:"instanceServers"`
+}
+
+type symbolEntry struct {
+	Symbol        string `json:"symbol"`
+	Market        string `json:"market"`
+	EnableTrading bool   `json:"enableTrading"`
+}
+
+type wsMessage struct {
+	Id      string          `json:"id"`
+	Type    string          `json:"type"`
+	Topic   string          `json:"topic"`
+	Subject string          `json:"subject"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type wsSnapshot struct {
+	Data struct {
+		Symbol          string  `json:"symbol"`
+		Datetime        int64   `json:"datetime"`
+		LastTradedPrice float64 `json:"lastTradedPrice"`
+		Buy             float64 `json:"buy"`
+		Sell            float64 `json:"sell"`
+		High            float64 `json:"high"`
+		Low             float64 `json:"low"`
+		VolValue        float64 `json:"volValue"`
+		ChangeRate      float64 `json:"changeRate"`
+	} `json:"data"`
+}
+
+type wsMatch struct {
+	Symbol   string  `json:"symbol"`
+	Sequence int64   `json:"sequence,string"`
+	Side     string  `json:"side"`
+	Price    float64 `json:"price,string"`
+	Size     float64 `json:"size,string"`
+	TradeId  string  `json:"tradeId"`
+
+	// Nanoseconds.
+	Time int64 `json:"time,string"`
+}
+
+// StreamClient is a client for the KuCoin public websocket feed. It
+// subscribes to the market snapshot topics for tickers and the match
+// topics for trades, reconnecting as required.
+type StreamClient struct {
+	RestUrl string
+
+	// Called with each decoded ticker and trade.
+	OnTicker func(ticker pkg.CommonTicker)
+	OnTrade  func(trade pkg.CommonTrade)
+
+	// The current connection, replaced on reconnect.
+	conn     *websocket.Conn
+	connLock sync.Mutex
+
+	writeLock sync.Mutex
+
+	recorder *pkg.Recorder
+
+	// If set, raw messages are read from here instead of the websocket.
+	replay chan []byte
+
+	health *pkg.StreamHealth
+}
+
+func NewStreamClient(clock pkg.Clock) *StreamClient {
+	return &StreamClient{
+		RestUrl: DefaultRestUrl,
+		health:  pkg.NewStreamHealth(clock, "kucoin", 0),
+	}
+}
+
+func (c *StreamClient) Status() pkg.StreamStatus {
+	return c.health.Status()
+}
+
+// SetBackoffOptions sets how reconnects are backed off. Must be called
+// before Run.
+func (c *StreamClient) SetBackoffOptions(options pkg.BackoffOptions) {
+	c.health.SetBackoffOptions(options)
+}
+
+// SetWatchdogOptions sets when the stream is considered stale and
+// reconnected. Must be called before Run.
+func (c *StreamClient) SetWatchdogOptions(options pkg.WatchdogOptions) {
+	c.health.SetWatchdogOptions(options)
+}
+
+// restGet makes a request to the REST API at baseUrl, decoding the data of
+// the response into v.
+func restGet(baseUrl string, method string, path string, v interface{}) error {
+	request, err := http.NewRequest(method, baseUrl+path, nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var decoded restResponse
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return err
+	}
+	if decoded.Code != "200000" {
+		return fmt.Errorf("kucoin: %s %s: code=%s: %s",
+			method, path, decoded.Code, decoded.Msg)
+	}
+	return json.Unmarshal(decoded.Data, v)
+}
+
+func getSymbols(baseUrl string) ([]symbolEntry, error) {
+	symbols := []symbolEntry{}
+	if err := restGet(baseUrl, "GET", "/api/v1/symbols", &symbols); err != nil {
+		return nil, err
+	}
+	return symbols, nil
+}
+
+func (c *StreamClient) getConn() *websocket.Conn {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.conn
+}
+
+func (c *StreamClient) write(v interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.getConn().WriteJSON(v)
+}
+
+// Close closes the current connection, making a blocked read fail.
+func (c *StreamClient) Close() {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Connect negotiates a token, connects and subscribes to the ticker and
+// match topics. The returned ping interval is how often the server
+// expects to be pinged.
+func (c *StreamClient) Connect() (time.Duration, error) {
+	var bullet bulletResponse
+	if err := restGet(c.RestUrl, "POST", "/api/v1/bullet-public", &bullet); err != nil {
+		return 0, err
+	}
+	if len(bullet.InstanceServers) == 0 {
+		return 0, fmt.Errorf("kucoin: no websocket servers")
+	}
+	server := bullet.InstanceServers[0]
+
+	connectId := fmt.Sprintf("%d", time.Now().UnixNano())
+	url := fmt.Sprintf("%s?token=%s&connectId=%s",
+		server.Endpoint, bullet.Token, connectId)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return 0, err
+	}
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+
+	var welcome wsMessage
+	if err := conn.ReadJSON(&welcome); err != nil {
+		conn.Close()
+		return 0, err
+	}
+	if welcome.Type != "welcome" {
+		conn.Close()
+		return 0, fmt.Errorf("kucoin: expected welcome, got %s", welcome.Type)
+	}
+
+	symbols, err := getSymbols(c.RestUrl)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	if err := c.subscribeAll(symbols); err != nil {
+		conn.Close()
+		return 0, err
+	}
+
+	return time.Duration(server.PingInterval) * time.Millisecond, nil
+}
+
+func (c *StreamClient) subscribe(topic string) error {
+	return c.write(map[string]interface{}{
+		"id":             fmt.Sprintf("%d", time.Now().UnixNano()),
+		"type":           "subscribe",
+		"topic":          topic,
+		"privateChannel": false,
+		"response":       true,
+	})
+}
+
+func (c *StreamClient) subscribeAll(symbols []symbolEntry) error {
+	markets := map[string]bool{}
+	names := []string{}
+	topics := 0
+	for _, symbol := range symbols {
+		if !symbol.EnableTrading {
+			continue
+		}
+		markets[symbol.Market] = true
+		names = append(names, symbol.Symbol)
+	}
+
+	for market := range markets {
+		if err := c.subscribe("/market/snapshot:" + market); err != nil {
+			return err
+		}
+		topics++
+	}
+
+	for i := 0; i < len(names); i += maxSymbolsPerTopic {
+		end := i + maxSymbolsPerTopic
+		if end > len(names) {
+			end = len(names)
+		}
+		topic := "/market/match:" + strings.Join(names[i:end], ",")
+		if err := c.subscribe(topic); err != nil {
+			return err
+		}
+		topics++
+	}
+
+	c.health.SetStreams(topics)
+	return nil
+}
+
+func (c *StreamClient) pingLoop(interval time.Duration, done chan bool) {
+	if interval <= 0 {
+		interval = 18 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.write(map[string]interface{}{
+				"id":   fmt.Sprintf("%d", time.Now().UnixNano()),
+				"type": "ping",
+			})
+			if err != nil {
+				log.Printf("kucoin: failed to send ping: %v\n", err)
+				return
+			}
+		}
+	}
+}
+
+func (c *StreamClient) handleMessage(body []byte) {
+	var message wsMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		log.Printf("kucoin: failed to decode stream message: %v\n", err)
+		return
+	}
+
+	switch message.Type {
+	case "message":
+	case "error":
+		log.Printf("kucoin: stream error: %s\n", string(body))
+		return
+	default:
+		// Pongs and acks.
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(message.Topic, "/market/snapshot:"):
+		var snapshot wsSnapshot
+		if err := json.Unmarshal(message.Data, &snapshot); err != nil {
+			log.Printf("kucoin: failed to decode snapshot: %v\n", err)
+			return
+		}
+		ticker := snapshot.toCommonTicker()
+		c.health.ServerTime(ticker.Timestamp)
+		if c.OnTicker != nil {
+			c.OnTicker(ticker)
+		}
+	case strings.HasPrefix(message.Topic, "/market/match:"):
+		var match wsMatch
+		if err := json.Unmarshal(message.Data, &match); err != nil {
+			log.Printf("kucoin: failed to decode match: %v\n", err)
+			return
+		}
+		trade := match.toCommonTrade()
+		c.health.ServerTime(trade.Timestamp)
+		if c.OnTrade != nil {
+			c.OnTrade(trade)
+		}
+	}
+}
+
+// Run connects and reads from the stream, reconnecting on error. It does
+// not return.
+func (c *StreamClient) Run() {
+	if c.replay != nil {
+		for body := range c.replay {
+			c.handleMessage(body)
+		}
+		return
+	}
+	backoff := c.health.Backoff()
+	for {
+		log.Printf("kucoin: connecting to stream\n")
+		backoff.Attempt()
+		pingInterval, err := c.Connect()
+		if err != nil {
+			c.health.Disconnected(err)
+			delay := backoff.Failure()
+			log.Printf("kucoin: failed to connect to stream, reconnecting in %v: %v\n",
+				delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		log.Printf("kucoin: connected to stream\n")
+		c.health.Connected()
+
+		done := make(chan bool)
+		go c.pingLoop(pingInterval, done)
+		go c.health.Watch(done, c.Close)
+
+		// Reset the backoff on the first message, not on connect.
+		conn := c.getConn()
+		received := false
+		for {
+			_, body, err := conn.ReadMessage()
+			if err != nil {
+				log.Printf("kucoin: stream read error: %v\n", err)
+				c.health.Disconnected(err)
+				break
+			}
+			if !received {
+				backoff.Success()
+				received = true
+			}
+			c.health.Message()
+			c.recorder.Record(RecordSourceStream, body)
+			c.handleMessage(body)
+		}
+
+		close(done)
+		c.Close()
+		delay := backoff.Failure()
+		log.Printf("kucoin: reconnecting to stream in %v\n", delay)
+		time.Sleep(delay)
+	}
+}
+
+func (s *wsSnapshot) toCommonTicker() pkg.CommonTicker {
+	return pkg.CommonTicker{
+		Symbol:           s.Data.Symbol,
+		Timestamp:        time.Unix(0, s.Data.Datetime*int64(time.Millisecond)),
+		LastPrice:        s.Data.LastTradedPrice,
+		QuoteVolume:      s.Data.VolValue,
+		PriceChangePct24: s.Data.ChangeRate * 100,
+		Bid:              s.Data.Buy,
+		Ask:              s.Data.Sell,
+		High:             s.Data.High,
+		Low:              s.Data.Low,
+	}
+}
+
+// toCommonTrade converts a match to a CommonTrade. KuCoin trade IDs are
+// not numeric so the sequence number is used for the trade ID.
+func (m *wsMatch) toCommonTrade() pkg.CommonTrade {
+	return pkg.CommonTrade{
+		Symbol:        m.Symbol,
+		Timestamp:     time.Unix(0, m.Time),
+		Price:         m.Price,
+		Quantity:      m.Size,
+		QuoteQuantity: m.Price * m.Size,
+		Side:          pkg.TradeSide(m.Side),
+		TradeId:       m.Sequence,
+		FirstTradeId:  m.Sequence,
+		LastTradeId:   m.Sequence,
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/websocket"
+)
+
+// kucoinStub serves the bullet, symbols and websocket endpoints, with the
+// responses set by the test, recording the topics subscribed to.
+type kucoinStub struct {
+	server *httptest.Server
+
+	// The code of the bullet response, 200000 if empty.
+	bulletCode string
+
+	// The number of instance servers in the bullet response.
+	servers int
+
+	// The type of the first message sent on connecting.
+	welcome string
+
+	symbols []symbolEntry
+
+	token  string
+	topics []string
+	lock   sync.Mutex
+}
+
+func newKucoinStub() *kucoinStub {
+	stub := &kucoinStub{
+		servers: 1,
+		welcome: "welcome",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/bullet-public", stub.handleBullet)
+	mux.HandleFunc("/api/v1/symbols", func(w http.ResponseWriter, r *http.Request) {
+		writeStubData(w, "200000", stub.symbols)
+	})
+	mux.HandleFunc("/endpoint", stub.handleEndpoint)
+	stub.server = httptest.NewServer(mux)
+	return stub
+}
+
+func writeStubData(w http.ResponseWriter, code string, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"code": code,
+		"msg":  "stub error",
+		"data": data,
+	})
+}
+
+func (s *kucoinStub) handleBullet(w http.ResponseWriter, r *http.Request) {
+	code := s.bulletCode
+	if code == "" {
+		code = "200000"
+	}
+	servers := []map[string]interface{}{}
+	for i := 0; i < s.servers; i++ {
+		servers = append(servers, map[string]interface{}{
+			"endpoint":     "ws" + strings.TrimPrefix(s.server.URL, "http") + "/endpoint",
+			"protocol":     "websocket",
+			"pingInterval": 5000,
+			"pingTimeout":  10000,
+		})
+	}
+	writeStubData(w, code, map[string]interface{}{
+		"token":           "stub-token",
+		"instanceServers": servers,
+	})
+}
+
+func (s *kucoinStub) handleEndpoint(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	s.lock.Lock()
+	s.token = r.URL.Query().Get("token")
+	s.lock.Unlock()
+	conn.WriteJSON(map[string]interface{}{"id": "1", "type": s.welcome})
+	for {
+		var message map[string]interface{}
+		if err := conn.ReadJSON(&message); err != nil {
+			return
+		}
+		if message["type"] == "subscribe" {
+			s.lock.Lock()
+			s.topics = append(s.topics, message["topic"].(string))
+			s.lock.Unlock()
+		}
+	}
+}
+
+func (s *kucoinStub) subscribed() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.topics...)
+}
+
+func waitForTopics(t *testing.T, stub *kucoinStub, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		topics := stub.subscribed()
+		if len(topics) >= count {
+			return topics
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d topics, got %v", count, topics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamClientHandleMessage(t *testing.T) {
+	client := NewStreamClient(pkg.SystemClock{})
+	tickers := []pkg.CommonTicker{}
+	trades := []pkg.CommonTrade{}
+	client.OnTicker = func(ticker pkg.CommonTicker) {
+		tickers = append(tickers, ticker)
+	}
+	client.OnTrade = func(trade pkg.CommonTrade) {
+		trades = append(trades, trade)
+	}
+
+	for _, message := range []string{
+		`{"type":"message","topic":"/market/snapshot:BTC","subject":"trade.snapshot",
+			"data":{"sequence":"1","data":{"symbol":"ETH-BTC","datetime":1500000000123,
+			"lastTradedPrice":0.03,"buy":0.029,"sell":0.031,"high":0.04,"low":0.02,
+			"vol":1000,"volValue":30.5,"changeRate":-0.0125}}}`,
+		`{"type":"message","topic":"/market/match:ETH-BTC,LTC-BTC",
+			"subject":"trade.l3match","data":{"symbol":"ETH-BTC","sequence":"1545896669145",
+			"side":"sell","price":"0.03","size":"2.5","tradeId":"5c24c5da03aa673885cd67aa",
+			"takerOrderId":"a","makerOrderId":"b","time":"1500000000123456789"}}`,
+
+		// Acks, pongs, errors and messages that can't be decoded are
+		// skipped.
+		`{"id":"1","type":"ack"}`,
+		`{"id":"2","type":"pong"}`,
+		`{"id":"3","type":"error","code":401,"data":"token is expired"}`,
+		`{"type":"message","topic":"/market/match:ETH-BTC","data":{"price":1}}`,
+		`{"type":"message","topic":"/market/level2:ETH-BTC","data":{}}`,
+		`not json`,
+	} {
+		client.handleMessage([]byte(message))
+	}
+
+	if len(tickers) != 1 {
+		t.Fatalf("expected 1 ticker, got %+v", tickers)
+	}
+	expectedTicker := pkg.CommonTicker{
+		Symbol:           "ETH-BTC",
+		Timestamp:        time.Unix(1500000000, 123000000),
+		LastPrice:        0.03,
+		QuoteVolume:      30.5,
+		PriceChangePct24: -1.25,
+		Bid:              0.029,
+		Ask:              0.031,
+		High:             0.04,
+		Low:              0.02,
+	}
+	if tickers[0] != expectedTicker {
+		t.Errorf("expected %+v, got %+v", expectedTicker, tickers[0])
+	}
+
+	if len(trades) != 1 {
+		t.Fatalf("expected 1 trade, got %+v", trades)
+	}
+	expectedTrade := pkg.CommonTrade{
+		Symbol:        "ETH-BTC",
+		Timestamp:     time.Unix(1500000000, 123456789),
+		Price:         0.03,
+		Quantity:      2.5,
+		QuoteQuantity: 0.075,
+		Side:          pkg.TradeSideSell,
+		TradeId:       1545896669145,
+		FirstTradeId:  1545896669145,
+		LastTradeId:   1545896669145,
+	}
+	if trades[0] != expectedTrade {
+		t.Errorf("expected %+v, got %+v", expectedTrade, trades[0])
+	}
+}
+
+// TestMatchToCommonTrade checks a match converts to a CommonTrade. The
+// side is the taker's, so is the aggressor side as is, and the time is in
+// nanoseconds.
+func TestMatchToCommonTrade(t *testing.T) {
+	for _, side := range []pkg.TradeSide{pkg.TradeSideBuy, pkg.TradeSideSell} {
+		body := `{"symbol":"LTC-BTC","sequence":"1545896669146","side":"` +
+			string(side) + `","price":"0.008","size":"12.5",` +
+			`"tradeId":"5c24c5da03aa673885cd67ab","time":"1500000000000000001"}`
+		var match wsMatch
+		if err := json.Unmarshal([]byte(body), &match); err != nil {
+			t.Fatal(err)
+		}
+		expected := pkg.CommonTrade{
+			Symbol:        "LTC-BTC",
+			Timestamp:     time.Unix(1500000000, 1),
+			Price:         0.008,
+			Quantity:      12.5,
+			QuoteQuantity: 0.1,
+			Side:          side,
+			TradeId:       1545896669146,
+			FirstTradeId:  1545896669146,
+			LastTradeId:   1545896669146,
+		}
+		trade := match.toCommonTrade()
+		if trade != expected {
+			t.Errorf("%s: expected %+v, got %+v", side, expected, trade)
+		}
+		if trade.IsBuy() != (side == pkg.TradeSideBuy) {
+			t.Errorf("%s: expected IsBuy to match the side", side)
+		}
+	}
+}
+
+func TestStreamClientConnect(t *testing.T) {
+	stub := newKucoinStub()
+	defer stub.server.Close()
+	stub.symbols = []symbolEntry{
+		{Symbol: "ETH-BTC", Market: "BTC", EnableTrading: true},
+		{Symbol: "ETH-USDT", Market: "USDS", EnableTrading: true},
+		{Symbol: "OLD-BTC", Market: "BTC", EnableTrading: false},
+		{Symbol: "OLD-KCS", Market: "KCS", EnableTrading: false},
+	}
+
+	client := NewStreamClient(pkg.SystemClock{})
+	client.RestUrl = stub.server.URL
+	pingInterval, err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if pingInterval != 5*time.Second {
+		t.Errorf("expected a ping interval of 5s, got %v", pingInterval)
+	}
+
+	topics := waitForTopics(t, stub, 3)
+	expected := map[string]bool{
+		"/market/snapshot:BTC":           true,
+		"/market/snapshot:USDS":          true,
+		"/market/match:ETH-BTC,ETH-USDT": true,
+	}
+	for _, topic := range topics {
+		if !expected[topic] {
+			t.Errorf("unexpected topic %s", topic)
+		}
+		delete(expected, topic)
+	}
+	if len(expected) > 0 {
+		t.Errorf("expected the topics %v, got %v", expected, topics)
+	}
+	stub.lock.Lock()
+	if stub.token != "stub-token" {
+		t.Errorf("expected the bullet token to be used, got %q", stub.token)
+	}
+	stub.lock.Unlock()
+	if streams := client.Status().Streams; streams != 3 {
+		t.Errorf("expected 3 streams, got %d", streams)
+	}
+}
+
+func TestStreamClientConnectErrors(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		bulletCode string
+		servers    int
+		welcome    string
+	}{
+		{name: "bullet error", bulletCode: "400100", servers: 1, welcome: "welcome"},
+		{name: "no servers", servers: 0, welcome: "welcome"},
+		{name: "no welcome", servers: 1, welcome: "error"},
+	} {
+		stub := newKucoinStub()
+		stub.bulletCode = test.bulletCode
+		stub.servers = test.servers
+		stub.welcome = test.welcome
+		client := NewStreamClient(pkg.SystemClock{})
+		client.RestUrl = stub.server.URL
+		if _, err := client.Connect(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		client.Close()
+		stub.server.Close()
+	}
+}
+
+func TestStreamClientSubscribeAllSplitsTopics(t *testing.T) {
+	stub := newKucoinStub()
+	defer stub.server.Close()
+	for i := 0; i < 2*maxSymbolsPerTopic+50; i++ {
+		stub.symbols = append(stub.symbols, symbolEntry{
+			Symbol:        fmt.Sprintf("S%03d-BTC", i),
+			Market:        "BTC",
+			EnableTrading: true,
+		})
+	}
+
+	client := NewStreamClient(pkg.SystemClock{})
+	client.RestUrl = stub.server.URL
+	if _, err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	topics := waitForTopics(t, stub, 4)
+	if topics[0] != "/market/snapshot:BTC" {
+		t.Errorf("expected the snapshot topic first, got %s", topics[0])
+	}
+	symbols := []string{}
+	for i, topic := range topics[1:] {
+		if !strings.HasPrefix(topic, "/market/match:") {
+			t.Fatalf("expected a match topic, got %s", topic)
+		}
+		names := strings.Split(strings.TrimPrefix(topic, "/market/match:"), ",")
+		expected := maxSymbolsPerTopic
+		if i == 2 {
+			expected = 50
+		}
+		if len(names) != expected {
+			t.Errorf("topic %d: expected %d symbols, got %d", i, expected, len(names))
+		}
+		symbols = append(symbols, names...)
+	}
+	if len(symbols) != len(stub.symbols) {
+		t.Fatalf("expected %d symbols, got %d", len(stub.symbols), len(symbols))
+	}
+	for i, symbol := range symbols {
+		if symbol != stub.symbols[i].Symbol {
+			t.Errorf("expected %s at %d, got %s", stub.symbols[i].Symbol, i, symbol)
+		}
+	}
+	if streams := client.Status().Streams; streams != 4 {
+		t.Errorf("expected 4 streams, got %d", streams)
+	}
+}
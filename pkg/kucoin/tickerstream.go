@@ -21,75 +21,249 @@ import (
 	"log"
 	"time"
 	"encoding/json"
+	"sync"
 )
 
+// How long the websocket feed can go without a ticker before falling back
+// to polling.
+const streamStaleAfter = time.Second * 10
+
+// The cache entry format for tickers, with the source being websocket or
+// rest. Older entries are the raw response of the legacy REST API.
+type streamCacheEntry struct {
+	Source  string             `json:"source"`
+	Tickers []pkg.CommonTicker `json:"tickers"`
+}
+
+// The data of the all tickers response.
+type restTickers struct {
+	// Milliseconds.
+	Time int64 `json:"time"`
+
+	Ticker []struct {
+		Symbol     string  `json:"symbol"`
+		Buy        float64 `json:"buy,string"`
+		Sell       float64 `json:"sell,string"`
+		ChangeRate float64 `json:"changeRate,string"`
+		High       float64 `json:"high,string"`
+		Low        float64 `json:"low,string"`
+		VolValue   float64 `json:"volValue,string"`
+		Last       float64 `json:"last,string"`
+	} `json:"ticker"`
+}
+
 type TickerStream struct {
-	client *kucoin.Client
-	cache  *pkg.RedisInputCache
+	cache pkg.InputCache
+	clock pkg.Clock
+
+	// The REST API tickers are polled from.
+	RestUrl string
+
+	// How long tickers are kept in the cache.
+	MaxAge time.Duration
+
+	// The websocket feed, started by Run if set.
+	stream *StreamClient
+
+	recorder *pkg.Recorder
+
+	// If set, raw messages are read from here instead of polling.
+	replay chan []byte
+
+	// Tickers received over the websocket since they were last sent on.
+	streamTickers    map[string]pkg.CommonTicker
+	streamLastTicker time.Time
+	streamLock       sync.Mutex
 }
 
-func NewTickerStream() (*TickerStream) {
+func NewTickerStream(clock pkg.Clock, cache pkg.InputCache) (*TickerStream) {
 	return &TickerStream{
-		client: kucoin.NewAnonymousClient(),
-		cache:  pkg.NewRedisInputCache("kucoin.tickers.list"),
+		cache:   cache,
+		clock:   clock,
+		MaxAge:  time.Hour,
+		RestUrl: DefaultRestUrl,
 	}
 }
 
 func (t *TickerStream) GetTickers() ([]pkg.CommonTicker, error) {
-	response, err := t.client.GetTick()
-	if err != nil {
+	var response restTickers
+	if err := restGet(t.RestUrl, "GET", "/api/v1/market/allTickers", &response); err != nil {
 		return nil, err
 	}
-	t.Cache(response)
-	return t.toCommonTicker(response), nil
+	timestamp := time.Unix(0, response.Time*int64(time.Millisecond))
+	tickers := []pkg.CommonTicker{}
+	for _, entry := range response.Ticker {
+		// Markets with no trading have nothing to calculate.
+		if entry.VolValue == 0 || entry.Last == 0 {
+			continue
+		}
+		tickers = append(tickers, pkg.CommonTicker{
+			Symbol:           entry.Symbol,
+			Timestamp:        timestamp,
+			LastPrice:        entry.Last,
+			QuoteVolume:      entry.VolValue,
+			PriceChangePct24: entry.ChangeRate * 100,
+			Bid:              entry.Buy,
+			Ask:              entry.Sell,
+			High:             entry.High,
+			Low:              entry.Low,
+		})
+	}
+	t.cacheTickers("rest", tickers)
+	return tickers, nil
+}
+
+// OnStreamTicker is to be called with each ticker received from the
+// websocket feed.
+func (t *TickerStream) OnStreamTicker(ticker pkg.CommonTicker) {
+	if ticker.QuoteVolume == 0 || ticker.LastPrice == 0 {
+		return
+	}
+	t.streamLock.Lock()
+	defer t.streamLock.Unlock()
+	if t.streamTickers == nil {
+		t.streamTickers = map[string]pkg.CommonTicker{}
+	}
+	t.streamTickers[ticker.Symbol] = ticker
+	t.streamLastTicker = t.clock.Now()
+}
+
+// takeStreamTickers returns the tickers received over the websocket since
+// the last call. False is returned if the websocket feed is stale.
+func (t *TickerStream) takeStreamTickers() ([]pkg.CommonTicker, bool) {
+	t.streamLock.Lock()
+	defer t.streamLock.Unlock()
+	if t.clock.Now().Sub(t.streamLastTicker) > streamStaleAfter {
+		return nil, false
+	}
+	tickers := []pkg.CommonTicker{}
+	for _, ticker := range t.streamTickers {
+		tickers = append(tickers, ticker)
+	}
+	t.streamTickers = map[string]pkg.CommonTicker{}
+	return tickers, true
+}
+
+// Run sends the tickers received over the websocket feed once a second,
+// falling back to polling the REST API while the websocket is stale.
+func (t *TickerStream) Run(channel chan []pkg.CommonTicker) {
+	if t.stream != nil {
+		go t.stream.Run()
+	}
+	if t.replay != nil {
+		t.runReplay(channel)
+		return
+	}
+	polling := false
+	for {
+		tickers, live := t.takeStreamTickers()
+		if live {
+			if polling {
+				log.Printf("kucoin: websocket feed is live, stopped polling\n")
+				polling = false
+			}
+			if len(tickers) > 0 {
+				t.CacheStreamTickers(tickers)
+				channel <- tickers
+			}
+		} else {
+			if !polling {
+				log.Printf("kucoin: websocket feed is stale, polling\n")
+				polling = true
+			}
+			tickers, err := t.GetTickers()
+			if err != nil {
+				log.Printf("error: failed to get kucoin tickers: %v\n", err)
+			} else {
+				channel <- tickers
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// runReplay handles replayed messages as they would be handled if they
+// were sent by Run.
+func (t *TickerStream) runReplay(channel chan []pkg.CommonTicker) {
+	for body := range t.replay {
+		t.cache.RPush(body)
+		t.PruneCache()
+		tickers, err := t.decodeTickers(body)
+		if err != nil {
+			log.Printf("error: failed to decode replayed kucoin tickers: %v\n", err)
+			continue
+		}
+		if len(tickers) > 0 {
+			channel <- tickers
+		}
+	}
 }
 
 func (t *TickerStream) toCommonTicker(tickers *kucoin.TickResponse) []pkg.CommonTicker {
 	common := []pkg.CommonTicker{}
 	for _, entry := range tickers.Entries {
 		ticker := pkg.CommonTickerFromKuCoinTicker(entry)
+
+		// Markets with no trading have nothing to calculate.
+		if ticker.QuoteVolume == 0 || ticker.LastPrice == 0 {
+			continue
+		}
+
 		common = append(common, ticker)
 	}
 	return common
 }
 
-func (t *TickerStream) Cache(tickers *kucoin.TickResponse) {
-	t.cache.RPush([]byte(tickers.Raw))
+func (t *TickerStream) CacheStreamTickers(tickers []pkg.CommonTicker) {
+	t.cacheTickers("websocket", tickers)
+}
 
-	// Trim the list.
-	for {
-		entry, err := t.cache.GetFirst()
-		if err != nil {
-			log.Printf("error: failed to get redis cache entry: %v\n", err)
-			break
-		}
-		if time.Now().Sub(time.Unix(entry.Timestamp, 0)) > time.Hour {
-			t.cache.LRemove()
-		} else {
-			break
-		}
+func (t *TickerStream) cacheTickers(source string, tickers []pkg.CommonTicker) {
+	buf, err := json.Marshal(&streamCacheEntry{
+		Source:  source,
+		Tickers: tickers,
+	})
+	if err != nil {
+		log.Printf("error: failed to encode kucoin tickers: %v\n", err)
+		return
 	}
+	t.cache.RPush(buf)
+	t.recorder.Record(RecordSourceTickers, buf)
+	t.PruneCache()
 }
 
-func (k *TickerStream) ReplayCache(cb func(tickers []pkg.CommonTicker)) {
-	log.Printf("kucoin: cache replay start\n")
-	i := int64(0)
-	for {
-		cacheEntry, err := k.cache.GetN(i)
+func (t *TickerStream) PruneCache() {
+	if err := t.cache.Prune(t.clock.Now().Add(-t.MaxAge)); err != nil {
+		log.Printf("error: kucoin ticker stream: failed to prune cache: %v\n", err)
+	}
+}
+
+func (k *TickerStream) ReplayCache(after time.Time, cb func(tickers []pkg.CommonTicker)) {
+	after = pkg.ReplayStartTime(k.clock, after, k.MaxAge)
+	pkg.ReplayInputCache("kucoin tickers", k.cache, after,
+		pkg.CacheEndTime(k.cache), func(cacheEntry pkg.CacheEntry) {
+		tickers, err := k.decodeTickers([]byte(cacheEntry.Message))
 		if err != nil {
-			log.Printf("error: failed to get redis cache entry %d: %v\n",
-				i, err)
-		}
-		if cacheEntry == nil {
-			break
-		}
-		var response kucoin.TickResponse
-		if err := json.Unmarshal([]byte(cacheEntry.Message), &response); err != nil {
 			log.Printf("error: failed to decode kucoin ticker cache entry: %v\n", err)
-			continue
+			return
+		}
+		cb(tickers)
+	})
+}
+
+// decodeTickers decodes tickers as cached, either a cache entry or the
+// raw response of the legacy REST API.
+func (k *TickerStream) decodeTickers(buf []byte) ([]pkg.CommonTicker, error) {
+	var streamEntry streamCacheEntry
+	if err := json.Unmarshal(buf, &streamEntry); err == nil {
+		if streamEntry.Source != "" {
+			return streamEntry.Tickers, nil
 		}
-		cb(k.toCommonTicker(&response))
-		i += 1
 	}
-	log.Printf("kucoin: cache replay done: ticks: %d\n", i)
+
+	var response kucoin.TickResponse
+	if err := json.Unmarshal(buf, &response); err != nil {
+		return nil, err
+	}
+	return k.toCommonTicker(&response), nil
 }
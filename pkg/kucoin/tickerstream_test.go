@@ -0,0 +1,124 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+func TestTickerStreamGetTickers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/market/allTickers" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`{"code":"200000","data":{"time":1500000000123,
+				"ticker":[
+				{"symbol":"ETH-BTC","buy":"0.029","sell":"0.031",
+					"changeRate":"0.05","high":"0.04","low":"0.02",
+					"volValue":"30.5","last":"0.03"},
+				{"symbol":"DEAD-BTC","buy":"0","sell":"0","changeRate":"0",
+					"high":"0","low":"0","volValue":"0","last":"0.01"}]}}`))
+		}))
+	defer server.Close()
+
+	cache := pkg.NewMemoryInputCache(pkg.SystemClock{})
+	stream := NewTickerStream(pkg.SystemClock{}, cache)
+	stream.RestUrl = server.URL
+	tickers, err := stream.GetTickers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pkg.CommonTicker{
+		Symbol:           "ETH-BTC",
+		Timestamp:        time.Unix(1500000000, 123000000),
+		LastPrice:        0.03,
+		QuoteVolume:      30.5,
+		PriceChangePct24: 5,
+		Bid:              0.029,
+		Ask:              0.031,
+		High:             0.04,
+		Low:              0.02,
+	}
+	if len(tickers) != 1 || tickers[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, tickers)
+	}
+
+	// Cached as a rest entry, decoded back to the same tickers.
+	entry, err := cache.GetN(-1)
+	if err != nil || entry == nil {
+		t.Fatalf("expected a cache entry, got %v", err)
+	}
+	cached, err := stream.decodeTickers([]byte(entry.Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 1 || !cached[0].Timestamp.Equal(expected.Timestamp) ||
+		cached[0].LastPrice != expected.LastPrice {
+		t.Errorf("expected the cached tickers to decode, got %+v", cached)
+	}
+}
+
+// TestTickerStreamSnapshotTickers checks the latest websocket snapshot
+// ticker of each symbol is taken, until the feed goes stale.
+func TestTickerStreamSnapshotTickers(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	stream := NewTickerStream(clock, pkg.NewMemoryInputCache(clock))
+
+	if _, live := stream.takeStreamTickers(); live {
+		t.Fatalf("expected the feed to be stale before any tickers")
+	}
+
+	ticker := func(symbol string, price, volume float64) pkg.CommonTicker {
+		return pkg.CommonTicker{Symbol: symbol, Timestamp: clock.Now(),
+			LastPrice: price, QuoteVolume: volume}
+	}
+	stream.OnStreamTicker(ticker("ETH-BTC", 1, 100))
+	stream.OnStreamTicker(ticker("ETH-BTC", 2, 100))
+	stream.OnStreamTicker(ticker("LTC-BTC", 3, 100))
+	stream.OnStreamTicker(ticker("DEAD-BTC", 1, 0))
+
+	tickers, live := stream.takeStreamTickers()
+	if !live || len(tickers) != 2 {
+		t.Fatalf("expected 2 live tickers, got %v %+v", live, tickers)
+	}
+	for _, ticker := range tickers {
+		if ticker.Symbol == "ETH-BTC" && ticker.LastPrice != 2 {
+			t.Errorf("expected the latest ETH-BTC ticker, got %+v", ticker)
+		}
+	}
+
+	// Taken once only.
+	if tickers, live := stream.takeStreamTickers(); !live || len(tickers) != 0 {
+		t.Errorf("expected no new tickers, got %v %+v", live, tickers)
+	}
+
+	clock.Advance(streamStaleAfter + time.Second)
+	if _, live := stream.takeStreamTickers(); live {
+		t.Errorf("expected the feed to be stale")
+	}
+	stream.OnStreamTicker(ticker("ETH-BTC", 4, 100))
+	if tickers, live := stream.takeStreamTickers(); !live || len(tickers) != 1 {
+		t.Errorf("expected the feed live again, got %v %+v", live, tickers)
+	}
+}
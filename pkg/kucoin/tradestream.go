@@ -0,0 +1,140 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package kucoin
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// TradeStream publishes the trades received from the websocket feed,
+// after first publishing any trades in the cache.
+type TradeStream struct {
+	subscribers map[chan pkg.CommonTrade]bool
+	cache       pkg.InputCache
+	lock        sync.RWMutex
+	clock       pkg.Clock
+	live        chan pkg.CommonTrade
+
+	// How long trades are kept in the cache.
+	MaxAge time.Duration
+}
+
+func NewTradeStream(clock pkg.Clock, cache pkg.InputCache) *TradeStream {
+	return &TradeStream{
+		subscribers: map[chan pkg.CommonTrade]bool{},
+		cache:       cache,
+		clock:       clock,
+		live:        make(chan pkg.CommonTrade),
+		MaxAge:      time.Hour,
+	}
+}
+
+func (s *TradeStream) Subscribe() chan pkg.CommonTrade {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channel := make(chan pkg.CommonTrade)
+	s.subscribers[channel] = true
+	return channel
+}
+
+func (s *TradeStream) Unsubscribe(channel chan pkg.CommonTrade) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.subscribers, channel)
+}
+
+// OnStreamTrade is to be called with each trade received from the
+// websocket feed.
+func (s *TradeStream) OnStreamTrade(trade pkg.CommonTrade) {
+	s.live <- trade
+}
+
+func (s *TradeStream) Publish(trade pkg.CommonTrade) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for subscriber := range s.subscribers {
+		subscriber <- trade
+	}
+}
+
+func (s *TradeStream) restoreFromCache(channel chan *pkg.CommonTrade, after, until time.Time) {
+	after = pkg.ReplayStartTime(s.clock, after, s.MaxAge)
+	pkg.ReplayInputCache("kucoin trades", s.cache, after, until, func(entry pkg.CacheEntry) {
+		var trade pkg.CommonTrade
+		if err := json.Unmarshal([]byte(entry.Message), &trade); err != nil {
+			log.Printf("error: kucoin trades: failed to decode cached trade: %v\n", err)
+			return
+		}
+		if trade.Side == "" {
+			// Cached in the old aggTrade format without a side.
+			return
+		}
+		channel <- &trade
+	})
+	channel <- nil
+}
+
+func (s *TradeStream) Run(after time.Time) {
+	// New trades are cached as they arrive, so only restore what was
+	// cached before starting.
+	cacheChannel := make(chan *pkg.CommonTrade)
+	go s.restoreFromCache(cacheChannel, after, pkg.CacheEndTime(s.cache))
+
+	cacheDone := false
+	tradeQueue := []pkg.CommonTrade{}
+	for {
+		select {
+		case trade := <-cacheChannel:
+			if trade == nil {
+				cacheDone = true
+				for _, trade := range tradeQueue {
+					s.Publish(trade)
+				}
+				tradeQueue = nil
+				continue
+			}
+			s.Publish(*trade)
+		case trade := <-s.live:
+			s.Cache(trade)
+			if !cacheDone {
+				tradeQueue = append(tradeQueue, trade)
+				continue
+			}
+			s.Publish(trade)
+		}
+	}
+}
+
+func (s *TradeStream) Cache(trade pkg.CommonTrade) {
+	buf, err := json.Marshal(&trade)
+	if err != nil {
+		log.Printf("error: kucoin trades: failed to encode trade: %v\n", err)
+		return
+	}
+	s.cache.RPush(buf)
+	s.PruneCache()
+}
+
+func (s *TradeStream) PruneCache() {
+	if err := s.cache.Prune(s.clock.Now().Add(-s.MaxAge)); err != nil {
+		log.Printf("error: kucoin trade stream: failed to prune cache: %v\n", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+// The default distance from the mid price, in percent, depth is measured
+// within.
+const DefaultDepthPercent = 1.0
+
+type PriceLevel struct {
+	Price    float64
+	Quantity float64
+}
+
+// OrderBook is a local copy of an exchange's order book, the quantity at
+// each price level. It is not safe for concurrent use.
+type OrderBook struct {
+	Bids map[float64]float64
+	Asks map[float64]float64
+}
+
+func NewOrderBook() *OrderBook {
+	return &OrderBook{
+		Bids: map[float64]float64{},
+		Asks: map[float64]float64{},
+	}
+}
+
+// Update sets the quantity at each level, removing levels with a quantity
+// of 0.
+func (b *OrderBook) Update(bids []PriceLevel, asks []PriceLevel) {
+	updateLevels(b.Bids, bids)
+	updateLevels(b.Asks, asks)
+}
+
+func updateLevels(side map[float64]float64, levels []PriceLevel) {
+	for _, level := range levels {
+		if level.Quantity == 0 {
+			delete(side, level.Price)
+		} else {
+			side[level.Price] = level.Quantity
+		}
+	}
+}
+
+// BestBid returns the highest bid, false if there are no bids.
+func (b *OrderBook) BestBid() (float64, bool) {
+	best := 0.0
+	for price := range b.Bids {
+		if price > best {
+			best = price
+		}
+	}
+	return best, len(b.Bids) > 0
+}
+
+// BestAsk returns the lowest ask, false if there are no asks.
+func (b *OrderBook) BestAsk() (float64, bool) {
+	best := 0.0
+	for price := range b.Asks {
+		if best == 0 || price < best {
+			best = price
+		}
+	}
+	return best, len(b.Asks) > 0
+}
+
+// DepthMetrics describe the liquidity of an order book.
+type DepthMetrics struct {
+	Symbol    string
+	Timestamp time.Time
+
+	// The quote volume of the bids and asks within the depth percent of
+	// the mid price.
+	BidDepth float64
+	AskDepth float64
+
+	// The spread relative to the mid price, in basis points.
+	SpreadBps float64
+
+	// (BidDepth - AskDepth) / (BidDepth + AskDepth), from -1 with only
+	// asks to 1 with only bids.
+	Imbalance float64
+
+	// Set, with no metrics, when the book is no longer synced, so the
+	// last metrics are not reported as live.
+	Unsynced bool
+}
+
+// Metrics calculates the depth metrics with depth measured within percent
+// of the mid price. False is returned if either side of the book is empty.
+func (b *OrderBook) Metrics(percent float64) (DepthMetrics, bool) {
+	metrics := DepthMetrics{}
+	bid, ok := b.BestBid()
+	if !ok {
+		return metrics, false
+	}
+	ask, ok := b.BestAsk()
+	if !ok {
+		return metrics, false
+	}
+	mid := (bid + ask) / 2
+	metrics.SpreadBps = (ask - bid) / mid * 10000
+
+	low := mid * (1 - percent/100)
+	for price, quantity := range b.Bids {
+		if price >= low {
+			metrics.BidDepth += price * quantity
+		}
+	}
+	high := mid * (1 + percent/100)
+	for price, quantity := range b.Asks {
+		if price <= high {
+			metrics.AskDepth += price * quantity
+		}
+	}
+	if total := metrics.BidDepth + metrics.AskDepth; total > 0 {
+		metrics.Imbalance = (metrics.BidDepth - metrics.AskDepth) / total
+	}
+
+	return metrics, true
+}
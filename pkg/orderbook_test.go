@@ -0,0 +1,109 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOrderBookUpdate(t *testing.T) {
+	book := NewOrderBook()
+	if _, ok := book.BestBid(); ok {
+		t.Fatalf("expected no best bid in an empty book")
+	}
+	if _, ok := book.BestAsk(); ok {
+		t.Fatalf("expected no best ask in an empty book")
+	}
+
+	book.Update(
+		[]PriceLevel{{Price: 0.9, Quantity: 1}, {Price: 0.95, Quantity: 2}},
+		[]PriceLevel{{Price: 1.1, Quantity: 3}, {Price: 1.05, Quantity: 4}})
+	if bid, _ := book.BestBid(); bid != 0.95 {
+		t.Errorf("expected a best bid of 0.95, got %v", bid)
+	}
+	if ask, _ := book.BestAsk(); ask != 1.05 {
+		t.Errorf("expected a best ask of 1.05, got %v", ask)
+	}
+
+	// A diff replaces the quantity of a level, and 0 removes it.
+	book.Update(
+		[]PriceLevel{{Price: 0.9, Quantity: 5}, {Price: 0.95, Quantity: 0}},
+		[]PriceLevel{{Price: 1.05, Quantity: 0}, {Price: 1.2, Quantity: 0}})
+	if len(book.Bids) != 1 || book.Bids[0.9] != 5 {
+		t.Errorf("expected only the bid at 0.9 of 5, got %v", book.Bids)
+	}
+	if len(book.Asks) != 1 || book.Asks[1.1] != 3 {
+		t.Errorf("expected only the ask at 1.1 of 3, got %v", book.Asks)
+	}
+	if bid, _ := book.BestBid(); bid != 0.9 {
+		t.Errorf("expected a best bid of 0.9, got %v", bid)
+	}
+	if ask, _ := book.BestAsk(); ask != 1.1 {
+		t.Errorf("expected a best ask of 1.1, got %v", ask)
+	}
+}
+
+func TestOrderBookMetrics(t *testing.T) {
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-9
+	}
+
+	book := NewOrderBook()
+	book.Update([]PriceLevel{{Price: 0.95, Quantity: 10}}, nil)
+	if _, ok := book.Metrics(10); ok {
+		t.Fatalf("expected no metrics without asks")
+	}
+	book = NewOrderBook()
+	book.Update(nil, []PriceLevel{{Price: 1.05, Quantity: 10}})
+	if _, ok := book.Metrics(10); ok {
+		t.Fatalf("expected no metrics without bids")
+	}
+
+	// The mid price is 1, so 10% takes in 0.9 to 1.1 inclusive.
+	book.Update(
+		[]PriceLevel{
+			{Price: 0.95, Quantity: 10},
+			{Price: 0.9, Quantity: 10},
+			{Price: 0.85, Quantity: 10},
+		},
+		[]PriceLevel{
+			{Price: 1.1, Quantity: 10},
+			{Price: 1.15, Quantity: 10},
+		})
+	metrics, ok := book.Metrics(10)
+	if !ok {
+		t.Fatalf("expected metrics")
+	}
+	if !near(metrics.BidDepth, 9.5+9) {
+		t.Errorf("expected a bid depth of 18.5, got %v", metrics.BidDepth)
+	}
+	if !near(metrics.AskDepth, 10.5+11) {
+		t.Errorf("expected an ask depth of 21.5, got %v", metrics.AskDepth)
+	}
+	if !near(metrics.SpreadBps, 1000) {
+		t.Errorf("expected a spread of 1000 bps, got %v", metrics.SpreadBps)
+	}
+	if !near(metrics.Imbalance, (18.5-21.5)/40) {
+		t.Errorf("expected an imbalance of -0.075, got %v", metrics.Imbalance)
+	}
+
+	// Only the best levels within a narrow percent.
+	metrics, _ = book.Metrics(5)
+	if !near(metrics.BidDepth, 9.5) || !near(metrics.AskDepth, 10.5) {
+		t.Errorf("expected only the best levels, got %+v", metrics)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The suffix of recording files.
+const RecordingSuffix = ".ndjson.gz"
+
+// How long a recording file is written to before starting a new one.
+const recordingRotateInterval = time.Hour
+
+// How often buffered recorded messages are flushed to the file.
+const recordingFlushInterval = time.Second
+
+// RecordedMessage is a line of a recording file.
+type RecordedMessage struct {
+	// Unix microseconds.
+	TimeMicros int64 `json:"time_us"`
+
+	// The feed the message was received on, eg. binance.tickers.
+	Source string `json:"source"`
+
+	// The raw message as received.
+	Message string `json:"message"`
+}
+
+func (m *RecordedMessage) Time() time.Time {
+	return time.Unix(0, m.TimeMicros*int64(time.Microsecond))
+}
+
+// Recorder writes raw exchange messages to gzip compressed newline
+// delimited JSON files in a directory, starting a new file every hour.
+// Files are named by the time they were started so sort in time order.
+type Recorder struct {
+	dir   string
+	clock Clock
+
+	file      *os.File
+	writer    *gzip.Writer
+	fileStart time.Time
+	dirty     bool
+	done      chan bool
+	lock      sync.Mutex
+}
+
+func NewRecorder(dir string, clock Clock) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	recorder := &Recorder{
+		dir:   dir,
+		clock: clock,
+		done:  make(chan bool),
+	}
+	go recorder.flushLoop()
+	return recorder, nil
+}
+
+// Record writes a message received on source. A nil recorder records
+// nothing.
+func (r *Recorder) Record(source string, message []byte) {
+	if r == nil {
+		return
+	}
+	now := r.clock.Now()
+	buf, err := json.Marshal(&RecordedMessage{
+		TimeMicros: timeToMicros(now),
+		Source:     source,
+		Message:    string(message),
+	})
+	if err != nil {
+		log.Printf("error: recorder: failed to encode message: %v\n", err)
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.writer == nil || now.Sub(r.fileStart) >= recordingRotateInterval {
+		if err := r.rotate(now); err != nil {
+			log.Printf("error: recorder: failed to open file: %v\n", err)
+			return
+		}
+	}
+	if _, err := r.writer.Write(append(buf, '\n')); err != nil {
+		log.Printf("error: recorder: failed to write message: %v\n", err)
+		return
+	}
+	r.dirty = true
+}
+
+// rotate closes the current file and opens a new one. The lock must be
+// held.
+func (r *Recorder) rotate(now time.Time) error {
+	r.closeFile()
+	filename := filepath.Join(r.dir,
+		now.UTC().Format("20060102-150405")+RecordingSuffix)
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("recorder: recording to %s\n", filename)
+	r.file = file
+	r.writer = gzip.NewWriter(file)
+	r.fileStart = now
+	return nil
+}
+
+// closeFile closes the current file, if any. The lock must be held.
+func (r *Recorder) closeFile() {
+	if r.writer == nil {
+		return
+	}
+	if err := r.writer.Close(); err != nil {
+		log.Printf("error: recorder: failed to close file: %v\n", err)
+	}
+	r.file.Close()
+	r.writer = nil
+	r.file = nil
+}
+
+// flushLoop flushes the compressed data so a recording is readable up to
+// the last second or so if the process exits without closing it.
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(recordingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.lock.Lock()
+			if r.writer != nil && r.dirty {
+				if err := r.writer.Flush(); err != nil {
+					log.Printf("error: recorder: failed to flush: %v\n", err)
+				}
+				r.dirty = false
+			}
+			r.lock.Unlock()
+		}
+	}
+}
+
+func (r *Recorder) Close() {
+	close(r.done)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeFile()
+}
+
+// ParseReplaySpeed parses a replay speed multiplier such as 1, 10 or 10x.
+// "max" replays as fast as possible and is returned as 0.
+func ParseReplaySpeed(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed: %s", value)
+	}
+	return speed, nil
+}
+
+// Player replays recording files, delivering each message to the
+// subscribers of its source with the same timing as it was recorded,
+// scaled by the speed. The clock is set to the time of each message as it
+// is delivered.
+type Player struct {
+	Clock *ManualClock
+
+	// The speed multiplier, 0 to replay as fast as possible.
+	Speed float64
+
+	files       []string
+	subscribers map[string]chan []byte
+}
+
+// NewPlayer creates a player for the given recording files, and
+// directories of recording files.
+func NewPlayer(paths []string, speed float64) (*Player, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), RecordingSuffix) {
+				names = append(names, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(names)
+		files = append(files, names...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recording files found")
+	}
+
+	player := &Player{
+		Speed:       speed,
+		files:       files,
+		subscribers: map[string]chan []byte{},
+	}
+
+	// Start the clock at the time of the first message, so anything
+	// created before the replay starts has a time within the recording.
+	start := time.Time{}
+	err := readRecording(files[0], func(message *RecordedMessage) bool {
+		start = message.Time()
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if start.IsZero() {
+		return nil, fmt.Errorf("%s: no messages", files[0])
+	}
+	player.Clock = NewManualClock(start)
+
+	return player, nil
+}
+
+// Subscribe returns the channel messages from source are sent on. It must
+// be called before Run.
+func (p *Player) Subscribe(source string) chan []byte {
+	if p.subscribers[source] == nil {
+		p.subscribers[source] = make(chan []byte)
+	}
+	return p.subscribers[source]
+}
+
+// Run replays the files in order, returning once all messages have been
+// delivered.
+func (p *Player) Run() {
+	startTime := time.Now()
+	first := p.Clock.Now()
+	count := 0
+	for _, filename := range p.files {
+		log.Printf("replay: playing %s\n", filename)
+		err := readRecording(filename, func(message *RecordedMessage) bool {
+			channel := p.subscribers[message.Source]
+			if channel == nil {
+				return true
+			}
+			messageTime := message.Time()
+			if p.Speed > 0 {
+				offset := float64(messageTime.Sub(first)) / p.Speed
+				if wait := time.Until(startTime.Add(time.Duration(offset))); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			if messageTime.After(p.Clock.Now()) {
+				p.Clock.Set(messageTime)
+			}
+			channel <- []byte(message.Message)
+			count++
+			return true
+		})
+		if err != nil {
+			log.Printf("error: replay: %s: %v\n", filename, err)
+		}
+	}
+	log.Printf("replay: finished, replayed %d messages in %v\n",
+		count, time.Since(startTime))
+}
+
+// readRecording calls cb with each message in a recording file until cb
+// returns false. A file truncated by the recorder not being closed is
+// read up to the truncation.
+func readRecording(filename string, cb func(message *RecordedMessage) bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	reader := bufio.NewReader(gz)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if err == io.ErrUnexpectedEOF {
+				log.Printf("warning: replay: %s is truncated\n", filename)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var message RecordedMessage
+		if err := json.Unmarshal(line, &message); err != nil {
+			log.Printf("error: replay: %s: skipping bad line: %v\n", filename, err)
+			continue
+		}
+		if !cb(&message) {
+			return nil
+		}
+	}
+}
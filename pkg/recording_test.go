@@ -0,0 +1,153 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testRecording struct {
+	offset  time.Duration
+	source  string
+	message string
+}
+
+func TestRecordingRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1500000000, 0)
+	clock := NewManualClock(start)
+	recorder, err := NewRecorder(dir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := []testRecording{
+		{0, "tickers", "ticker 1"},
+		{time.Millisecond, "trades", "trade 1"},
+		{time.Second, "ignored", "ignored 1"},
+		{time.Second, "trades", "trade 2"},
+		{time.Minute, "tickers", "ticker 2"},
+		// In a second file.
+		{time.Hour + time.Minute, "trades", "trade 3"},
+		{time.Hour + 2*time.Minute, "tickers", "ticker 3"},
+	}
+	for _, message := range recorded {
+		clock.Set(start.Add(message.offset))
+		recorder.Record(message.source, []byte(message.message))
+	}
+	recorder.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+RecordingSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 recording files, got %v", files)
+	}
+
+	expected := []testRecording{}
+	for _, message := range recorded {
+		if message.source != "ignored" {
+			expected = append(expected, message)
+		}
+	}
+	replayRecording(t, dir, 0, start, expected)
+
+	// The last message is an hour and 2 minutes in, so takes over 372ms
+	// at 10000x.
+	replayStart := time.Now()
+	replayRecording(t, dir, 10000, start, expected)
+	if elapsed := time.Since(replayStart); elapsed < 372*time.Millisecond {
+		t.Errorf("expected the replay to take at least 372ms, took %v", elapsed)
+	}
+}
+
+// replayRecording replays the recordings in dir, checking the messages
+// are delivered in the expected order with the clock advanced to each.
+func replayRecording(t *testing.T, dir string, speed float64, start time.Time,
+	expected []testRecording) {
+	t.Helper()
+	player, err := NewPlayer([]string{dir}, speed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !player.Clock.Now().Equal(start) {
+		t.Fatalf("expected the clock to start at %v, got %v",
+			start, player.Clock.Now())
+	}
+	tickers := player.Subscribe("tickers")
+	trades := player.Subscribe("trades")
+	done := make(chan bool)
+	go func() {
+		player.Run()
+		close(done)
+	}()
+
+	received := []string{}
+	check := func(source string, body []byte) {
+		i := len(received)
+		received = append(received, source+" "+string(body))
+		if i >= len(expected) {
+			return
+		}
+
+		// The clock is set before each message is delivered, so may
+		// already be at the time of the next.
+		now := player.Clock.Now().Sub(start)
+		until := expected[i].offset
+		if i+1 < len(expected) {
+			until = expected[i+1].offset
+		}
+		if now < expected[i].offset || now > until {
+			t.Errorf("%s: expected the clock at +%v, got +%v",
+				body, expected[i].offset, now)
+		}
+	}
+	for {
+		select {
+		case body := <-tickers:
+			check("tickers", body)
+			continue
+		case body := <-trades:
+			check("trades", body)
+			continue
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out replaying, got %v", received)
+		}
+		break
+	}
+
+	want := []string{}
+	for _, message := range expected {
+		want = append(want, message.source+" "+message.message)
+	}
+	if fmt.Sprint(received) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, received)
+	}
+	if now := player.Clock.Now().Sub(start); now != expected[len(expected)-1].offset {
+		t.Errorf("expected the clock to end at the last message, got +%v", now)
+	}
+}
@@ -17,70 +17,232 @@ package pkg
 
 import (
 	"github.com/go-redis/redis"
-	"time"
 	"encoding/json"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"time"
 )
 
-type RedisCacheEntry struct {
-	Timestamp int64  `json:"timestamp"`
-	Message   string `json:"message"`
+const DefaultRedisAddress = "localhost:6379"
+
+type RedisOptions struct {
+	Address  string
+	Password string
+	DB       int
+
+	TLS bool
+
+	// Skip verification of the server certificate when using TLS.
+	TLSInsecure bool
+
+	// Prepended to every key, so instances sharing a Redis server don't
+	// clobber each other's caches.
+	KeyPrefix string
+
+	// Zero values use the go-redis defaults.
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
-func DecodeRedisCacheEntry(buf string) (RedisCacheEntry, error) {
-	var cacheEntry RedisCacheEntry
-	err := json.Unmarshal([]byte(buf), &cacheEntry)
-	return cacheEntry, err
+// Caches with the same options share a client and its connection pool.
+var redisClients = map[RedisOptions]*redis.Client{}
+var redisClientsLock sync.Mutex
+
+func getRedisClient(options RedisOptions) *redis.Client {
+	redisClientsLock.Lock()
+	defer redisClientsLock.Unlock()
+	if client := redisClients[options]; client != nil {
+		return client
+	}
+
+	clientOptions := &redis.Options{
+		Addr:         options.Address,
+		Password:     options.Password,
+		DB:           options.DB,
+		PoolSize:     options.PoolSize,
+		DialTimeout:  options.DialTimeout,
+		ReadTimeout:  options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+	}
+	if clientOptions.Addr == "" {
+		clientOptions.Addr = DefaultRedisAddress
+	}
+	if options.TLS {
+		clientOptions.TLSConfig = &tls.Config{
+			InsecureSkipVerify: options.TLSInsecure,
+		}
+	}
+
+	client := redis.NewClient(clientOptions)
+	redisClients[options] = client
+	return client
 }
 
+// RedisInputCache keeps the entries in a sorted set scored by the entry
+// time in microseconds, so pruning and reading by time are single
+// commands.
 type RedisInputCache struct {
-	client *redis.Client
-	key    string
+	client  *redis.Client
+	key     string
+	encoder cacheEntryEncoder
+	lock    sync.Mutex
+
+	// The list older versions kept the entries in.
+	listKey string
 }
 
-func NewRedisInputCache(key string) *RedisInputCache {
+// The suffix of the sorted set key. The key without the suffix is the list
+// used by older versions, moved to the sorted set by Migrate.
+const redisSortedSetSuffix = ".zset"
+
+// How often progress is logged while migrating a list.
+const redisMigrateLogInterval = 100000
+
+func NewRedisInputCache(options RedisOptions, key string, clock Clock) *RedisInputCache {
 	cache := RedisInputCache{}
-	cache.client = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379",
-	})
-	cache.key = key
+	cache.client = getRedisClient(options)
+	cache.key = options.KeyPrefix + key + redisSortedSetSuffix
+	cache.listKey = options.KeyPrefix + key
+	cache.encoder = cacheEntryEncoder{clock: clock}
 	return &cache
 }
 
+// Migrate moves the entries of the list used by older versions into the
+// sorted set, then deletes the list. It does nothing if there is no list.
+// The list entries only have a time to the second, so they are given
+// increasing times within each second to keep them in order.
+//
+// It must be called before the cache is used. If interrupted the entries
+// already moved are moved again, replacing themselves.
+func (c *RedisInputCache) Migrate() error {
+	key := c.listKey
+	keyType, err := c.client.Type(key).Result()
+	if err != nil {
+		return err
+	}
+	if keyType != "list" {
+		return nil
+	}
+
+	length, err := c.client.LLen(key).Result()
+	if err != nil {
+		return err
+	}
+	log.Printf("redis: migrating %d entries from list %s to %s\n",
+		length, key, c.key)
+
+	last := int64(0)
+	logAt := int64(redisMigrateLogInterval)
+	for start := int64(0); start < length; start += ReplayBatchSize {
+		if start >= logAt {
+			log.Printf("redis: migrated %d of %d entries from list %s\n",
+				start, length, key)
+			logAt += redisMigrateLogInterval
+		}
+		elements, err := c.client.LRange(key, start, start+ReplayBatchSize-1).Result()
+		if err != nil {
+			return err
+		}
+		members := make([]redis.Z, 0, len(elements))
+		for _, element := range elements {
+			entry, err := DecodeCacheEntry(element)
+			if err != nil {
+				log.Printf("error: redis: skipping bad list entry: %v\n", err)
+				continue
+			}
+			micros := entry.Micros()
+			if micros <= last {
+				micros = last + 1
+			}
+			last = micros
+			entry.TimeMicros = micros
+			encoded, err := json.Marshal(&entry)
+			if err != nil {
+				return err
+			}
+			members = append(members, redis.Z{
+				Score:  float64(micros),
+				Member: encoded,
+			})
+		}
+		if len(members) > 0 {
+			if err := c.client.ZAdd(c.key, members...).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.lock.Lock()
+	if last > c.encoder.last {
+		c.encoder.last = last
+	}
+	c.lock.Unlock()
+
+	if err := c.client.Del(key).Err(); err != nil {
+		return err
+	}
+	log.Printf("redis: migrated %d entries from list %s\n", length, key)
+	return nil
+}
+
 func (c *RedisInputCache) RPush(buf []byte) {
-	entry := RedisCacheEntry{
-		Timestamp: time.Now().Unix(),
-		Message:   string(buf),
+	c.lock.Lock()
+	encoded, micros := c.encoder.encode(buf)
+	c.lock.Unlock()
+	err := c.client.ZAdd(c.key, redis.Z{
+		Score:  float64(micros),
+		Member: encoded,
+	}).Err()
+	if err != nil {
+		log.Printf("error: redis: failed to add to %s: %v\n", c.key, err)
 	}
-	encoded, _ := json.Marshal(&entry)
-	c.client.RPush(c.key, encoded)
 }
 
 func (c *RedisInputCache) LRange(start, stop int64) ([]string, error) {
-	return c.client.LRange(c.key, start, stop).Result()
+	return c.client.ZRange(c.key, start, stop).Result()
 }
 
-func (c *RedisInputCache) GetFirst() (*RedisCacheEntry, error) {
+func (c *RedisInputCache) GetFirst() (*CacheEntry, error) {
 	return c.GetN(0)
 }
 
-func (c *RedisInputCache) GetN(n int64) (*RedisCacheEntry, error) {
-	var cacheEntry RedisCacheEntry
-	elements, err := c.LRange(n, n)
-	if err != nil {
-		return nil, err
-	}
-	if len(elements) == 0 {
-		return nil, nil
-	}
-	cacheEntry, err = DecodeRedisCacheEntry(elements[0])
-	return &cacheEntry, err
+func (c *RedisInputCache) GetN(n int64) (*CacheEntry, error) {
+	return getCacheEntry(c, n)
 }
 
 func (c *RedisInputCache) Len() (int64, error) {
-	return c.client.LLen(c.key).Result()
+	return c.client.ZCard(c.key).Result()
 }
 
-// Like LPop, but ignores the result.
 func (c *RedisInputCache) LRemove() {
-	c.client.LPop(c.key).Err()
+	c.client.ZRemRangeByRank(c.key, 0, 0).Err()
+}
+
+func (c *RedisInputCache) Prune(before time.Time) error {
+	max := fmt.Sprintf("(%d", timeToMicros(before))
+	return c.client.ZRemRangeByScore(c.key, "-inf", max).Err()
+}
+
+func (c *RedisInputCache) Range(after, until time.Time, count int64) ([]CacheEntry, error) {
+	elements, err := c.client.ZRangeByScore(c.key, redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", timeToMicros(after)),
+		Max:   fmt.Sprintf("%d", timeToMicros(until)),
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CacheEntry, 0, len(elements))
+	for _, element := range elements {
+		entry, err := DecodeCacheEntry(element)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
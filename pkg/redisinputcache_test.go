@@ -0,0 +1,485 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests run against the Redis server at REDIS_TEST_ADDRESS if set,
+// otherwise against fakeRedis. Keys are prefixed with a unique prefix and
+// deleted afterwards.
+func testRedisOptions(t *testing.T) (RedisOptions, func()) {
+	options := RedisOptions{
+		KeyPrefix: fmt.Sprintf("cryptoxscanner-test-%d:", time.Now().UnixNano()),
+	}
+	if address := os.Getenv("REDIS_TEST_ADDRESS"); address != "" {
+		options.Address = address
+		return options, func() {
+			client := getRedisClient(options)
+			keys, _ := client.Keys(options.KeyPrefix + "*").Result()
+			if len(keys) > 0 {
+				client.Del(keys...)
+			}
+		}
+	}
+	server, err := newFakeRedis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Address = server.Addr()
+	return options, func() { server.Close() }
+}
+
+// fakeRedis implements the Redis commands used by RedisInputCache, enough
+// to test it without a server.
+type fakeRedis struct {
+	listener net.Listener
+	lists    map[string][]string
+	zsets    map[string]map[string]float64
+	lock     sync.Mutex
+}
+
+func newFakeRedis() (*fakeRedis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &fakeRedis{
+		listener: listener,
+		lists:    map[string][]string{},
+		zsets:    map[string]map[string]float64{},
+	}
+	go server.serve()
+	return server, nil
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		reply := s.execute(strings.ToLower(args[0]), args[1:])
+		s.lock.Unlock()
+		writeResp(writer, reply)
+		if err := writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readRespCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+type respStatus string
+type respError string
+
+func writeResp(writer *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case respStatus:
+		fmt.Fprintf(writer, "+%s\r\n", reply)
+	case respError:
+		fmt.Fprintf(writer, "-%s\r\n", reply)
+	case int:
+		fmt.Fprintf(writer, ":%d\r\n", reply)
+	case string:
+		fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(reply), reply)
+	case []string:
+		fmt.Fprintf(writer, "*%d\r\n", len(reply))
+		for _, element := range reply {
+			writeResp(writer, element)
+		}
+	}
+}
+
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+// sorted returns the members of a sorted set ordered by score, then
+// member, as Redis orders them.
+func (s *fakeRedis) sorted(key string) []zsetMember {
+	members := []zsetMember{}
+	for member, score := range s.zsets[key] {
+		members = append(members, zsetMember{member, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+	return members
+}
+
+// parseScoreBound parses a ZRANGEBYSCORE bound such as -inf, (5 or 5.
+func parseScoreBound(bound string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(bound, "(")
+	bound = strings.TrimPrefix(bound, "(")
+	switch bound {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	}
+	value, err := strconv.ParseFloat(bound, 64)
+	return value, exclusive, err
+}
+
+func (s *fakeRedis) byScore(key, min, max string) ([]zsetMember, error) {
+	minValue, minExclusive, err := parseScoreBound(min)
+	if err != nil {
+		return nil, err
+	}
+	maxValue, maxExclusive, err := parseScoreBound(max)
+	if err != nil {
+		return nil, err
+	}
+	members := []zsetMember{}
+	for _, member := range s.sorted(key) {
+		if member.score < minValue || (minExclusive && member.score == minValue) {
+			continue
+		}
+		if member.score > maxValue || (maxExclusive && member.score == maxValue) {
+			continue
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *fakeRedis) execute(command string, args []string) interface{} {
+	switch command {
+	case "ping":
+		return respStatus("PONG")
+	case "type":
+		if _, ok := s.lists[args[0]]; ok {
+			return respStatus("list")
+		}
+		if _, ok := s.zsets[args[0]]; ok {
+			return respStatus("zset")
+		}
+		return respStatus("none")
+	case "del":
+		n := 0
+		for _, key := range args {
+			if _, ok := s.lists[key]; ok {
+				n++
+			}
+			if _, ok := s.zsets[key]; ok {
+				n++
+			}
+			delete(s.lists, key)
+			delete(s.zsets, key)
+		}
+		return n
+	case "rpush":
+		s.lists[args[0]] = append(s.lists[args[0]], args[1:]...)
+		return len(s.lists[args[0]])
+	case "llen":
+		return len(s.lists[args[0]])
+	case "lrange":
+		start, _ := strconv.ParseInt(args[1], 10, 64)
+		stop, _ := strconv.ParseInt(args[2], 10, 64)
+		list := s.lists[args[0]]
+		start, end, ok := rangeBounds(start, stop, int64(len(list)))
+		if !ok {
+			return []string{}
+		}
+		return list[start:end]
+	case "zadd":
+		if s.zsets[args[0]] == nil {
+			s.zsets[args[0]] = map[string]float64{}
+		}
+		added := 0
+		for i := 1; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return respError("ERR value is not a valid float")
+			}
+			if _, ok := s.zsets[args[0]][args[i+1]]; !ok {
+				added++
+			}
+			s.zsets[args[0]][args[i+1]] = score
+		}
+		return added
+	case "zcard":
+		return len(s.zsets[args[0]])
+	case "zrange", "zremrangebyrank":
+		start, _ := strconv.ParseInt(args[1], 10, 64)
+		stop, _ := strconv.ParseInt(args[2], 10, 64)
+		members := s.sorted(args[0])
+		start, end, ok := rangeBounds(start, stop, int64(len(members)))
+		if !ok {
+			if command == "zrange" {
+				return []string{}
+			}
+			return 0
+		}
+		if command == "zremrangebyrank" {
+			for _, member := range members[start:end] {
+				delete(s.zsets[args[0]], member.member)
+			}
+			return int(end - start)
+		}
+		elements := []string{}
+		for _, member := range members[start:end] {
+			elements = append(elements, member.member)
+		}
+		return elements
+	case "zrangebyscore":
+		members, err := s.byScore(args[0], args[1], args[2])
+		if err != nil {
+			return respError("ERR min or max is not a float")
+		}
+		if len(args) == 6 && strings.ToLower(args[3]) == "limit" {
+			offset, _ := strconv.Atoi(args[4])
+			count, _ := strconv.Atoi(args[5])
+			if offset > len(members) {
+				offset = len(members)
+			}
+			members = members[offset:]
+			if count >= 0 && count < len(members) {
+				members = members[:count]
+			}
+		}
+		elements := []string{}
+		for _, member := range members {
+			elements = append(elements, member.member)
+		}
+		return elements
+	case "zremrangebyscore":
+		members, err := s.byScore(args[0], args[1], args[2])
+		if err != nil {
+			return respError("ERR min or max is not a float")
+		}
+		for _, member := range members {
+			delete(s.zsets[args[0]], member.member)
+		}
+		return len(members)
+	}
+	return respError(fmt.Sprintf("ERR unknown command '%s'", command))
+}
+
+func TestRedisInputCacheMigrate(t *testing.T) {
+	options, cleanup := testRedisOptions(t)
+	defer cleanup()
+	client := getRedisClient(options)
+
+	// An older version's list, with several entries in the same second.
+	start := time.Unix(1500000000, 0)
+	listKey := options.KeyPrefix + "binance"
+	count := int(ReplayBatchSize) + 10
+	for i := 0; i < count; i++ {
+		buf, _ := json.Marshal(&CacheEntry{
+			Timestamp: start.Unix() + int64(i/3),
+			Message:   fmt.Sprintf("message %d", i),
+		})
+		if err := client.RPush(listKey, buf).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock := NewManualClock(start)
+	cache := NewRedisInputCache(options, "binance", clock)
+	if length, _ := cache.Len(); length != 0 {
+		t.Fatalf("expected nothing migrated before Migrate, got %d entries", length)
+	}
+
+	if err := cache.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if keyType, _ := client.Type(listKey).Result(); keyType != "none" {
+		t.Errorf("expected the list to be deleted, it is a %s", keyType)
+	}
+	if length, _ := cache.Len(); length != int64(count) {
+		t.Fatalf("expected %d entries, got %d", count, length)
+	}
+
+	entries, err := cache.Range(time.Time{}, start.Add(time.Hour), int64(count))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := int64(0)
+	for i, entry := range entries {
+		if entry.Message != fmt.Sprintf("message %d", i) {
+			t.Fatalf("entry %d out of order: %s", i, entry.Message)
+		}
+		if entry.Micros() <= last {
+			t.Fatalf("entry %d time %d not after %d", i, entry.Micros(), last)
+		}
+		last = entry.Micros()
+	}
+
+	// New entries follow the migrated ones though the clock hasn't moved.
+	cache.RPush([]byte("new"))
+	entry, err := cache.GetN(-1)
+	if err != nil || entry == nil || entry.Message != "new" || entry.Micros() <= last {
+		t.Fatalf("expected the new entry last, got %+v, %v", entry, err)
+	}
+
+	// Migrating again does nothing.
+	if err := cache.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := cache.Len(); length != int64(count+1) {
+		t.Errorf("expected %d entries, got %d", count+1, length)
+	}
+}
+
+func TestRedisInputCacheReplay(t *testing.T) {
+	options, cleanup := testRedisOptions(t)
+	defer cleanup()
+
+	start := time.Unix(1500000000, 0)
+	clock := NewManualClock(start)
+	cache := NewRedisInputCache(options, "binance.trades", clock)
+	for i := 0; i < 10; i++ {
+		clock.Set(start.Add(time.Duration(i) * time.Second))
+		cache.RPush([]byte(fmt.Sprintf("message %d", i)))
+	}
+
+	// Range selects by time, after exclusive and until inclusive.
+	entries, err := cache.Range(start.Add(2*time.Second), start.Add(5*time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Message != "message 3" || entries[2].Message != "message 5" {
+		t.Fatalf("expected messages 3 to 5, got %+v", entries)
+	}
+
+	// Replay reads in batches smaller than the cache.
+	batchSize := ReplayBatchSize
+	ReplayBatchSize = 3
+	defer func() { ReplayBatchSize = batchSize }()
+	messages := []string{}
+	replayed := ReplayInputCache("test", cache, start.Add(time.Second), CacheEndTime(cache),
+		func(entry CacheEntry) {
+			messages = append(messages, entry.Message)
+		})
+	if replayed != 8 || len(messages) != 8 {
+		t.Fatalf("expected 8 entries replayed, got %d: %v", replayed, messages)
+	}
+	for i, message := range messages {
+		if message != fmt.Sprintf("message %d", i+2) {
+			t.Fatalf("expected message %d, got %s", i+2, message)
+		}
+	}
+}
+
+func TestRedisInputCachePrune(t *testing.T) {
+	options, cleanup := testRedisOptions(t)
+	defer cleanup()
+
+	start := time.Unix(1500000000, 0)
+	clock := NewManualClock(start)
+	cache := NewRedisInputCache(options, "kucoin.trades", clock)
+	for i := 0; i < 10; i++ {
+		clock.Set(start.Add(time.Duration(i) * time.Second))
+		cache.RPush([]byte(fmt.Sprintf("message %d", i)))
+	}
+
+	// Entries before the time are removed, an entry at it is kept.
+	if err := cache.Prune(start.Add(4 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := cache.Len(); length != 6 {
+		t.Fatalf("expected 6 entries, got %d", length)
+	}
+	first, err := cache.GetFirst()
+	if err != nil || first == nil || first.Message != "message 4" {
+		t.Fatalf("expected message 4 first, got %+v, %v", first, err)
+	}
+
+	cache.LRemove()
+	if first, _ := cache.GetFirst(); first == nil || first.Message != "message 5" {
+		t.Fatalf("expected message 5 first after LRemove, got %+v", first)
+	}
+
+	if err := cache.Prune(start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if length, _ := cache.Len(); length != 0 {
+		t.Fatalf("expected an empty cache, got %d entries", length)
+	}
+	if entry, err := cache.GetFirst(); entry != nil || err != nil {
+		t.Fatalf("expected no entry, got %+v, %v", entry, err)
+	}
+}
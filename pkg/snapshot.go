@@ -0,0 +1,298 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// The version of the snapshot format. Snapshots of another version are
+// ignored.
+const SnapshotVersion = 1
+
+// TrackerMapSnapshot is the state of a TickerTrackerMap at a point in
+// time, so it can be restored on startup without replaying the input
+// caches up to that time.
+type TrackerMapSnapshot struct {
+	Version  int
+	Time     time.Time
+	Trackers []TrackerSnapshot
+}
+
+// TrackerSnapshot is the state of a TickerTracker. The order book metrics,
+// Depth and HaveDepth, are not included: they are only meaningful while
+// the order book is synced, so after a restore depth is missing from
+// updates until the depth feed has resynced the books.
+type TrackerSnapshot struct {
+	Symbol     string
+	Ticks      []CommonTicker
+	Trades     []CommonTrade
+	Metrics    map[string]TickerMetrics
+	H24Metrics TickerMetrics
+	LastUpdate time.Time
+
+	HaveVwap        bool
+	HaveTotalVolume bool
+	HaveNetVolume   bool
+
+	// When the indicators in Metrics were calculated.
+	IndicatorsAt time.Time
+
+	// Keyed by interval name.
+	Candles map[string]CandleBuilderSnapshot
+}
+
+type CandleBuilderSnapshot struct {
+	Candles         []Candle
+	HaveTrades      bool
+	LastQuoteVolume float64
+}
+
+// Snapshot returns a copy of the tracker state. The tracker must be locked
+// for reading.
+//
+// Ticks and trades are never modified once added, only appended to and
+// pruned from the front, so rather than being copied the snapshot shares
+// them. The shared slices are capped at their length so appending to a
+// snapshot can't write into the tracker's array. This keeps a snapshot
+// cheap however long the history.
+func (t *TickerTracker) Snapshot() TrackerSnapshot {
+	snapshot := TrackerSnapshot{
+		Symbol:          t.Symbol,
+		Ticks:           t.Ticks[:len(t.Ticks):len(t.Ticks)],
+		Trades:          t.Trades[:len(t.Trades):len(t.Trades)],
+		Metrics:         map[string]TickerMetrics{},
+		H24Metrics:      t.H24Metrics,
+		LastUpdate:      t.LastUpdate,
+		HaveVwap:        t.HaveVwap,
+		HaveTotalVolume: t.HaveTotalVolume,
+		HaveNetVolume:   t.HaveNetVolume,
+		IndicatorsAt:    t.indicatorsAt,
+		Candles:         map[string]CandleBuilderSnapshot{},
+	}
+	// The indicator maps are replaced rather than modified when metrics
+	// are recalculated, so can be shared.
+	for name, metrics := range t.Metrics {
+		snapshot.Metrics[name] = *metrics
+	}
+
+	for name, builder := range t.Candles {
+		snapshot.Candles[name] = CandleBuilderSnapshot{
+			Candles:         builder.GetCandles(0),
+			HaveTrades:      builder.haveTrades,
+			LastQuoteVolume: builder.lastQuoteVolume,
+		}
+	}
+
+	return snapshot
+}
+
+// Restore adds the ticks and trades of a snapshot to a new tracker, in
+// time order, rebuilding the metric windows and indicators, then restores
+// the metrics and candles as they were. The tracker must be locked for
+// writing.
+func (t *TickerTracker) Restore(snapshot TrackerSnapshot) {
+	tick, trade := 0, 0
+	for tick < len(snapshot.Ticks) || trade < len(snapshot.Trades) {
+		if trade == len(snapshot.Trades) || (tick < len(snapshot.Ticks) &&
+			!snapshot.Trades[trade].Timestamp.Before(snapshot.Ticks[tick].Timestamp)) {
+			t.Update(snapshot.Ticks[tick])
+			tick++
+		} else {
+			t.AddTrade(snapshot.Trades[trade])
+			trade++
+		}
+	}
+
+	for name, metrics := range snapshot.Metrics {
+		if t.Metrics[name] == nil {
+			// The bucket is no longer configured.
+			continue
+		}
+		metrics := metrics
+		if metrics.Indicators == nil {
+			metrics.Indicators = map[string]float64{}
+		}
+		t.Metrics[name] = &metrics
+	}
+	t.H24Metrics = snapshot.H24Metrics
+	t.LastUpdate = snapshot.LastUpdate
+	t.HaveVwap = snapshot.HaveVwap
+	t.HaveTotalVolume = snapshot.HaveTotalVolume
+	t.HaveNetVolume = snapshot.HaveNetVolume
+	t.indicatorsAt = snapshot.IndicatorsAt
+
+	for name, candles := range snapshot.Candles {
+		builder := t.Candles[name]
+		if builder == nil {
+			continue
+		}
+		builder.Candles = candles.Candles
+		builder.haveTrades = candles.HaveTrades
+		builder.lastQuoteVolume = candles.LastQuoteVolume
+	}
+}
+
+// Snapshot returns a copy of the state of all the trackers, taken at the
+// given time.
+func (t *TickerTrackerMap) Snapshot(now time.Time) *TrackerMapSnapshot {
+	snapshot := &TrackerMapSnapshot{
+		Version:  SnapshotVersion,
+		Time:     now,
+		Trackers: []TrackerSnapshot{},
+	}
+	for _, tracker := range t.Trackers() {
+		tracker.Lock.RLock()
+		snapshot.Trackers = append(snapshot.Trackers, tracker.Snapshot())
+		tracker.Lock.RUnlock()
+	}
+	sort.Slice(snapshot.Trackers, func(i, j int) bool {
+		return snapshot.Trackers[i].Symbol < snapshot.Trackers[j].Symbol
+	})
+	return snapshot
+}
+
+// Restore restores the trackers in a snapshot, replacing any existing
+// trackers for the same symbols.
+func (t *TickerTrackerMap) Restore(snapshot *TrackerMapSnapshot) {
+	for _, trackerSnapshot := range snapshot.Trackers {
+		if trackerSnapshot.Symbol == "" {
+			continue
+		}
+		tracker := NewTickerTracker(trackerSnapshot.Symbol, t.clock, t.Buckets)
+		tracker.Restore(trackerSnapshot)
+		t.lock.Lock()
+		t.trackers[tracker.Symbol] = tracker
+		t.lock.Unlock()
+	}
+}
+
+// EncodeSnapshot encodes a snapshot as gzip compressed gob.
+func EncodeSnapshot(snapshot *TrackerMapSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewEncoder(writer).Encode(snapshot); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodeSnapshot(buf []byte) (*TrackerMapSnapshot, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	var snapshot TrackerMapSnapshot
+	if err := gob.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	return &snapshot, nil
+}
+
+// SnapshotStore keeps the latest encoded snapshot.
+type SnapshotStore interface {
+	Save(buf []byte) error
+
+	// Load returns the saved snapshot, or nil if there is none.
+	Load() ([]byte, error)
+}
+
+// OpenSnapshotStore opens the snapshot store for key using the configured
+// cache backend. The memory backend doesn't persist anything, so there is
+// no store for it and nil is returned.
+func OpenSnapshotStore(options CacheOptions, key string) (SnapshotStore, error) {
+	switch options.Backend {
+	case CacheBackendRedis, "":
+		return &RedisSnapshotStore{
+			client: getRedisClient(options.Redis),
+			key:    options.Redis.KeyPrefix + key,
+		}, nil
+	case CacheBackendMemory:
+		return nil, nil
+	case CacheBackendDisk:
+		if options.Directory == "" {
+			return nil, fmt.Errorf("no directory for disk cache")
+		}
+		if err := os.MkdirAll(options.Directory, 0755); err != nil {
+			return nil, err
+		}
+		return &FileSnapshotStore{
+			filename: filepath.Join(options.Directory, key),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", options.Backend)
+}
+
+type RedisSnapshotStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *RedisSnapshotStore) Save(buf []byte) error {
+	return s.client.Set(s.key, buf, 0).Err()
+}
+
+func (s *RedisSnapshotStore) Load() ([]byte, error) {
+	buf, err := s.client.Get(s.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return buf, err
+}
+
+// FileSnapshotStore saves the snapshot to a temporary file that is then
+// renamed over the previous snapshot, so a partially written snapshot is
+// never loaded.
+type FileSnapshotStore struct {
+	filename string
+}
+
+func (s *FileSnapshotStore) Save(buf []byte) error {
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+func (s *FileSnapshotStore) Load() ([]byte, error) {
+	buf, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return buf, err
+}
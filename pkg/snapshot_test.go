@@ -0,0 +1,101 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshotSharedHistory checks a snapshot, which shares the tracker's
+// tick and trade history, is unchanged as the tracker goes on appending
+// and pruning, including while it is being encoded.
+func TestSnapshotSharedHistory(t *testing.T) {
+	clock := NewManualClock(testStart)
+	trackers := NewTickerTrackerMap(clock, DefaultBuckets)
+	tracker := trackers.GetTracker("ETHBTC")
+
+	update := func(i int) {
+		now := testStart.Add(time.Duration(i) * time.Second)
+		clock.Set(now)
+		tracker.Lock.Lock()
+		tracker.Update(CommonTicker{
+			Symbol:      "ETHBTC",
+			Timestamp:   now,
+			LastPrice:   1 + float64(i%10)/100,
+			QuoteVolume: 100 + float64(i),
+			High:        2,
+			Low:         0.5,
+		})
+		tracker.AddTrade(CommonTrade{
+			Symbol:        "ETHBTC",
+			Timestamp:     now,
+			Price:         1,
+			Quantity:      1,
+			QuoteQuantity: 1,
+			Side:          TradeSideBuy,
+			TradeId:       int64(i),
+		})
+		tracker.Recalculate()
+		tracker.Lock.Unlock()
+	}
+
+	retention := int(tracker.Retention / time.Second)
+	for i := 0; i < retention; i++ {
+		update(i)
+	}
+
+	snapshot := trackers.Snapshot(clock.Now())
+	expected, err := EncodeSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encode the snapshot while the tracker is updated, long enough for
+	// the history it shares to be pruned from the tracker.
+	encoded := make(chan []byte)
+	go func() {
+		buf, err := EncodeSnapshot(snapshot)
+		if err != nil {
+			t.Error(err)
+		}
+		encoded <- buf
+	}()
+	for i := retention; i < retention*2; i++ {
+		update(i)
+	}
+
+	// Gob encodes maps in no particular order, so compare decoded.
+	decoded, err := DecodeSnapshot(<-encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := DecodeSnapshot(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Fatalf("snapshot changed while the tracker was updated")
+	}
+	if !reflect.DeepEqual(decoded.Trackers[0].Ticks, snapshot.Trackers[0].Ticks) {
+		t.Fatalf("snapshot ticks changed")
+	}
+	first := snapshot.Trackers[0].Ticks[0].Timestamp
+	if !first.Equal(testStart) {
+		t.Errorf("expected the snapshot to start at %v, starts at %v", testStart, first)
+	}
+}
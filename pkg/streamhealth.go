@@ -0,0 +1,242 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often the watchdog checks a stream by default.
+const watchdogInterval = time.Second
+
+// WatchdogOptions are the limits a stream is considered stale beyond.
+// Zero disables a check.
+type WatchdogOptions struct {
+	// How long a connection can go without a message.
+	MaxSilence time.Duration
+
+	// How far the server time of the last message can be behind the local
+	// time.
+	MaxLag time.Duration
+
+	// How often the stream is checked, every second if zero.
+	Interval time.Duration
+}
+
+var DefaultWatchdogOptions = WatchdogOptions{
+	MaxSilence: time.Minute,
+	MaxLag:     30 * time.Second,
+}
+
+// StreamStatus is the health of a websocket connection to an exchange, as
+// reported by the status API.
+type StreamStatus struct {
+	Name string `json:"name"`
+
+	// The number of streams or topics subscribed to on the connection.
+	Streams int `json:"streams"`
+
+	Connected   bool      `json:"connected"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastMessage time.Time `json:"last_message"`
+	Messages    int64     `json:"messages"`
+
+	// The number of times the connection has been re-established.
+	Reconnects int64 `json:"reconnects"`
+
+	// How far behind the local time the server time of the last message
+	// was, in milliseconds.
+	LagMillis int64 `json:"lag_ms"`
+
+	// Set when the watchdog found the stream stale, until data is
+	// received in time again.
+	Degraded       bool   `json:"degraded"`
+	DegradedReason string `json:"degraded_reason,omitempty"`
+
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+
+	// The state of reconnecting.
+	BackoffStatus
+}
+
+// StreamHealth tracks the status of a websocket connection, including the
+// backoff used to reconnect it. It is safe for concurrent use.
+type StreamHealth struct {
+	clock    Clock
+	status   StreamStatus
+	backoff  *Backoff
+	watchdog WatchdogOptions
+	lock     sync.RWMutex
+}
+
+func NewStreamHealth(clock Clock, name string, streams int) *StreamHealth {
+	return &StreamHealth{
+		clock: clock,
+		status: StreamStatus{
+			Name:    name,
+			Streams: streams,
+		},
+		backoff:  NewBackoff(DefaultBackoffOptions),
+		watchdog: DefaultWatchdogOptions,
+	}
+}
+
+func (h *StreamHealth) SetBackoffOptions(options BackoffOptions) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.backoff = NewBackoff(options)
+}
+
+func (h *StreamHealth) SetWatchdogOptions(options WatchdogOptions) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.watchdog = options
+}
+
+func (h *StreamHealth) Backoff() *Backoff {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.backoff
+}
+
+func (h *StreamHealth) SetStreams(streams int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.status.Streams = streams
+}
+
+func (h *StreamHealth) Connected() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.status.ConnectedAt.IsZero() {
+		h.status.Reconnects++
+	}
+	h.status.Connected = true
+	h.status.ConnectedAt = h.clock.Now()
+	h.status.LagMillis = 0
+}
+
+// Disconnected records the connection being lost, or failing to connect,
+// with the error that caused it.
+func (h *StreamHealth) Disconnected(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.status.Connected = false
+	if err != nil {
+		h.status.LastError = err.Error()
+		h.status.LastErrorTime = h.clock.Now()
+	}
+}
+
+// Message records a message being received. If the lag is not checked
+// this also clears the degraded state.
+func (h *StreamHealth) Message() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.status.Messages++
+	h.status.LastMessage = h.clock.Now()
+	if h.watchdog.MaxLag == 0 {
+		h.clearDegraded()
+	}
+}
+
+// ServerTime records the server time of the last message received, and
+// clears the degraded state if it is within the maximum lag.
+func (h *StreamHealth) ServerTime(serverTime time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	lag := h.clock.Now().Sub(serverTime)
+	h.status.LagMillis = int64(lag / time.Millisecond)
+	if h.watchdog.MaxLag == 0 || lag <= h.watchdog.MaxLag {
+		h.clearDegraded()
+	}
+}
+
+// clearDegraded clears the degraded state. The lock must be held.
+func (h *StreamHealth) clearDegraded() {
+	if h.status.Degraded {
+		log.Printf("%s: stream recovered\n", h.status.Name)
+	}
+	h.status.Degraded = false
+	h.status.DegradedReason = ""
+}
+
+// Check returns why a connected stream is stale, marking it degraded, or
+// an empty string if it is not.
+func (h *StreamHealth) Check(now time.Time) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.status.Connected {
+		return ""
+	}
+
+	reason := ""
+	lastMessage := h.status.LastMessage
+	if lastMessage.Before(h.status.ConnectedAt) {
+		lastMessage = h.status.ConnectedAt
+	}
+	lag := time.Duration(h.status.LagMillis) * time.Millisecond
+	if h.watchdog.MaxSilence > 0 && now.Sub(lastMessage) > h.watchdog.MaxSilence {
+		reason = fmt.Sprintf("no messages for %v", now.Sub(lastMessage).Round(time.Second))
+	} else if h.watchdog.MaxLag > 0 && lag > h.watchdog.MaxLag {
+		reason = fmt.Sprintf("lagging by %v", lag.Round(time.Second))
+	}
+
+	if reason != "" {
+		h.status.Degraded = true
+		h.status.DegradedReason = reason
+	}
+	return reason
+}
+
+// Watch checks the stream until done is closed. If it goes stale the
+// stream is marked degraded and reconnect is called to force a new
+// connection, which should start a new watch.
+func (h *StreamHealth) Watch(done chan bool, reconnect func()) {
+	h.lock.RLock()
+	interval := h.watchdog.Interval
+	h.lock.RUnlock()
+	if interval <= 0 {
+		interval = watchdogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if reason := h.Check(h.clock.Now()); reason != "" {
+				log.Printf("warning: %s: stream is stale, reconnecting: %s\n",
+					h.status.Name, reason)
+				reconnect()
+				return
+			}
+		}
+	}
+}
+
+func (h *StreamHealth) Status() StreamStatus {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	status := h.status
+	status.BackoffStatus = h.backoff.Status()
+	return status
+}
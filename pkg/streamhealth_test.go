@@ -0,0 +1,147 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestStreamHealth(clock Clock) *StreamHealth {
+	health := NewStreamHealth(clock, "test", 1)
+	health.SetWatchdogOptions(WatchdogOptions{
+		MaxSilence: time.Minute,
+		MaxLag:     30 * time.Second,
+		Interval:   10 * time.Millisecond,
+	})
+	return health
+}
+
+func TestStreamHealthCheck(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := NewManualClock(start)
+	health := newTestStreamHealth(clock)
+
+	// Not checked until connected.
+	clock.Advance(time.Hour)
+	if reason := health.Check(clock.Now()); reason != "" {
+		t.Fatalf("expected a disconnected stream not to be stale, got %s", reason)
+	}
+
+	health.Connected()
+	if status := health.Status(); !status.ConnectedAt.Equal(clock.Now()) {
+		t.Errorf("expected connected at %v, got %v", clock.Now(), status.ConnectedAt)
+	}
+
+	// Healthy, with messages within the maximum silence and lag.
+	for i := 0; i < 3; i++ {
+		clock.Advance(50 * time.Second)
+		health.Message()
+		health.ServerTime(clock.Now().Add(-10 * time.Second))
+		if reason := health.Check(clock.Now()); reason != "" {
+			t.Fatalf("expected a healthy stream, got %s", reason)
+		}
+	}
+	status := health.Status()
+	if status.Degraded || status.LagMillis != 10000 || status.Messages != 3 ||
+		!status.LastMessage.Equal(clock.Now()) {
+		t.Fatalf("unexpected status of a healthy stream: %+v", status)
+	}
+
+	// Stale, without a message for over the maximum silence.
+	clock.Advance(61 * time.Second)
+	if reason := health.Check(clock.Now()); reason != "no messages for 1m1s" {
+		t.Fatalf("expected a stale stream, got %q", reason)
+	}
+	if status := health.Status(); !status.Degraded ||
+		status.DegradedReason != "no messages for 1m1s" {
+		t.Fatalf("expected the stream degraded, got %+v", status)
+	}
+
+	// Lagging, with messages whose server time is too far behind.
+	health.Message()
+	health.ServerTime(clock.Now().Add(-45 * time.Second))
+	if reason := health.Check(clock.Now()); reason != "lagging by 45s" {
+		t.Fatalf("expected a lagging stream, got %q", reason)
+	}
+
+	// Recovered once the lag is back within the maximum.
+	health.Message()
+	health.ServerTime(clock.Now())
+	if status := health.Status(); status.Degraded || status.DegradedReason != "" {
+		t.Fatalf("expected the stream recovered, got %+v", status)
+	}
+}
+
+func TestStreamHealthWatch(t *testing.T) {
+	clock := NewManualClock(time.Unix(1500000000, 0))
+	health := newTestStreamHealth(clock)
+	health.Connected()
+
+	reconnects := make(chan bool, 1)
+	returned := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		health.Watch(done, func() {
+			reconnects <- true
+		})
+		close(returned)
+	}()
+
+	// A healthy stream is left alone.
+	select {
+	case <-reconnects:
+		t.Fatalf("unexpected reconnect of a healthy stream")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A stale stream is reconnected, ending the watch.
+	clock.Advance(2 * time.Minute)
+	select {
+	case <-reconnects:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the stale stream to be reconnected")
+	}
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the watch to end after reconnecting")
+	}
+	if status := health.Status(); !status.Degraded {
+		t.Errorf("expected the stream degraded, got %+v", status)
+	}
+
+	// Closing done ends a watch without reconnecting.
+	health.Connected()
+	returned = make(chan bool)
+	go func() {
+		health.Watch(done, func() {
+			reconnects <- true
+		})
+		close(returned)
+	}()
+	close(done)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the watch to end when done is closed")
+	}
+	select {
+	case <-reconnects:
+		t.Errorf("unexpected reconnect after done was closed")
+	default:
+	}
+}
@@ -18,10 +18,15 @@ package pkg
 import (
 	"math"
 	"time"
-	"github.com/crankykernel/cryptotrader/binance"
 	"log"
+	"sync"
 )
 
+// How often the indicators are recalculated by default. Unlike the bucket
+// metrics they are calculated from the whole of each bucket, so are not
+// recalculated with every tick.
+const DefaultIndicatorInterval = 10 * time.Second
+
 type TickerMetrics struct {
 	// Common metrics.
 	PriceChangePercent  float64
@@ -36,48 +41,92 @@ type TickerMetrics struct {
 	TotalVolume float64
 	NetVolume   float64
 	BuyVolume   float64
+
+	// Indicator values, keyed by value name.
+	Indicators map[string]float64
 }
 
 type TickerTracker struct {
+	// Held for writing while the tracker is being updated, and for reading
+	// by anything reading the tracker from another goroutine.
+	Lock sync.RWMutex
+
 	Symbol     string
 	Ticks      []CommonTicker
-	Metrics    map[int]*TickerMetrics
+	Metrics    map[string]*TickerMetrics
 	LastUpdate time.Time
 	H24Metrics TickerMetrics
 
-	// Trades, in Binance format.
-	Trades []binance.AggTrade
+	Trades []CommonTrade
 
 	HaveVwap        bool
 	HaveTotalVolume bool
 	HaveNetVolume   bool
-}
 
-var Buckets []int
-
-func init() {
-	Buckets = []int{
-		1,
-		2,
-		3,
-		4,
-		5,
-		10,
-		15,
-		60,
-	}
+	// The latest order book metrics, if HaveDepth.
+	Depth     DepthMetrics
+	HaveDepth bool
+
+	// The tick prices, shared by the indicators.
+	Prices *PriceSeries
+
+	// Indicator plugins, keyed by registered name.
+	Indicators map[string]Indicator
+
+	// How often the indicator values are recalculated, with every
+	// Recalculate if 0.
+	IndicatorInterval time.Duration
+
+	// When the indicator values were last recalculated.
+	indicatorsAt time.Time
+
+	// Candle builders, keyed by interval name.
+	Candles map[string]*CandleBuilder
+
+	// The buckets metrics are calculated for, shortest first. Metrics are
+	// keyed by bucket name.
+	Buckets []Bucket
+
+	// How long ticks and trades are kept for.
+	Retention time.Duration
+
+	Clock Clock
+
+	// A window for each bucket, in the same order as Buckets.
+	windows []*bucketWindow
+
+	// The absolute index of the first tick and trade, incremented as they
+	// are pruned.
+	tickOffset  int
+	tradeOffset int
 }
 
-func NewTickerTracker(symbol string) *TickerTracker {
+func NewTickerTracker(symbol string, clock Clock, buckets []Bucket) *TickerTracker {
+	prices := &PriceSeries{}
 	tracker := TickerTracker{
-		Symbol:  symbol,
-		Ticks:   []CommonTicker{},
-		Trades:  []binance.AggTrade{},
-		Metrics: make(map[int]*TickerMetrics),
+		Symbol:     symbol,
+		Clock:      clock,
+		Buckets:    buckets,
+		Retention:  BucketRetention(buckets),
+		Ticks:      []CommonTicker{},
+		Trades:     []CommonTrade{},
+		Metrics:    make(map[string]*TickerMetrics),
+		Prices:     prices,
+		Indicators: NewIndicators(prices),
+		Candles:    make(map[string]*CandleBuilder),
+
+		IndicatorInterval: DefaultIndicatorInterval,
+	}
+
+	for _, interval := range CandleIntervals {
+		tracker.Candles[interval.Name] = NewCandleBuilder(interval.Duration)
 	}
 
-	for _, i := range Buckets {
-		tracker.Metrics[i] = &TickerMetrics{}
+	for _, bucket := range buckets {
+		tracker.Metrics[bucket.Name] = &TickerMetrics{
+			Indicators: map[string]float64{},
+		}
+		tracker.windows = append(tracker.windows, newBucketWindow(bucket))
 	}
 
 	return &tracker;
@@ -90,52 +139,30 @@ func (t *TickerTracker) LastTick() *CommonTicker {
 	return &t.Ticks[len(t.Ticks)-1]
 }
 
+func (t *TickerTracker) tickAt(index int) *CommonTicker {
+	return &t.Ticks[index-t.tickOffset]
+}
+
+func (t *TickerTracker) tradeAt(index int) CommonTrade {
+	return t.Trades[index-t.tradeOffset]
+}
+
 func (t *TickerTracker) Recalculate() {
 	lastTick := t.LastTick()
-	now := time.Now()
-
-	nextBucket := 0
-	maxBucket := 0
+	now := t.Clock.Now()
 
 	// Need at least 2 ticks to calculate anything...
 	if len(t.Ticks) < 2 {
 		return
 	}
 
-	for _, i := range Buckets {
-		metrics := t.Metrics[i]
-		metrics.Low = 0
-		metrics.High = 0
-	}
-
-	high := float64(0)
-	low := float64(0)
-	for i := len(t.Ticks) - 1; i >= 0; i-- {
-		tick := t.Ticks[i]
-		timeDiff := int(now.Sub(tick.Timestamp).Seconds())
-		bucket := ((timeDiff - 1) / 60) + 1
-
-		if i == len(t.Ticks)-1 {
-			high = tick.LastPrice
-			low = tick.LastPrice
-		} else {
-			if tick.LastPrice < low {
-				low = tick.LastPrice
-			}
-			if tick.LastPrice > high {
-				high = tick.LastPrice
-			}
-		}
-
-		if _, exists := t.Metrics[bucket]; !exists {
-			continue
-		}
-
-		metrics := t.Metrics[bucket];
-		metrics.High = high
-		metrics.Low = low
-		metrics.Range = Round8(high - low)
-		metrics.RangePercent = Round3(metrics.Range / low * 100)
+	// Each bucket is calculated against the oldest tick that still falls
+	// within it. Buckets longer than the available history use the oldest
+	// tick there is.
+	for _, window := range t.windows {
+		window.advance(t, now)
+		t.updateTickMetrics(window.bucket, lastTick,
+			t.tickAt(window.tickStart), window.high(t), window.low(t))
 	}
 
 	// Some 24 hour metrics.
@@ -144,45 +171,6 @@ func (t *TickerTracker) Recalculate() {
 	t.H24Metrics.Range = Round8(lastTick.High - lastTick.Low)
 	t.H24Metrics.RangePercent = Round3(t.H24Metrics.Range / lastTick.Low * 100)
 
-	for i := 0; i < len(t.Ticks); i++ {
-		tick := t.Ticks[i]
-		timeDiff := int(now.Sub(tick.Timestamp).Seconds())
-		bucket := ((timeDiff - 1) / 60) + 1
-
-		if i == 0 {
-			nextBucket = bucket
-			maxBucket = bucket
-		} else if bucket > nextBucket {
-			continue
-		}
-
-		if _, exists := t.Metrics[bucket]; !exists {
-			continue
-		}
-
-		metrics := t.Metrics[bucket];
-		priceDiff := lastTick.LastPrice - tick.LastPrice
-		priceDiffPct := Round3(priceDiff / tick.LastPrice * 100)
-		metrics.PriceChangePercent = priceDiffPct
-
-		volumeDiff := lastTick.QuoteVolume - tick.QuoteVolume
-		volumeDiffPct := Round3((volumeDiff / tick.QuoteVolume) * 100)
-		metrics.VolumeChangePercent = volumeDiffPct
-
-		nextBucket = bucket - 1
-	}
-
-	previousPrice := t.Metrics[Buckets[0]].PriceChangePercent
-	previousVolume := t.Metrics[Buckets[0]].PriceChangePercent
-	for j := 1; j < len(Buckets); j++ {
-		if maxBucket < Buckets[j] {
-			t.Metrics[Buckets[j]].PriceChangePercent = previousPrice
-			t.Metrics[Buckets[j]].VolumeChangePercent = previousVolume
-		}
-		previousPrice = t.Metrics[Buckets[j]].PriceChangePercent
-		previousVolume = t.Metrics[Buckets[j]].VolumeChangePercent
-	}
-
 	// Calculate values that depend on actual trades:
 	// - VWAP
 	// - Total volume
@@ -191,58 +179,84 @@ func (t *TickerTracker) Recalculate() {
 		t.HaveNetVolume = true
 		t.HaveTotalVolume = true
 		t.HaveVwap = true;
-		vwapPrice := float64(0)
-		vwapVolume := float64(0)
-		buyVolume := float64(0)
-		sellVolume := float64(0)
+		for _, window := range t.windows {
+			window.totals.apply(t.Metrics[window.bucket.Name])
+		}
+	}
 
-		for i := len(t.Trades) - 1; i >= 0; i-- {
-			trade := t.Trades[i]
+	t.recalculateIndicators(now)
 
-			age := now.Sub(trade.Timestamp)
+	t.PruneTrades(now)
+}
 
-			if trade.IsBuy() {
-				buyVolume += trade.QuoteQuantity
-			} else {
-				sellVolume += trade.QuoteQuantity
-			}
+func (t *TickerTracker) updateTickMetrics(bucket Bucket, last *CommonTicker,
+	ref *CommonTicker, high float64, low float64) {
+	metrics := t.Metrics[bucket.Name]
+	metrics.High = high
+	metrics.Low = low
+	metrics.Range = Round8(high - low)
+	metrics.RangePercent = Round3(metrics.Range / low * 100)
 
-			vwapVolume += trade.Quantity
-			vwapPrice += trade.Quantity * trade.Price
-			vwap := vwapPrice / vwapVolume
+	priceDiff := last.LastPrice - ref.LastPrice
+	metrics.PriceChangePercent = Round3(priceDiff / ref.LastPrice * 100)
 
-			totalVolume := buyVolume + sellVolume
-			netVolume := buyVolume - sellVolume
+	volumeDiff := last.QuoteVolume - ref.QuoteVolume
+	metrics.VolumeChangePercent = Round3((volumeDiff / ref.QuoteVolume) * 100)
+}
 
-			for _, i := range Buckets {
-				if age <= time.Duration(i)*60*time.Second {
-					t.Metrics[i].NetVolume = netVolume
-					t.Metrics[i].TotalVolume = totalVolume
-					t.Metrics[i].BuyVolume = buyVolume
-					t.Metrics[i].Vwap = vwap
-				}
+// recalculateIndicators calculates every indicator over every bucket. The
+// cost grows with the history held, so it is done at most once every
+// IndicatorInterval.
+func (t *TickerTracker) recalculateIndicators(now time.Time) {
+	if t.IndicatorInterval > 0 && !now.Before(t.indicatorsAt) &&
+		now.Sub(t.indicatorsAt) < t.IndicatorInterval {
+		return
+	}
+	t.indicatorsAt = now
+	for _, bucket := range t.Buckets {
+		metrics := t.Metrics[bucket.Name]
+		values := map[string]float64{}
+		for _, indicator := range t.Indicators {
+			for key, value := range indicator.Calculate(now, bucket.Duration) {
+				values[key] = value
 			}
 		}
+		metrics.Indicators = values
 	}
-
-	t.PruneTrades(now)
 }
 
 func (t *TickerTracker) Update(ticker CommonTicker) {
-	t.LastUpdate = time.Now()
+	t.LastUpdate = t.Clock.Now()
 	t.Ticks = append(t.Ticks, ticker)
 	now := ticker.Timestamp
 	for {
 		first := t.Ticks[0]
-		if now.Sub(first.Timestamp) > (time.Minute*60)+1 {
+		if now.Sub(first.Timestamp) > t.Retention {
 			t.Ticks = t.Ticks[1:]
+			t.tickOffset++
 		} else {
 			break
 		}
 	}
+
+	index := t.tickOffset + len(t.Ticks) - 1
+	for _, window := range t.windows {
+		window.addTick(t, index)
+	}
+
+	t.Prices.Update(ticker)
+	t.Prices.Prune(t.Ticks[0].Timestamp)
+	for _, indicator := range t.Indicators {
+		indicator.Update(ticker)
+		indicator.Prune(t.Ticks[0].Timestamp)
+	}
+
+	for _, candles := range t.Candles {
+		candles.Update(ticker)
+	}
 }
 
-func (t *TickerTracker) AddTrade(trade binance.AggTrade) {
+func (t *TickerTracker) AddTrade(trade CommonTrade) {
 	if trade.Symbol == "" {
 		log.Printf("error: not adding trade with empty symbol")
 		return
@@ -256,46 +270,117 @@ func (t *TickerTracker) AddTrade(trade binance.AggTrade) {
 	}
 
 	t.Trades = append(t.Trades, trade)
+
+	for _, window := range t.windows {
+		window.addTrade(trade)
+	}
+
+	for _, indicator := range t.Indicators {
+		indicator.AddTrade(trade)
+	}
+
+	for _, candles := range t.Candles {
+		candles.AddTrade(trade)
+	}
+}
+
+// UpdateDepth sets the latest order book metrics, or clears them if the
+// book is no longer synced.
+func (t *TickerTracker) UpdateDepth(depth DepthMetrics) {
+	if depth.Unsynced {
+		t.Depth = DepthMetrics{}
+		t.HaveDepth = false
+		return
+	}
+	t.Depth = depth
+	t.HaveDepth = true
 }
 
 func (t *TickerTracker) PruneTrades(now time.Time) {
 	chop := 0
 	for i, trade := range t.Trades {
 		age := now.Sub(trade.Timestamp)
-		if age < time.Hour {
+		if age < t.Retention {
 			break
 		}
 		chop = i + 1
 	}
 	if chop > 0 {
+		for _, window := range t.windows {
+			window.dropTradesBefore(t, t.tradeOffset+chop)
+		}
 		t.Trades = t.Trades[chop:]
+		t.tradeOffset += chop
 	}
 }
 
+// TickerTrackerMap is a map of trackers by symbol that is safe for
+// concurrent use. The trackers themselves are protected by their own lock.
 type TickerTrackerMap struct {
-	Trackers map[string]*TickerTracker
+	trackers map[string]*TickerTracker
+	Buckets  []Bucket
+	clock    Clock
+	lock     sync.RWMutex
 }
 
-func NewTickerTrackerMap() *TickerTrackerMap {
+func NewTickerTrackerMap(clock Clock, buckets []Bucket) *TickerTrackerMap {
 	return &TickerTrackerMap{
-		Trackers: make(map[string]*TickerTracker),
+		trackers: make(map[string]*TickerTracker),
+		Buckets:  buckets,
+		clock:    clock,
 	}
 }
 
+// GetTracker returns the tracker for symbol, creating it if it doesn't
+// exist.
 func (t *TickerTrackerMap) GetTracker(symbol string) *TickerTracker {
 	if symbol == "" {
 		log.Printf("GetTracker called with empty string symbol")
 		return nil
 	}
-	if _, ok := t.Trackers[symbol]; !ok {
-		t.Trackers[symbol] = NewTickerTracker(symbol)
+	if tracker := t.Get(symbol); tracker != nil {
+		return tracker
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.trackers[symbol]; !ok {
+		t.trackers[symbol] = NewTickerTracker(symbol, t.clock, t.Buckets)
+	}
+	return t.trackers[symbol]
+}
+
+// Get returns the tracker for symbol, or nil if there isn't one.
+func (t *TickerTrackerMap) Get(symbol string) *TickerTracker {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.trackers[symbol]
+}
+
+// Trackers returns a snapshot of all the trackers.
+func (t *TickerTrackerMap) Trackers() []*TickerTracker {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	trackers := make([]*TickerTracker, 0, len(t.trackers))
+	for _, tracker := range t.trackers {
+		trackers = append(trackers, tracker)
 	}
-	return t.Trackers[symbol]
+	return trackers
+}
+
+func (t *TickerTrackerMap) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.trackers)
 }
 
 func (t *TickerTrackerMap) GetLastForSymbol(symbol string) *CommonTicker {
-	if tracker, ok := t.Trackers[symbol]; ok {
-		return tracker.LastTick()
+	if tracker := t.Get(symbol); tracker != nil {
+		tracker.Lock.RLock()
+		defer tracker.Lock.RUnlock()
+		if last := tracker.LastTick(); last != nil {
+			ticker := *last
+			return &ticker
+		}
 	}
 	return nil
 }
@@ -0,0 +1,332 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+var testStart = time.Unix(1500000000, 0)
+
+func newTestTracker(t *testing.T, clock *ManualClock, durations ...string) *TickerTracker {
+	buckets, err := ParseBuckets(durations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTickerTracker("ETHBTC", clock, buckets)
+}
+
+// addTick adds a tick at offset from testStart, moving the clock to it.
+func addTick(clock *ManualClock, tracker *TickerTracker, offset time.Duration, price float64) {
+	now := testStart.Add(offset)
+	clock.Set(now)
+	tracker.Update(CommonTicker{
+		Symbol:      tracker.Symbol,
+		Timestamp:   now,
+		LastPrice:   price,
+		QuoteVolume: price * 10,
+		High:        price,
+		Low:         price,
+	})
+}
+
+func TestRecalculateFewerThanTwoTicks(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+
+	tracker.Recalculate()
+	if metrics := tracker.Metrics["1m"]; metrics.High != 0 || metrics.Low != 0 {
+		t.Fatalf("expected no metrics without ticks, got %+v", metrics)
+	}
+
+	addTick(clock, tracker, 0, 100)
+	tracker.Recalculate()
+	if metrics := tracker.Metrics["1m"]; metrics.High != 0 || metrics.PriceChangePercent != 0 {
+		t.Fatalf("expected no metrics with one tick, got %+v", metrics)
+	}
+	if tracker.H24Metrics.High != 0 {
+		t.Fatalf("expected no 24h metrics with one tick, got %+v", tracker.H24Metrics)
+	}
+}
+
+func TestRecalculateHistoryShorterThanBucket(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m", "1h")
+	addTick(clock, tracker, 0, 100)
+	addTick(clock, tracker, 10*time.Second, 90)
+	addTick(clock, tracker, 20*time.Second, 110)
+	tracker.Recalculate()
+
+	// Both buckets are longer than the history, so both are calculated
+	// against the oldest tick.
+	for _, name := range []string{"1m", "1h"} {
+		metrics := tracker.Metrics[name]
+		if metrics.PriceChangePercent != 10 {
+			t.Errorf("%s: expected a price change of 10%%, got %v",
+				name, metrics.PriceChangePercent)
+		}
+		if metrics.High != 110 || metrics.Low != 90 {
+			t.Errorf("%s: expected high 110 and low 90, got %v and %v",
+				name, metrics.High, metrics.Low)
+		}
+		if metrics.VolumeChangePercent != 10 {
+			t.Errorf("%s: expected a volume change of 10%%, got %v",
+				name, metrics.VolumeChangePercent)
+		}
+	}
+}
+
+func TestRecalculateBucketBoundary(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	addTick(clock, tracker, 0, 100)
+	addTick(clock, tracker, 30*time.Second, 200)
+	addTick(clock, tracker, time.Minute, 150)
+
+	// A tick exactly a bucket old is still in the bucket.
+	tracker.Recalculate()
+	metrics := tracker.Metrics["1m"]
+	if metrics.PriceChangePercent != 50 || metrics.Low != 100 || metrics.High != 200 {
+		t.Fatalf("expected the tick at the boundary in the bucket, got %+v", metrics)
+	}
+
+	// Any later and it isn't.
+	clock.Advance(time.Millisecond)
+	tracker.Recalculate()
+	metrics = tracker.Metrics["1m"]
+	if metrics.PriceChangePercent != -25 || metrics.Low != 150 || metrics.High != 200 {
+		t.Fatalf("expected the tick past the boundary out of the bucket, got %+v", metrics)
+	}
+
+	// Once every tick but the last has left the bucket, the last tick is
+	// the reference.
+	clock.Advance(time.Minute)
+	tracker.Recalculate()
+	metrics = tracker.Metrics["1m"]
+	if metrics.PriceChangePercent != 0 || metrics.Low != 150 || metrics.High != 150 {
+		t.Fatalf("expected only the last tick in the bucket, got %+v", metrics)
+	}
+}
+
+func TestRecalculateTradeBucketBoundary(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	addTick(clock, tracker, 0, 100)
+	tracker.AddTrade(CommonTrade{Symbol: "ETHBTC", Timestamp: testStart,
+		Price: 100, Quantity: 1, QuoteQuantity: 100, Side: TradeSideBuy})
+	tracker.AddTrade(CommonTrade{Symbol: "ETHBTC", Timestamp: testStart.Add(30 * time.Second),
+		Price: 100, Quantity: 2, QuoteQuantity: 200, Side: TradeSideSell})
+	addTick(clock, tracker, time.Minute, 100)
+
+	tracker.Recalculate()
+	if metrics := tracker.Metrics["1m"]; metrics.NetVolume != -100 || metrics.TotalVolume != 300 {
+		t.Fatalf("expected both trades in the bucket, got %+v", metrics)
+	}
+
+	clock.Advance(time.Millisecond)
+	tracker.Recalculate()
+	if metrics := tracker.Metrics["1m"]; metrics.NetVolume != -200 || metrics.TotalVolume != 200 {
+		t.Fatalf("expected only the second trade in the bucket, got %+v", metrics)
+	}
+}
+
+func TestPruneAtRetention(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	if tracker.Retention != time.Hour {
+		t.Fatalf("expected a retention of 1h, got %v", tracker.Retention)
+	}
+	addTick(clock, tracker, 0, 100)
+	tracker.AddTrade(CommonTrade{Symbol: "ETHBTC", Timestamp: testStart,
+		Price: 100, Quantity: 1, QuoteQuantity: 100, Side: TradeSideBuy})
+	addTick(clock, tracker, time.Minute, 101)
+
+	// Ticks are kept until they are older than the retention.
+	addTick(clock, tracker, time.Hour, 102)
+	if len(tracker.Ticks) != 3 {
+		t.Fatalf("expected the tick at the retention to be kept, have %d ticks",
+			len(tracker.Ticks))
+	}
+	addTick(clock, tracker, time.Hour+time.Millisecond, 103)
+	if len(tracker.Ticks) != 3 || tracker.Ticks[0].LastPrice != 101 {
+		t.Fatalf("expected the tick past the retention to be pruned, have %+v",
+			tracker.Ticks)
+	}
+
+	// Trades are pruned once they reach the retention.
+	clock.Set(testStart.Add(time.Hour - time.Millisecond))
+	tracker.PruneTrades(clock.Now())
+	if len(tracker.Trades) != 1 {
+		t.Fatalf("expected the trade to be kept before the retention")
+	}
+	clock.Set(testStart.Add(time.Hour))
+	tracker.PruneTrades(clock.Now())
+	if len(tracker.Trades) != 0 {
+		t.Fatalf("expected the trade to be pruned at the retention")
+	}
+
+	// The windows still line up with the pruned history.
+	clock.Set(testStart.Add(time.Hour + time.Minute))
+	tracker.Recalculate()
+	if metrics := tracker.Metrics["1m"]; metrics.PriceChangePercent != Round3((103.0-102)/102*100) {
+		t.Fatalf("unexpected metrics after pruning: %+v", metrics)
+	}
+}
+
+func TestRecalculateIndicatorInterval(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	addTick(clock, tracker, 0, 100)
+	addTick(clock, tracker, time.Second, 110)
+	tracker.Recalculate()
+	sma := tracker.Metrics["1m"].Indicators["sma"]
+	if sma != 105 {
+		t.Fatalf("expected an sma of 105, got %v", sma)
+	}
+
+	// Not recalculated until the interval has passed.
+	addTick(clock, tracker, 2*time.Second, 120)
+	tracker.Recalculate()
+	if value := tracker.Metrics["1m"].Indicators["sma"]; value != sma {
+		t.Fatalf("expected the sma to be unchanged within the interval, got %v", value)
+	}
+	addTick(clock, tracker, time.Second+DefaultIndicatorInterval, 130)
+	tracker.Recalculate()
+	if value := tracker.Metrics["1m"].Indicators["sma"]; value != 115 {
+		t.Fatalf("expected an sma of 115 after the interval, got %v", value)
+	}
+
+	tracker.IndicatorInterval = 0
+	addTick(clock, tracker, 2*time.Second+DefaultIndicatorInterval, 140)
+	tracker.Recalculate()
+	if value := tracker.Metrics["1m"].Indicators["sma"]; value != 120 {
+		t.Fatalf("expected an sma of 120 with no interval, got %v", value)
+	}
+}
+
+// rescanRecalculate calculates the bucket metrics by walking the whole
+// history, as Recalculate did before the rolling windows, with the
+// indicators recalculated every time. It is the baseline for the
+// benchmarks.
+func rescanRecalculate(t *TickerTracker) {
+	now := t.Clock.Now()
+	lastTick := t.LastTick()
+	ref := lastTick
+	high := lastTick.LastPrice
+	low := lastTick.LastPrice
+	next := 0
+	for i := len(t.Ticks) - 1; i >= 0 && next < len(t.Buckets); i-- {
+		tick := &t.Ticks[i]
+		for next < len(t.Buckets) && now.Sub(tick.Timestamp) > t.Buckets[next].Duration {
+			t.updateTickMetrics(t.Buckets[next], lastTick, ref, high, low)
+			next++
+		}
+		ref = tick
+		if tick.LastPrice < low {
+			low = tick.LastPrice
+		}
+		if tick.LastPrice > high {
+			high = tick.LastPrice
+		}
+	}
+	for ; next < len(t.Buckets); next++ {
+		t.updateTickMetrics(t.Buckets[next], lastTick, ref, high, low)
+	}
+
+	totals := tradeTotals{}
+	next = 0
+	for i := len(t.Trades) - 1; i >= 0 && next < len(t.Buckets); i-- {
+		trade := t.Trades[i]
+		for next < len(t.Buckets) && now.Sub(trade.Timestamp) > t.Buckets[next].Duration {
+			totals.apply(t.Metrics[t.Buckets[next].Name])
+			next++
+		}
+		totals.add(trade)
+	}
+	for ; next < len(t.Buckets); next++ {
+		totals.apply(t.Metrics[t.Buckets[next].Name])
+	}
+
+	t.IndicatorInterval = 0
+	t.recalculateIndicators(now)
+	t.PruneTrades(now)
+}
+
+// benchmarkRecalculate fills a tracker with the default buckets with
+// history ticks a second apart, each with 5 trades, then times adding a
+// tick and its trades and recalculating.
+func benchmarkRecalculate(b *testing.B, history int, recalculate func(*TickerTracker)) {
+	clock := NewManualClock(testStart)
+	tracker := NewTickerTracker("ETHBTC", clock, DefaultBuckets)
+	tracker.Retention = time.Duration(history) * time.Second
+	second := 0
+	add := func() {
+		now := testStart.Add(time.Duration(second) * time.Second)
+		clock.Set(now)
+		price := 100 + float64(second%600)/10
+		tracker.Update(CommonTicker{Symbol: "ETHBTC", Timestamp: now,
+			LastPrice: price, QuoteVolume: 1000 + float64(second)})
+		for i := 0; i < 5; i++ {
+			side := TradeSideBuy
+			if i%2 == 1 {
+				side = TradeSideSell
+			}
+			tracker.AddTrade(CommonTrade{Symbol: "ETHBTC", Timestamp: now,
+				Price: price, Quantity: 1, QuoteQuantity: price, Side: side})
+		}
+		second++
+	}
+	for i := 0; i < history; i++ {
+		add()
+	}
+	recalculate(tracker)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		add()
+		recalculate(tracker)
+	}
+}
+
+func BenchmarkRecalculate1h(b *testing.B) {
+	benchmarkRecalculate(b, 3600, (*TickerTracker).Recalculate)
+}
+
+func BenchmarkRecalculate4h(b *testing.B) {
+	benchmarkRecalculate(b, 4*3600, (*TickerTracker).Recalculate)
+}
+
+func BenchmarkRecalculateRescan1h(b *testing.B) {
+	benchmarkRecalculate(b, 3600, rescanRecalculate)
+}
+
+func BenchmarkRecalculateRescan4h(b *testing.B) {
+	benchmarkRecalculate(b, 4*3600, rescanRecalculate)
+}
+
+func TestUpdateDepthUnsynced(t *testing.T) {
+	clock := NewManualClock(testStart)
+	tracker := newTestTracker(t, clock, "1m")
+	tracker.UpdateDepth(DepthMetrics{Symbol: "ETHBTC", BidDepth: 1, AskDepth: 2})
+	if !tracker.HaveDepth || tracker.Depth.AskDepth != 2 {
+		t.Fatalf("expected the depth to be set, got %+v", tracker.Depth)
+	}
+	tracker.UpdateDepth(DepthMetrics{Symbol: "ETHBTC", Unsynced: true})
+	if tracker.HaveDepth || tracker.Depth.AskDepth != 0 {
+		t.Fatalf("expected the depth to be cleared, got %+v", tracker.Depth)
+	}
+}
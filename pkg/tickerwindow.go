@@ -0,0 +1,189 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"time"
+)
+
+// indexDeque is a double ended queue of absolute tick indexes.
+type indexDeque struct {
+	items []int
+}
+
+func (d *indexDeque) empty() bool {
+	return len(d.items) == 0
+}
+
+func (d *indexDeque) front() int {
+	return d.items[0]
+}
+
+func (d *indexDeque) back() int {
+	return d.items[len(d.items)-1]
+}
+
+func (d *indexDeque) pushBack(i int) {
+	d.items = append(d.items, i)
+}
+
+func (d *indexDeque) popBack() {
+	d.items = d.items[:len(d.items)-1]
+}
+
+func (d *indexDeque) popFront() {
+	d.items = d.items[1:]
+}
+
+// tradeTotals accumulates the trade derived metrics.
+type tradeTotals struct {
+	vwapPrice  float64
+	vwapVolume float64
+	buyVolume  float64
+	sellVolume float64
+}
+
+func (t *tradeTotals) add(trade CommonTrade) {
+	if trade.IsBuy() {
+		t.buyVolume += trade.QuoteQuantity
+	} else {
+		t.sellVolume += trade.QuoteQuantity
+	}
+	t.vwapVolume += trade.Quantity
+	t.vwapPrice += trade.Quantity * trade.Price
+}
+
+func (t *tradeTotals) remove(trade CommonTrade) {
+	if trade.IsBuy() {
+		t.buyVolume -= trade.QuoteQuantity
+	} else {
+		t.sellVolume -= trade.QuoteQuantity
+	}
+	t.vwapVolume -= trade.Quantity
+	t.vwapPrice -= trade.Quantity * trade.Price
+}
+
+func (t *tradeTotals) apply(metrics *TickerMetrics) {
+	metrics.NetVolume = t.buyVolume - t.sellVolume
+	metrics.TotalVolume = t.buyVolume + t.sellVolume
+	metrics.BuyVolume = t.buyVolume
+	metrics.Vwap = 0
+	if t.vwapVolume > 0 {
+		metrics.Vwap = t.vwapPrice / t.vwapVolume
+	}
+}
+
+// bucketWindow maintains the ticks and trades that fall within a bucket.
+// Rather than rescanning the history on each update, the start of the
+// window is moved forward as time passes, trades are added to and removed
+// from running totals, and the high and low are kept in monotonic queues.
+//
+// Indexes are absolute, that is they continue to count up as the tracker
+// prunes its history.
+type bucketWindow struct {
+	bucket Bucket
+
+	// The index of the oldest tick in the window. The last tick is always
+	// considered part of the window.
+	tickStart int
+
+	// Tick indexes with decreasing prices (highs) and increasing prices
+	// (lows). The front of each is the high or low of the window.
+	highs indexDeque
+	lows  indexDeque
+
+	// The index of the oldest trade in the window.
+	tradeStart int
+
+	totals tradeTotals
+}
+
+func newBucketWindow(bucket Bucket) *bucketWindow {
+	return &bucketWindow{
+		bucket: bucket,
+	}
+}
+
+func (w *bucketWindow) addTick(t *TickerTracker, index int) {
+	w.dropTicksBefore(t.tickOffset)
+	price := t.tickAt(index).LastPrice
+	for !w.highs.empty() && t.tickAt(w.highs.back()).LastPrice <= price {
+		w.highs.popBack()
+	}
+	w.highs.pushBack(index)
+	for !w.lows.empty() && t.tickAt(w.lows.back()).LastPrice >= price {
+		w.lows.popBack()
+	}
+	w.lows.pushBack(index)
+}
+
+func (w *bucketWindow) addTrade(trade CommonTrade) {
+	w.totals.add(trade)
+}
+
+// dropTicksBefore moves the start of the window to at least index.
+func (w *bucketWindow) dropTicksBefore(index int) {
+	if w.tickStart < index {
+		w.tickStart = index
+	}
+	for !w.highs.empty() && w.highs.front() < w.tickStart {
+		w.highs.popFront()
+	}
+	for !w.lows.empty() && w.lows.front() < w.tickStart {
+		w.lows.popFront()
+	}
+}
+
+// dropTradesBefore removes trades before index from the running totals.
+func (w *bucketWindow) dropTradesBefore(t *TickerTracker, index int) {
+	for ; w.tradeStart < index; w.tradeStart++ {
+		w.totals.remove(t.tradeAt(w.tradeStart))
+	}
+
+	// Reset when empty so floating point error doesn't accumulate.
+	if w.tradeStart == t.tradeOffset+len(t.Trades) {
+		w.totals = tradeTotals{}
+	}
+}
+
+// advance moves the window forward to end at now.
+func (w *bucketWindow) advance(t *TickerTracker, now time.Time) {
+	start := w.tickStart
+	if start < t.tickOffset {
+		start = t.tickOffset
+	}
+	last := t.tickOffset + len(t.Ticks) - 1
+	for start < last && now.Sub(t.tickAt(start).Timestamp) > w.bucket.Duration {
+		start++
+	}
+	w.dropTicksBefore(start)
+
+	tradeStart := w.tradeStart
+	tradeEnd := t.tradeOffset + len(t.Trades)
+	for tradeStart < tradeEnd &&
+		now.Sub(t.tradeAt(tradeStart).Timestamp) > w.bucket.Duration {
+		tradeStart++
+	}
+	w.dropTradesBefore(t, tradeStart)
+}
+
+func (w *bucketWindow) high(t *TickerTracker) float64 {
+	return t.tickAt(w.highs.front()).LastPrice
+}
+
+func (w *bucketWindow) low(t *TickerTracker) float64 {
+	return t.tickAt(w.lows.front()).LastPrice
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package pkg
+
+import (
+	"github.com/crankykernel/cryptotrader/binance"
+	"time"
+)
+
+type TradeSide string
+
+const (
+	TradeSideBuy  TradeSide = "buy"
+	TradeSideSell TradeSide = "sell"
+)
+
+type CommonTrade struct {
+	// The coin and the pairing: ETHBTC, ETH-BTC...
+	Symbol string
+
+	Timestamp time.Time
+
+	Price float64
+
+	// Quantity in the base asset.
+	Quantity float64
+
+	// Quantity in the quote asset, Price * Quantity.
+	QuoteQuantity float64
+
+	// The side of the taker, the side that caused the trade.
+	Side TradeSide
+
+	// The exchange's ID for this trade. For Binance this is the aggregate
+	// trade ID.
+	TradeId int64
+
+	// The range of underlying trade IDs this trade aggregates. For
+	// exchanges that don't aggregate these are both TradeId.
+	FirstTradeId int64
+	LastTradeId  int64
+}
+
+func (t *CommonTrade) IsBuy() bool {
+	return t.Side == TradeSideBuy
+}
+
+func CommonTradeFromBinanceAggTrade(trade binance.AggTrade) CommonTrade {
+	common := CommonTrade{}
+	common.Symbol = trade.Symbol
+	common.Timestamp = trade.Timestamp
+	common.Price = trade.Price
+	common.Quantity = trade.Quantity
+	common.QuoteQuantity = trade.QuoteQuantity
+	if trade.IsBuy() {
+		common.Side = TradeSideBuy
+	} else {
+		common.Side = TradeSideSell
+	}
+	common.TradeId = trade.TradeID
+	common.FirstTradeId = trade.FirstTradeID
+	common.LastTradeId = trade.LastTradeID
+	return common
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultAlertQueryLimit = 100
+	maxAlertQueryLimit     = 1000
+)
+
+// The default time alerts are kept in the history.
+const DefaultAlertRetention = 30 * 24 * time.Hour
+
+// AlertStore is the history of fired alerts. Events are appended to a file
+// of newline delimited JSON and held in memory for querying.
+//
+// Alerts older than the retention are dropped as new alerts are added, and
+// the file is rewritten without them once they make up most of it.
+type AlertStore struct {
+	filename  string
+	file      *os.File
+	retention time.Duration
+
+	// Oldest first, so also in ID order.
+	events []*AlertEvent
+	byId   map[int64]*AlertEvent
+	lastId int64
+
+	// The number of lines in the file for alerts no longer kept.
+	stale int
+
+	lock sync.RWMutex
+}
+
+// OpenAlertStore loads the existing history from filename, creating it if
+// it doesn't exist. A partly written last line, as left by a crash, is
+// truncated. Alerts are kept for retention, forever if 0.
+func OpenAlertStore(filename string, retention time.Duration) (*AlertStore, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &AlertStore{
+		filename:  filename,
+		file:      file,
+		retention: retention,
+		events:    []*AlertEvent{},
+		byId:      map[int64]*AlertEvent{},
+	}
+
+	buf, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+		end := bytes.LastIndexByte(buf, '\n') + 1
+		log.Printf("warning: alert history: truncating partly written entry at offset %d of %s\n",
+			end, filename)
+		if err := file.Truncate(int64(end)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		buf = buf[:end]
+	}
+
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var event AlertEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			log.Printf("error: alert history: skipping bad entry: %v\n", err)
+			store.stale++
+			continue
+		}
+		store.events = append(store.events, &event)
+		store.byId[event.Id] = &event
+		if event.Id > store.lastId {
+			store.lastId = event.Id
+		}
+	}
+
+	store.prune(time.Now())
+	if store.stale > 0 {
+		if err := store.compact(); err != nil {
+			store.file.Close()
+			return nil, err
+		}
+	}
+
+	log.Printf("Loaded %d alerts from %s\n", len(store.events), filename)
+	return store, nil
+}
+
+// Add assigns the event an ID and appends it to the history.
+func (s *AlertStore) Add(event *AlertEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastId++
+	event.Id = s.lastId
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.events = append(s.events, event)
+	s.byId[event.Id] = event
+	if _, err := s.file.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	s.prune(event.Timestamp)
+	if s.stale > len(s.events) {
+		return s.compact()
+	}
+	return nil
+}
+
+// prune drops the alerts older than the retention, except the newest so
+// its ID is still known after the file is rewritten. The caller must hold
+// the write lock.
+func (s *AlertStore) prune(now time.Time) {
+	if s.retention <= 0 {
+		return
+	}
+	i := 0
+	for i < len(s.events)-1 && now.Sub(s.events[i].Timestamp) > s.retention {
+		delete(s.byId, s.events[i].Id)
+		i++
+	}
+	if i > 0 {
+		s.events = append([]*AlertEvent{}, s.events[i:]...)
+		s.stale += i
+	}
+}
+
+// compact rewrites the file with only the alerts still kept. The caller
+// must hold the write lock.
+func (s *AlertStore) compact() error {
+	tmp := s.filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, event := range s.events {
+		if err := encoder.Encode(event); err != nil {
+			file.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	file, err = os.OpenFile(s.filename, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.stale = 0
+	return nil
+}
+
+func (s *AlertStore) Get(id int64) *AlertEvent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.byId[id]
+}
+
+type AlertQuery struct {
+	Exchange string
+	Symbol   string
+	Rule     string
+
+	// Only events at or after Start and before End, if set.
+	Start time.Time
+	End   time.Time
+
+	Offset int
+	Limit  int
+}
+
+func (q *AlertQuery) match(event *AlertEvent) bool {
+	if q.Exchange != "" && event.Exchange != q.Exchange {
+		return false
+	}
+	if q.Symbol != "" && event.Symbol != q.Symbol {
+		return false
+	}
+	if q.Rule != "" && event.Rule != q.Rule {
+		return false
+	}
+	if !q.Start.IsZero() && event.Timestamp.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && !event.Timestamp.Before(q.End) {
+		return false
+	}
+	return true
+}
+
+// Query returns a page of the matching events, newest first, and the total
+// number of matching events.
+func (s *AlertStore) Query(query AlertQuery) ([]*AlertEvent, int) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	events := []*AlertEvent{}
+	total := 0
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		if !query.match(event) {
+			continue
+		}
+		if total >= query.Offset && len(events) < query.Limit {
+			events = append(events, event)
+		}
+		total++
+	}
+	return events, total
+}
+
+func (s *AlertStore) Close() error {
+	return s.file.Close()
+}
+
+// parseTimeParam parses a time given as RFC3339 or Unix milliseconds.
+func parseTimeParam(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// AlertHistoryHandler serves the alert history.
+type AlertHistoryHandler struct {
+	store *AlertStore
+}
+
+func NewAlertHistoryHandler(store *AlertStore) *AlertHistoryHandler {
+	return &AlertHistoryHandler{
+		store: store,
+	}
+}
+
+// HandleList returns the alerts matching the exchange, symbol, rule, start
+// and end parameters, newest first. Pages are selected with offset and
+// limit.
+func (h *AlertHistoryHandler) HandleList(w http.ResponseWriter, r *http.Request) {
+	query := AlertQuery{
+		Exchange: r.FormValue("exchange"),
+		Symbol:   r.FormValue("symbol"),
+		Rule:     r.FormValue("rule"),
+		Limit:    defaultAlertQueryLimit,
+	}
+
+	var err error
+	if value := r.FormValue("start"); value != "" {
+		if query.Start, err = parseTimeParam(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid start")
+			return
+		}
+	}
+	if value := r.FormValue("end"); value != "" {
+		if query.End, err = parseTimeParam(value); err != nil {
+			writeJsonError(w, http.StatusBadRequest, "invalid end")
+			return
+		}
+	}
+	if value := r.FormValue("offset"); value != "" {
+		query.Offset, err = strconv.Atoi(value)
+		if err != nil || query.Offset < 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid offset")
+			return
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit < 1 || query.Limit > maxAlertQueryLimit {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	events, total := h.store.Query(query)
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"alerts": events,
+		"total":  total,
+		"offset": query.Offset,
+		"limit":  query.Limit,
+	})
+}
+
+func (h *AlertHistoryHandler) HandleGet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	event := h.store.Get(id)
+	if event == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown alert")
+		return
+	}
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempAlertHistory(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "alerthistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "alerts.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+func addAlert(t *testing.T, store *AlertStore, symbol string, timestamp time.Time) *AlertEvent {
+	event := &AlertEvent{
+		Exchange:  "binance",
+		Symbol:    symbol,
+		Rule:      "test",
+		Timestamp: timestamp,
+	}
+	if err := store.Add(event); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func countLines(t *testing.T, filename string) int {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(buf, []byte("\n"))
+}
+
+func TestAlertStoreReopen(t *testing.T) {
+	filename, cleanup := tempAlertHistory(t)
+	defer cleanup()
+
+	store, err := OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, symbol := range []string{"ETHBTC", "LTCBTC", "BNBBTC"} {
+		addAlert(t, store, symbol, now)
+	}
+	store.Close()
+
+	store, err = OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if event := store.Get(2); event == nil || event.Symbol != "LTCBTC" {
+		t.Errorf("expected alert 2 for LTCBTC, got %+v", event)
+	}
+	if event := store.Get(4); event != nil {
+		t.Errorf("expected no alert 4, got %+v", event)
+	}
+	if event := addAlert(t, store, "ETHBTC", now); event.Id != 4 {
+		t.Errorf("expected IDs to continue at 4, got %d", event.Id)
+	}
+}
+
+func TestAlertStoreTruncatesTornLine(t *testing.T) {
+	filename, cleanup := tempAlertHistory(t)
+	defer cleanup()
+
+	store, err := OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addAlert(t, store, "ETHBTC", time.Now())
+	addAlert(t, store, "LTCBTC", time.Now())
+	store.Close()
+
+	// A crash part way through writing the third alert.
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(`{"id":3,"exchange":"bin`))
+	file.Close()
+
+	store, err = OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, total := store.Query(AlertQuery{Limit: 10}); total != 2 {
+		t.Errorf("expected 2 alerts, got %d", total)
+	}
+
+	// The next alert must start on its own line, not follow the torn one.
+	addAlert(t, store, "BNBBTC", time.Now())
+	store.Close()
+
+	store, err = OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if event := store.Get(3); event == nil || event.Symbol != "BNBBTC" {
+		t.Errorf("expected alert 3 for BNBBTC, got %+v", event)
+	}
+	if lines := countLines(t, filename); lines != 3 {
+		t.Errorf("expected 3 lines, got %d", lines)
+	}
+}
+
+func TestAlertStoreRetention(t *testing.T) {
+	filename, cleanup := tempAlertHistory(t)
+	defer cleanup()
+
+	store, err := OpenAlertStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-4 * time.Hour)
+	for i := 0; i < 4; i++ {
+		addAlert(t, store, "ETHBTC", start.Add(time.Duration(i)*time.Minute))
+	}
+	if _, total := store.Query(AlertQuery{Limit: 10}); total != 4 {
+		t.Fatalf("expected 4 alerts, got %d", total)
+	}
+
+	// Adding an alert 2 hours later drops those more than an hour older.
+	later := start.Add(2 * time.Hour)
+	addAlert(t, store, "ETHBTC", later)
+	if _, total := store.Query(AlertQuery{Limit: 10}); total != 1 {
+		t.Errorf("expected 1 alert, got %d", total)
+	}
+	if event := store.Get(1); event != nil {
+		t.Errorf("expected alert 1 to be pruned, got %+v", event)
+	}
+
+	// Most of the file is now pruned alerts so it is rewritten.
+	if lines := countLines(t, filename); lines != 1 {
+		t.Errorf("expected the file to be compacted to 1 line, got %d", lines)
+	}
+	store.Close()
+
+	// The newest alert is kept though expired so IDs aren't reused.
+	store, err = OpenAlertStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, total := store.Query(AlertQuery{Limit: 10}); total != 1 {
+		t.Errorf("expected 1 alert, got %d", total)
+	}
+	event := addAlert(t, store, "ETHBTC", time.Now())
+	if event.Id != 6 {
+		t.Errorf("expected IDs to continue at 6, got %d", event.Id)
+	}
+	if _, total := store.Query(AlertQuery{Limit: 10}); total != 1 {
+		t.Errorf("expected only the new alert, got %d", total)
+	}
+}
+
+func TestAlertStoreCompactsOnOpen(t *testing.T) {
+	filename, cleanup := tempAlertHistory(t)
+	defer cleanup()
+
+	store, err := OpenAlertStore(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-4 * time.Hour)
+	for i := 0; i < 3; i++ {
+		addAlert(t, store, "ETHBTC", start.Add(time.Duration(i)*time.Minute))
+	}
+	addAlert(t, store, "LTCBTC", time.Now())
+	store.Close()
+
+	store, err = OpenAlertStore(filename, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if events, total := store.Query(AlertQuery{Limit: 10}); total != 1 || events[0].Id != 4 {
+		t.Errorf("expected only alert 4, got %d alerts", total)
+	}
+	if lines := countLines(t, filename); lines != 1 {
+		t.Errorf("expected the file to be compacted to 1 line, got %d", lines)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// AlertRule fires when its filter expression matches a symbol's update
+// message. For example:
+//
+//     1m price change:  price_change_pct.1m > 2
+//     net volume spike: nv_1 > 10 && volume > 100
+//     range breakout:   close >= h_60 && rp_60 > 3
+//     thin book:        spread_bps > 20 && book_imbalance < -0.5
+//
+// Once fired the rule does not fire again for the symbol until it has
+// cleared, that is the filter no longer matches or, if set, the clear
+// expression matches, and the cooldown has passed.
+type AlertRule struct {
+	Name string
+
+	// The exchange the rule applies to, all exchanges if empty.
+	Exchange string
+
+	Filter string
+
+	// Optional expression to re-arm the rule, eg. a lower threshold than
+	// the filter so a value hovering around the threshold doesn't fire
+	// repeatedly.
+	Clear string
+
+	Cooldown time.Duration
+
+	// Webhooks to post fired alerts to. If empty the engine's default
+	// webhooks are used.
+	Webhooks []string
+}
+
+// AlertEvent is a fired alert as posted to webhooks.
+type AlertEvent struct {
+	Id        int64                  `json:"id"`
+	Exchange  string                 `json:"exchange"`
+	Symbol    string                 `json:"symbol"`
+	Rule      string                 `json:"rule"`
+	Timestamp time.Time              `json:"timestamp"`
+	Ticker    map[string]interface{} `json:"ticker"`
+}
+
+// The number of fired alerts that can be waiting to be recorded and
+// delivered before new alerts are dropped.
+const alertQueueSize = 1000
+
+type alertState struct {
+	armed     bool
+	lastFired time.Time
+}
+
+type firedAlert struct {
+	event    *AlertEvent
+	webhooks []string
+}
+
+type alertRule struct {
+	AlertRule
+	filter *pkg.Filter
+	clear  *pkg.Filter
+
+	// Keyed by exchange and symbol.
+	states map[string]*alertState
+}
+
+// AlertEngine evaluates the alert rules against update messages and
+// delivers fired alerts to webhooks. Fired alerts are recorded and
+// delivered in the background so Evaluate never waits on I/O.
+type AlertEngine struct {
+	rules    []*alertRule
+	notifier *WebhookNotifier
+	clock    pkg.Clock
+	lock     sync.Mutex
+	queue    chan firedAlert
+
+	// Fired alerts are recorded here if set. It must be set before the
+	// first call to Evaluate.
+	Store *AlertStore
+}
+
+func NewAlertEngine(rules []AlertRule, webhooks []string, clock pkg.Clock) (*AlertEngine, error) {
+	engine := &AlertEngine{
+		notifier: NewWebhookNotifier(),
+		clock:    clock,
+		queue:    make(chan firedAlert, alertQueueSize),
+	}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("alert rule without a name")
+		}
+		filter, err := pkg.ParseFilter(rule.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %s: filter: %v", rule.Name, err)
+		}
+		var clear *pkg.Filter
+		if rule.Clear != "" {
+			clear, err = pkg.ParseFilter(rule.Clear)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %s: clear: %v", rule.Name, err)
+			}
+		}
+		if len(rule.Webhooks) == 0 {
+			rule.Webhooks = webhooks
+		}
+		engine.rules = append(engine.rules, &alertRule{
+			AlertRule: rule,
+			filter:    filter,
+			clear:     clear,
+			states:    map[string]*alertState{},
+		})
+	}
+	go engine.dispatch()
+	return engine, nil
+}
+
+// Evaluate checks each rule against a symbol's update message, which must
+// not be modified afterwards. Fired alerts are returned and queued to be
+// recorded and delivered. A nil engine has no rules.
+func (e *AlertEngine) Evaluate(exchange string, update map[string]interface{}) []*AlertEvent {
+	if e == nil {
+		return nil
+	}
+
+	symbol, _ := update["symbol"].(string)
+	key := exchange + ":" + symbol
+	now := e.clock.Now()
+	fired := []*AlertEvent{}
+
+	e.lock.Lock()
+	for _, rule := range e.rules {
+		if rule.Exchange != "" && rule.Exchange != exchange {
+			continue
+		}
+
+		state := rule.states[key]
+		if state == nil {
+			state = &alertState{armed: true}
+			rule.states[key] = state
+		}
+
+		match := rule.filter.Match(update)
+
+		if !state.armed {
+			if rule.clear != nil {
+				state.armed = rule.clear.Match(update)
+			} else {
+				state.armed = !match
+			}
+			continue
+		}
+
+		if !match || now.Sub(state.lastFired) < rule.Cooldown {
+			continue
+		}
+
+		state.armed = false
+		state.lastFired = now
+		event := &AlertEvent{
+			Exchange:  exchange,
+			Symbol:    symbol,
+			Rule:      rule.Name,
+			Timestamp: now,
+			Ticker:    update,
+		}
+		fired = append(fired, event)
+		log.Printf("alert: %s: %s: %s\n", rule.Name, exchange, symbol)
+		select {
+		case e.queue <- firedAlert{event: event, webhooks: rule.Webhooks}:
+		default:
+			log.Printf("error: alerts: queue full, dropping alert %s: %s: %s\n",
+				rule.Name, exchange, symbol)
+		}
+	}
+	e.lock.Unlock()
+
+	return fired
+}
+
+// dispatch records each fired alert, assigning its ID, then hands it to the
+// notifier for delivery.
+func (e *AlertEngine) dispatch() {
+	for alert := range e.queue {
+		if e.Store != nil {
+			if err := e.Store.Add(alert.event); err != nil {
+				log.Printf("error: alerts: failed to record alert: %v\n", err)
+			}
+		}
+		for _, url := range alert.webhooks {
+			e.notifier.Notify(url, alert.event)
+		}
+	}
+}
+
+// WebhookNotifier posts alert events to webhooks as JSON, retrying failed
+// deliveries with an increasing delay.
+type WebhookNotifier struct {
+	client *http.Client
+
+	// The number of attempts made to deliver an event.
+	MaxAttempts int
+
+	// The delay before the first retry, doubled on each retry.
+	RetryDelay time.Duration
+}
+
+func NewWebhookNotifier() *WebhookNotifier {
+	return &WebhookNotifier{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		MaxAttempts: 5,
+		RetryDelay:  time.Second,
+	}
+}
+
+// Notify delivers the event in the background.
+func (n *WebhookNotifier) Notify(url string, event *AlertEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error: alerts: failed to encode event: %v\n", err)
+		return
+	}
+	go n.deliver(url, body)
+}
+
+func (n *WebhookNotifier) deliver(url string, body []byte) {
+	delay := n.RetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= n.MaxAttempts {
+			log.Printf("error: alerts: giving up on webhook %s after %d attempts: %v\n",
+				url, attempt, err)
+			return
+		}
+		log.Printf("warning: alerts: webhook %s failed, retrying in %v: %v\n",
+			url, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes a single delivery attempt, returning whether a failure is
+// worth retrying.
+func (n *WebhookNotifier) post(url string, body []byte) (bool, error) {
+	response, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("status %s", response.Status)
+
+	// Client errors other than rate limiting won't succeed on retry.
+	if response.StatusCode >= 400 && response.StatusCode < 500 &&
+		response.StatusCode != http.StatusTooManyRequests {
+		return false, err
+	}
+	return true, err
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// webhookServer responds to each post with the next of its statuses,
+// repeating the last, and records the bodies posted.
+type webhookServer struct {
+	*httptest.Server
+	statuses []int
+	bodies   [][]byte
+	lock     sync.Mutex
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		status := s.statuses[len(s.statuses)-1]
+		if len(s.bodies) < len(s.statuses) {
+			status = s.statuses[len(s.bodies)]
+		}
+		s.bodies = append(s.bodies, body)
+		s.lock.Unlock()
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *webhookServer) attempts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.bodies)
+}
+
+func newTestNotifier() *WebhookNotifier {
+	notifier := NewWebhookNotifier()
+	notifier.MaxAttempts = 3
+	notifier.RetryDelay = time.Millisecond
+	return notifier
+}
+
+func TestWebhookPost(t *testing.T) {
+	tests := []struct {
+		status int
+		retry  bool
+		err    bool
+	}{
+		{http.StatusOK, false, false},
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, false, true},
+		{http.StatusNotFound, false, true},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusInternalServerError, true, true},
+		{http.StatusServiceUnavailable, true, true},
+	}
+	notifier := newTestNotifier()
+	for _, test := range tests {
+		server := newWebhookServer(test.status)
+		retry, err := notifier.post(server.URL, []byte(`{}`))
+		server.Close()
+		if retry != test.retry || (err != nil) != test.err {
+			t.Errorf("status %d: expected retry %v, error %v; got %v, %v",
+				test.status, test.retry, test.err, retry, err)
+		}
+	}
+}
+
+func TestWebhookPostConnectionError(t *testing.T) {
+	server := newWebhookServer(http.StatusOK)
+	url := server.URL
+	server.Close()
+	retry, err := newTestNotifier().post(url, []byte(`{}`))
+	if err == nil || !retry {
+		t.Fatalf("expected a retryable error, got %v, %v", retry, err)
+	}
+}
+
+func TestWebhookDeliverRetries(t *testing.T) {
+	server := newWebhookServer(http.StatusServiceUnavailable,
+		http.StatusInternalServerError, http.StatusOK)
+	defer server.Close()
+	newTestNotifier().deliver(server.URL, []byte(`{"id":1}`))
+	if attempts := server.attempts(); attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	for _, body := range server.bodies {
+		if string(body) != `{"id":1}` {
+			t.Errorf("unexpected body %s", body)
+		}
+	}
+}
+
+func TestWebhookDeliverGivesUp(t *testing.T) {
+	server := newWebhookServer(http.StatusInternalServerError)
+	defer server.Close()
+	newTestNotifier().deliver(server.URL, []byte(`{}`))
+	if attempts := server.attempts(); attempts != 3 {
+		t.Fatalf("expected MaxAttempts of 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWebhookDeliverClientError(t *testing.T) {
+	server := newWebhookServer(http.StatusBadRequest, http.StatusOK)
+	defer server.Close()
+	newTestNotifier().deliver(server.URL, []byte(`{}`))
+	if attempts := server.attempts(); attempts != 1 {
+		t.Fatalf("expected no retry after a client error, got %d attempts", attempts)
+	}
+}
+
+func TestAlertEngineRecordsAndDelivers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenAlertStore(filepath.Join(dir, "alerts.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	server := newWebhookServer(http.StatusOK)
+	defer server.Close()
+
+	clock := pkg.NewManualClock(time.Unix(1500000000, 0))
+	engine, err := NewAlertEngine([]AlertRule{{
+		Name:   "spike",
+		Filter: "close > 2",
+	}}, []string{server.URL}, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Store = store
+
+	fired := engine.Evaluate("binance", map[string]interface{}{
+		"symbol": "ETHBTC",
+		"close":  3.0,
+	})
+	if len(fired) != 1 {
+		t.Fatalf("expected 1 alert, got %d", len(fired))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.attempts() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the webhook")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var event AlertEvent
+	if err := json.Unmarshal(server.bodies[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Id != 1 || event.Symbol != "ETHBTC" || event.Rule != "spike" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if recorded := store.Get(1); recorded == nil || recorded.Symbol != "ETHBTC" {
+		t.Errorf("alert not recorded: %+v", recorded)
+	}
+}
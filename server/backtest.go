@@ -0,0 +1,418 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// The horizons forward returns are calculated at if none are given.
+var DefaultBacktestHorizons = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+}
+
+// How long an exchange must go without a message after the replay is done
+// for its backtest to be considered finished.
+const backtestIdleTimeout = time.Second
+
+type BacktestOptions struct {
+	Exchanges []string
+
+	// Metric buckets by exchange name, as in Options.
+	Buckets map[string][]pkg.Bucket
+
+	// Evaluated as alert rules, so a rule triggers once per symbol until
+	// it clears. Webhooks are ignored.
+	Rules []AlertRule
+
+	Horizons []time.Duration
+
+	Player *pkg.Player
+}
+
+// BacktestTrigger is a rule triggering for a symbol, with the percentage
+// return from the trigger price at each horizon, keyed by horizon name.
+// Returns are nil if the replay ended before the horizon.
+type BacktestTrigger struct {
+	Rule     string              `json:"rule"`
+	Exchange string              `json:"exchange"`
+	Symbol   string              `json:"symbol"`
+	Time     time.Time           `json:"time"`
+	Price    float64             `json:"price"`
+	Returns  map[string]*float64 `json:"returns"`
+}
+
+// BacktestReturns summarizes the forward returns of a rule's triggers at
+// a horizon. Count is the number of triggers with a return.
+type BacktestReturns struct {
+	Horizon string  `json:"horizon"`
+	Count   int     `json:"count"`
+	Mean    float64 `json:"mean"`
+	Median  float64 `json:"median"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+
+	// The percentage of returns greater than 0.
+	WinRate float64 `json:"win_rate"`
+}
+
+type BacktestRuleReport struct {
+	Rule    string            `json:"rule"`
+	Hits    int               `json:"hits"`
+	Returns []BacktestReturns `json:"returns"`
+}
+
+type BacktestReport struct {
+	Start    time.Time             `json:"start"`
+	End      time.Time             `json:"end"`
+	Horizons []string              `json:"horizons"`
+	Rules    []*BacktestRuleReport `json:"rules"`
+	Triggers []*BacktestTrigger    `json:"triggers"`
+}
+
+// HorizonName returns the name of a horizon as used in reports, eg. 5m
+// or 60m.
+func HorizonName(horizon time.Duration) string {
+	if horizon >= time.Minute && horizon%time.Minute == 0 {
+		return fmt.Sprintf("%dm", horizon/time.Minute)
+	}
+	return horizon.String()
+}
+
+type backtest struct {
+	options BacktestOptions
+	engine  *AlertEngine
+	report  *BacktestReport
+	lock    sync.Mutex
+}
+
+// RunBacktest replays the player's recording through the trackers of each
+// exchange, evaluating the rules against each update as the server would,
+// and reports the triggers and their forward returns.
+func RunBacktest(options BacktestOptions) (*BacktestReport, error) {
+	if len(options.Horizons) == 0 {
+		options.Horizons = DefaultBacktestHorizons
+	}
+	rules := []AlertRule{}
+	for _, rule := range options.Rules {
+		rule.Webhooks = nil
+		rules = append(rules, rule)
+	}
+	clock := options.Player.Clock
+	engine, err := NewAlertEngine(rules, nil, clock)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &backtest{
+		options: options,
+		engine:  engine,
+		report: &BacktestReport{
+			Start:    clock.Now(),
+			Horizons: []string{},
+			Triggers: []*BacktestTrigger{},
+		},
+	}
+	for _, horizon := range options.Horizons {
+		b.report.Horizons = append(b.report.Horizons, HorizonName(horizon))
+	}
+
+	playerDone := make(chan bool)
+	wg := sync.WaitGroup{}
+	for _, name := range options.Exchanges {
+		exchange, err := NewReplayExchange(name, options.Player)
+		if err != nil {
+			return nil, err
+		}
+		buckets := Options{Buckets: options.Buckets}.GetBuckets(name)
+		runner := NewExchangeRunner(exchange, clock, buckets)
+		wg.Add(1)
+		go func() {
+			b.runExchange(runner, playerDone)
+			wg.Done()
+		}()
+	}
+
+	options.Player.Run()
+	close(playerDone)
+	wg.Wait()
+
+	b.report.End = clock.Now()
+	b.summarize(rules)
+	return b.report, nil
+}
+
+// runExchange feeds the exchange's tickers and trades into the runner's
+// trackers, returning once the replay is done and the exchange has gone
+// idle.
+func (b *backtest) runExchange(runner *ExchangeRunner, playerDone chan bool) {
+	name := runner.Name()
+
+	var tradeChannel chan pkg.CommonTrade
+	if tradeFeed := runner.exchange.TradeFeed(); tradeFeed != nil {
+		tradeChannel = tradeFeed.Subscribe()
+		go tradeFeed.Run(time.Time{})
+	}
+	tickerChannel := make(chan []pkg.CommonTicker)
+	go runner.exchange.TickerFeed().Run(tickerChannel)
+
+	// Triggers waiting for a return, by symbol then horizon.
+	pending := map[string][][]*BacktestTrigger{}
+
+	lastUpdate := runner.clock.Now()
+	var idle <-chan time.Time
+	for {
+		select {
+		case <-playerDone:
+			playerDone = nil
+			idle = time.After(backtestIdleTimeout)
+
+		case <-idle:
+			return
+
+		case trade := <-tradeChannel:
+			tracker := runner.trackers.GetTracker(trade.Symbol)
+			tracker.Lock.Lock()
+			tracker.AddTrade(trade)
+			tracker.Lock.Unlock()
+
+		case tickers := <-tickerChannel:
+			runner.updateTrackers(tickers, true)
+			b.resolveReturns(pending, tickers)
+
+			for _, tracker := range runner.trackers.Trackers() {
+				tracker.Lock.RLock()
+				if tracker.LastUpdate.Before(lastUpdate) {
+					tracker.Lock.RUnlock()
+					continue
+				}
+				update := buildUpdateMessage(tracker)
+				tracker.Lock.RUnlock()
+				for _, event := range b.engine.Evaluate(name, update) {
+					trigger := b.addTrigger(event, update)
+					if pending[trigger.Symbol] == nil {
+						pending[trigger.Symbol] = make([][]*BacktestTrigger,
+							len(b.options.Horizons))
+					}
+					for i := range b.options.Horizons {
+						pending[trigger.Symbol][i] = append(
+							pending[trigger.Symbol][i], trigger)
+					}
+				}
+			}
+			lastUpdate = runner.clock.Now()
+		}
+
+		if playerDone == nil {
+			idle = time.After(backtestIdleTimeout)
+		}
+	}
+}
+
+func (b *backtest) addTrigger(event *AlertEvent, update map[string]interface{}) *BacktestTrigger {
+	trigger := &BacktestTrigger{
+		Rule:     event.Rule,
+		Exchange: event.Exchange,
+		Symbol:   event.Symbol,
+		Time:     event.Timestamp,
+		Returns:  map[string]*float64{},
+	}
+	// Returns are measured against ticker times, so use the time of the
+	// ticker that triggered.
+	if timestamp, ok := update["timestamp"].(time.Time); ok {
+		trigger.Time = timestamp
+	}
+	trigger.Price, _ = update["close"].(float64)
+	for _, name := range b.report.Horizons {
+		trigger.Returns[name] = nil
+	}
+	b.lock.Lock()
+	b.report.Triggers = append(b.report.Triggers, trigger)
+	b.lock.Unlock()
+	return trigger
+}
+
+// resolveReturns sets the returns of the pending triggers whose horizon
+// has been reached by the tickers. Triggers are pending in time order, so
+// only the front of each queue needs checking.
+func (b *backtest) resolveReturns(pending map[string][][]*BacktestTrigger, tickers []pkg.CommonTicker) {
+	for _, ticker := range tickers {
+		queues := pending[ticker.Symbol]
+		if queues == nil {
+			continue
+		}
+		for i, horizon := range b.options.Horizons {
+			queue := queues[i]
+			for len(queue) > 0 && !queue[0].Time.Add(horizon).After(ticker.Timestamp) {
+				trigger := queue[0]
+				if trigger.Price > 0 {
+					value := pkg.Round3((ticker.LastPrice - trigger.Price) / trigger.Price * 100)
+					b.lock.Lock()
+					trigger.Returns[b.report.Horizons[i]] = &value
+					b.lock.Unlock()
+				}
+				queue = queue[1:]
+			}
+			queues[i] = queue
+		}
+	}
+}
+
+func (b *backtest) summarize(rules []AlertRule) {
+	sort.SliceStable(b.report.Triggers, func(i, j int) bool {
+		return b.report.Triggers[i].Time.Before(b.report.Triggers[j].Time)
+	})
+
+	b.report.Rules = []*BacktestRuleReport{}
+	for _, rule := range rules {
+		report := &BacktestRuleReport{
+			Rule:    rule.Name,
+			Returns: []BacktestReturns{},
+		}
+		returns := make([][]float64, len(b.report.Horizons))
+		for _, trigger := range b.report.Triggers {
+			if trigger.Rule != rule.Name {
+				continue
+			}
+			report.Hits++
+			for i, name := range b.report.Horizons {
+				if value := trigger.Returns[name]; value != nil {
+					returns[i] = append(returns[i], *value)
+				}
+			}
+		}
+		for i, name := range b.report.Horizons {
+			report.Returns = append(report.Returns, summarizeReturns(name, returns[i]))
+		}
+		b.report.Rules = append(b.report.Rules, report)
+		log.Printf("backtest: %s: %d hits\n", rule.Name, report.Hits)
+	}
+}
+
+func summarizeReturns(horizon string, values []float64) BacktestReturns {
+	summary := BacktestReturns{
+		Horizon: horizon,
+		Count:   len(values),
+	}
+	if len(values) == 0 {
+		return summary
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	sum := float64(0)
+	wins := 0
+	for _, value := range sorted {
+		sum += value
+		if value > 0 {
+			wins++
+		}
+	}
+	summary.Mean = pkg.Round3(sum / float64(len(sorted)))
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		summary.Median = pkg.Round3((sorted[middle-1] + sorted[middle]) / 2)
+	} else {
+		summary.Median = sorted[middle]
+	}
+	summary.Min = sorted[0]
+	summary.Max = sorted[len(sorted)-1]
+	summary.WinRate = pkg.Round3(float64(wins) / float64(len(sorted)) * 100)
+	return summary
+}
+
+func (r *BacktestReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteTriggersCSV writes a row for each trigger with a column for the
+// return at each horizon, empty if there is no return.
+func (r *BacktestReport) WriteTriggersCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"rule", "exchange", "symbol", "time", "price"}
+	for _, name := range r.Horizons {
+		header = append(header, "return_"+name)
+	}
+	writer.Write(header)
+	for _, trigger := range r.Triggers {
+		row := []string{
+			trigger.Rule,
+			trigger.Exchange,
+			trigger.Symbol,
+			trigger.Time.UTC().Format(time.RFC3339Nano),
+			formatFloat(trigger.Price),
+		}
+		for _, name := range r.Horizons {
+			value := ""
+			if trigger.Returns[name] != nil {
+				value = formatFloat(*trigger.Returns[name])
+			}
+			row = append(row, value)
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteSummaryCSV writes a row for each rule and horizon. The statistics
+// are empty for horizons without returns.
+func (r *BacktestReport) WriteSummaryCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"rule", "hits", "horizon", "count", "mean",
+		"median", "min", "max", "win_rate"})
+	for _, rule := range r.Rules {
+		for _, returns := range rule.Returns {
+			row := []string{
+				rule.Rule,
+				strconv.Itoa(rule.Hits),
+				returns.Horizon,
+				strconv.Itoa(returns.Count),
+			}
+			for _, value := range []float64{returns.Mean, returns.Median,
+				returns.Min, returns.Max, returns.WinRate} {
+				if returns.Count == 0 {
+					row = append(row, "")
+				} else {
+					row = append(row, formatFloat(value))
+				}
+			}
+			writer.Write(row)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
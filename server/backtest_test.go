@@ -0,0 +1,265 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/binance"
+)
+
+func TestSummarizeReturns(t *testing.T) {
+	for _, test := range []struct {
+		values   []float64
+		expected BacktestReturns
+	}{
+		{
+			values:   nil,
+			expected: BacktestReturns{Horizon: "1m"},
+		},
+		{
+			values: []float64{2},
+			expected: BacktestReturns{Horizon: "1m", Count: 1, Mean: 2,
+				Median: 2, Min: 2, Max: 2, WinRate: 100},
+		},
+		{
+			// Odd, the middle value once sorted.
+			values: []float64{3, -1, 1},
+			expected: BacktestReturns{Horizon: "1m", Count: 3, Mean: 1,
+				Median: 1, Min: -1, Max: 3, WinRate: 66.667},
+		},
+		{
+			// Even, the mean of the middle two.
+			values: []float64{4, -2, 1, 0},
+			expected: BacktestReturns{Horizon: "1m", Count: 4, Mean: 0.75,
+				Median: 0.5, Min: -2, Max: 4, WinRate: 50},
+		},
+		{
+			// A return of 0 is not a win.
+			values: []float64{0, -1},
+			expected: BacktestReturns{Horizon: "1m", Count: 2, Mean: -0.5,
+				Median: -0.5, Min: -1, Max: 0, WinRate: 0},
+		},
+	} {
+		if summary := summarizeReturns("1m", test.values); summary != test.expected {
+			t.Errorf("%v: expected %+v, got %+v", test.values, test.expected, summary)
+		}
+	}
+}
+
+func returnOf(value float64) *float64 {
+	return &value
+}
+
+// TestBacktestSummarize checks the hits of each rule are counted, with
+// the returns at each horizon leaving out the triggers without one.
+func TestBacktestSummarize(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	b := &backtest{
+		report: &BacktestReport{
+			Horizons: []string{"1m", "5m"},
+			Triggers: []*BacktestTrigger{
+				{Rule: "up", Symbol: "ETHBTC", Time: start.Add(time.Minute),
+					Returns: map[string]*float64{"1m": returnOf(-1), "5m": nil}},
+				{Rule: "up", Symbol: "LTCBTC", Time: start,
+					Returns: map[string]*float64{"1m": returnOf(2), "5m": returnOf(4)}},
+				{Rule: "down", Symbol: "ETHBTC", Time: start,
+					Returns: map[string]*float64{"1m": nil, "5m": nil}},
+			},
+		},
+	}
+	b.summarize([]AlertRule{{Name: "up"}, {Name: "down"}, {Name: "never"}})
+
+	if b.report.Triggers[0].Symbol != "LTCBTC" || b.report.Triggers[2].Rule != "up" {
+		t.Errorf("expected the triggers in time order")
+	}
+	if len(b.report.Rules) != 3 {
+		t.Fatalf("expected 3 rule reports, got %d", len(b.report.Rules))
+	}
+	up := b.report.Rules[0]
+	if up.Rule != "up" || up.Hits != 2 {
+		t.Errorf("expected 2 hits of up, got %+v", up)
+	}
+	expected := []BacktestReturns{
+		{Horizon: "1m", Count: 2, Mean: 0.5, Median: 0.5, Min: -1, Max: 2, WinRate: 50},
+		{Horizon: "5m", Count: 1, Mean: 4, Median: 4, Min: 4, Max: 4, WinRate: 100},
+	}
+	for i, returns := range up.Returns {
+		if returns != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], returns)
+		}
+	}
+	for _, report := range b.report.Rules[1:] {
+		hits := map[string]int{"down": 1, "never": 0}[report.Rule]
+		if report.Hits != hits {
+			t.Errorf("expected %d hits of %s, got %d", hits, report.Rule, report.Hits)
+		}
+		for _, returns := range report.Returns {
+			if returns.Count != 0 {
+				t.Errorf("%s: expected no returns, got %+v", report.Rule, returns)
+			}
+		}
+	}
+}
+
+// TestBacktestResolveReturns checks a return is set by the first ticker
+// at or after each horizon, and left nil past the end of the replay.
+func TestBacktestResolveReturns(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	b := &backtest{
+		options: BacktestOptions{
+			Horizons: []time.Duration{time.Minute, 5 * time.Minute, time.Hour},
+		},
+		report: &BacktestReport{
+			Horizons: []string{"1m", "5m", "60m"},
+		},
+	}
+	pending := map[string][][]*BacktestTrigger{}
+	trigger := b.addTrigger(&AlertEvent{Rule: "up", Symbol: "ETHBTC"},
+		map[string]interface{}{"timestamp": start, "close": 2.0})
+	pending["ETHBTC"] = [][]*BacktestTrigger{{trigger}, {trigger}, {trigger}}
+
+	ticker := func(offset time.Duration, price float64) []pkg.CommonTicker {
+		return []pkg.CommonTicker{
+			{Symbol: "LTCBTC", Timestamp: start.Add(offset), LastPrice: 100},
+			{Symbol: "ETHBTC", Timestamp: start.Add(offset), LastPrice: price},
+		}
+	}
+	b.resolveReturns(pending, ticker(59*time.Second, 3))
+	b.resolveReturns(pending, ticker(time.Minute, 2.5))
+	b.resolveReturns(pending, ticker(6*time.Minute, 1.5))
+	b.resolveReturns(pending, ticker(7*time.Minute, 4))
+
+	for horizon, expected := range map[string]*float64{
+		"1m":  returnOf(25),
+		"5m":  returnOf(-25),
+		"60m": nil,
+	} {
+		value := trigger.Returns[horizon]
+		if (value == nil) != (expected == nil) ||
+			(value != nil && *value != *expected) {
+			t.Errorf("%s: expected a return of %v, got %v", horizon,
+				expected, value)
+		}
+	}
+}
+
+// writeBinanceTickers records a ticker stream message for each ticker.
+func writeBinanceTickers(recorder *pkg.Recorder, clock *pkg.ManualClock,
+	at time.Time, prices map[string]float64) {
+	clock.Set(at)
+	events := []map[string]interface{}{}
+	for symbol, price := range prices {
+		millis := at.UnixNano() / int64(time.Millisecond)
+		formatted := strconv.FormatFloat(price, 'f', -1, 64)
+		events = append(events, map[string]interface{}{
+			"e": "24hrTicker",
+			"E": millis,
+			"s": symbol,
+			"P": "0",
+			"c": formatted,
+			"b": formatted,
+			"a": formatted,
+			"h": formatted,
+			"l": formatted,
+			"v": "1000",
+			"q": "1000",
+			"O": millis - int64(24*time.Hour/time.Millisecond),
+			"C": millis,
+		})
+	}
+	buf, _ := json.Marshal(map[string]interface{}{
+		"stream": "!ticker@arr",
+		"data":   events,
+	})
+	recorder.Record(binance.RecordSourceTickers, buf)
+}
+
+// TestRunBacktest replays a recording of Binance tickers where ETHBTC
+// rises above the rule's threshold once, 10% more a minute later.
+func TestRunBacktest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	recorder, err := pkg.NewRecorder(dir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= 18; i++ {
+		offset := time.Duration(i) * 10 * time.Second
+		price := 1.0
+		if offset >= 2*time.Minute {
+			price = 1.32
+		} else if offset >= time.Minute {
+			price = 1.2
+		}
+		writeBinanceTickers(recorder, clock, start.Add(offset),
+			map[string]float64{"ETHBTC": price, "LTCBTC": 1})
+	}
+	recorder.Close()
+
+	player, err := pkg.NewPlayer([]string{dir}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := RunBacktest(BacktestOptions{
+		Exchanges: []string{"binance"},
+		Rules: []AlertRule{
+			{Name: "up", Filter: "close > 1.1"},
+			{Name: "never", Filter: "close > 100"},
+		},
+		Horizons: []time.Duration{time.Minute, time.Hour},
+		Player:   player,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Rules) != 2 || report.Rules[0].Hits != 1 ||
+		report.Rules[1].Hits != 0 {
+		t.Fatalf("expected 1 hit of up and none of never, got %+v %+v",
+			report.Rules[0], report.Rules[1])
+	}
+	if len(report.Triggers) != 1 {
+		t.Fatalf("expected 1 trigger, got %d", len(report.Triggers))
+	}
+	trigger := report.Triggers[0]
+	if trigger.Symbol != "ETHBTC" || trigger.Price != 1.2 ||
+		!trigger.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected ETHBTC to trigger at 1.2 after a minute, got %+v", trigger)
+	}
+	if value := trigger.Returns["1m"]; value == nil || *value != 10 {
+		t.Errorf("expected a 1m return of 10, got %v", value)
+	}
+	if value := trigger.Returns["60m"]; value != nil {
+		t.Errorf("expected no 60m return past the end of the replay, got %v", *value)
+	}
+	if !report.Start.Equal(start) || !report.End.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("expected the report to cover the recording, got %v to %v",
+			report.Start, report.End)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/mux"
+)
+
+// CandleHandler serves the candles kept by each exchange's trackers.
+type CandleHandler struct {
+	trackers map[string]*pkg.TickerTrackerMap
+}
+
+func NewCandleHandler() *CandleHandler {
+	return &CandleHandler{
+		trackers: make(map[string]*pkg.TickerTrackerMap),
+	}
+}
+
+func (h *CandleHandler) AddExchange(exchange string, trackers *pkg.TickerTrackerMap) {
+	h.trackers[exchange] = trackers
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": message,
+	})
+}
+
+// Handle returns the candles for a symbol. The interval defaults to 1m and
+// the number of candles returned can be limited with the limit parameter.
+func (h *CandleHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	exchange := mux.Vars(r)["exchange"]
+	trackers := h.trackers[exchange]
+	if trackers == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+
+	symbol := r.FormValue("symbol")
+	if symbol == "" {
+		writeJsonError(w, http.StatusBadRequest, "symbol required")
+		return
+	}
+
+	interval := r.FormValue("interval")
+	if interval == "" {
+		interval = "1m"
+	}
+
+	limit := 0
+	if r.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit < 0 {
+			writeJsonError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+
+	tracker := trackers.Get(symbol)
+	if tracker == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown symbol")
+		return
+	}
+
+	tracker.Lock.RLock()
+	builder := tracker.Candles[interval]
+	var candles []pkg.Candle
+	if builder != nil {
+		candles = builder.GetCandles(limit)
+	}
+	tracker.Lock.RUnlock()
+
+	if builder == nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid interval")
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"exchange": exchange,
+		"symbol":   symbol,
+		"interval": interval,
+		"candles":  candles,
+	})
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/mux"
+)
+
+func TestCandleHandler(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	trackers := pkg.NewTickerTrackerMap(clock, pkg.DefaultBuckets)
+	tracker := trackers.GetTracker("ETHBTC")
+	for i := 0; i < 3; i++ {
+		tracker.AddTrade(pkg.CommonTrade{
+			Symbol:        "ETHBTC",
+			Timestamp:     start.Add(time.Duration(i) * time.Minute),
+			Price:         float64(i + 1),
+			Quantity:      1,
+			QuoteQuantity: float64(i + 1),
+			Side:          pkg.TradeSideBuy,
+		})
+	}
+
+	handler := NewCandleHandler()
+	handler.AddExchange("binance", trackers)
+	router := mux.NewRouter()
+	router.HandleFunc("/api/1/{exchange}/candles", handler.Handle)
+
+	for _, test := range []struct {
+		query   string
+		status  int
+		error   string
+		candles int
+	}{
+		{query: "/api/1/kucoin/candles?symbol=ETHBTC", status: 404,
+			error: "unknown exchange"},
+		{query: "/api/1/binance/candles", status: 400,
+			error: "symbol required"},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&limit=abc", status: 400,
+			error: "invalid limit"},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&limit=-1", status: 400,
+			error: "invalid limit"},
+		{query: "/api/1/binance/candles?symbol=LTCBTC", status: 404,
+			error: "unknown symbol"},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&interval=2m", status: 400,
+			error: "invalid interval"},
+		{query: "/api/1/binance/candles?symbol=ETHBTC", status: 200,
+			candles: 3},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&limit=0", status: 200,
+			candles: 3},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&limit=2", status: 200,
+			candles: 2},
+		{query: "/api/1/binance/candles?symbol=ETHBTC&interval=5m", status: 200,
+			candles: 1},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", test.query, nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.query,
+				test.status, recorder.Code)
+			continue
+		}
+		var response struct {
+			Error   string       `json:"error"`
+			Candles []pkg.Candle `json:"candles"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if response.Error != test.error {
+			t.Errorf("%s: expected the error %q, got %q", test.query,
+				test.error, response.Error)
+		}
+		if len(response.Candles) != test.candles {
+			t.Errorf("%s: expected %d candles, got %d", test.query,
+				test.candles, len(response.Candles))
+		}
+	}
+
+	// The most recent candles are returned when limited.
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET",
+		"/api/1/binance/candles?symbol=ETHBTC&limit=2", nil))
+	var response struct {
+		Candles []pkg.Candle `json:"candles"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Candles) != 2 || response.Candles[0].Close != 2 ||
+		response.Candles[1].Close != 3 {
+		t.Errorf("expected the last 2 candles, got %+v", response.Candles)
+	}
+}
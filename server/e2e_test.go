@@ -0,0 +1,292 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/crankykernel/cryptoxscanner/pkg/binance"
+	"github.com/crankykernel/cryptoxscanner/pkg/fakeexchange"
+	"github.com/crankykernel/cryptoxscanner/pkg/kucoin"
+	"github.com/gorilla/websocket"
+)
+
+const e2eTimeout = 10 * time.Second
+
+// Reconnect quickly so dropped connections don't hold up the tests.
+var e2eBackoffOptions = pkg.BackoffOptions{
+	InitialDelay: 50 * time.Millisecond,
+	MaxDelay:     time.Second,
+	Multiplier:   2,
+}
+
+// e2eClient is a websocket client of the broadcast feed, collecting the
+// ticker updates it is sent.
+type e2eClient struct {
+	server  *httptest.Server
+	conn    *websocket.Conn
+	updates chan map[string]interface{}
+}
+
+// startE2E runs exchange through an ExchangeRunner, connecting a client to
+// its broadcast feed.
+func startE2E(t *testing.T, exchange pkg.Exchange) *e2eClient {
+	t.Helper()
+	runner := NewExchangeRunner(exchange, pkg.SystemClock{}, pkg.DefaultBuckets)
+	handler := NewBroadcastWebSocketHandler()
+	handler.Feed = runner
+	runner.websocket = handler
+	runner.Run()
+
+	client := &e2eClient{
+		server:  httptest.NewServer(http.HandlerFunc(handler.Handle)),
+		updates: make(chan map[string]interface{}, 1000),
+	}
+	url := "ws" + strings.TrimPrefix(client.server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		client.server.Close()
+		t.Fatal(err)
+	}
+	client.conn = conn
+	go client.read()
+	return client
+}
+
+func (c *e2eClient) Close() {
+	c.conn.Close()
+	c.server.Close()
+}
+
+// read queues the tickers of each broadcast, skipping status messages.
+func (c *e2eClient) read() {
+	for {
+		_, buf, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message struct {
+			Tickers []map[string]interface{} `json:"tickers"`
+		}
+		if err := json.Unmarshal(buf, &message); err != nil {
+			continue
+		}
+		for _, update := range message.Tickers {
+			c.updates <- update
+		}
+	}
+}
+
+// waitForUpdate calls send, which should cause an update of symbol to be
+// broadcast, until an update of symbol matches. The update is returned.
+func (c *e2eClient) waitForUpdate(t *testing.T, symbol string, send func(),
+	match func(update map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	deadline := time.After(e2eTimeout)
+	var last map[string]interface{}
+	for {
+		send()
+		timeout := time.After(100 * time.Millisecond)
+	Read:
+		for {
+			select {
+			case update := <-c.updates:
+				if update["symbol"] != symbol {
+					continue
+				}
+				last = update
+				if match(update) {
+					return update
+				}
+			case <-timeout:
+				break Read
+			case <-deadline:
+				t.Fatalf("timed out waiting for a matching %s update, last was %v",
+					symbol, last)
+			}
+		}
+	}
+}
+
+// hasValue returns a match for updates where key is value.
+func hasValue(key string, value float64) func(map[string]interface{}) bool {
+	return func(update map[string]interface{}) bool {
+		got, ok := update[key].(float64)
+		return ok && math.Abs(got-value) < 1e-6
+	}
+}
+
+// waitReconnected waits until every stream of exchange has reconnected
+// since the connections were dropped.
+func waitReconnected(t *testing.T, exchange pkg.Exchange, reconnects int64) {
+	t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for {
+		streams := exchange.Streams()
+		done := len(streams) > 0
+		for _, stream := range streams {
+			done = done && stream.Connected && stream.Reconnects >= reconnects
+		}
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the streams to reconnect: %+v", streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestE2EBinance(t *testing.T) {
+	fake := fakeexchange.NewBinanceServer("ETHBTC", "LTCBTC")
+	defer fake.Close()
+
+	exchange, err := binance.NewExchange(pkg.SystemClock{},
+		pkg.CacheOptions{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange.SetRestUrl(fake.RestUrl())
+	exchange.SetStreamUrl(fake.StreamUrl())
+	exchange.SetBackoffOptions(e2eBackoffOptions)
+	if err := exchange.SetDepthOptions([]string{"ETHBTC"}, 0, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	client := startE2E(t, exchange)
+	defer client.Close()
+	for _, stream := range []string{
+		fakeexchange.BinanceTickerStream, "ethbtc@aggTrade", "ethbtc@depth",
+	} {
+		if err := fake.WaitForStream(stream, e2eTimeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	price := 1.0
+	sendTickers := func() {
+		fake.SendTickers(
+			fakeexchange.Ticker{Symbol: "ETHBTC", LastPrice: price, High: 2,
+				Low: 0.5, QuoteVolume: 100},
+			fakeexchange.Ticker{Symbol: "LTCBTC", LastPrice: 1, High: 2,
+				Low: 0.5, QuoteVolume: 100})
+	}
+	trade := func(quantity float64) fakeexchange.Trade {
+		return fakeexchange.Trade{Symbol: "ETHBTC", Price: 1, Quantity: quantity}
+	}
+
+	// The trade lost from the stream is backfilled.
+	fake.SendTrade(trade(1))
+	fake.LoseTrade(trade(2))
+	fake.SendTrade(trade(3))
+	update := client.waitForUpdate(t, "ETHBTC", sendTickers,
+		hasValue("total_volume_60", 6))
+	if update["close"] != 1.0 {
+		t.Errorf("expected a close of 1, got %v", update["close"])
+	}
+
+	// The order book is resynced after the lost update.
+	fake.SendDepthUpdate(fakeexchange.DepthUpdate{
+		Symbol: "ETHBTC",
+		Bids:   []fakeexchange.Level{{Price: 0.9, Quantity: 10}},
+		Asks:   []fakeexchange.Level{{Price: 1.1, Quantity: 10}},
+	})
+	client.waitForUpdate(t, "ETHBTC", sendTickers, hasValue("bid_depth", 9))
+	fake.LoseDepthUpdate(fakeexchange.DepthUpdate{
+		Symbol: "ETHBTC",
+		Bids:   []fakeexchange.Level{{Price: 0.95, Quantity: 10}},
+	})
+	fake.SendDepthUpdate(fakeexchange.DepthUpdate{
+		Symbol: "ETHBTC",
+		Asks:   []fakeexchange.Level{{Price: 1.05, Quantity: 10}},
+	})
+	update = client.waitForUpdate(t, "ETHBTC", sendTickers,
+		hasValue("bid_depth", 18.5))
+	if !hasValue("ask_depth", 21.5)(update) {
+		t.Errorf("expected an ask depth of 21.5, got %v", update["ask_depth"])
+	}
+
+	// Updates continue after the connections are dropped.
+	fake.DropConnections()
+	waitReconnected(t, exchange, 1)
+	price = 1.5
+	fake.SendTrade(trade(4))
+	update = client.waitForUpdate(t, "ETHBTC", sendTickers,
+		hasValue("total_volume_60", 10))
+	if update["close"] != 1.5 {
+		t.Errorf("expected a close of 1.5, got %v", update["close"])
+	}
+}
+
+func TestE2EKucoin(t *testing.T) {
+	fake := fakeexchange.NewKucoinServer("ETH-BTC", "LTC-BTC")
+	defer fake.Close()
+
+	exchange, err := kucoin.NewExchange(pkg.SystemClock{},
+		pkg.CacheOptions{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange.SetRestUrl(fake.RestUrl())
+	exchange.SetBackoffOptions(e2eBackoffOptions)
+
+	client := startE2E(t, exchange)
+	defer client.Close()
+	if err := fake.WaitForTopic("/market/match:ETH-BTC", e2eTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	price := 1.0
+	sendTickers := func() {
+		fake.SendTickers(
+			fakeexchange.Ticker{Symbol: "ETH-BTC", LastPrice: price, High: 2,
+				Low: 0.5, QuoteVolume: 100},
+			fakeexchange.Ticker{Symbol: "LTC-BTC", LastPrice: 1, High: 2,
+				Low: 0.5, QuoteVolume: 100})
+	}
+	trade := func(quantity float64) fakeexchange.Trade {
+		return fakeexchange.Trade{Symbol: "ETH-BTC", Price: 1, Quantity: quantity}
+	}
+
+	fake.SendTrade(trade(1))
+	fake.SendTrade(trade(2))
+	update := client.waitForUpdate(t, "ETH-BTC", sendTickers,
+		hasValue("total_volume_60", 3))
+	if update["close"] != 1.0 {
+		t.Errorf("expected a close of 1, got %v", update["close"])
+	}
+
+	// Updates continue after the connection is dropped.
+	fake.DropConnections()
+	waitReconnected(t, exchange, 1)
+	if err := fake.WaitForTopic("/market/match:ETH-BTC", e2eTimeout); err != nil {
+		t.Fatal(err)
+	}
+	price = 1.5
+	fake.SendTrade(trade(4))
+	update = client.waitForUpdate(t, "ETH-BTC", sendTickers,
+		hasValue("total_volume_60", 7))
+	if update["close"] != 1.5 {
+		t.Errorf("expected a close of 1.5, got %v", update["close"])
+	}
+}
@@ -24,9 +24,11 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/crankykernel/cryptoxscanner/pkg"
 	"github.com/crankykernel/cryptoxscanner/pkg/binance"
+	"github.com/crankykernel/cryptoxscanner/pkg/kucoin"
 	"crypto/sha256"
 	"encoding/hex"
 	"math/rand"
+	"sync"
 )
 
 var salt []byte
@@ -37,38 +39,228 @@ func init() {
 	rand.Read(salt)
 }
 
+// The exchanges that can be enabled.
+var SupportedExchanges = []string{"binance", "kucoin"}
+
+func NewExchange(name string, clock pkg.Clock, options Options) (pkg.Exchange, error) {
+	switch name {
+	case "binance":
+		exchange, err := binance.NewExchange(clock, options.Cache)
+		if err != nil {
+			return nil, err
+		}
+		if options.BinanceMaxStreams > 0 {
+			exchange.SetMaxStreamsPerConnection(options.BinanceMaxStreams)
+		}
+		if options.BinanceRestUrl != "" {
+			exchange.SetRestUrl(options.BinanceRestUrl)
+		}
+		if options.BinanceStreamUrl != "" {
+			exchange.SetStreamUrl(options.BinanceStreamUrl)
+		}
+		if len(options.BinanceDepthSymbols) > 0 {
+			percent := options.DepthPercent
+			if percent == 0 {
+				percent = pkg.DefaultDepthPercent
+			}
+			if err := exchange.SetDepthOptions(options.BinanceDepthSymbols,
+				options.BinanceDepthLevels, percent); err != nil {
+				return nil, err
+			}
+		}
+		return exchange, nil
+	case "kucoin":
+		exchange, err := kucoin.NewExchange(clock, options.Cache)
+		if err != nil {
+			return nil, err
+		}
+		if options.KucoinRestUrl != "" {
+			exchange.SetRestUrl(options.KucoinRestUrl)
+		}
+		return exchange, nil
+	}
+	return nil, fmt.Errorf("unsupported exchange: %s", name)
+}
+
+// NewReplayExchange creates an exchange fed by the messages replayed by
+// player instead of the live feeds.
+func NewReplayExchange(name string, player *pkg.Player) (pkg.Exchange, error) {
+	switch name {
+	case "binance":
+		return binance.NewReplayExchange(player.Clock, player), nil
+	case "kucoin":
+		return kucoin.NewReplayExchange(player.Clock, player), nil
+	}
+	return nil, fmt.Errorf("unsupported exchange: %s", name)
+}
+
 type Options struct {
 	Port uint16
+
+	// The exchanges to run.
+	Exchanges []string
+
+	// Metric buckets by exchange name. Exchanges without an entry use
+	// pkg.DefaultBuckets.
+	Buckets map[string][]pkg.Bucket
+
+	AlertRules []AlertRule
+
+	// Webhooks for alert rules that don't specify their own.
+	AlertWebhooks []string
+
+	// The backend for the input caches used to restore state on start.
+	Cache pkg.CacheOptions
+
+	// The file fired alerts are recorded in, no history is kept if empty.
+	AlertHistory string
+
+	// How long alerts are kept in the history, forever if 0.
+	AlertRetention time.Duration
+
+	// How often the trackers are snapshotted to the cache backend, never
+	// if 0.
+	SnapshotInterval time.Duration
+
+	// The directory raw exchange messages are recorded to, nothing is
+	// recorded if empty.
+	RecordDir string
+
+	// If set the exchanges are fed from the player instead of the live
+	// feeds, and the player's clock is used.
+	Player *pkg.Player
+
+	// The maximum number of Binance trade streams per connection, the
+	// default if 0.
+	BinanceMaxStreams int
+
+	// The base URLs of the exchange APIs, the real exchanges if empty.
+	BinanceRestUrl   string
+	BinanceStreamUrl string
+	KucoinRestUrl    string
+
+	// The Binance symbols order books are maintained for, none if empty.
+	BinanceDepthSymbols []string
+
+	// The levels of the Binance partial book depth streams, or 0 to sync
+	// the full books from the diff depth streams.
+	BinanceDepthLevels int
+
+	// The distance from the mid price, in percent, order book depth is
+	// measured within, pkg.DefaultDepthPercent if 0.
+	DepthPercent float64
+
+	// How reconnects to the exchanges are backed off,
+	// pkg.DefaultBackoffOptions if not set.
+	Backoff pkg.BackoffOptions
+
+	// When exchange streams are considered stale and reconnected, zero
+	// values disable the checks.
+	Watchdog pkg.WatchdogOptions
 }
 
-func ServerMain(options Options) {
+func (o Options) GetBuckets(exchange string) []pkg.Bucket {
+	if buckets := o.Buckets[exchange]; len(buckets) > 0 {
+		return buckets
+	}
+	return pkg.DefaultBuckets
+}
 
-	// Start the KuCoin runner.
-	kucoinWebSocketHandler := NewBroadcastWebSocketHandler()
-	go KuCoinRunner(kucoinWebSocketHandler)
+func ServerMain(options Options) {
+	var clock pkg.Clock = pkg.SystemClock{}
+	if options.Player != nil {
+		clock = options.Player.Clock
+	}
 
-	// Start the Binance runner. This is a little bit of a message as the
-	// socket can subscribe to specific symbol feeds directly. This should be
-	// abstracted with some sort of broker.
-	binanceFeed := NewBinanceRunner()
-	binanceWebSocketHandler := NewBroadcastWebSocketHandler()
-	binanceFeed.websocket = binanceWebSocketHandler
-	binanceWebSocketHandler.Feed = binanceFeed
-	go binanceFeed.Run()
+	var recorder *pkg.Recorder
+	if options.RecordDir != "" {
+		var err error
+		recorder, err = pkg.NewRecorder(options.RecordDir, clock)
+		if err != nil {
+			log.Fatalf("error: failed to start recording: %v\n", err)
+		}
+	}
 
 	router := mux.NewRouter()
+	candleHandler := NewCandleHandler()
+	screenerHandler := NewScreenerHandler()
 
-	router.HandleFunc("/ws/kucoin/live", kucoinWebSocketHandler.Handle)
-	router.HandleFunc("/ws/kucoin/monitor", kucoinWebSocketHandler.Handle)
+	alerts, err := NewAlertEngine(options.AlertRules, options.AlertWebhooks, clock)
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+	if options.AlertHistory != "" {
+		store, err := OpenAlertStore(options.AlertHistory, options.AlertRetention)
+		if err != nil {
+			log.Fatalf("error: failed to open alert history: %v\n", err)
+		}
+		alerts.Store = store
+		alertHistoryHandler := NewAlertHistoryHandler(store)
+		router.HandleFunc("/api/1/alerts", alertHistoryHandler.HandleList)
+		router.HandleFunc("/api/1/alerts/{id}", alertHistoryHandler.HandleGet)
+	}
+
+	exchanges := map[string]pkg.Exchange{}
+	for _, name := range options.Exchanges {
+		var exchange pkg.Exchange
+		if options.Player != nil {
+			exchange, err = NewReplayExchange(name, options.Player)
+		} else {
+			exchange, err = NewExchange(name, clock, options)
+		}
+		if err != nil {
+			log.Fatalf("error: %v\n", err)
+		}
+		if recorder != nil {
+			exchange.SetRecorder(recorder)
+		}
+		if options.Backoff.InitialDelay > 0 {
+			exchange.SetBackoffOptions(options.Backoff)
+		}
+		exchange.SetWatchdogOptions(options.Watchdog)
+		exchanges[name] = exchange
+
+		runner := NewExchangeRunner(exchange, clock, options.GetBuckets(name))
+		webSocketHandler := NewBroadcastWebSocketHandler()
+		runner.websocket = webSocketHandler
+		runner.alerts = alerts
+		if options.SnapshotInterval > 0 {
+			snapshots, err := pkg.OpenSnapshotStore(options.Cache, name+".snapshot")
+			if err != nil {
+				log.Fatalf("error: %s: failed to open snapshot store: %v\n", name, err)
+			}
+			runner.snapshots = snapshots
+			runner.snapshotInterval = options.SnapshotInterval
+		}
+		webSocketHandler.Feed = runner
+		go runner.Run()
+
+		router.HandleFunc(fmt.Sprintf("/ws/%s/live", name), webSocketHandler.Handle)
+		router.HandleFunc(fmt.Sprintf("/ws/%s/monitor", name), webSocketHandler.Handle)
+		router.HandleFunc(fmt.Sprintf("/ws/%s/symbol", name), webSocketHandler.Handle)
+
+		router.HandleFunc(fmt.Sprintf("/api/1/%s/symbols", name),
+			symbolsHandler(exchange))
+
+		candleHandler.AddExchange(name, runner.trackers)
+		screenerHandler.AddExchange(name, runner.trackers)
+	}
 
-	router.HandleFunc("/ws/binance/live", binanceWebSocketHandler.Handle)
-	router.HandleFunc("/ws/binance/monitor", binanceWebSocketHandler.Handle)
-	router.HandleFunc("/ws/binance/symbol", binanceWebSocketHandler.Handle)
+	if options.Player != nil {
+		go options.Player.Run()
+	}
 
-	router.PathPrefix("/api/1/binance/proxy").Handler(binance.NewApiProxy())
+	binanceRestUrl := binance.DefaultRestUrl
+	if options.BinanceRestUrl != "" {
+		binanceRestUrl = options.BinanceRestUrl
+	}
+	router.PathPrefix("/api/1/binance/proxy").Handler(binance.NewApiProxy(binanceRestUrl))
+	router.HandleFunc("/api/1/{exchange}/candles", candleHandler.Handle)
+	router.HandleFunc("/api/1/{exchange}/screener", screenerHandler.Handle)
 
 	router.HandleFunc("/api/1/ping", pingHandler)
 	router.HandleFunc("/api/1/status/websockets", webSocketsStatusHandler)
+	router.HandleFunc("/api/1/status/streams", streamsStatusHandler(exchanges))
 
 	http.Handle("/", router)
 
@@ -79,6 +271,9 @@ func buildUpdateMessage(tracker *pkg.TickerTracker) map[string]interface{} {
 	last := tracker.LastTick()
 	key := last.Symbol
 
+	priceChange := map[string]float64{}
+	volumeChange := map[string]float64{}
+
 	message := map[string]interface{}{
 		"symbol": key,
 		"close":  last.LastPrice,
@@ -88,45 +283,89 @@ func buildUpdateMessage(tracker *pkg.TickerTracker) map[string]interface{} {
 		"low":    last.Low,
 		"volume": last.QuoteVolume,
 
-		"price_change_pct": map[string]float64{
-			"1m":  tracker.Metrics[1].PriceChangePercent,
-			"5m":  tracker.Metrics[5].PriceChangePercent,
-			"10m": tracker.Metrics[10].PriceChangePercent,
-			"15m": tracker.Metrics[15].PriceChangePercent,
-			"1h":  tracker.Metrics[60].PriceChangePercent,
-			"24h": tracker.LastTick().PriceChangePct24,
-		},
-
-		"volume_change_pct": map[string]float64{
-			"1m":  tracker.Metrics[1].VolumeChangePercent,
-			"2m":  tracker.Metrics[2].VolumeChangePercent,
-			"3m":  tracker.Metrics[3].VolumeChangePercent,
-			"4m":  tracker.Metrics[4].VolumeChangePercent,
-			"5m":  tracker.Metrics[5].VolumeChangePercent,
-			"10m": tracker.Metrics[10].VolumeChangePercent,
-			"15m": tracker.Metrics[15].VolumeChangePercent,
-			"1h":  tracker.Metrics[60].VolumeChangePercent,
-		},
+		"price_change_pct":  priceChange,
+		"volume_change_pct": volumeChange,
 
 		"timestamp": last.Timestamp,
 	}
 
-	for _, bucket := range pkg.Buckets {
-		metrics := tracker.Metrics[bucket]
+	for _, bucket := range tracker.Buckets {
+		metrics := tracker.Metrics[bucket.Name]
+		key := bucket.Key()
+
+		priceChange[bucket.Name] = metrics.PriceChangePercent
+		volumeChange[bucket.Name] = metrics.VolumeChangePercent
 
-		message[fmt.Sprintf("l_%d", bucket)] = metrics.Low
-		message[fmt.Sprintf("h_%d", bucket)] = metrics.High
+		message["l_"+key] = metrics.Low
+		message["h_"+key] = metrics.High
+
+		message["r_"+key] = metrics.Range
+		message["rp_"+key] = metrics.RangePercent
+
+		if tracker.HaveVwap {
+			message["vwap_"+bucket.MinuteKey()] = pkg.Round8(metrics.Vwap)
+		}
+
+		if tracker.HaveTotalVolume {
+			message["total_volume_"+key] = pkg.Round8(metrics.TotalVolume)
+		}
 
-		message[fmt.Sprintf("r_%d", bucket)] = metrics.Range
-		message[fmt.Sprintf("rp_%d", bucket)] = metrics.RangePercent
+		if tracker.HaveNetVolume {
+			message["nv_"+key] = pkg.Round8(metrics.NetVolume)
+		}
 	}
 
+	priceChange["24h"] = last.PriceChangePct24
+
 	message["r_24"] = tracker.H24Metrics.Range
 	message["rp_24"] = tracker.H24Metrics.RangePercent
 
+	if tracker.HaveDepth {
+		message["bid_depth"] = pkg.Round8(tracker.Depth.BidDepth)
+		message["ask_depth"] = pkg.Round8(tracker.Depth.AskDepth)
+		message["spread_bps"] = pkg.Round8(tracker.Depth.SpreadBps)
+		message["book_imbalance"] = pkg.Round8(tracker.Depth.Imbalance)
+	}
+
+	// Indicators are added last so a value named like a built in one,
+	// such as l or h, can't replace it.
+	for _, bucket := range tracker.Buckets {
+		key := bucket.Key()
+		for name, value := range tracker.Metrics[bucket.Name].Indicators {
+			if _, exists := message[name+"_"+key]; exists {
+				warnIndicatorCollision(name + "_" + key)
+				continue
+			}
+			message[name+"_"+key] = value
+		}
+	}
+
 	return message
 }
 
+// The indicator keys already warned about colliding.
+var indicatorCollisions sync.Map
+
+// warnIndicatorCollision logs, once, an indicator value being dropped for
+// having the same key as a built in value.
+func warnIndicatorCollision(key string) {
+	if _, warned := indicatorCollisions.LoadOrStore(key, true); !warned {
+		log.Printf("warning: dropping indicator value %s, the key is already used\n", key)
+	}
+}
+
+func symbolsHandler(exchange pkg.Exchange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		symbols, err := exchange.Symbols()
+		if err != nil {
+			writeJsonError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(symbols)
+	}
+}
+
 func pingHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("content-type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -135,6 +374,19 @@ func pingHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// streamsStatusHandler reports the status of each exchange's websocket
+// connections.
+func streamsStatusHandler(exchanges map[string]pkg.Exchange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := map[string][]pkg.StreamStatus{}
+		for name, exchange := range exchanges {
+			status[name] = exchange.Streams()
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
 func webSocketsStatusHandler(w http.ResponseWriter, r *http.Request) {
 	wsConnectionTracker.Lock.RLock()
 	defer wsConnectionTracker.Lock.RUnlock()
@@ -0,0 +1,54 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// TestBuildUpdateMessageIndicatorCollision checks an indicator value with
+// the key of a built in value doesn't replace it.
+func TestBuildUpdateMessageIndicatorCollision(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	buckets, err := pkg.ParseBuckets([]string{"1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := pkg.NewTickerTracker("ETHBTC", clock, buckets)
+	tracker.Update(pkg.CommonTicker{Symbol: "ETHBTC", Timestamp: start,
+		LastPrice: 1, QuoteVolume: 100})
+	metrics := tracker.Metrics["1m"]
+	metrics.Low = 1
+	metrics.High = 2
+	metrics.Indicators = map[string]float64{
+		"l":   5,
+		"h":   6,
+		"rsi": 50,
+	}
+
+	update := buildUpdateMessage(tracker)
+	if update["l_1"] != 1.0 || update["h_1"] != 2.0 {
+		t.Errorf("expected a low of 1 and high of 2, got %v and %v",
+			update["l_1"], update["h_1"])
+	}
+	if update["rsi_1"] != 50.0 {
+		t.Errorf("expected an rsi of 50, got %v", update["rsi_1"])
+	}
+}
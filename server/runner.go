@@ -0,0 +1,413 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"time"
+	"log"
+	"sync"
+)
+
+// ExchangeRunner feeds an exchange's tickers and trades into its trackers
+// and broadcasts the resulting updates to websocket clients and per symbol
+// subscribers.
+type ExchangeRunner struct {
+	exchange        pkg.Exchange
+	trackers        *pkg.TickerTrackerMap
+	websocket       *TickerWebSocketHandler
+	subscribers     map[string]map[chan interface{}]bool
+	subscribersLock sync.RWMutex
+	clock           pkg.Clock
+
+	// Evaluated against each update, may be nil.
+	alerts *AlertEngine
+
+	// Where snapshots of the trackers are saved every snapshotInterval, so
+	// on start only messages cached since the last snapshot need to be
+	// replayed. No snapshots are taken if nil.
+	snapshots        pkg.SnapshotStore
+	snapshotInterval time.Duration
+
+	// The status last sent to websocket clients.
+	status     FeedStatus
+	statusLock sync.RWMutex
+}
+
+// FeedStatus is sent to websocket clients when any of the exchange's
+// streams becomes degraded or recovers, so stale prices can be flagged.
+type FeedStatus struct {
+	Exchange string `json:"exchange"`
+	Degraded bool   `json:"degraded"`
+
+	// The degraded streams.
+	Streams []pkg.StreamStatus `json:"streams"`
+}
+
+// StatusMessage is the websocket message a FeedStatus is sent in.
+type StatusMessage struct {
+	Status FeedStatus `json:"status"`
+}
+
+func NewExchangeRunner(exchange pkg.Exchange, clock pkg.Clock, buckets []pkg.Bucket) *ExchangeRunner {
+	runner := ExchangeRunner{
+		exchange:    exchange,
+		trackers:    pkg.NewTickerTrackerMap(clock, buckets),
+		subscribers: map[string]map[chan interface{}]bool{},
+		clock:       clock,
+		status: FeedStatus{
+			Exchange: exchange.Name(),
+			Streams:  []pkg.StreamStatus{},
+		},
+	}
+	exchange.SetMaxAge(pkg.BucketRetention(buckets))
+	return &runner
+}
+
+func (r *ExchangeRunner) Name() string {
+	return r.exchange.Name()
+}
+
+func (r *ExchangeRunner) Subscribe(symbol string) chan interface{} {
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	channel := make(chan interface{})
+	if r.subscribers[symbol] == nil {
+		r.subscribers[symbol] = map[chan interface{}]bool{}
+	}
+	r.subscribers[symbol][channel] = true
+	return channel
+}
+
+func (r *ExchangeRunner) Unsubscribe(symbol string, channel chan interface{}) {
+	r.subscribersLock.Lock()
+	defer r.subscribersLock.Unlock()
+	if r.subscribers[symbol] != nil {
+		delete(r.subscribers[symbol], channel)
+		if len(r.subscribers[symbol]) == 0 {
+			delete(r.subscribers, symbol)
+		}
+	}
+}
+
+// publish sends an update to the subscribers of symbol, dropping it for
+// any subscriber that is not ready to receive.
+func (r *ExchangeRunner) publish(symbol string, update interface{}) {
+	r.subscribersLock.RLock()
+	defer r.subscribersLock.RUnlock()
+	for subscriber := range r.subscribers[symbol] {
+		select {
+		case subscriber <- update:
+		default:
+			log.Printf("warning: feed subscriber is blocked\n")
+		}
+	}
+}
+
+// publishAll sends an update to the subscribers of every symbol.
+func (r *ExchangeRunner) publishAll(update interface{}) {
+	r.subscribersLock.RLock()
+	symbols := []string{}
+	for symbol := range r.subscribers {
+		symbols = append(symbols, symbol)
+	}
+	r.subscribersLock.RUnlock()
+	for _, symbol := range symbols {
+		r.publish(symbol, update)
+	}
+}
+
+func (r *ExchangeRunner) Status() FeedStatus {
+	r.statusLock.RLock()
+	defer r.statusLock.RUnlock()
+	return r.status
+}
+
+// checkStatus sends a status message to websocket clients if the set of
+// degraded streams has changed.
+func (r *ExchangeRunner) checkStatus() {
+	status := FeedStatus{
+		Exchange: r.exchange.Name(),
+		Streams:  []pkg.StreamStatus{},
+	}
+	for _, stream := range r.exchange.Streams() {
+		if stream.Degraded {
+			status.Degraded = true
+			status.Streams = append(status.Streams, stream)
+		}
+	}
+
+	r.statusLock.Lock()
+	changed := len(status.Streams) != len(r.status.Streams)
+	for i := 0; !changed && i < len(status.Streams); i++ {
+		changed = status.Streams[i].Name != r.status.Streams[i].Name
+	}
+	if changed {
+		r.status = status
+	}
+	r.statusLock.Unlock()
+	if !changed {
+		return
+	}
+
+	if status.Degraded {
+		log.Printf("warning: %s: feed degraded, %d stale streams\n",
+			status.Exchange, len(status.Streams))
+	} else {
+		log.Printf("%s: feed recovered\n", status.Exchange)
+	}
+	message := StatusMessage{Status: status}
+	if err := r.websocket.BroadcastStatus(message); err != nil {
+		log.Printf("error: %s: broadcasting status: %v\n", status.Exchange, err)
+	}
+	r.publishAll(message)
+}
+
+func (r *ExchangeRunner) Run() {
+	name := r.exchange.Name()
+	lastUpdate := r.clock.Now()
+
+	// Only the messages cached since the snapshot are replayed.
+	replayAfter := r.restoreSnapshot()
+
+	// A nil channel is never ready, so exchanges without trades just
+	// never take the trade case.
+	var tradeChannel chan pkg.CommonTrade
+	if tradeFeed := r.exchange.TradeFeed(); tradeFeed != nil {
+		tradeChannel = tradeFeed.Subscribe()
+		go tradeFeed.Run(replayAfter)
+	}
+
+	// Likewise for exchanges without order books.
+	var depthChannel chan pkg.DepthMetrics
+	if depthFeed := r.exchange.DepthFeed(); depthFeed != nil {
+		depthChannel = depthFeed.Subscribe()
+		go depthFeed.Run()
+	}
+
+	tickerFeed := r.exchange.TickerFeed()
+	tickerChannel := make(chan []pkg.CommonTicker)
+	go tickerFeed.Run(tickerChannel)
+
+	// Cached tickers are replayed while the trade feed restores its cached
+	// trades. New tickers are still read so the stream isn't blocked, but
+	// are queued until the replay is done so they are added to the
+	// trackers after the cached tickers.
+	tickerReplayDone := make(chan bool)
+	go func() {
+		tickerFeed.ReplayCache(replayAfter, func(tickers []pkg.CommonTicker) {
+			r.updateTrackers(tickers, false)
+		})
+		close(tickerReplayDone)
+	}()
+	queuedTickers := [][]pkg.CommonTicker{}
+
+	// Snapshots are taken once the replay is done, and skipped while the
+	// previous one is still being saved.
+	var snapshotTimer <-chan time.Time
+	snapshotSaving := make(chan bool, 1)
+
+	statusTicker := time.NewTicker(time.Second)
+
+	go func() {
+		tradeCount := 0
+		lastTradeTime := time.Time{}
+
+		// Updates the trackers with live tickers and sends out the updates.
+		handleTickers := func(tickers []pkg.CommonTicker, loopStartTime time.Time, waitTime time.Duration) {
+			lastServerTickerTimestamp := time.Time{}
+			for _, ticker := range tickers {
+				if ticker.Timestamp.After(lastServerTickerTimestamp) {
+					lastServerTickerTimestamp = ticker.Timestamp
+				}
+			}
+
+			r.updateTrackers(tickers, true)
+
+			// Create enhanced feed.
+			message := []interface{}{}
+			for _, tracker := range r.trackers.Trackers() {
+				tracker.Lock.RLock()
+				if tracker.LastUpdate.Before(lastUpdate) {
+					tracker.Lock.RUnlock()
+					continue
+				}
+				update := buildUpdateMessage(tracker)
+				tracker.Lock.RUnlock()
+				message = append(message, update)
+				r.publish(tracker.Symbol, update)
+				r.alerts.Evaluate(name, update)
+			}
+			if err := r.websocket.Broadcast(TickerStream{Tickers: message,}); err != nil {
+				log.Printf("error: %s: broadcasting message: %v", name, err)
+			}
+
+			now := r.clock.Now()
+			lastUpdate = now;
+			processingTime := time.Now().Sub(loopStartTime) - waitTime
+			lagTime := now.Sub(lastServerTickerTimestamp)
+
+			if tradeChannel != nil {
+				tradeLag := now.Sub(lastTradeTime)
+				log.Printf("%s: wait: %v; processing: %v; lag: %v; trades: %d; trade lag: %v",
+					name, waitTime, processingTime, lagTime, tradeCount, tradeLag)
+			} else {
+				log.Printf("%s: wait: %v; processing: %v; lag: %v",
+					name, waitTime, processingTime, lagTime)
+			}
+			tradeCount = 0
+		}
+
+		for {
+		ReadLoop:
+			loopStartTime := time.Now()
+			select {
+
+			case <-tickerReplayDone:
+				tickerReplayDone = nil
+				if len(queuedTickers) > 0 {
+					log.Printf("%s: applying %d ticker updates queued during replay\n",
+						name, len(queuedTickers))
+				}
+				for _, tickers := range queuedTickers {
+					handleTickers(tickers, time.Now(), 0)
+				}
+				queuedTickers = nil
+				if r.snapshots != nil && r.snapshotInterval > 0 {
+					snapshotTimer = time.NewTicker(r.snapshotInterval).C
+				}
+
+			case <-statusTicker.C:
+				r.checkStatus()
+
+			case <-snapshotTimer:
+				select {
+				case snapshotSaving <- true:
+					// Taken here, between updates, so every tracker is
+					// as of the snapshot time and replaying from it
+					// doesn't repeat updates. It shares the tick and
+					// trade history rather than copying it, so it is
+					// cheap; the encoding is done outside the loop.
+					snapshot := r.trackers.Snapshot(r.clock.Now())
+					go func() {
+						r.saveSnapshot(snapshot)
+						<-snapshotSaving
+					}()
+				default:
+					log.Printf("warning: %s: skipping snapshot, previous snapshot still being saved\n", name)
+				}
+
+			case trade := <-tradeChannel:
+				ticker := r.trackers.GetTracker(trade.Symbol)
+				ticker.Lock.Lock()
+				ticker.AddTrade(trade)
+				ticker.Lock.Unlock()
+
+				if trade.Timestamp.After(lastTradeTime) {
+					lastTradeTime = trade.Timestamp
+				}
+
+				tradeCount++
+
+			case depth := <-depthChannel:
+				tracker := r.trackers.GetTracker(depth.Symbol)
+				tracker.Lock.Lock()
+				tracker.UpdateDepth(depth)
+				tracker.Lock.Unlock()
+
+			case tickers := <-tickerChannel:
+
+				waitTime := time.Now().Sub(loopStartTime)
+				if len(tickers) == 0 {
+					goto ReadLoop
+				}
+
+				if tickerReplayDone != nil {
+					queuedTickers = append(queuedTickers, tickers)
+					goto ReadLoop
+				}
+
+				handleTickers(tickers, loopStartTime, waitTime)
+			}
+		}
+	}()
+}
+
+func (r *ExchangeRunner) updateTrackers(tickers []pkg.CommonTicker, recalculate bool) {
+	for _, ticker := range tickers {
+		tracker := r.trackers.GetTracker(ticker.Symbol)
+		tracker.Lock.Lock()
+		tracker.Update(ticker)
+		if recalculate {
+			tracker.Recalculate()
+		}
+		tracker.Lock.Unlock()
+	}
+}
+
+// restoreSnapshot restores the trackers from the saved snapshot, returning
+// the time of the snapshot, or the zero time if there is no usable
+// snapshot.
+func (r *ExchangeRunner) restoreSnapshot() time.Time {
+	if r.snapshots == nil {
+		return time.Time{}
+	}
+	name := r.exchange.Name()
+	startTime := time.Now()
+
+	buf, err := r.snapshots.Load()
+	if err != nil {
+		log.Printf("error: %s: failed to load snapshot: %v\n", name, err)
+		return time.Time{}
+	}
+	if buf == nil {
+		log.Printf("%s: no snapshot to restore\n", name)
+		return time.Time{}
+	}
+	snapshot, err := pkg.DecodeSnapshot(buf)
+	if err != nil {
+		log.Printf("error: %s: failed to decode snapshot: %v\n", name, err)
+		return time.Time{}
+	}
+
+	maxAge := pkg.BucketRetention(r.trackers.Buckets)
+	if r.clock.Now().Sub(snapshot.Time) > maxAge {
+		log.Printf("%s: not restoring snapshot from %v, older than %v\n",
+			name, snapshot.Time, maxAge)
+		return time.Time{}
+	}
+
+	r.trackers.Restore(snapshot)
+	log.Printf("%s: restored %d trackers from snapshot at %v in %v\n",
+		name, len(snapshot.Trackers), snapshot.Time, time.Since(startTime))
+	return snapshot.Time
+}
+
+func (r *ExchangeRunner) saveSnapshot(snapshot *pkg.TrackerMapSnapshot) {
+	name := r.exchange.Name()
+	startTime := time.Now()
+	buf, err := pkg.EncodeSnapshot(snapshot)
+	if err != nil {
+		log.Printf("error: %s: failed to encode snapshot: %v\n", name, err)
+		return
+	}
+	if err := r.snapshots.Save(buf); err != nil {
+		log.Printf("error: %s: failed to save snapshot: %v\n", name, err)
+		return
+	}
+	log.Printf("%s: saved snapshot of %d trackers (%d bytes) in %v\n",
+		name, len(snapshot.Trackers), len(buf), time.Since(startTime))
+}
@@ -0,0 +1,334 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+)
+
+// TestRunnerConcurrentAccess updates the trackers as the runner does while
+// reading them and subscribing from other goroutines, so run with -race
+// it catches any unprotected access.
+func TestRunnerConcurrentAccess(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	runner := &ExchangeRunner{
+		trackers:    pkg.NewTickerTrackerMap(clock, pkg.DefaultBuckets),
+		subscribers: map[string]map[chan interface{}]bool{},
+		clock:       clock,
+	}
+	symbols := []string{"ETHBTC", "LTCBTC", "BNBBTC"}
+	const iterations = 500
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// The runner's ticker case.
+	run(func(i int) {
+		now := start.Add(time.Duration(i) * time.Second)
+		clock.Set(now)
+		tickers := []pkg.CommonTicker{}
+		for _, symbol := range symbols {
+			tickers = append(tickers, pkg.CommonTicker{
+				Symbol:      symbol,
+				Timestamp:   now,
+				LastPrice:   1 + float64(i%10)/100,
+				QuoteVolume: 100 + float64(i),
+			})
+		}
+		runner.updateTrackers(tickers, true)
+	})
+
+	// The runner's trade case.
+	run(func(i int) {
+		symbol := symbols[i%len(symbols)]
+		tracker := runner.trackers.GetTracker(symbol)
+		tracker.Lock.Lock()
+		tracker.AddTrade(pkg.CommonTrade{
+			Symbol:        symbol,
+			Timestamp:     clock.Now(),
+			Price:         1,
+			Quantity:      1,
+			QuoteQuantity: 1,
+			Side:          pkg.TradeSideBuy,
+		})
+		tracker.Lock.Unlock()
+	})
+
+	// Building and publishing updates, as for the websocket feed.
+	run(func(i int) {
+		for _, tracker := range runner.trackers.Trackers() {
+			tracker.Lock.RLock()
+			if tracker.LastTick() == nil {
+				tracker.Lock.RUnlock()
+				continue
+			}
+			update := buildUpdateMessage(tracker)
+			tracker.Lock.RUnlock()
+			runner.publish(tracker.Symbol, update)
+		}
+		runner.trackers.GetLastForSymbol(symbols[i%len(symbols)])
+		runner.trackers.Len()
+	})
+
+	// Subscribers coming and going, as websocket clients do.
+	for _, symbol := range symbols {
+		symbol := symbol
+		run(func(i int) {
+			channel := runner.Subscribe(symbol)
+			select {
+			case <-channel:
+			default:
+			}
+			runner.Unsubscribe(symbol, channel)
+		})
+	}
+
+	wg.Wait()
+
+	for _, symbol := range symbols {
+		tracker := runner.trackers.Get(symbol)
+		if tracker == nil {
+			t.Fatalf("no tracker for %s", symbol)
+		}
+		if len(tracker.Ticks) != iterations {
+			t.Errorf("%s: expected %d ticks, have %d", symbol, iterations, len(tracker.Ticks))
+		}
+	}
+	if len(runner.subscribers) != 0 {
+		t.Errorf("expected no subscribers left, have %d", len(runner.subscribers))
+	}
+}
+
+// stubTickerFeed replays its cached tickers once released, and hands its
+// channel to the test to send live tickers on.
+type stubTickerFeed struct {
+	cached   []pkg.CommonTicker
+	release  chan bool
+	channels chan chan []pkg.CommonTicker
+}
+
+func (f *stubTickerFeed) ReplayCache(after time.Time, cb func(tickers []pkg.CommonTicker)) {
+	<-f.release
+	cb(f.cached)
+}
+
+func (f *stubTickerFeed) Run(channel chan []pkg.CommonTicker) {
+	f.channels <- channel
+}
+
+// stubTradeFeed hands the runner a channel the test sends trades on.
+type stubTradeFeed struct {
+	channel chan pkg.CommonTrade
+}
+
+func (f *stubTradeFeed) Subscribe() chan pkg.CommonTrade          { return f.channel }
+func (f *stubTradeFeed) Unsubscribe(channel chan pkg.CommonTrade) {}
+func (f *stubTradeFeed) Run(after time.Time)                      {}
+
+type stubExchange struct {
+	tickerFeed *stubTickerFeed
+	tradeFeed  *stubTradeFeed
+}
+
+func (e *stubExchange) Name() string                                   { return "stub" }
+func (e *stubExchange) TickerFeed() pkg.TickerFeed                     { return e.tickerFeed }
+func (e *stubExchange) DepthFeed() pkg.DepthFeed                       { return nil }
+func (e *stubExchange) Symbols() ([]string, error)                     { return nil, nil }
+func (e *stubExchange) SetMaxAge(maxAge time.Duration)                 {}
+func (e *stubExchange) Streams() []pkg.StreamStatus                    { return nil }
+func (e *stubExchange) SetBackoffOptions(options pkg.BackoffOptions)   {}
+func (e *stubExchange) SetWatchdogOptions(options pkg.WatchdogOptions) {}
+func (e *stubExchange) SetRecorder(recorder *pkg.Recorder)             {}
+
+func (e *stubExchange) TradeFeed() pkg.TradeFeed {
+	if e.tradeFeed == nil {
+		return nil
+	}
+	return e.tradeFeed
+}
+
+// TestRunnerQueuesTickersDuringReplay checks live tickers are read while the
+// cache is still being replayed, then applied after the cached tickers.
+func TestRunnerQueuesTickersDuringReplay(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	feed := &stubTickerFeed{
+		cached: []pkg.CommonTicker{
+			{Symbol: "ETHBTC", Timestamp: start, LastPrice: 1},
+		},
+		release:  make(chan bool),
+		channels: make(chan chan []pkg.CommonTicker, 1),
+	}
+	runner := NewExchangeRunner(&stubExchange{tickerFeed: feed}, clock, pkg.DefaultBuckets)
+	runner.websocket = NewBroadcastWebSocketHandler()
+	runner.Run()
+	channel := <-feed.channels
+
+	// The replay is blocked, but live tickers must not be.
+	for i := 1; i <= 3; i++ {
+		tickers := []pkg.CommonTicker{{
+			Symbol:    "ETHBTC",
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			LastPrice: float64(1 + i),
+		}}
+		select {
+		case channel <- tickers:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("live ticker %d blocked during the replay", i)
+		}
+	}
+
+	close(feed.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		prices := []float64{}
+		if tracker := runner.trackers.Get("ETHBTC"); tracker != nil {
+			tracker.Lock.RLock()
+			for _, tick := range tracker.Ticks {
+				prices = append(prices, tick.LastPrice)
+			}
+			tracker.Lock.RUnlock()
+		}
+		if len(prices) == 4 {
+			for i, price := range prices {
+				if price != float64(1+i) {
+					t.Fatalf("expected the cached ticker then the live tickers, got prices %v", prices)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 4 ticks, got prices %v", prices)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestRunnerUpdatesTrackers sends tickers and trades through a running
+// runner, checking they reach the trackers and an update is published to
+// the subscribers of each symbol.
+func TestRunnerUpdatesTrackers(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	clock := pkg.NewManualClock(start)
+	feed := &stubTickerFeed{
+		release:  make(chan bool),
+		channels: make(chan chan []pkg.CommonTicker, 1),
+	}
+	close(feed.release)
+	tradeFeed := &stubTradeFeed{channel: make(chan pkg.CommonTrade)}
+	runner := NewExchangeRunner(&stubExchange{tickerFeed: feed, tradeFeed: tradeFeed},
+		clock, pkg.DefaultBuckets)
+	runner.websocket = NewBroadcastWebSocketHandler()
+
+	// Buffered, so an update published before the test is ready to
+	// receive it isn't dropped.
+	updates := make(chan interface{}, 10)
+	runner.subscribers["ETHBTC"] = map[chan interface{}]bool{updates: true}
+
+	runner.Run()
+	channel := <-feed.channels
+
+	receiveUpdate := func() map[string]interface{} {
+		t.Helper()
+		select {
+		case update := <-updates:
+			return update.(map[string]interface{})
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for an update")
+		}
+		return nil
+	}
+	sendTickers := func(at time.Time, price float64) {
+		clock.Set(at)
+		channel <- []pkg.CommonTicker{
+			{Symbol: "ETHBTC", Timestamp: at, LastPrice: price, QuoteVolume: 100},
+			{Symbol: "LTCBTC", Timestamp: at, LastPrice: 5, QuoteVolume: 100},
+		}
+	}
+
+	sendTickers(start, 1)
+	update := receiveUpdate()
+	if update["symbol"] != "ETHBTC" || update["close"] != 1.0 {
+		t.Fatalf("expected an ETHBTC update with a close of 1, got %v", update)
+	}
+	if _, ok := update["nv_1"]; ok {
+		t.Errorf("expected no trade metrics before any trades")
+	}
+
+	// The trade channel is unbuffered, so each trade has been taken by
+	// the runner before the next tickers are sent.
+	for _, trade := range []pkg.CommonTrade{
+		{Symbol: "ETHBTC", Timestamp: start.Add(5 * time.Second), Price: 1.1,
+			Quantity: 2, QuoteQuantity: 2.2, Side: pkg.TradeSideBuy},
+		{Symbol: "ETHBTC", Timestamp: start.Add(6 * time.Second), Price: 1.1,
+			Quantity: 1, QuoteQuantity: 1.1, Side: pkg.TradeSideSell},
+	} {
+		select {
+		case tradeFeed.channel <- trade:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out sending a trade")
+		}
+	}
+
+	sendTickers(start.Add(10*time.Second), 1.1)
+	update = receiveUpdate()
+	for key, expected := range map[string]interface{}{
+		"symbol":         "ETHBTC",
+		"close":          1.1,
+		"nv_1":           1.1,
+		"total_volume_1": 3.3,
+		"vwap_1m":        1.1,
+	} {
+		if update[key] != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, update[key])
+		}
+	}
+	if change := update["price_change_pct"].(map[string]float64)["1m"]; change != 10 {
+		t.Errorf("expected a 1m price change of 10%%, got %v", change)
+	}
+
+	tracker := runner.trackers.Get("ETHBTC")
+	tracker.Lock.RLock()
+	ticks, trades := len(tracker.Ticks), len(tracker.Trades)
+	tracker.Lock.RUnlock()
+	if ticks != 2 || trades != 2 {
+		t.Errorf("expected 2 ticks and 2 trades, got %d and %d", ticks, trades)
+	}
+	if runner.trackers.Get("LTCBTC") == nil {
+		t.Errorf("expected a tracker for LTCBTC")
+	}
+
+	// Only the subscribed symbol's updates are published.
+	select {
+	case update := <-updates:
+		t.Errorf("unexpected update %v", update)
+	default:
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/mux"
+)
+
+// ScreenerHandler evaluates a filter expression against the current state
+// of each exchange's trackers.
+type ScreenerHandler struct {
+	trackers map[string]*pkg.TickerTrackerMap
+}
+
+func NewScreenerHandler() *ScreenerHandler {
+	return &ScreenerHandler{
+		trackers: make(map[string]*pkg.TickerTrackerMap),
+	}
+}
+
+func (h *ScreenerHandler) AddExchange(exchange string, trackers *pkg.TickerTrackerMap) {
+	h.trackers[exchange] = trackers
+}
+
+// Handle returns the update message of each symbol matching the filter
+// parameter, sorted by symbol. With no filter all symbols are returned.
+func (h *ScreenerHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	exchange := mux.Vars(r)["exchange"]
+	trackers := h.trackers[exchange]
+	if trackers == nil {
+		writeJsonError(w, http.StatusNotFound, "unknown exchange")
+		return
+	}
+
+	var filter *pkg.Filter
+	if expression := r.FormValue("filter"); expression != "" {
+		var err error
+		filter, err = pkg.ParseFilter(expression)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid filter: %v", err))
+			return
+		}
+	}
+
+	matches := []map[string]interface{}{}
+	for _, tracker := range trackers.Trackers() {
+		tracker.Lock.RLock()
+		if tracker.LastTick() == nil {
+			tracker.Lock.RUnlock()
+			continue
+		}
+		update := buildUpdateMessage(tracker)
+		tracker.Lock.RUnlock()
+		if filter == nil || filter.Match(update) {
+			matches = append(matches, update)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i]["symbol"].(string) < matches[j]["symbol"].(string)
+	})
+
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"exchange": exchange,
+		"tickers":  matches,
+	})
+}
@@ -20,8 +20,10 @@ import (
 	"net/http"
 	"log"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"strings"
+	"github.com/crankykernel/cryptoxscanner/pkg"
 )
 
 var wsConnectionTracker *WsConnectionTracker
@@ -78,7 +80,12 @@ type WebSocketClient struct {
 	// Data written into this Channel will be sent to the client.
 	sendChannel chan []byte
 
-	done bool
+	// If set, only tickers matching the filter are sent to the client.
+	filter *pkg.Filter
+
+	// Set once the client is no longer being written to.
+	done     bool
+	doneLock sync.Mutex
 }
 
 func NewWebSocketClient(c *websocket.Conn, r *http.Request) *WebSocketClient {
@@ -106,6 +113,18 @@ func (c *WebSocketClient) GetRemoteHost() string {
 	return strings.Split(remoteAddr, ":")[0]
 }
 
+func (c *WebSocketClient) setDone() {
+	c.doneLock.Lock()
+	defer c.doneLock.Unlock()
+	c.done = true
+}
+
+func (c *WebSocketClient) isDone() bool {
+	c.doneLock.Lock()
+	defer c.doneLock.Unlock()
+	return c.done
+}
+
 func (c *WebSocketClient) WriteTextMessage(msg []byte) error {
 	return c.conn.WriteMessage(websocket.TextMessage, msg)
 }
@@ -114,7 +133,7 @@ type TickerWebSocketHandler struct {
 	upgrader    websocket.Upgrader
 	clients     map[*WebSocketClient]bool
 	clientsLock sync.RWMutex
-	Feed        *BinanceRunner
+	Feed        *ExchangeRunner
 }
 
 func NewBroadcastWebSocketHandler() *TickerWebSocketHandler {
@@ -131,7 +150,9 @@ func NewBroadcastWebSocketHandler() *TickerWebSocketHandler {
 }
 
 func (h *TickerWebSocketHandler) CloseClient(client *WebSocketClient) {
+	h.clientsLock.Lock()
 	delete(h.clients, client)
+	h.clientsLock.Unlock()
 	client.conn.Close()
 }
 
@@ -150,11 +171,23 @@ func (h *TickerWebSocketHandler) Upgrade(w http.ResponseWriter, r *http.Request)
 }
 
 func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	var filter *pkg.Filter
+	if expression := r.FormValue("filter"); expression != "" {
+		var err error
+		filter, err = pkg.ParseFilter(expression)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid filter: %v", err))
+			return
+		}
+	}
+
 	client, err := h.Upgrade(w, r)
 	if err != nil {
 		log.Printf("Failed to upgrade websocket connection: %v\n", err)
 		return
 	}
+	client.filter = filter
 	h.AddClient(client)
 	log.Printf("WebSocket connnected to %s: RemoteAddr=%v; Origin=%s\n",
 		r.URL.String(),
@@ -170,12 +203,30 @@ func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request)
 	// received.
 	go h.readLoop(client)
 
+	// Let the client know straight away if the prices are stale.
+	if status := h.Feed.Status(); status.Degraded {
+		buf, err := json.Marshal(StatusMessage{Status: status})
+		if err == nil {
+			err = client.WriteTextMessage(buf)
+		}
+		if err != nil {
+			log.Printf("WebSocket write error: %v\n", err)
+		}
+	}
+
 	if symbol != "" {
 		channel := h.Feed.Subscribe(symbol)
 		defer h.Feed.Unsubscribe(symbol, channel)
 		for {
 			select {
 			case filteredMessage := <-channel:
+				// Only updates are filtered, status messages always
+				// go through.
+				if fields, ok := filteredMessage.(map[string]interface{}); ok {
+					if filter != nil && !filter.Match(fields) {
+						continue
+					}
+				}
 				bytes, err := json.Marshal(filteredMessage)
 				if err != nil {
 					log.Printf("failed to marshal filtered ticker: %v\n", err)
@@ -206,7 +257,7 @@ func (h *TickerWebSocketHandler) Handle(w http.ResponseWriter, r *http.Request)
 		}
 	}
 Done:
-	client.done = true
+	client.setDone()
 	log.Printf("WebSocket connection closed: %v\n", client.GetRemoteAddr())
 }
 
@@ -223,28 +274,75 @@ type TickerStream struct {
 	Tickers []interface{} `json:"tickers"`
 }
 
-func (h *TickerWebSocketHandler) Broadcast(v TickerStream) error {
-	buf, err := json.Marshal(v)
-	if err != nil {
-		return err
+// filterTickers returns the tickers that match the filter.
+func filterTickers(filter *pkg.Filter, tickers []interface{}) []interface{} {
+	filtered := []interface{}{}
+	for _, ticker := range tickers {
+		fields, ok := ticker.(map[string]interface{})
+		if ok && filter.Match(fields) {
+			filtered = append(filtered, ticker)
+		}
 	}
+	return filtered
+}
 
-	h.clientsLock.RLock()
-	defer h.clientsLock.RUnlock()
+// send queues a message to each client, as returned by message, closing
+// the clients that are done or too slow to keep up.
+func (h *TickerWebSocketHandler) send(message func(client *WebSocketClient) ([]byte, error)) error {
+	failed := []*WebSocketClient{}
 
+	h.clientsLock.RLock()
 	for client := range h.clients {
+		if client.isDone() {
+			failed = append(failed, client)
+			continue
+		}
+
+		buf, err := message(client)
+		if err != nil {
+			h.clientsLock.RUnlock()
+			return err
+		}
+
 		select {
 		case client.sendChannel <- buf:
 		default:
 			log.Printf("WebSocket client [%v] appears to be blocked. Dropping.\n",
 				client.GetRemoteAddr())
-			client.done = true
+			failed = append(failed, client)
 		}
+	}
+	h.clientsLock.RUnlock()
 
-		if client.done {
-			h.CloseClient(client)
-		}
+	for _, client := range failed {
+		h.CloseClient(client)
 	}
 
 	return nil
 }
+
+// BroadcastStatus sends a status message to all clients, unfiltered.
+func (h *TickerWebSocketHandler) BroadcastStatus(v StatusMessage) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.send(func(client *WebSocketClient) ([]byte, error) {
+		return buf, nil
+	})
+}
+
+func (h *TickerWebSocketHandler) Broadcast(v TickerStream) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.send(func(client *WebSocketClient) ([]byte, error) {
+		if client.filter == nil {
+			return buf, nil
+		}
+		return json.Marshal(TickerStream{
+			Tickers: filterTickers(client.filter, v.Tickers),
+		})
+	})
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2018 Cranky Kernel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crankykernel/cryptoxscanner/pkg"
+	"github.com/gorilla/websocket"
+)
+
+// testClients connects websocket clients to the handler without running
+// Handle, so the test controls which clients read their send channel.
+type testClients struct {
+	server  *httptest.Server
+	clients chan *WebSocketClient
+}
+
+func newTestClients(h *TickerWebSocketHandler) *testClients {
+	c := &testClients{
+		clients: make(chan *WebSocketClient, 1),
+	}
+	c.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			client, err := h.Upgrade(w, r)
+			if err != nil {
+				return
+			}
+			h.AddClient(client)
+			c.clients <- client
+		}))
+	return c
+}
+
+func (c *testClients) connect(t *testing.T) *WebSocketClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(c.server.URL, "http")
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closed with the server side of the connection.
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+	return <-c.clients
+}
+
+// drain reads messages sent to the client until the test ends.
+func drain(client *WebSocketClient) chan []byte {
+	messages := make(chan []byte, 10)
+	go func() {
+		for msg := range client.sendChannel {
+			messages <- msg
+		}
+	}()
+	return messages
+}
+
+func receiveMessage(t *testing.T, messages chan []byte) []byte {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+func hasClient(h *TickerWebSocketHandler, client *WebSocketClient) bool {
+	h.clientsLock.RLock()
+	defer h.clientsLock.RUnlock()
+	return h.clients[client]
+}
+
+func TestBroadcastDropsFailedClients(t *testing.T) {
+	h := NewBroadcastWebSocketHandler()
+	clients := newTestClients(h)
+	defer clients.server.Close()
+
+	reader := clients.connect(t)
+	messages := drain(reader)
+	filtered := clients.connect(t)
+	filter, err := pkg.ParseFilter("symbol startsWith LTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered.filter = filter
+	filteredMessages := drain(filtered)
+	blocked := clients.connect(t)
+	done := clients.connect(t)
+	done.setDone()
+
+	// Let the readers start receiving.
+	time.Sleep(50 * time.Millisecond)
+
+	err = h.Broadcast(TickerStream{
+		Tickers: []interface{}{
+			map[string]interface{}{"symbol": "ETHBTC"},
+			map[string]interface{}{"symbol": "LTCBTC"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := TickerStream{}
+	if err := json.Unmarshal(receiveMessage(t, messages), &stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.Tickers) != 2 {
+		t.Errorf("expected 2 tickers, got %v", stream.Tickers)
+	}
+	stream = TickerStream{}
+	if err := json.Unmarshal(receiveMessage(t, filteredMessages), &stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.Tickers) != 1 {
+		t.Errorf("expected only the LTCBTC ticker, got %v", stream.Tickers)
+	}
+
+	if hasClient(h, blocked) {
+		t.Errorf("expected the blocked client to be removed")
+	}
+	if hasClient(h, done) {
+		t.Errorf("expected the done client to be removed")
+	}
+	if !hasClient(h, reader) || !hasClient(h, filtered) {
+		t.Errorf("expected the reading clients to remain")
+	}
+
+	// Status messages go to every remaining client unfiltered.
+	err = h.BroadcastStatus(StatusMessage{Status: FeedStatus{Degraded: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, messages := range []chan []byte{messages, filteredMessages} {
+		status := StatusMessage{}
+		if err := json.Unmarshal(receiveMessage(t, messages), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Status.Degraded {
+			t.Errorf("expected a degraded status, got %+v", status)
+		}
+	}
+}
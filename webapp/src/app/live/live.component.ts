@@ -120,6 +120,9 @@ export class BinanceLiveComponent implements OnInit, OnDestroy {
     // The sorted and filtered tickers to be displayed on the screen.
     tickers: SymbolUpdate[] = [];
 
+    // Set while the server reports the exchange feed as stale.
+    private feedStale = false;
+
     banner: Banner = {
         show: true,
         className: "alert-info",
@@ -396,8 +399,42 @@ export class BinanceLiveComponent implements OnInit, OnDestroy {
             },
         ];
 
+        // Only symbols with order books enabled on the server have these.
+        const depthHeaders = [
+            {
+                title: "Bid Depth",
+                name: "bid_depth",
+                type: "number",
+                format: ".2-2",
+                display: false,
+            },
+            {
+                title: "Ask Depth",
+                name: "ask_depth",
+                type: "number",
+                format: ".2-2",
+                display: false,
+            },
+            {
+                title: "Spread bps",
+                name: "spread_bps",
+                type: "number",
+                format: ".1-1",
+                display: false,
+            },
+            {
+                title: "Imbalance",
+                name: "book_imbalance",
+                type: "number",
+                format: ".2-2",
+                display: false,
+                updown: true,
+            },
+        ];
+
         if (this.exchange == "binance") {
             this.headers.push.apply(this.headers, extendedVolumeHeaders);
+            this.headers.push.apply(this.headers, depthHeaders);
         }
 
         this.restoreConfig();
@@ -464,7 +501,12 @@ export class BinanceLiveComponent implements OnInit, OnDestroy {
 
         this.stream = this.connect().subscribe(
                 (update: any) => {
-                    if (this.banner.show) {
+                    if (update && update.status) {
+                        this.updateFeedStatus(update.status);
+                        return;
+                    }
+
+                    if (this.banner.show && !this.feedStale) {
                         console.log("Updating banner.");
                         this.banner = {
                             show: true,
@@ -516,6 +558,19 @@ export class BinanceLiveComponent implements OnInit, OnDestroy {
                 });
     }
 
+    private updateFeedStatus(status: any) {
+        this.feedStale = status.degraded;
+        if (status.degraded) {
+            this.banner = {
+                show: true,
+                className: "alert-warning",
+                message: "Exchange feed is stale, prices may be out of date.",
+            };
+        } else {
+            this.banner.show = false;
+        }
+    }
+
     /**
      * Convert the string v into a number. Null is returned if the string
      * is not a number.
@@ -90,6 +90,9 @@ export class BinanceMonitorComponent implements OnInit, OnDestroy, AfterViewInit
 
     private tickerMap: { [key: string]: SymbolUpdate } = {};
 
+    // Set while the server reports the exchange feed as stale.
+    private feedStale = false;
+
     banner = {
         show: true,
         className: "alert-info",
@@ -405,9 +408,14 @@ export class BinanceMonitorComponent implements OnInit, OnDestroy, AfterViewInit
 
     private update(update: any) {
 
+        if (update && update.status) {
+            this.updateFeedStatus(update.status);
+            return;
+        }
+
         this.lastUpdateTime = new Date();
 
-        if (this.banner.show) {
+        if (this.banner.show && !this.feedStale) {
             this.banner.className = "alert-success";
             this.banner.message = "Connected!";
             this.banner.show = true;
@@ -509,6 +517,19 @@ export class BinanceMonitorComponent implements OnInit, OnDestroy, AfterViewInit
         // this.lastAlerts = {};
     }
 
+    private updateFeedStatus(status: any) {
+        this.feedStale = status.degraded;
+        if (status.degraded) {
+            this.banner = {
+                show: true,
+                className: "alert-warning",
+                message: "Exchange feed is stale, prices may be out of date.",
+            };
+        } else {
+            this.banner.show = false;
+        }
+    }
+
     private updateGainers() {
         const range = this.config.gainers.range;
 